@@ -0,0 +1,508 @@
+package lsp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gala377/MLLang/cmd/funk/std"
+	"github.com/gala377/MLLang/codegen"
+	"github.com/gala377/MLLang/syntax"
+	"github.com/gala377/MLLang/syntax/ast"
+	"github.com/gala377/MLLang/syntax/span"
+	"github.com/gala377/MLLang/types"
+)
+
+type (
+	definition struct {
+		name string
+		// function, variable, parameter, effect, module or import
+		kind   string
+		node   ast.Node
+		offset int
+		global bool
+	}
+
+	// reference is a use of the name, def is nil
+	// for names defined outside of the document.
+	reference struct {
+		name   string
+		offset int
+		def    *definition
+	}
+
+	// scopeRange holds the names defined within the
+	// fragment of the source, used for completion.
+	scopeRange struct {
+		beg, end int
+		defs     []*definition
+	}
+
+	analysis struct {
+		doc    *document
+		nodes  []ast.Node
+		defs   []*definition
+		refs   []reference
+		byNode map[ast.Node]*definition
+		scopes []*scopeRange
+		types  *types.Checker
+	}
+)
+
+// analyze parses and compiles the document returning found problems.
+// If the document has syntax errors it is not compiled and
+// the analysis is done on the partial tree returned by the parser.
+func analyze(d *document, env []string) (a *analysis, diags []Diagnostic) {
+	diags = []Diagnostic{}
+	defer func() {
+		if r := recover(); r != nil {
+			a = nil
+			diags = append(diags, Diagnostic{
+				Range:    d.rangeOf(0, 0),
+				Severity: severityError,
+				Source:   "funk",
+				Message:  fmt.Sprintf("internal error while analyzing the file: %v", r),
+			})
+		}
+	}()
+	p := syntax.NewParser(strings.NewReader(d.text))
+	// fixities of the prelude operators, as used when running the file
+	p.UseOperators(std.Operators())
+	nodes := p.Parse()
+	if errs := p.Errors(); len(errs) > 0 {
+		for _, e := range errs {
+			loc := e.SourceLoc()
+			diags = append(diags, diagnostic(d, &loc, severityError, e.Error()))
+		}
+		// the parser recovers from errors so the partial
+		// tree is still good enough to navigate the document
+		return resolve(d, nodes), diags
+	}
+	e := codegen.NewEmitter(d.uri, codegen.NewInterner())
+	_, errs := e.Compile(nodes)
+	for _, err := range errs {
+		diags = append(diags, diagnostic(d, err.Location, severityError, err.Message))
+	}
+	for _, w := range append(e.Warnings(), codegen.Lint(nodes, env)...) {
+		diags = append(diags, diagnostic(d, w.Location, severityWarning, w.Message))
+	}
+	return resolve(d, nodes), diags
+}
+
+func diagnostic(d *document, loc *span.Span, severity int, msg string) Diagnostic {
+	return Diagnostic{
+		Range:    d.spanRange(loc),
+		Severity: severity,
+		Source:   "funk",
+		Message:  msg,
+	}
+}
+
+// definitionAt returns the definition of the name at the offset,
+// either used or defined there.
+func (a *analysis) definitionAt(offset int) (*definition, string) {
+	for _, r := range a.refs {
+		if r.offset <= offset && offset <= r.offset+len(r.name) {
+			return r.def, r.name
+		}
+	}
+	for _, def := range a.defs {
+		if def.offset <= offset && offset <= def.offset+len(def.name) {
+			return def, def.name
+		}
+	}
+	return nil, ""
+}
+
+// references returns offsets of all of the uses of the definition.
+func (a *analysis) references(def *definition) []int {
+	res := []int{}
+	for _, r := range a.refs {
+		if r.def == def {
+			res = append(res, r.offset)
+		}
+	}
+	return res
+}
+
+// visible returns definitions that can be used at the offset.
+func (a *analysis) visible(offset int) []*definition {
+	res := []*definition{}
+	for _, def := range a.defs {
+		if def.global {
+			res = append(res, def)
+		}
+	}
+	for _, s := range a.scopes {
+		if s.beg > offset || offset > s.end {
+			continue
+		}
+		for _, def := range s.defs {
+			if def.offset < offset {
+				res = append(res, def)
+			}
+		}
+	}
+	return res
+}
+
+// resolver binds uses of the names to their definitions
+// using the same scoping rules as the compiler.
+type resolver struct {
+	a      *analysis
+	scope  *syntax.Scope
+	ranges []*scopeRange
+}
+
+func resolve(d *document, nodes []ast.Node) *analysis {
+	a := &analysis{
+		doc:    d,
+		nodes:  nodes,
+		defs:   []*definition{},
+		refs:   []reference{},
+		byNode: map[ast.Node]*definition{},
+		scopes: []*scopeRange{},
+		types:  types.NewChecker(),
+	}
+	a.types.Check(nodes)
+	r := resolver{a: a, scope: syntax.NewScope(nil)}
+	r.declareGlobals(nodes)
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *ast.FuncDecl:
+			r.function(n.Span, n.Args, n.Body)
+		case *ast.MacroDecl:
+			r.function(n.Span, n.Args, n.Body)
+		case *ast.GlobalValDecl:
+			r.expr(n.Rhs)
+		case *ast.OperatorDecl:
+			r.expr(n.Rhs)
+		case *ast.GlobalPatternDecl:
+			r.expr(n.Rhs)
+		case ast.Stmt:
+			r.stmt(n)
+		}
+	}
+	sort.Slice(a.refs, func(i, j int) bool {
+		return a.refs[i].offset < a.refs[j].offset
+	})
+	return a
+}
+
+func (r *resolver) declareGlobals(nodes []ast.Node) {
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *ast.FuncDecl:
+			r.declareGlobal(n.Name, "function", n)
+		case *ast.GlobalValDecl:
+			r.declareGlobal(n.Name, valueKind(n.Rhs), n)
+		case *ast.EffectDecl:
+			r.declareGlobal(n.Name, "effect", n)
+		case *ast.MacroDecl:
+			r.declareGlobal(n.Name, "macro", n)
+		case *ast.OperatorDecl:
+			r.declareGlobal(n.Name, "operator", n)
+		case *ast.ImportDecl:
+			def := r.define(n.Name, "import", n, r.lastNameOffset(n.Span, n.Name))
+			def.global = true
+			r.scope.InsertDecl(n.Name, n)
+		case *ast.FromImportDecl:
+			for _, id := range n.Names {
+				def := r.define(id.Name, "import", id, int(id.Beg.Offset))
+				def.global = true
+				r.scope.InsertDecl(id.Name, id)
+			}
+		case *ast.GlobalPatternDecl:
+			for _, b := range ast.Bindings(n.Pattern) {
+				def := r.define(b.Name, "variable", b, int(b.Beg.Offset))
+				def.global = true
+				r.scope.InsertBinding(b)
+			}
+		}
+	}
+}
+
+func (r *resolver) declareGlobal(name, kind string, node ast.Node) {
+	def := r.define(name, kind, node, r.nameOffset(node.NodeSpan(), name))
+	def.global = true
+	r.scope.InsertDecl(name, node)
+}
+
+// valueKind returns the kind of the definition based on its value.
+func valueKind(rhs ast.Expr) string {
+	switch v := rhs.(type) {
+	case *ast.LambdaExpr:
+		return "function"
+	case *ast.LocalEffect:
+		return "effect"
+	case *ast.FuncApplication:
+		if id, ok := v.Callee.(*ast.Identifier); ok && v.Block != nil && len(v.Args) == 0 {
+			if id.Name == "module" || id.Name == "scope" {
+				return "module"
+			}
+		}
+	}
+	return "variable"
+}
+
+func (r *resolver) define(name, kind string, node ast.Node, offset int) *definition {
+	def := &definition{name: name, kind: kind, node: node, offset: offset}
+	r.a.defs = append(r.a.defs, def)
+	r.a.byNode[node] = def
+	if len(r.ranges) > 0 {
+		s := r.ranges[len(r.ranges)-1]
+		s.defs = append(s.defs, def)
+	}
+	return def
+}
+
+// nameOffset finds where the declared name begins
+// as declarations' spans start with a keyword.
+func (r *resolver) nameOffset(loc *span.Span, name string) int {
+	text := r.a.doc.text
+	beg := int(loc.Beg.Offset)
+	for i := beg; i+len(name) <= len(text); {
+		j := strings.Index(text[i:], name)
+		if j < 0 {
+			break
+		}
+		at := i + j
+		if isWordAt(text, at, len(name)) {
+			return at
+		}
+		i = at + 1
+	}
+	return beg
+}
+
+// lastNameOffset finds the last occurrence of
+// the name in the span, like the import's alias.
+func (r *resolver) lastNameOffset(loc *span.Span, name string) int {
+	text := r.a.doc.text
+	beg, end := int(loc.Beg.Offset), int(loc.End.Offset)
+	if end > len(text) {
+		end = len(text)
+	}
+	for at := strings.LastIndex(text[beg:end], name); at >= 0; at = strings.LastIndex(text[beg:beg+at], name) {
+		if isWordAt(text, beg+at, len(name)) {
+			return beg + at
+		}
+	}
+	return beg
+}
+
+func isWordAt(text string, at, length int) bool {
+	if at > 0 && isIdentifierChar(rune(text[at-1])) {
+		return false
+	}
+	end := at + length
+	return end >= len(text) || !isIdentifierChar(rune(text[end]))
+}
+
+// inScope runs f in a new scope covering the span.
+func (r *resolver) inScope(loc *span.Span, f func()) {
+	outer := r.scope
+	r.scope = r.scope.Derive()
+	s := &scopeRange{beg: int(loc.Beg.Offset), end: int(loc.End.Offset)}
+	r.a.scopes = append(r.a.scopes, s)
+	r.ranges = append(r.ranges, s)
+	f()
+	r.ranges = r.ranges[:len(r.ranges)-1]
+	r.scope = outer
+}
+
+func (r *resolver) use(id *ast.Identifier) {
+	offset := int(id.Beg.Offset)
+	// infix calls start with colons
+	text := r.a.doc.text
+	for offset < len(text) && text[offset] == ':' {
+		offset++
+	}
+	var def *definition
+	if si := r.scope.Lookup(id.Name); si != nil {
+		def = r.a.byNode[si.Definition()]
+	}
+	r.a.refs = append(r.a.refs, reference{name: id.Name, offset: offset, def: def})
+}
+
+func (r *resolver) bindPattern(pat ast.Pattern) {
+	for _, b := range ast.Bindings(pat) {
+		r.define(b.Name, "variable", b, int(b.Beg.Offset))
+		r.scope.InsertBinding(b)
+	}
+}
+
+func (r *resolver) bindArg(arg *ast.FuncDeclArg) {
+	if arg.Pattern != nil {
+		r.bindPattern(arg.Pattern)
+		return
+	}
+	r.define(arg.Name, "parameter", arg, int(arg.Beg.Offset))
+	r.scope.InsertFuncArg(arg)
+}
+
+func (r *resolver) function(loc *span.Span, args []*ast.FuncDeclArg, body ast.Expr) {
+	r.inScope(loc, func() {
+		for _, a := range args {
+			r.bindArg(a)
+		}
+		r.expr(body)
+	})
+}
+
+func (r *resolver) block(node *ast.Block) {
+	r.inScope(node.Span, func() {
+		for _, s := range node.Instr {
+			r.stmt(s)
+		}
+	})
+}
+
+func (r *resolver) stmt(node ast.Stmt) {
+	switch n := node.(type) {
+	case *ast.StmtExpr:
+		r.expr(n.Expr)
+	case *ast.ValDecl:
+		define := func() {
+			r.define(n.Name, valueKind(n.Rhs), n, r.nameOffset(n.Span, n.Name))
+			r.scope.InsertVal(n)
+		}
+		if f, ok := n.Rhs.(*ast.LambdaExpr); ok && f.Name != "" {
+			// local functions can call themselves
+			define()
+			r.expr(n.Rhs)
+			return
+		}
+		r.expr(n.Rhs)
+		define()
+	case *ast.PatternDecl:
+		r.expr(n.Rhs)
+		r.bindPattern(n.Pattern)
+	case *ast.Assignment:
+		r.expr(n.RValue)
+		r.expr(n.LValue)
+	case *ast.Return:
+		if n.Val != nil {
+			r.expr(n.Val)
+		}
+	case *ast.WhileStmt:
+		r.expr(n.Cond)
+		r.block(n.Body)
+	case *ast.ForStmt:
+		r.expr(n.Iterable)
+		r.inScope(n.Span, func() {
+			r.bindPattern(n.Pattern)
+			r.block(n.Body)
+		})
+	}
+}
+
+func (r *resolver) expr(node ast.Expr) {
+	switch n := node.(type) {
+	case *ast.Identifier:
+		r.use(n)
+	case *ast.TupleConst:
+		for _, v := range n.Vals {
+			r.expr(v)
+		}
+	case *ast.ListConst:
+		for _, v := range n.Vals {
+			r.expr(v)
+		}
+	case *ast.RecordConst:
+		for _, f := range n.Fields {
+			r.expr(f.Val)
+		}
+	case *ast.Access:
+		r.expr(n.Lhs)
+	case *ast.FuncApplication:
+		r.expr(n.Callee)
+		for _, a := range n.Args {
+			r.expr(a)
+		}
+		if n.Block != nil {
+			r.expr(n.Block)
+		}
+	case *ast.LambdaExpr:
+		r.function(n.Span, n.Args, n.Body)
+	case *ast.Block:
+		r.block(n)
+	case *ast.IfExpr:
+		r.expr(n.Cond)
+		r.block(n.IfBranch)
+		if n.ElseBranch != nil {
+			r.expr(n.ElseBranch)
+		}
+	case *ast.Match:
+		r.expr(n.Scrutinee)
+		for _, arm := range n.Arms {
+			r.inScope(arm.Span, func() {
+				r.pattern(arm.Pattern)
+				if arm.Guard != nil {
+					r.expr(arm.Guard)
+				}
+				r.block(arm.Body)
+			})
+		}
+	case *ast.Handle:
+		r.block(n.Body)
+		for _, arm := range n.Arms {
+			r.expr(arm.Effect)
+			r.inScope(arm.Span, func() {
+				if arm.Arg != nil {
+					r.bindArg(arm.Arg)
+				}
+				if arm.Continuation != nil {
+					r.bindArg(arm.Continuation)
+				}
+				if arm.Guard != nil {
+					r.expr(arm.Guard)
+				}
+				r.block(arm.Body)
+			})
+		}
+		if n.Return != nil {
+			r.inScope(n.Return.Span, func() {
+				r.bindArg(n.Return.Arg)
+				r.block(n.Return.Body)
+			})
+		}
+		if n.Finally != nil {
+			r.block(n.Finally)
+		}
+	case *ast.Resume:
+		r.expr(n.Cont)
+		if n.Arg != nil {
+			r.expr(n.Arg)
+		}
+	case *ast.LetExpr:
+		r.expr(n.Decls)
+		r.block(n.Body)
+	case *ast.QuasiQuote:
+		r.expr(n.Node)
+	case *ast.Unquote:
+		r.expr(n.Expr)
+	}
+}
+
+func (r *resolver) pattern(pat ast.Pattern) {
+	switch p := pat.(type) {
+	case *ast.LiteralPattern:
+		r.expr(p.Val)
+	case *ast.TuplePattern:
+		for _, e := range p.Elems {
+			r.pattern(e)
+		}
+	case *ast.ListPattern:
+		for _, e := range p.Elems {
+			r.pattern(e)
+		}
+	case *ast.RecordPattern:
+		for _, f := range p.Fields {
+			r.pattern(f.Pat)
+		}
+	case *ast.BindPattern:
+		r.define(p.Name, "variable", p, int(p.Beg.Offset))
+		r.scope.InsertBinding(p)
+	}
+}
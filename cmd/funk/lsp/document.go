@@ -0,0 +1,103 @@
+package lsp
+
+import (
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/gala377/MLLang/syntax/span"
+)
+
+// document is an opened file. Positions in the protocol are given
+// as lines and UTF-16 code units while spans of the nodes use byte
+// offsets, so the offsets of the lines are kept to convert between
+// them.
+type document struct {
+	uri   string
+	text  string
+	lines []int
+	// last analysis of the document that parsed without errors,
+	// used to answer queries while the document is being edited
+	analysis *analysis
+}
+
+func newDocument(uri, text string) *document {
+	d := &document{uri: uri}
+	d.setText(text)
+	return d
+}
+
+func (d *document) setText(text string) {
+	d.text = text
+	d.lines = []int{0}
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\n' {
+			d.lines = append(d.lines, i+1)
+		}
+	}
+}
+
+func (d *document) line(n int) string {
+	if n < 0 || n >= len(d.lines) {
+		return ""
+	}
+	end := len(d.text)
+	if n+1 < len(d.lines) {
+		end = d.lines[n+1] - 1
+	}
+	return d.text[d.lines[n]:end]
+}
+
+// position converts the byte offset to the protocol's position.
+func (d *document) position(offset int) Position {
+	if offset > len(d.text) {
+		offset = len(d.text)
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	line := 0
+	for line+1 < len(d.lines) && d.lines[line+1] <= offset {
+		line++
+	}
+	prefix := d.text[d.lines[line]:offset]
+	return Position{Line: line, Character: len(utf16.Encode([]rune(prefix)))}
+}
+
+// offset converts the protocol's position to the byte offset.
+func (d *document) offset(p Position) int {
+	if p.Line >= len(d.lines) {
+		return len(d.text)
+	}
+	text := d.line(p.Line)
+	units := 0
+	for i, r := range text {
+		if units >= p.Character {
+			return d.lines[p.Line] + i
+		}
+		units += len(utf16.Encode([]rune{r}))
+	}
+	return d.lines[p.Line] + len(text)
+}
+
+func (d *document) rangeOf(beg, end int) Range {
+	if end < beg {
+		end = beg
+	}
+	return Range{Start: d.position(beg), End: d.position(end)}
+}
+
+func (d *document) spanRange(s *span.Span) Range {
+	if s == nil {
+		return Range{}
+	}
+	return d.rangeOf(int(s.Beg.Offset), int(s.End.Offset))
+}
+
+// lineOf returns the line containing the offset.
+func (d *document) lineOf(offset int) int {
+	return d.position(offset).Line
+}
+
+func isIdentifierChar(r rune) bool {
+	return r == '_' || r == '?' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= utf8.RuneSelf
+}
@@ -0,0 +1,275 @@
+package lsp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gala377/MLLang/syntax/ast"
+)
+
+// docComment returns the comment placed directly above the
+// definition, with the comment markers stripped.
+func (a *analysis) docComment(def *definition) []string {
+	switch def.node.(type) {
+	case *ast.FuncDecl, *ast.GlobalValDecl, *ast.EffectDecl, *ast.ValDecl, *ast.OperatorDecl:
+	default:
+		return nil
+	}
+	doc := []string{}
+	for l := a.doc.lineOf(int(def.node.NodeSpan().Beg.Offset)) - 1; l >= 0; l-- {
+		text := strings.TrimSpace(a.doc.line(l))
+		if !strings.HasPrefix(text, ";") {
+			break
+		}
+		doc = append([]string{strings.TrimSpace(strings.TrimLeft(text, ";"))}, doc...)
+	}
+	return doc
+}
+
+// hover describes the name at the offset. The signature is taken
+// from the "; type ::" line of the doc comment, if there is none
+// inferred types are shown for the globals.
+func (a *analysis) hover(offset int, modules map[string][]string) *Hover {
+	def, name := a.definitionAt(offset)
+	if name == "" {
+		return nil
+	}
+	if def == nil {
+		members, ok := modules[name]
+		if !ok {
+			return nil
+		}
+		return &Hover{Contents: MarkupContent{
+			Kind:  "markdown",
+			Value: fmt.Sprintf("```funk\nmodule %s\n```\n\n%s", name, strings.Join(members, ", ")),
+		}}
+	}
+	signature := fmt.Sprintf("%s %s", def.kind, def.name)
+	if def.global {
+		if t, ok := a.types.TypeOf(def.name); ok && t != "" {
+			signature = fmt.Sprintf("%s :: %s", def.name, t)
+		}
+	}
+	text := []string{}
+	for _, line := range a.docComment(def) {
+		if strings.HasPrefix(line, "type ::") {
+			signature = fmt.Sprintf("%s :: %s", def.name, strings.TrimSpace(strings.TrimPrefix(line, "type ::")))
+			continue
+		}
+		text = append(text, line)
+	}
+	value := fmt.Sprintf("```funk\n%s\n```", signature)
+	if len(text) > 0 {
+		value += "\n\n" + strings.Join(text, "\n")
+	}
+	return &Hover{Contents: MarkupContent{Kind: "markdown", Value: value}}
+}
+
+// moduleMembers returns names exported by the module
+// defined in the document.
+func (a *analysis) moduleMembers(name string) []string {
+	for _, def := range a.defs {
+		if !def.global || def.name != name || def.kind != "module" {
+			continue
+		}
+		body, ok := moduleBody(def.node)
+		if !ok {
+			return nil
+		}
+		members := []string{}
+		for i, s := range body.Instr {
+			expr, ok := s.(*ast.StmtExpr)
+			if !ok {
+				continue
+			}
+			switch e := expr.Expr.(type) {
+			case *ast.FuncApplication:
+				// module: export {a, b}
+				if id, ok := e.Callee.(*ast.Identifier); ok && id.Name == "export" {
+					for _, arg := range e.Args {
+						members = append(members, recordKeys(arg)...)
+					}
+				}
+			case *ast.RecordConst:
+				// scope: {a, b}
+				if i == len(body.Instr)-1 {
+					members = append(members, recordKeys(e)...)
+				}
+			}
+		}
+		return members
+	}
+	return nil
+}
+
+func moduleBody(node ast.Node) (*ast.Block, bool) {
+	var rhs ast.Expr
+	switch n := node.(type) {
+	case *ast.GlobalValDecl:
+		rhs = n.Rhs
+	case *ast.ValDecl:
+		rhs = n.Rhs
+	default:
+		return nil, false
+	}
+	app, ok := rhs.(*ast.FuncApplication)
+	if !ok || app.Block == nil {
+		return nil, false
+	}
+	body, ok := app.Block.Body.(*ast.Block)
+	return body, ok
+}
+
+func recordKeys(node ast.Expr) []string {
+	r, ok := node.(*ast.RecordConst)
+	if !ok {
+		return nil
+	}
+	keys := []string{}
+	for _, f := range r.Fields {
+		keys = append(keys, f.Key)
+	}
+	return keys
+}
+
+// completionContext returns the partially typed name before
+// the offset and the module it is accessed from, if any.
+func completionContext(d *document, offset int) (module, prefix string) {
+	text := d.text[:offset]
+	beg := len(text)
+	for beg > 0 && isIdentifierChar(rune(text[beg-1])) {
+		beg--
+	}
+	prefix = text[beg:]
+	if beg == 0 || text[beg-1] != '.' {
+		return "", prefix
+	}
+	end := beg - 1
+	beg = end
+	for beg > 0 && isIdentifierChar(rune(text[beg-1])) {
+		beg--
+	}
+	return text[beg:end], prefix
+}
+
+func completionKind(kind string) int {
+	switch kind {
+	case "function":
+		return completionFunction
+	case "effect":
+		return completionEvent
+	case "module", "import":
+		return completionModule
+	}
+	return completionVariable
+}
+
+// complete returns names that can be used at the offset. Members
+// of the modules are completed after a dot.
+func (s *Server) complete(d *document, offset int) []CompletionItem {
+	module, prefix := completionContext(d, offset)
+	items := []CompletionItem{}
+	seen := map[string]bool{}
+	add := func(label string, kind int, detail string) {
+		if seen[label] || !strings.HasPrefix(label, prefix) {
+			return
+		}
+		seen[label] = true
+		items = append(items, CompletionItem{Label: label, Kind: kind, Detail: detail})
+	}
+	a := d.analysis
+	if module != "" {
+		members, ok := s.modules[module]
+		if a != nil {
+			if m := a.moduleMembers(module); m != nil {
+				members, ok = m, true
+			}
+		}
+		if ok {
+			for _, m := range members {
+				add(m, completionField, module)
+			}
+		}
+		return items
+	}
+	if a != nil {
+		visible := a.visible(offset)
+		// inner definitions come last, prefer them
+		for i := len(visible) - 1; i >= 0; i-- {
+			add(visible[i].name, completionKind(visible[i].kind), visible[i].kind)
+		}
+	}
+	env := append([]string{}, s.env...)
+	sort.Strings(env)
+	for _, name := range env {
+		if _, ok := s.modules[name]; ok {
+			add(name, completionModule, "module")
+			continue
+		}
+		add(name, completionVariable, "builtin")
+	}
+	return items
+}
+
+// symbols returns functions, effects and modules defined in the
+// document. Definitions nested in them are returned as children.
+func (a *analysis) symbols() []DocumentSymbol {
+	res := []DocumentSymbol{}
+	for _, n := range a.nodes {
+		switch n := n.(type) {
+		case *ast.FuncDecl:
+			res = append(res, a.symbol(n, symbolFunction, a.nestedSymbols(n.Body)))
+		case *ast.EffectDecl:
+			res = append(res, a.symbol(n, symbolEvent, nil))
+		case *ast.ImportDecl:
+			res = append(res, a.symbol(n, symbolModule, nil))
+		case *ast.GlobalValDecl:
+			if s, ok := a.valueSymbol(n, n.Rhs); ok {
+				res = append(res, s)
+			}
+		}
+	}
+	return res
+}
+
+func (a *analysis) valueSymbol(node ast.Node, rhs ast.Expr) (DocumentSymbol, bool) {
+	switch valueKind(rhs) {
+	case "function":
+		return a.symbol(node, symbolFunction, a.nestedSymbols(rhs.(*ast.LambdaExpr).Body)), true
+	case "effect":
+		return a.symbol(node, symbolEvent, nil), true
+	case "module":
+		return a.symbol(node, symbolModule, a.nestedSymbols(rhs.(*ast.FuncApplication).Block.Body)), true
+	}
+	return DocumentSymbol{}, false
+}
+
+func (a *analysis) nestedSymbols(body ast.Expr) []DocumentSymbol {
+	block, ok := body.(*ast.Block)
+	if !ok {
+		return nil
+	}
+	res := []DocumentSymbol{}
+	for _, s := range block.Instr {
+		if v, ok := s.(*ast.ValDecl); ok {
+			if sym, ok := a.valueSymbol(v, v.Rhs); ok {
+				res = append(res, sym)
+			}
+		}
+	}
+	return res
+}
+
+func (a *analysis) symbol(node ast.Node, kind int, children []DocumentSymbol) DocumentSymbol {
+	def := a.byNode[node]
+	d := a.doc
+	return DocumentSymbol{
+		Name:           def.name,
+		Detail:         def.kind,
+		Kind:           kind,
+		Range:          d.spanRange(node.NodeSpan()),
+		SelectionRange: d.rangeOf(def.offset, def.offset+len(def.name)),
+		Children:       children,
+	}
+}
@@ -0,0 +1,239 @@
+// Package lsp implements the Language Server Protocol for funk
+// source files. The server speaks JSON-RPC over the given streams
+// and handles one message at a time.
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+type Server struct {
+	// globals defined by the standard library
+	env []string
+	// members of the standard library's modules
+	modules map[string][]string
+	docs    map[string]*document
+	out     io.Writer
+}
+
+// NewServer creates a server that knows about the given
+// globals and members of the std modules.
+func NewServer(env []string, modules map[string][]string) *Server {
+	return &Server{
+		env:     env,
+		modules: modules,
+		docs:    map[string]*document{},
+	}
+}
+
+// Run serves requests read from in until the exit
+// notification is received or the input is closed.
+func (s *Server) Run(in io.Reader, out io.Writer) error {
+	s.out = out
+	r := bufio.NewReader(in)
+	for {
+		body, err := readMessage(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var msg message
+		if err := json.Unmarshal(body, &msg); err != nil {
+			if err := s.reply(nil, nil, &responseError{parseError, err.Error()}); err != nil {
+				return err
+			}
+			continue
+		}
+		if msg.Method == "exit" {
+			return nil
+		}
+		if msg.ID == nil {
+			if err := s.notification(msg.Method, msg.Params); err != nil {
+				return err
+			}
+			continue
+		}
+		result, rerr := s.request(msg.Method, msg.Params)
+		if err := s.reply(msg.ID, result, rerr); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) reply(id *json.RawMessage, result interface{}, rerr *responseError) error {
+	resp := map[string]interface{}{"jsonrpc": "2.0", "id": id}
+	if rerr != nil {
+		resp["error"] = rerr
+	} else {
+		resp["result"] = result
+	}
+	return writeMessage(s.out, resp)
+}
+
+func (s *Server) notify(method string, params interface{}) error {
+	return writeMessage(s.out, map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  method,
+		"params":  params,
+	})
+}
+
+func (s *Server) notification(method string, params json.RawMessage) error {
+	switch method {
+	case "textDocument/didOpen":
+		var p didOpenParams
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil
+		}
+		d := newDocument(p.TextDocument.URI, p.TextDocument.Text)
+		s.docs[d.uri] = d
+		return s.publishDiagnostics(d)
+	case "textDocument/didChange":
+		var p didChangeParams
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil
+		}
+		d, ok := s.docs[p.TextDocument.URI]
+		if !ok || len(p.ContentChanges) == 0 {
+			return nil
+		}
+		// the server asks for full synchronization so
+		// the last change holds the whole document
+		d.setText(p.ContentChanges[len(p.ContentChanges)-1].Text)
+		return s.publishDiagnostics(d)
+	case "textDocument/didClose":
+		var p didCloseParams
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil
+		}
+		delete(s.docs, p.TextDocument.URI)
+		return s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{
+			URI:         p.TextDocument.URI,
+			Diagnostics: []Diagnostic{},
+		})
+	}
+	// other notifications, like initialized, are ignored
+	return nil
+}
+
+func (s *Server) publishDiagnostics(d *document) error {
+	a, diags := analyze(d, s.env)
+	if a != nil {
+		d.analysis = a
+	}
+	return s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{
+		URI:         d.uri,
+		Diagnostics: diags,
+	})
+}
+
+func (s *Server) request(method string, params json.RawMessage) (interface{}, *responseError) {
+	switch method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				// full document is sent on every change
+				"textDocumentSync":       1,
+				"definitionProvider":     true,
+				"referencesProvider":     true,
+				"hoverProvider":          true,
+				"documentSymbolProvider": true,
+				"completionProvider": map[string]interface{}{
+					"triggerCharacters": []string{"."},
+				},
+			},
+			"serverInfo": map[string]string{"name": "funk"},
+		}, nil
+	case "shutdown":
+		return nil, nil
+	case "textDocument/definition":
+		var p positionParams
+		d, offset, err := s.position(params, &p)
+		if err != nil || d.analysis == nil {
+			return nil, err
+		}
+		def, _ := d.analysis.definitionAt(offset)
+		if def == nil {
+			return nil, nil
+		}
+		return Location{URI: d.uri, Range: d.rangeOf(def.offset, def.offset+len(def.name))}, nil
+	case "textDocument/references":
+		var p referenceParams
+		d, offset, err := s.position(params, &p)
+		if err != nil || d.analysis == nil {
+			return []Location{}, err
+		}
+		return s.references(d, offset, p.Context.IncludeDeclaration), nil
+	case "textDocument/hover":
+		var p positionParams
+		d, offset, err := s.position(params, &p)
+		if err != nil || d.analysis == nil {
+			return nil, err
+		}
+		if h := d.analysis.hover(offset, s.modules); h != nil {
+			return h, nil
+		}
+		return nil, nil
+	case "textDocument/completion":
+		var p positionParams
+		d, offset, err := s.position(params, &p)
+		if err != nil {
+			return nil, err
+		}
+		return s.complete(d, offset), nil
+	case "textDocument/documentSymbol":
+		var p documentSymbolParams
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, &responseError{invalidParams, err.Error()}
+		}
+		d, ok := s.docs[p.TextDocument.URI]
+		if !ok || d.analysis == nil {
+			return []DocumentSymbol{}, nil
+		}
+		return d.analysis.symbols(), nil
+	}
+	return nil, &responseError{methodNotFound, fmt.Sprintf("method %s is not supported", method)}
+}
+
+// position decodes the params of the request made at the position
+// in the document and returns the document and the position's offset.
+func (s *Server) position(params json.RawMessage, p interface{}) (*document, int, *responseError) {
+	if err := json.Unmarshal(params, p); err != nil {
+		return nil, 0, &responseError{invalidParams, err.Error()}
+	}
+	var pos positionParams
+	switch p := p.(type) {
+	case *positionParams:
+		pos = *p
+	case *referenceParams:
+		pos = p.positionParams
+	}
+	d, ok := s.docs[pos.TextDocument.URI]
+	if !ok {
+		return nil, 0, &responseError{invalidParams, fmt.Sprintf("document %s is not opened", pos.TextDocument.URI)}
+	}
+	return d, d.offset(pos.Position), nil
+}
+
+func (s *Server) references(d *document, offset int, withDecl bool) []Location {
+	res := []Location{}
+	def, _ := d.analysis.definitionAt(offset)
+	if def == nil {
+		return res
+	}
+	offsets := d.analysis.references(def)
+	if withDecl {
+		offsets = append(offsets, def.offset)
+	}
+	sort.Ints(offsets)
+	for _, o := range offsets {
+		res = append(res, Location{URI: d.uri, Range: d.rangeOf(o, o+len(def.name))})
+	}
+	return res
+}
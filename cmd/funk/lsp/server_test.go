@@ -0,0 +1,327 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+)
+
+const uri = "file:///test.fnk"
+
+const source = `; Adds one to the number
+; type :: {int -> int}
+fn inc x = add x 1
+
+effect Log
+
+let Queue = module:
+  fn new = []
+  fn push q x = add q x
+  export {new, push}
+
+fn main:
+  let a = inc 1
+  io.print a
+  Log a
+`
+
+// client drives the server the way an editor would.
+type client struct {
+	t    *testing.T
+	in   *io.PipeWriter
+	out  *bufio.Reader
+	id   int
+	done chan error
+}
+
+func newClient(t *testing.T) *client {
+	t.Helper()
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	s := NewServer(
+		[]string{"io", "add", "export", "module"},
+		map[string][]string{"io": {"print", "readLine"}},
+	)
+	c := &client{t: t, in: inW, out: bufio.NewReader(outR), done: make(chan error, 1)}
+	go func() {
+		c.done <- s.Run(inR, outW)
+		outW.Close()
+	}()
+	return c
+}
+
+func (c *client) send(msg map[string]interface{}) {
+	c.t.Helper()
+	msg["jsonrpc"] = "2.0"
+	if err := writeMessage(c.in, msg); err != nil {
+		c.t.Fatalf("could not send the message: %s", err)
+	}
+}
+
+func (c *client) read() map[string]json.RawMessage {
+	c.t.Helper()
+	body, err := readMessage(c.out)
+	if err != nil {
+		c.t.Fatalf("could not read the message: %s", err)
+	}
+	var msg map[string]json.RawMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		c.t.Fatalf("invalid message %s: %s", body, err)
+	}
+	return msg
+}
+
+// request sends the request and returns the response to it.
+func (c *client) request(method string, params interface{}, result interface{}) *responseError {
+	c.t.Helper()
+	c.id++
+	c.send(map[string]interface{}{"id": c.id, "method": method, "params": params})
+	msg := c.read()
+	if _, ok := msg["method"]; ok {
+		c.t.Fatalf("expected a response to %s, got notification %s", method, msg["method"])
+	}
+	var id int
+	json.Unmarshal(msg["id"], &id)
+	if id != c.id {
+		c.t.Fatalf("expected response with id %d, got %d", c.id, id)
+	}
+	if e, ok := msg["error"]; ok {
+		var rerr responseError
+		json.Unmarshal(e, &rerr)
+		return &rerr
+	}
+	if err := json.Unmarshal(msg["result"], result); err != nil {
+		c.t.Fatalf("invalid result %s: %s", msg["result"], err)
+	}
+	return nil
+}
+
+func (c *client) notify(method string, params interface{}) {
+	c.t.Helper()
+	c.send(map[string]interface{}{"method": method, "params": params})
+}
+
+// diagnostics returns the diagnostics published after
+// the document has been opened or changed.
+func (c *client) diagnostics() []Diagnostic {
+	c.t.Helper()
+	msg := c.read()
+	var method string
+	json.Unmarshal(msg["method"], &method)
+	if method != "textDocument/publishDiagnostics" {
+		c.t.Fatalf("expected diagnostics, got %v", msg)
+	}
+	var p publishDiagnosticsParams
+	json.Unmarshal(msg["params"], &p)
+	return p.Diagnostics
+}
+
+func (c *client) open(text string) []Diagnostic {
+	c.t.Helper()
+	c.notify("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri, "languageId": "funk", "version": 1, "text": text},
+	})
+	return c.diagnostics()
+}
+
+func (c *client) change(text string) []Diagnostic {
+	c.t.Helper()
+	c.notify("textDocument/didChange", map[string]interface{}{
+		"textDocument":   map[string]interface{}{"uri": uri, "version": 2},
+		"contentChanges": []map[string]string{{"text": text}},
+	})
+	return c.diagnostics()
+}
+
+func (c *client) exit() {
+	c.t.Helper()
+	var res interface{}
+	if err := c.request("shutdown", nil, &res); err != nil {
+		c.t.Fatalf("shutdown failed %v", err)
+	}
+	c.notify("exit", nil)
+	if err := <-c.done; err != nil {
+		c.t.Fatalf("server failed %s", err)
+	}
+}
+
+func at(line, character int) map[string]interface{} {
+	return map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri},
+		"position":     Position{Line: line, Character: character},
+	}
+}
+
+func startedClient(t *testing.T) *client {
+	c := newClient(t)
+	var init struct {
+		Capabilities map[string]interface{} `json:"capabilities"`
+	}
+	if err := c.request("initialize", map[string]interface{}{"capabilities": map[string]interface{}{}}, &init); err != nil {
+		t.Fatalf("initialize failed %v", err)
+	}
+	for _, cap := range []string{"hoverProvider", "definitionProvider", "referencesProvider", "documentSymbolProvider", "completionProvider"} {
+		if _, ok := init.Capabilities[cap]; !ok {
+			t.Errorf("expected capability %s", cap)
+		}
+	}
+	c.notify("initialized", map[string]interface{}{})
+	if diags := c.open(source); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics %v", diags)
+	}
+	return c
+}
+
+func TestDiagnostics(t *testing.T) {
+	c := startedClient(t)
+	defer c.exit()
+	diags := c.change("fn f x =\n")
+	if len(diags) != 1 || diags[0].Severity != severityError {
+		t.Fatalf("expected one syntax error, got %v", diags)
+	}
+	if diags[0].Range.Start.Line != 0 {
+		t.Errorf("expected the error in the first line, got %v", diags[0].Range)
+	}
+	diags = c.change("fn f x:\n  prnt x\n")
+	if len(diags) != 1 || diags[0].Severity != severityWarning || diags[0].Message != "undefined variable prnt" {
+		t.Fatalf("expected undefined variable warning, got %v", diags)
+	}
+	want := Range{Start: Position{1, 2}, End: Position{1, 6}}
+	if diags[0].Range != want {
+		t.Errorf("expected warning at %v, got %v", want, diags[0].Range)
+	}
+	diags = c.change("fn f:\n  break\n")
+	if len(diags) != 1 || diags[0].Severity != severityError {
+		t.Fatalf("expected compilation error, got %v", diags)
+	}
+	// the fixities of the prelude operators are known
+	diags = c.change("fn f:\n  1 < 2 < 3\n")
+	if len(diags) != 1 || diags[0].Severity != severityError || !strings.Contains(diags[0].Message, "cannot be chained") {
+		t.Fatalf("expected chained operator error, got %v", diags)
+	}
+	if diags := c.change(source); len(diags) != 0 {
+		t.Fatalf("expected diagnostics to be cleared, got %v", diags)
+	}
+}
+
+func TestDefinitionAndReferences(t *testing.T) {
+	c := startedClient(t)
+	defer c.exit()
+	var loc Location
+	// inc in "let a = inc 1"
+	c.request("textDocument/definition", at(12, 11), &loc)
+	want := Range{Start: Position{2, 3}, End: Position{2, 6}}
+	if loc.URI != uri || loc.Range != want {
+		t.Errorf("expected definition at %v, got %v", want, loc)
+	}
+	// parameter x in "add x 1"
+	c.request("textDocument/definition", at(2, 15), &loc)
+	want = Range{Start: Position{2, 7}, End: Position{2, 8}}
+	if loc.Range != want {
+		t.Errorf("expected definition at %v, got %v", want, loc.Range)
+	}
+	var refs []Location
+	params := at(12, 6)
+	params["context"] = map[string]bool{"includeDeclaration": true}
+	c.request("textDocument/references", params, &refs)
+	lines := []int{}
+	for _, r := range refs {
+		lines = append(lines, r.Range.Start.Line)
+	}
+	if len(lines) != 3 || lines[0] != 12 || lines[1] != 13 || lines[2] != 14 {
+		t.Errorf("expected references of a in lines 12, 13 and 14, got %v", refs)
+	}
+}
+
+func TestHover(t *testing.T) {
+	c := startedClient(t)
+	defer c.exit()
+	var h Hover
+	c.request("textDocument/hover", at(12, 11), &h)
+	if !strings.Contains(h.Contents.Value, "inc :: {int -> int}") || !strings.Contains(h.Contents.Value, "Adds one to the number") {
+		t.Errorf("expected hover with the doc comment, got %q", h.Contents.Value)
+	}
+	c.request("textDocument/hover", at(13, 2), &h)
+	if !strings.Contains(h.Contents.Value, "module io") || !strings.Contains(h.Contents.Value, "print") {
+		t.Errorf("expected hover of std module, got %q", h.Contents.Value)
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	c := startedClient(t)
+	defer c.exit()
+	labels := func(items []CompletionItem) map[string]int {
+		res := map[string]int{}
+		for _, i := range items {
+			res[i.Label] = i.Kind
+		}
+		return res
+	}
+	var items []CompletionItem
+	c.request("textDocument/completion", at(14, 2), &items)
+	got := labels(items)
+	for name, kind := range map[string]int{"a": completionVariable, "inc": completionFunction, "Log": completionEvent, "io": completionModule} {
+		if got[name] != kind {
+			t.Errorf("expected completion %s of kind %d, got %v", name, kind, items)
+		}
+	}
+	// the document does not parse while typing
+	c.change(strings.Replace(source, "  Log a\n", "  io.\n  Queue.p\n", 1))
+	c.request("textDocument/completion", at(14, 5), &items)
+	if got := labels(items); len(got) != 2 || got["print"] != completionField {
+		t.Errorf("expected members of io, got %v", items)
+	}
+	c.request("textDocument/completion", at(15, 9), &items)
+	if got := labels(items); len(got) != 1 || got["push"] != completionField {
+		t.Errorf("expected push member of Queue, got %v", items)
+	}
+}
+
+func TestDocumentSymbols(t *testing.T) {
+	c := startedClient(t)
+	defer c.exit()
+	var symbols []DocumentSymbol
+	c.request("textDocument/documentSymbol", map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri},
+	}, &symbols)
+	want := []struct {
+		name     string
+		kind     int
+		children []string
+	}{
+		{"inc", symbolFunction, nil},
+		{"Log", symbolEvent, nil},
+		{"Queue", symbolModule, []string{"new", "push"}},
+		{"main", symbolFunction, nil},
+	}
+	if len(symbols) != len(want) {
+		t.Fatalf("expected %d symbols, got %v", len(want), symbols)
+	}
+	for i, w := range want {
+		s := symbols[i]
+		if s.Name != w.name || s.Kind != w.kind || len(s.Children) != len(w.children) {
+			t.Errorf("expected symbol %v, got %v", w, s)
+			continue
+		}
+		for j, child := range w.children {
+			if s.Children[j].Name != child || s.Children[j].Kind != symbolFunction {
+				t.Errorf("expected child function %s, got %v", child, s.Children[j])
+			}
+		}
+	}
+	if r := symbols[0].SelectionRange; r.Start != (Position{2, 3}) {
+		t.Errorf("expected selection of the name, got %v", r)
+	}
+}
+
+func TestUnknownMethod(t *testing.T) {
+	c := startedClient(t)
+	defer c.exit()
+	var res interface{}
+	err := c.request("textDocument/rename", at(0, 0), &res)
+	if err == nil || err.Code != methodNotFound {
+		t.Errorf("expected method not found error, got %v", err)
+	}
+}
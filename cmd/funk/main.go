@@ -9,11 +9,14 @@ import (
 	"os"
 	"runtime/pprof"
 
+	"github.com/gala377/MLLang/cmd/funk/lsp"
 	"github.com/gala377/MLLang/cmd/funk/std"
 	"github.com/gala377/MLLang/codegen"
 	"github.com/gala377/MLLang/data"
 	"github.com/gala377/MLLang/isa"
 	"github.com/gala377/MLLang/syntax"
+	"github.com/gala377/MLLang/syntax/format"
+	"github.com/gala377/MLLang/types"
 	"github.com/gala377/MLLang/vm"
 )
 
@@ -23,21 +26,41 @@ var showCode = flag.Bool("dump_bytecode", false, "just compiles the file and pri
 var showAst = flag.Bool("dump_ast", false, "just parse the file and print the ast to stdout")
 var panicOnError = flag.Bool("panic_on_error", false, "runtime error will cause panic in the interpreter")
 var profile = flag.String("profile", "", "start profiling and write data to file specified as a value of this flag")
+var noOptimizations = flag.Bool("O0", false, "disable the optimization of the compiled bytecode")
+var writeFormatted = flag.Bool("w", false, "fmt writes the formatted source back to the file instead of the stdout")
+var traceEffects = flag.Bool("trace_effects", false, "log performed effects, resumes and aborts to the stderr")
+var traceFormat = flag.String("trace_format", "text", "format of the effect trace, text or json")
+var maxFrames = flag.Int("max_frames", vm.DefaultMaxFrames, "maximum call depth, 0 for no limit")
+var maxStack = flag.Int("max_stack", vm.DefaultMaxStack, "maximum number of the vm's stack slots, 0 for no limit")
 
 var filePath = ""
 
+// commands are run with "funk command [file]" instead
+// of evaluating the file.
+var commands = map[string]func(){
+	"check": checkFile,
+	"fmt":   formatFiles,
+	"lsp":   runLanguageServer,
+}
+
 func main() {
 	flag.Parse()
+	if cmd, ok := commands[flag.Arg(0)]; ok {
+		cmd()
+		return
+	}
 	parsePositionalArgs()
 	f := getFile()
 	vm.Debug = *verboseFlag
 	vm.AllowTailCalls = *tailCalls
+	codegen.Optimize = !*noOptimizations
 	if !*verboseFlag {
 		log.SetOutput(ioutil.Discard)
 	}
 	if *showAst {
 		sr := bytes.NewReader(f)
 		p := syntax.NewParser(sr)
+		p.UseOperators(std.Operators())
 		ast := p.Parse()
 		fmt.Printf("%s", ast)
 		return
@@ -54,17 +77,27 @@ func parsePositionalArgs() {
 
 func evaluateBuffer(path string, buff []byte) {
 	i := codegen.NewInterner()
-	c, err := codegen.Compile(path, buff, i)
+	s := bytes.NewReader(buff)
+	vm := vmWithStdEnv(s, i)
+	vm.SetLimits(*maxFrames, *maxStack)
+	if *showCode {
+		// optimized after printing the emitted code
+		codegen.Optimize = false
+	}
+	c, err := codegen.CompileWithVm(path, buff, i, vm.BuiltinNames(), vm)
 	if err != nil {
 		fmt.Print(err)
 		os.Exit(1)
 	}
 	if *showCode {
-		printCode(c)
+		dumpCode(c)
 		os.Exit(0)
 	}
-	s := bytes.NewReader(buff)
-	vm := vmWithStdEnv(s, i)
+	if *traceEffects {
+		// enabled after the std library has been loaded
+		// so that only effects of the program are traced
+		enableEffectTrace()
+	}
 	defer func() {
 		if r := recover(); r != nil {
 			if msg, ok := r.(string); ok && msg == "runtime error" {
@@ -95,6 +128,25 @@ func evaluateBuffer(path string, buff []byte) {
 	}
 }
 
+func enableEffectTrace() {
+	vm.EffectTrace = os.Stderr
+	vm.TraceJSON = *traceFormat == "json"
+}
+
+// dumpCode prints the code as emitted and, unless
+// the optimizations are disabled, after optimizing it.
+func dumpCode(c *data.Code) {
+	if *noOptimizations {
+		printCode(c)
+		return
+	}
+	fmt.Println("== emitted ==")
+	printCode(c)
+	codegen.OptimizeCode(c)
+	fmt.Println("== optimized ==")
+	printCode(c)
+}
+
 func printCode(c *data.Code) {
 	fmt.Println(isa.DisassembleCode(c))
 	for _, c := range c.Consts {
@@ -115,9 +167,106 @@ func vmWithStdEnv(source *bytes.Reader, interner *codegen.Interner) *vm.Vm {
 	for _, e := range std.StdEnv {
 		e.Inject(&vm)
 	}
+	vm.MarkBuiltins()
 	return &vm
 }
 
+// checkFile runs the type checker over the file given
+// after the command and reports found type errors.
+func checkFile() {
+	if flag.NArg() < 2 {
+		panic("Expected a file name to check")
+	}
+	filePath = flag.Arg(1)
+	log.SetOutput(ioutil.Discard)
+	f := getFile()
+	sr := bytes.NewReader(f)
+	p := syntax.NewParser(sr)
+	p.UseOperators(std.Operators())
+	nodes := p.Parse()
+	if len(p.Errors()) > 0 {
+		fmt.Print("Parsing error:")
+		for _, e := range p.Errors() {
+			codegen.PrintWithSource(filePath, sr, e)
+		}
+		os.Exit(1)
+	}
+	failed := false
+	errs := types.NewChecker().Check(nodes)
+	if len(errs) > 0 {
+		fmt.Print("Type errors:\n")
+		for _, e := range errs {
+			codegen.PrintWithSource(filePath, sr, e)
+		}
+		failed = true
+	}
+	fns, errs := types.AnalyzeEffects(nodes)
+	fmt.Print("Effects:\n")
+	for _, f := range fns {
+		fmt.Printf("\t%s\n", f)
+	}
+	if len(errs) > 0 {
+		fmt.Print("Effect errors:\n")
+		for _, e := range errs {
+			codegen.PrintWithSource(filePath, sr, e)
+		}
+		failed = true
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// formatFiles formats files given after the command
+// and prints them or writes them back with -w flag.
+func formatFiles() {
+	if flag.NArg() < 2 {
+		panic("Expected a file name to format")
+	}
+	log.SetOutput(ioutil.Discard)
+	failed := false
+	for _, path := range flag.Args()[1:] {
+		filePath = path
+		f := getFile()
+		res, errs := format.SourceWithOperators(f, std.Operators())
+		if len(errs) > 0 {
+			fmt.Print("Parsing error:")
+			for _, e := range errs {
+				codegen.PrintWithSource(filePath, bytes.NewReader(f), e)
+			}
+			failed = true
+			continue
+		}
+		if !*writeFormatted {
+			os.Stdout.Write(res)
+			continue
+		}
+		if bytes.Equal(f, res) {
+			continue
+		}
+		if err := ioutil.WriteFile(filePath, res, 0644); err != nil {
+			fmt.Println(err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// runLanguageServer serves the language server protocol over stdio.
+func runLanguageServer() {
+	log.SetOutput(ioutil.Discard)
+	// stdout is used for the protocol's messages
+	vm.Debug = false
+	env := vmWithStdEnv(bytes.NewReader(nil), codegen.NewInterner())
+	s := lsp.NewServer(env.BuiltinNames(), std.ModuleMembers(env))
+	if err := s.Run(os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
 func getFile() []byte {
 	filename := filePath
 	buffer, err := ioutil.ReadFile(filename)
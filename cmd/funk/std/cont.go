@@ -0,0 +1,39 @@
+package std
+
+import (
+	"errors"
+
+	"github.com/gala377/MLLang/data"
+	"github.com/gala377/MLLang/vm"
+)
+
+var contModule = module{
+	Name: "cont",
+	Entries: map[string]AsValue{
+		"clone": &funcEntry{"clone", 1, contClone},
+		"drop":  &valueEntry{vm.DropContinuation},
+	},
+}
+
+// valueEntry is a module entry with a value given up front.
+type valueEntry struct {
+	Value data.Value
+}
+
+func (v *valueEntry) AsValue(*vm.Vm) data.Value {
+	return v.Value
+}
+
+func contClone(_ data.VmProxy, vv ...data.Value) (data.Value, error) {
+	k, ok := vv[0].(*data.Continuation)
+	if !ok {
+		return nil, errors.New("clone expects a continuation")
+	}
+	if k.Resumed() {
+		return nil, errors.New("continuation has already been resumed and cannot be cloned")
+	}
+	if k.Dropped() {
+		return nil, errors.New("continuation has been dropped and cannot be cloned")
+	}
+	return k.Clone(), nil
+}
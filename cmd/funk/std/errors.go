@@ -2,7 +2,50 @@ package std
 
 import (
 	_ "embed"
+	"fmt"
+
+	"github.com/gala377/MLLang/data"
+	"github.com/gala377/MLLang/vm"
 )
 
 //go:embed errors.fnk
 var funkErrors []byte
+
+// Error is an error thrown by the funk code
+// and not handled by any of its handlers.
+type Error struct {
+	Kind string
+	Msg  string
+	// the thrown record
+	Value data.Value
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Kind, e.Msg)
+}
+
+// HandleErrors makes errors thrown with errors.error and not handled
+// by the funk code abort the run of the vm. The run then returns them
+// as *Error. Returns false if the errors module is not in the vm.
+func HandleErrors(v *vm.Vm) bool {
+	typ, ok := v.EffectType("errors.error")
+	if !ok {
+		return false
+	}
+	v.HandleEffect(typ, func(v *vm.Vm, arg data.Value) (data.Value, error) {
+		err := &Error{Value: arg}
+		if r, ok := arg.(*data.Record); ok {
+			if kind, ok := r.GetField(v.CreateSymbol("kind")); ok {
+				err.Kind = kind.String()
+			}
+			if msg, ok := r.GetField(v.CreateSymbol("msg")); ok {
+				err.Msg = msg.String()
+				if s, ok := msg.(data.String); ok {
+					err.Msg = s.Val
+				}
+			}
+		}
+		return nil, err
+	})
+	return true
+}
@@ -0,0 +1,94 @@
+package std
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gala377/MLLang/codegen"
+	"github.com/gala377/MLLang/data"
+	"github.com/gala377/MLLang/vm"
+)
+
+// compile returns a vm with the standard environment, the globals
+// and errors handled by HandleErrors, and the compiled source.
+func compile(t *testing.T, src string, globals map[string]data.Value) (*vm.Vm, *data.Code) {
+	t.Helper()
+	i := codegen.NewInterner()
+	source := []byte(src)
+	v := vm.NewVm("test.fnk", bytes.NewReader(source), i)
+	for _, e := range StdEnv {
+		e.Inject(&v)
+	}
+	for name, val := range globals {
+		v.AddToGlobals(name, val)
+	}
+	v.MarkBuiltins()
+	if !HandleErrors(&v) {
+		t.Fatal("the errors module is missing")
+	}
+	c, err := codegen.CompileWithVm("test.fnk", source, i, v.BuiltinNames(), &v)
+	if err != nil {
+		t.Fatalf("unexpected compilation error %s", err)
+	}
+	return &v, c
+}
+
+func checkError(t *testing.T, err error, kind, msg string) {
+	t.Helper()
+	var e *Error
+	if !errors.As(err, &e) {
+		t.Fatalf("expected *Error, got %#v", err)
+	}
+	if e.Kind != kind || e.Msg != msg {
+		t.Errorf("expected %s: %s, got %s: %s", kind, msg, e.Kind, e.Msg)
+	}
+}
+
+func TestHandleErrors(t *testing.T) {
+	t.Run("interpret", func(t *testing.T) {
+		v, c := compile(t, "errors.throw `Custom \"went wrong\"\n", nil)
+		_, err := v.Interpret(c)
+		checkError(t, err, "Custom", "went wrong")
+	})
+	t.Run("run closure", func(t *testing.T) {
+		var fail data.Callable
+		keep := data.NewNativeFunc("keep", 1, func(_ data.VmProxy, vs ...data.Value) (data.Value, error) {
+			fail = vs[0].(data.Callable)
+			return data.None, nil
+		})
+		v, c := compile(t, "fn fail msg = errors.throw `Custom msg\nkeep fail\n", map[string]data.Value{"keep": keep})
+		if _, err := v.Interpret(c); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		_, err := v.RunClosureWith(nil, fail, data.NewString("from the host"))
+		checkError(t, err, "Custom", "from the host")
+	})
+	t.Run("handled by the code", func(t *testing.T) {
+		var got data.Value
+		keep := data.NewNativeFunc("keep", 1, func(_ data.VmProxy, vs ...data.Value) (data.Value, error) {
+			got = vs[0]
+			return data.None, nil
+		})
+		src := "let r = handle:\n  errors.throw `Custom \"handled\"\nwith errors.error e:\n  e.msg\nkeep r\n"
+		v, c := compile(t, src, map[string]data.Value{"keep": keep})
+		if _, err := v.Interpret(c); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		if s, ok := got.(data.String); !ok || s.Val != "handled" {
+			t.Errorf("expected the handler's result, got %v", got)
+		}
+	})
+	t.Run("import", func(t *testing.T) {
+		module := filepath.Join(t.TempDir(), "failing.fnk")
+		if err := os.WriteFile(module, []byte("errors.throw `Custom \"in the module\"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		v, c := compile(t, fmt.Sprintf("import %q as failing\n", module), nil)
+		_, err := v.Interpret(c)
+		checkError(t, err, "Custom", "in the module")
+	})
+}
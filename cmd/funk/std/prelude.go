@@ -1,17 +1,28 @@
 package std
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 
 	_ "embed"
 
 	"github.com/gala377/MLLang/data"
+	"github.com/gala377/MLLang/syntax"
+	"github.com/gala377/MLLang/vm"
 )
 
 //go:embed prelude.fnk
 var funkPrelude []byte
 
+// Operators returns fixities of the operators declared by the prelude,
+// for the tools which need to parse the code without running it.
+func Operators() syntax.Operators {
+	p := syntax.NewParser(bytes.NewReader(funkPrelude))
+	p.Parse()
+	return p.Operators()
+}
+
 //go:embed struct.fnk
 var funkStruct []byte
 
@@ -162,13 +173,25 @@ func vmGenSym(vm data.VmProxy, vv ...data.Value) (data.Value, error) {
 	return vm.GenerateSymbol(), nil
 }
 
-func vmSpawn(vm data.VmProxy, vv ...data.Value) (data.Value, error) {
+func vmSpawn(v data.VmProxy, vv ...data.Value) (data.Value, error) {
 	c, ok := vv[0].(data.Callable)
 	if !ok || c.Arity() > 0 {
 		return nil, errors.New("spawn expects a callable of arity 0 to run")
 	}
-	cloned := vm.Clone()
-	go cloned.RunClosure(c)
+	cloned := v.Clone()
+	machine, ok := cloned.(*vm.Vm)
+	if !ok {
+		go cloned.RunClosure(c)
+		return data.None, nil
+	}
+	go func() {
+		// the goroutine inherits the context of the run
+		// and quietly stops when it gets cancelled
+		_, err := machine.RunClosureWith(nil, c)
+		if err != nil && !errors.Is(err, vm.ErrCancelled) {
+			panic(fmt.Sprintf("error in spawned goroutine: %s", err))
+		}
+	}()
 	return data.None, nil
 }
 
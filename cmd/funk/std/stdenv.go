@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"sort"
 
 	"github.com/gala377/MLLang/codegen"
 	"github.com/gala377/MLLang/data"
@@ -54,7 +55,7 @@ func (m *module) Inject(vm *vm.Vm) {
 
 func (fs *funkSource) Inject(vm *vm.Vm) {
 	inter := vm.Interner()
-	c, err := codegen.Compile(fs.Path, fs.Source, inter)
+	c, err := codegen.CompileWithVm(fs.Path, fs.Source, inter, nil, vm)
 	if err != nil {
 		fmt.Print(err)
 		os.Exit(1)
@@ -67,6 +68,27 @@ func (fs *funkSource) Inject(vm *vm.Vm) {
 	}
 }
 
+// ModuleMembers returns names of the members of the modules
+// injected into the vm, keyed by the module's name. Modules
+// implemented in funk are included as well.
+func ModuleMembers(vm *vm.Vm) map[string][]string {
+	res := map[string][]string{}
+	for _, name := range vm.BuiltinNames() {
+		v, _ := vm.Builtin(name)
+		r, ok := v.(*data.Record)
+		if !ok {
+			continue
+		}
+		members := []string{}
+		for _, k := range r.Keys() {
+			members = append(members, k.String())
+		}
+		sort.Strings(members)
+		res[name] = members
+	}
+	return res
+}
+
 var StdEnv = [...]EnvironmentEntry{
 	&funcEntry{"add", 2, add},
 	&funcEntry{"sub", 2, sub},
@@ -103,6 +125,7 @@ var StdEnv = [...]EnvironmentEntry{
 	&httpModule,
 	&inspectModule,
 	&recordsModule,
+	&contModule,
 	&funkSource{"@errors", funkErrors},
 	&funkSource{"@iter", funkIter},
 	&funkSource{"@prelude", funkPrelude},
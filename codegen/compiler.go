@@ -3,14 +3,39 @@ package codegen
 import (
 	"bytes"
 	"fmt"
+	"os"
 
 	"github.com/gala377/MLLang/data"
 	"github.com/gala377/MLLang/syntax"
 )
 
 func Compile(path string, source []byte, interner *Interner) (*data.Code, error) {
+	return CompileWithEnv(path, source, interner, nil)
+}
+
+// CompileWithEnv compiles the source which is going to be run with
+// the given global names already defined. If env is not nil the
+// program is also linted and found problems are reported as warnings.
+func CompileWithEnv(path string, source []byte, interner *Interner, env []string) (*data.Code, error) {
+	return CompileWithVm(path, source, interner, env, nil)
+}
+
+// operatorTable is implemented by virtual machines which keep
+// fixities of the declared operators, so that the code compiled
+// later, like the user's code using the prelude, can use them.
+type operatorTable interface {
+	Operators() syntax.Operators
+}
+
+// CompileWithVm compiles the source expanding its macros
+// by running them in the clones of the given virtual machine.
+func CompileWithVm(path string, source []byte, interner *Interner, env []string, vm data.VmProxy) (*data.Code, error) {
 	sr := bytes.NewReader(source)
 	p := syntax.NewParser(sr)
+	ops, hasOps := vm.(operatorTable)
+	if hasOps {
+		p.UseOperators(ops.Operators())
+	}
 	ast := p.Parse()
 	if len(p.Errors()) > 0 {
 		fmt.Print("Parsing error:")
@@ -19,6 +44,14 @@ func Compile(path string, source []byte, interner *Interner) (*data.Code, error)
 		}
 		return nil, fmt.Errorf("syntax errors")
 	}
+	ast, errs := ExpandMacros(path, ast, interner, vm)
+	if len(errs) > 0 {
+		fmt.Print("Compilation errors:\n")
+		for _, e := range errs {
+			PrintWithSource(path, sr, e)
+		}
+		return nil, fmt.Errorf("compilation errors")
+	}
 	e := NewEmitter(path, interner)
 	c, errs := e.Compile(ast)
 	if len(errs) > 0 {
@@ -28,6 +61,24 @@ func Compile(path string, source []byte, interner *Interner) (*data.Code, error)
 		}
 		return nil, fmt.Errorf("compilation errors")
 	}
+	if Optimize {
+		OptimizeCode(c)
+	}
+	if hasOps {
+		for op, fixity := range p.Operators() {
+			ops.Operators()[op] = fixity
+		}
+	}
+	ww := e.Warnings()
+	if env != nil {
+		ww = append(ww, Lint(ast, env)...)
+	}
+	if len(ww) > 0 {
+		fmt.Fprint(os.Stderr, "Compilation warnings:\n")
+		for _, w := range ww {
+			PrintWarningWithSource(path, sr, w)
+		}
+	}
 	c.Path = path
 	return c, nil
 }
@@ -29,8 +29,10 @@ type ClausGroup struct {
 // like for example guard using Ask to get a value to check against.
 func desugarGuards(h *ast.Handle, effectc int) (*ast.Handle, []*ast.ValDecl) {
 	res := ast.Handle{
-		Span: h.Span,
-		Body: h.Body,
+		Span:    h.Span,
+		Body:    h.Body,
+		Return:  h.Return,
+		Finally: h.Finally,
 	}
 	arms := groupClauses(h.Arms)
 	savedeff := make([]*ast.ValDecl, 0, len(arms))
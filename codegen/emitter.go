@@ -2,7 +2,6 @@ package codegen
 
 import (
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"log"
 	"math"
@@ -14,6 +13,14 @@ import (
 	"github.com/gala377/MLLang/syntax/span"
 )
 
+// Values returned from the handle's body to break
+// or continue the loop the handle is placed in.
+var (
+	SIGNAL_PREFIX = "@signal"
+	// Handlers of handles with finalizers, kept to finalize them.
+	FINALLY_PREFIX = "@finally"
+)
+
 type CompilationError struct {
 	Location *span.Span
 	Message  string
@@ -29,13 +36,30 @@ func (c CompilationError) SourceLoc() span.Span {
 
 type Emitter struct {
 	result         *data.Code
-	line           int
+	loc            data.Location
 	interner       *Interner
 	errors         []CompilationError
+	warnings       []CompilationError
 	scope          *syntax.Scope
 	path           string
 	inTailPosition bool
 	counter        int
+	// loops enclosing currently emitted code within this function.
+	loops []*loop
+	// true if this function is a body of the handle placed
+	// inside of a loop. Break and continue then return a loop
+	// signal so that the loop can be left after the handler
+	// has been popped.
+	inLoopHandler bool
+	// set if a loop signal has been returned from this function.
+	usedLoopSignals bool
+}
+
+type loop struct {
+	// position of the loop's condition
+	beg int
+	// jumps that have to be patched to the loop's end
+	breaks []int
 }
 
 func NewEmitter(path string, i *Interner) *Emitter {
@@ -43,9 +67,9 @@ func NewEmitter(path string, i *Interner) *Emitter {
 	c.Path = path
 	e := Emitter{
 		result:   &c,
-		line:     0,
 		interner: i,
 		errors:   make([]CompilationError, 0),
+		warnings: make([]CompilationError, 0),
 		// todo share scope from parser
 		scope:          syntax.NewScope(nil),
 		path:           path,
@@ -72,12 +96,24 @@ func (e *Emitter) error(loc *span.Span, msg string) {
 	})
 }
 
+func (e *Emitter) warn(loc *span.Span, msg string) {
+	e.warnings = append(e.warnings, CompilationError{
+		Location: loc,
+		Message:  msg,
+	})
+}
+
+// Warnings returns diagnostics that do not stop the compilation.
+func (e *Emitter) Warnings() []CompilationError {
+	return e.warnings
+}
+
 func (e *Emitter) Interner() *Interner {
 	return e.interner
 }
 
 func (e *Emitter) emitNode(n ast.Node) {
-	e.line = int(n.NodeSpan().Beg.Line)
+	e.locate(n.NodeSpan())
 	if v, ok := n.(ast.Stmt); ok {
 		e.emitStmt(v)
 		return
@@ -90,7 +126,24 @@ func (e *Emitter) emitNode(n ast.Node) {
 }
 
 func (e *Emitter) emitByte(b byte) {
-	e.result.WriteByte(b, e.line)
+	e.result.WriteByte(b, e.loc)
+}
+
+// locate sets the source location of the instructions
+// emitted from now on and returns the previous one.
+func (e *Emitter) locate(s *span.Span) data.Location {
+	return e.setLocation(data.Location{
+		Line:   int(s.Beg.Line),
+		Column: int(s.Beg.Column),
+		Beg:    int(s.Beg.Offset),
+		End:    int(s.End.Offset),
+	})
+}
+
+func (e *Emitter) setLocation(loc data.Location) data.Location {
+	prev := e.loc
+	e.loc = loc
+	return prev
 }
 func (e *Emitter) emitBytes(bb ...byte) {
 	for _, b := range bb {
@@ -101,21 +154,46 @@ func (e *Emitter) emitBytes(bb ...byte) {
 func (e *Emitter) emitConstant(v data.Value) {
 	index := e.result.AddConstant(v)
 	if index > 255 {
-		if index > math.MaxUint16 {
-			// rare panic but that is the best we can do honestly
-			panic("More constants that uint16 can hold. That is not supported.")
-		}
-		e.emitByte(isa.Constant2)
-		args := []byte{0, 0}
-		binary.BigEndian.PutUint16(args, uint16(index))
-		e.emitBytes(args...)
+		e.emitOp(isa.Constant2, index)
 		return
 	}
 	e.emitBytes(isa.Constant, byte(index))
 }
 
+// emitOp emits the instruction with its 2 byte argument.
+// Arguments that do not fit are widened to 4 bytes
+// by prefixing the instruction with Wide.
+func (e *Emitter) emitOp(instr isa.Op, arg int) {
+	if int64(arg) > math.MaxUint32 {
+		e.error(spanOf(e.loc), fmt.Sprintf("instruction argument %d does not fit in 4 bytes", arg))
+		return
+	}
+	if arg > math.MaxUint16 {
+		args := []byte{0, 0, 0, 0}
+		binary.BigEndian.PutUint32(args, uint32(arg))
+		e.emitBytes(isa.Wide, instr)
+		e.emitBytes(args...)
+		return
+	}
+	args := []byte{0, 0}
+	binary.BigEndian.PutUint16(args, uint16(arg))
+	e.emitByte(instr)
+	e.emitBytes(args...)
+}
+
+// spanOf returns a span covering the location
+// for errors not associated with any node.
+func spanOf(loc data.Location) *span.Span {
+	pos := func(offset int) span.Position {
+		return span.Position{Line: uint(loc.Line), Column: uint(loc.Column), Offset: uint(offset)}
+	}
+	return &span.Span{Beg: pos(loc.Beg), End: pos(loc.End)}
+}
+
 func (e *Emitter) emitExpr(node ast.Expr) {
-	e.line = int(node.NodeSpan().Beg.Line)
+	// instructions emitted after the subexpressions,
+	// like calls, belong to the whole expression
+	defer e.setLocation(e.locate(node.NodeSpan()))
 	switch v := node.(type) {
 	case *ast.IfExpr:
 		e.emitIf(v, false)
@@ -157,6 +235,8 @@ func (e *Emitter) emitExpr(node ast.Expr) {
 		e.emitLocalEffect(v)
 	case *ast.Resume:
 		e.emitResume(v, false)
+	case *ast.Match:
+		e.emitMatch(v, false)
 	default:
 		log.Printf("Node is %v", node)
 		e.error(node.NodeSpan(), "Node cannot be emitted. Not supported")
@@ -164,19 +244,27 @@ func (e *Emitter) emitExpr(node ast.Expr) {
 }
 
 func (e *Emitter) emitStmt(node ast.Stmt) {
-	e.line = int(node.NodeSpan().Beg.Line)
+	e.locate(node.NodeSpan())
 	switch v := node.(type) {
 	case *ast.StmtExpr:
 		log.Printf("Got StmtExpression")
 		e.emitUnboundExpr(v.Expr)
 	case *ast.ValDecl:
 		e.emitVariableDecl(v)
+	case *ast.PatternDecl:
+		e.emitPatternDecl(v)
 	case *ast.Assignment:
 		e.emitAssignment(v)
 	case *ast.WhileStmt:
 		e.emitWhile(v)
+	case *ast.ForStmt:
+		e.emitFor(v)
 	case *ast.Return:
 		e.emitReturn(v)
+	case *ast.Break:
+		e.emitBreak(v.Span)
+	case *ast.Continue:
+		e.emitContinue(v.Span)
 	default:
 		log.Printf("Stmt node is %v", node)
 		e.error(node.NodeSpan(), "Stmt node cannot be emitted. Not supported")
@@ -232,9 +320,14 @@ func (e *Emitter) emitJumpBack() int {
 	return e.result.Len() - 3
 }
 
+// patchJump sets the offset of the jump at i. Jumps cannot be
+// widened so jumping further than uint16 is a compilation error.
 func (e *Emitter) patchJump(i int, offset int) {
 	if offset > math.MaxUint16 {
-		panic("Trying to jump more than uint16. Not supported")
+		e.error(
+			spanOf(e.result.Location(i)),
+			fmt.Sprintf("jumps can only span %d bytes of code, try splitting the function", math.MaxUint16))
+		return
 	}
 	args := []byte{0, 0}
 	binary.BigEndian.PutUint16(args, uint16(offset))
@@ -253,28 +346,15 @@ func (e *Emitter) emitLocalLookup(node *ast.Identifier, si syntax.ScopeInfo) {
 	}
 }
 func (e *Emitter) emitLookup(kind isa.Op, node *ast.Identifier) {
-	index, err := e.addSymbol(node.Name)
-	if err != nil {
-		e.error(node.NodeSpan(), err.Error())
-		return
-	}
-	args := []byte{0, 0}
-	binary.BigEndian.PutUint16(args, uint16(index))
-	e.emitByte(kind)
-	e.emitBytes(args...)
+	e.emitOp(kind, e.addSymbol(node.Name))
 }
 
 func (e *Emitter) emitAssignment(node *ast.Assignment) {
 	var index int
-	var err error
 	instr := isa.StoreDyn
 	switch loc := node.LValue.(type) {
 	case *ast.Identifier:
-		index, err = e.addSymbol(loc.Name)
-		if err != nil {
-			e.error(node.NodeSpan(), err.Error())
-			return
-		}
+		index = e.addSymbol(loc.Name)
 		if si := e.scope.LookupLocal(loc.Name); si != nil {
 			instr = isa.StoreLocal
 			if si.IsLifted() {
@@ -283,39 +363,52 @@ func (e *Emitter) emitAssignment(node *ast.Assignment) {
 		}
 	case *ast.Access:
 		e.emitExpr(loc.Lhs)
-		index, err = e.addSymbol(loc.Property.Name)
-		if err != nil {
-			e.error(node.NodeSpan(), err.Error())
-		}
+		index = e.addSymbol(loc.Property.Name)
 		instr = isa.SetField
 	default:
 		e.error(node.NodeSpan(), "values can only be assigned to names or properties")
 		return
 	}
 	e.emitExpr(node.RValue)
-	args := []byte{0, 0}
-	binary.BigEndian.PutUint16(args, uint16(index))
-	e.line = int(node.Beg.Line)
-	e.emitByte(instr)
-	e.emitBytes(args...)
+	e.locate(node.Span)
+	e.emitOp(instr, index)
 }
 
 func (e *Emitter) emitApplication(node *ast.FuncApplication, tailpos bool) {
 	e.emitExpr(node.Callee)
 	call0 := isa.Call0
 	call1 := isa.Call1
+	calln := isa.Call
 	if tailpos {
 		call0 = isa.TailCall0
 		call1 = isa.TailCall1
+		calln = isa.TailCall
 	}
-	if len(node.Args) == 0 && node.Block == nil {
-		e.line = int(node.Beg.Line)
+	argc := len(node.Args)
+	if node.Block != nil {
+		argc++
+	}
+	if argc == 0 {
+		e.locate(node.Span)
 		e.emitByte(call0)
 		return
 	}
+	if argc > 1 && argc <= math.MaxUint8 {
+		for _, a := range node.Args {
+			e.emitExpr(a)
+		}
+		if node.Block != nil {
+			e.emitLambda(node.Block)
+		}
+		e.locate(node.Span)
+		e.emitBytes(calln, byte(argc))
+		return
+	}
+	// a single argument or more than Call can take
+	// are applied one by one
 	for i, a := range node.Args {
 		e.emitExpr(a)
-		e.line = int(node.Beg.Line)
+		e.locate(node.Span)
 		if i == len(node.Args)-1 && node.Block == nil {
 			e.emitByte(call1)
 		} else {
@@ -324,7 +417,7 @@ func (e *Emitter) emitApplication(node *ast.FuncApplication, tailpos bool) {
 	}
 	if node.Block != nil {
 		e.emitLambda(node.Block)
-		e.line = int(node.Beg.Line)
+		e.locate(node.Span)
 		e.emitByte(call1)
 	}
 }
@@ -333,10 +426,27 @@ func (e *Emitter) emitDeclaration(node ast.Decl) {
 	switch v := node.(type) {
 	case *ast.GlobalValDecl:
 		e.emitGlobalVariableDecl(v)
+	case *ast.GlobalPatternDecl:
+		e.emitGlobalPatternDecl(v)
 	case *ast.FuncDecl:
 		e.emitFuncDeclaration(v)
 	case *ast.EffectDecl:
 		e.emitGlobalEffectDecl(v)
+	case *ast.ImportDecl:
+		e.emitImport(v)
+	case *ast.FromImportDecl:
+		e.emitFromImport(v)
+	case *ast.OperatorDecl:
+		// operators are variables named with the operator
+		e.emitGlobalVariableDecl(&ast.GlobalValDecl{
+			Span: v.Span,
+			Name: v.Name,
+			Rhs:  v.Rhs,
+		})
+	case *ast.MacroDecl:
+		// macros are removed by ExpandMacros, they are only left
+		// when the code is compiled just to find errors in it
+		e.scope.Insert(v.Name)
 	default:
 		panic("unreachable")
 	}
@@ -354,16 +464,8 @@ func (e *Emitter) emitGlobalVariableDecl(node *ast.GlobalValDecl) {
 	e.emitExpr(node.Rhs)
 	s := e.interner.Intern(node.Name)
 	v := data.NewSymbol(s)
-	index := e.result.AddConstant(v)
-	if index > math.MaxUint16 {
-		e.error(node.NodeSpan(), "More constants that uint16 can hold. That is not supported.")
-		return
-	}
-	e.line = int(node.Beg.Line)
-	args := []byte{0, 0}
-	binary.BigEndian.PutUint16(args, uint16(index))
-	e.emitByte(isa.DefGlobal)
-	e.emitBytes(args...)
+	e.locate(node.Span)
+	e.emitOp(isa.DefGlobal, e.result.AddConstant(v))
 }
 
 func (e *Emitter) emitGlobalEffectDecl(node *ast.EffectDecl) {
@@ -378,15 +480,7 @@ func (e *Emitter) emitGlobalEffectDecl(node *ast.EffectDecl) {
 	iname := e.interner.Intern(node.Name)
 	s := data.NewSymbol(iname)
 	e.emitConstant(data.NewType(s))
-	index, err := e.addSymbol(node.Name)
-	if err != nil {
-		e.error(node.Span, fmt.Sprintf("Cannot emit effect name %s", err))
-		return
-	}
-	args := []byte{0, 0}
-	binary.BigEndian.PutUint16(args, uint16(index))
-	e.emitByte(isa.DefGlobal)
-	e.emitBytes(args...)
+	e.emitOp(isa.DefGlobal, e.addSymbol(node.Name))
 }
 
 func (e *Emitter) emitFuncDeclaration(node *ast.FuncDecl) {
@@ -400,7 +494,7 @@ func (e *Emitter) emitFuncDeclaration(node *ast.FuncDecl) {
 	fname := data.NewSymbol(e.interner.Intern(node.Name))
 	// emit function body
 	fe := NewEmitter(e.path, e.interner)
-	fe.scope = e.scope.Derive()
+	fe.scope = e.scope.DeriveFunction()
 	fargs := make([]data.Symbol, 0, len(node.Args))
 	for _, arg := range node.Args {
 		fe.scope.InsertFuncArg(arg)
@@ -408,50 +502,28 @@ func (e *Emitter) emitFuncDeclaration(node *ast.FuncDecl) {
 		fargs = append(fargs, data.NewSymbol(s))
 	}
 	fe.emitLiftingForFuncArgs(node.Args, fargs)
+	fe.emitArgsDestructuring(node.Args)
 	fe.emitExprInTailPos(node.Body)
 	// todo: implicit return might not always be needed but then
 	// we will never get there if there is an explicit one
 	fe.emitByte(isa.Return)
 	e.errors = append(e.errors, fe.errors...)
+	e.warnings = append(e.warnings, fe.warnings...)
 	code := fe.result
 	l := data.NewFunction(fname, fargs, code)
-	index := e.result.AddConstant(l)
-	if index > math.MaxUint16 {
-		e.error(node.NodeSpan(), "More constants that uint16 can hold. That is not supported.")
-		return
-	}
-	args := []byte{0, 0}
-	binary.BigEndian.PutUint16(args, uint16(index))
-	e.line = int(node.Beg.Line)
-	e.emitByte(isa.Closure)
-	e.emitBytes(args...)
+	e.locate(node.Span)
+	e.emitOp(isa.Closure, e.result.AddConstant(l))
 	// assign to global variable
-	index = e.result.AddConstant(fname)
-	if index > math.MaxUint16 {
-		e.error(node.NodeSpan(), "More constants that uint16 can hold. That is not supported.")
-		return
-	}
-	args = []byte{0, 0}
-	binary.BigEndian.PutUint16(args, uint16(index))
-	e.emitByte(isa.DefGlobal)
-	e.emitBytes(args...)
+	e.emitOp(isa.DefGlobal, e.result.AddConstant(fname))
 }
 
 func (e *Emitter) emitLiftingForFuncArgs(args []*ast.FuncDeclArg, fargs []data.Symbol) {
 	for i, arg := range args {
 		if arg.Lift {
 			id := ast.Identifier{Name: arg.Name, Span: arg.Span}
-			index := e.result.AddConstant(fargs[i])
-			if index > math.MaxUint16 {
-				e.error(arg.Span, "More constants that uint16 can hold. That is not supported.")
-				return
-			}
-			args := []byte{0, 0}
-			binary.BigEndian.PutUint16(args, uint16(index))
 			e.emitLookup(isa.LoadLocal, &id)
 			e.emitByte(isa.MakeCell)
-			e.emitByte(isa.StoreLocal)
-			e.emitBytes(args...)
+			e.emitOp(isa.StoreLocal, e.result.AddConstant(fargs[i]))
 		}
 	}
 }
@@ -460,30 +532,31 @@ func (e *Emitter) emitVariableDecl(node *ast.ValDecl) {
 	if e.scope.IsGlobal() {
 		panic("ICE: trying to emit local val declaration in global scope")
 	}
-	if e.scope.LookupLocal(node.Name) != nil {
+	if e.scope.LookupInFunction(node.Name) != nil {
 		e.error(node.NodeSpan(), fmt.Sprintf("redeclaration of local name %s", node.Name))
 		return
 	}
 	e.emitExpr(node.Rhs)
-	e.line = int(node.Beg.Line)
-	index, err := e.addSymbol(node.Name)
-	if err != nil {
-		e.error(node.NodeSpan(), err.Error())
-		return
-	}
+	e.locate(node.Span)
+	index := e.addSymbol(node.Name)
 	e.scope.InsertVal(node)
 	if node.Lift {
 		e.emitByte(isa.MakeCell)
 	}
-	args := []byte{0, 0}
-	binary.BigEndian.PutUint16(args, uint16(index))
-	e.emitByte(isa.DefLocal)
-	e.emitBytes(args...)
+	e.emitOp(isa.DefLocal, index)
 }
 
 func (e *Emitter) emitLambda(node *ast.LambdaExpr) {
+	e.emitNestedLambda(node, false)
+}
+
+// emitNestedLambda emits the lambda and returns the emitter used for
+// its body. If inLoopHandler is set the lambda is a handle's body
+// placed inside of a loop.
+func (e *Emitter) emitNestedLambda(node *ast.LambdaExpr, inLoopHandler bool) *Emitter {
 	le := NewEmitter(e.path, e.interner)
-	le.scope = e.scope.Derive()
+	le.scope = e.scope.DeriveFunction()
+	le.inLoopHandler = inLoopHandler
 	name := data.NewSymbol(nil)
 	if node.Name != "" {
 		// todo: probably will need lifting information
@@ -497,23 +570,18 @@ func (e *Emitter) emitLambda(node *ast.LambdaExpr) {
 		fargs = append(fargs, data.NewSymbol(s))
 	}
 	le.emitLiftingForFuncArgs(node.Args, fargs)
+	le.emitArgsDestructuring(node.Args)
 	le.emitExprInTailPos(node.Body)
 	// todo: implicit return might not always be needed but then
 	// we will never get there if there is an explicit one
 	le.emitByte(isa.Return)
-	e.line = int(node.Beg.Line)
+	e.locate(node.Span)
 	e.errors = append(e.errors, le.errors...)
+	e.warnings = append(e.warnings, le.warnings...)
 	code := le.result
 	l := data.NewLambda(name, nil, fargs, code)
-	index := e.result.AddConstant(l)
-	if index > math.MaxUint16 {
-		e.error(node.NodeSpan(), "More constants that uint16 can hold. That is not supported.")
-		return
-	}
-	args := []byte{0, 0}
-	binary.BigEndian.PutUint16(args, uint16(index))
-	e.emitByte(isa.Closure)
-	e.emitBytes(args...)
+	e.emitOp(isa.Closure, e.result.AddConstant(l))
+	return le
 }
 
 func (e *Emitter) emitSequence(instr isa.Op, node ast.SequenceLiteral) {
@@ -521,18 +589,8 @@ func (e *Emitter) emitSequence(instr isa.Op, node ast.SequenceLiteral) {
 	for _, expr := range vals {
 		e.emitExpr(expr)
 	}
-	size := len(vals)
-	if size > math.MaxUint16 {
-		e.error(
-			node.NodeSpan(),
-			fmt.Sprintf("sequence literals can only support max of %d elements", math.MaxUint16))
-		return
-	}
-	e.line = int(node.NodeSpan().Beg.Line)
-	args := []byte{0, 0}
-	binary.BigEndian.PutUint16(args, uint16(size))
-	e.emitByte(instr)
-	e.emitBytes(args...)
+	e.locate(node.NodeSpan())
+	e.emitOp(instr, len(vals))
 }
 
 func (e *Emitter) emitRecord(node *ast.RecordConst) {
@@ -540,18 +598,8 @@ func (e *Emitter) emitRecord(node *ast.RecordConst) {
 		e.emitExpr(f.Val)
 		e.emitSymbol(f.Key)
 	}
-	size := len(node.Fields)
-	if size > math.MaxUint16 {
-		e.error(
-			node.NodeSpan(),
-			fmt.Sprintf("Record literals can only support max of %d elements", math.MaxUint16))
-		return
-	}
-	e.line = int(node.Beg.Line)
-	args := []byte{0, 0}
-	binary.BigEndian.PutUint16(args, uint16(size))
-	e.emitByte(isa.MakeRecord)
-	e.emitBytes(args...)
+	e.locate(node.Span)
+	e.emitOp(isa.MakeRecord, len(node.Fields))
 }
 
 func (e *Emitter) emitLocalEffect(node *ast.LocalEffect) {
@@ -561,15 +609,7 @@ func (e *Emitter) emitLocalEffect(node *ast.LocalEffect) {
 
 func (e *Emitter) emitAccess(node *ast.Access) {
 	e.emitExpr(node.Lhs)
-	index, err := e.addSymbol(node.Property.Name)
-	if err != nil {
-		e.error(node.NodeSpan(), err.Error())
-		return
-	}
-	args := []byte{0, 0}
-	binary.BigEndian.PutUint16(args, uint16(index))
-	e.emitByte(isa.GetField)
-	e.emitBytes(args...)
+	e.emitOp(isa.GetField, e.addSymbol(node.Property.Name))
 }
 
 func (e *Emitter) emitIf(node *ast.IfExpr, tailpos bool) {
@@ -601,11 +641,69 @@ func (e *Emitter) emitWhile(node *ast.WhileStmt) {
 	lbeg := len(e.result.Instrs)
 	e.emitExpr(node.Cond)
 	jpos := e.emitJumpIfFalse()
+	l := &loop{beg: lbeg}
+	e.loops = append(e.loops, l)
 	e.emitStmtBlock(node.Body)
+	e.loops = e.loops[:len(e.loops)-1]
 	jb := e.emitJumpBack()
 	e.patchJump(jb, jb-lbeg)
 	off := e.result.Len() - jpos
 	e.patchJump(jpos, off)
+	for _, b := range l.breaks {
+		e.patchJump(b, e.result.Len()-b)
+	}
+}
+
+func (e *Emitter) emitBreak(loc *span.Span) {
+	if len(e.loops) > 0 {
+		l := e.loops[len(e.loops)-1]
+		l.breaks = append(l.breaks, e.emitJump())
+		return
+	}
+	e.emitLoopSignal(isa.BreakSignal, loc)
+}
+
+func (e *Emitter) emitContinue(loc *span.Span) {
+	if len(e.loops) > 0 {
+		l := e.loops[len(e.loops)-1]
+		jb := e.emitJumpBack()
+		e.patchJump(jb, jb-l.beg)
+		return
+	}
+	e.emitLoopSignal(isa.ContinueSignal, loc)
+}
+
+// emitLoopSignal unwinds the stack to the site of the handle
+// whose body this is and leaves the signal there so that the
+// break or continue can be performed after the handler has
+// been popped.
+func (e *Emitter) emitLoopSignal(signal byte, loc *span.Span) {
+	if !e.inLoopHandler {
+		e.error(loc, "break and continue can only be used inside of a loop")
+		return
+	}
+	e.usedLoopSignals = true
+	e.emitBytes(isa.LoopSignal, signal)
+}
+
+// emitLoopSignalsDispatch checks if the value on top of the stack,
+// left by the handle's body, is a loop signal and performs break
+// or continue if so. The value is left on the stack otherwise.
+func (e *Emitter) emitLoopSignalsDispatch(loc *span.Span) {
+	slot := fmt.Sprint(SIGNAL_PREFIX, e.nextCounterVal())
+	e.emitSymbolOp(isa.DefLocal, slot, loc)
+	for _, signal := range []byte{isa.BreakSignal, isa.ContinueSignal} {
+		e.emitSymbolOp(isa.LoadLocal, slot, loc)
+		e.emitBytes(isa.IsLoopSignal, signal)
+		skip := e.emitJumpIfFalse()
+		if signal == isa.BreakSignal {
+			e.emitBreak(loc)
+		} else {
+			e.emitContinue(loc)
+		}
+		e.patchJump(skip, e.result.Len()-skip)
+	}
+	e.emitSymbolOp(isa.LoadLocal, slot, loc)
 }
 
 func (e *Emitter) emitHandler(node *ast.Handle, tailpos bool) {
@@ -643,21 +741,52 @@ func (e *Emitter) emitHandler(node *ast.Handle, tailpos bool) {
 			Body: arm.Body,
 		})
 	}
-	if len(node.Arms) > math.MaxUint16 {
-		e.error(node.Span, "More handler arms than uint16 can hold, that is unsupported")
-		return
+	e.emitOp(isa.InstallHandler, len(node.Arms))
+	inLoop := len(e.loops) > 0 || e.inLoopHandler
+	if node.Return != nil {
+		// loop signals skip the return clause in the vm
+		e.emitLambda(&ast.LambdaExpr{
+			Span: node.Return.Span,
+			Args: []*ast.FuncDeclArg{node.Return.Arg},
+			Body: node.Return.Body,
+		})
+		e.emitByte(isa.SetReturn)
 	}
-	args := []byte{0, 0}
-	binary.BigEndian.PutUint16(args, uint16(len(node.Arms)))
-	e.emitByte(isa.InstallHandler)
-	e.emitBytes(args...)
-	e.emitLambda(&ast.LambdaExpr{
+	slot := ""
+	if node.Finally != nil {
+		e.emitLambda(&ast.LambdaExpr{
+			Span: node.Finally.Span,
+			Args: []*ast.FuncDeclArg{},
+			Body: node.Finally,
+		})
+		e.emitByte(isa.SetFinally)
+		slot = fmt.Sprint(FINALLY_PREFIX, e.nextCounterVal())
+		e.emitSymbolOp(isa.DefLocal, slot, node.Span)
+		e.emitSymbolOp(isa.LoadLocal, slot, node.Span)
+	}
+	le := e.emitNestedLambda(&ast.LambdaExpr{
 		Span: node.Body.Span,
 		Args: []*ast.FuncDeclArg{},
 		Body: node.Body,
-	})
+	}, inLoop)
 	e.emitByte(isa.Call0)
 	e.emitByte(isa.PopHandler)
+	if slot != "" {
+		// aborts run the finalizer in the vm, leaving the handle
+		// normally runs it here unless it has already been run
+		e.locate(node.Finally.Span)
+		e.emitSymbolOp(isa.LoadLocal, slot, node.Finally.Span)
+		e.emitByte(isa.Finalize)
+		e.emitByte(isa.Call0)
+		e.emitByte(isa.Pop)
+	}
+	if le.usedLoopSignals {
+		e.emitLoopSignalsDispatch(node.Span)
+	} else if tailpos {
+		// the vm tail calls clauses of handlers
+		// followed by Return, see runHandler
+		e.emitByte(isa.Return)
+	}
 }
 
 func (e *Emitter) emitReturn(node *ast.Return) {
@@ -668,20 +797,17 @@ func (e *Emitter) emitReturn(node *ast.Return) {
 func (e *Emitter) emitResume(node *ast.Resume, tailpos bool) {
 	e.emitExpr(node.Cont)
 	if tailpos {
-		// todo: Tail resume only works if it's called in the withclause
-		// or if it's called in a function that is tailcalled
-		// by the with clause.
-		// so clause -> tailcall -> tailcall -> tailresume works
-		// but clause ->tailcall -> call -> tailresume does not
-		// We can either try to guard against it or maybe instead
-		// of "resume" keyword we could create "tailresume" keyword to
-		// be more explicit.
+		// Tail resume replaces the with clause's frame so it only
+		// works if the clause reached it through tail calls.
+		// Otherwise the vm resumes like a regular resume
+		// and the handler is popped by the following instruction.
 		if node.Arg == nil {
 			e.emitByte(isa.TailResume0)
 		} else {
 			e.emitExpr(node.Arg)
 			e.emitByte(isa.TailResume1)
 		}
+		e.emitByte(isa.PopHandler)
 	} else {
 		e.emitByte(isa.Resume)
 		if node.Arg != nil {
@@ -724,6 +850,7 @@ func (e *Emitter) emitBlock(node *ast.Block, tailpos bool) {
 }
 
 func (e *Emitter) emitExprInTailPos(node ast.Expr) {
+	defer e.setLocation(e.locate(node.NodeSpan()))
 	switch v := node.(type) {
 	case *ast.Resume:
 		e.emitResume(v, true)
@@ -735,19 +862,16 @@ func (e *Emitter) emitExprInTailPos(node ast.Expr) {
 		e.emitHandler(v, true)
 	case *ast.Block:
 		e.emitBlock(v, true)
+	case *ast.Match:
+		e.emitMatch(v, true)
 	default:
 		e.emitExpr(node)
 	}
 }
 
-func (e *Emitter) addSymbol(val string) (int, error) {
+func (e *Emitter) addSymbol(val string) int {
 	s := e.interner.Intern(val)
-	v := data.NewSymbol(s)
-	index := e.result.AddConstant(v)
-	if index > math.MaxUint16 {
-		return 0, errors.New("more constants that uint16 can hold, that is not supported")
-	}
-	return index, nil
+	return e.result.AddConstant(data.NewSymbol(s))
 }
 
 func (e *Emitter) nextCounterVal() int {
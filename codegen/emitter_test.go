@@ -2,6 +2,7 @@ package codegen
 
 import (
 	"bytes"
+	"fmt"
 	"strings"
 	"testing"
 
@@ -69,16 +70,16 @@ func TestEmittingIf(t *testing.T) {
 				"else:\n" +
 				"  2\n" +
 				"  2\n",
-			codeFromBytes(5, []byte{
+			codeFromBytes(3, []byte{
 				isa.Constant, 0,
 				isa.JumpIfFalse, 0, 11,
 				isa.Constant, 1,
 				isa.Pop,
-				isa.Constant, 2,
+				isa.Constant, 1,
 				isa.Jump, 0, 8,
-				isa.Constant, 3,
+				isa.Constant, 2,
 				isa.Pop,
-				isa.Constant, 4,
+				isa.Constant, 2,
 				isa.Pop,
 			}),
 		},
@@ -101,6 +102,106 @@ func TestEmittingMultipleStatements(t *testing.T) {
 	matchResults(t, &test)
 }
 
+func TestEmittingBreakAndContinue(t *testing.T) {
+	test := etest{
+		{
+			"while a:\n" +
+				"  if b:\n" +
+				"    break\n" +
+				"  continue\n",
+			codeFromBytes(2, []byte{
+				isa.LoadDyn, 0, 0,
+				isa.JumpIfFalse, 0, 24,
+				isa.LoadDyn, 0, 1,
+				isa.JumpIfFalse, 0, 10,
+				// break
+				isa.Jump, 0, 15,
+				isa.PushNone,
+				isa.Jump, 0, 4,
+				isa.PushNone,
+				isa.Pop,
+				// continue
+				isa.JumpBack, 0, 21,
+				isa.JumpBack, 0, 24,
+			}),
+		},
+	}
+	matchResults(t, &test)
+}
+
+func TestEmittingMatch(t *testing.T) {
+	test := etest{
+		{
+			"match a:\n" +
+				"  case 1 -> 2\n" +
+				"  case x -> x\n",
+			codeFromBytes(6, []byte{
+				isa.LoadDyn, 0, 0,
+				isa.DefLocal, 0, 1,
+				// case 1
+				isa.LoadLocal, 0, 1,
+				isa.Constant, 2,
+				isa.Equal,
+				isa.JumpIfFalse, 0, 8,
+				isa.Constant, 3,
+				isa.Jump, 0, 21,
+				// case x
+				isa.LoadLocal, 0, 1,
+				isa.DefLocal, 0, 4,
+				isa.LoadLocal, 0, 4,
+				isa.Jump, 0, 9,
+				// no arm matched
+				isa.LoadLocal, 0, 1,
+				isa.MatchFail, 0, 5,
+				isa.Pop,
+			}),
+		},
+	}
+	matchResults(t, &test)
+}
+
+func TestNonExhaustiveMatchWarning(t *testing.T) {
+	table := []struct {
+		source string
+		warns  bool
+	}{
+		{"match a:\n  case 1 -> 2\n", true},
+		{"match a:\n  case true -> 1\n  case false -> 2\n", false},
+		{"match a:\n  case 1 -> 1\n  case _ -> 2\n", false},
+		{"match a:\n  case x if f x -> 1\n", true},
+		{"match a:\n  case (1, 2) -> 1\n", false},
+	}
+	for _, test := range table {
+		t.Run(test.source, func(t *testing.T) {
+			p := syntax.NewParser(strings.NewReader(test.source))
+			e := NewEmitter("dummy", NewInterner())
+			if _, errs := e.Compile(p.Parse()); len(errs) > 0 {
+				t.Fatalf("Unexpected compilation errors %v", errs)
+			}
+			if got := len(e.Warnings()) > 0; got != test.warns {
+				t.Errorf("Expected warning=%v got %v", test.warns, e.Warnings())
+			}
+		})
+	}
+}
+
+func TestJumpTooLongError(t *testing.T) {
+	elems := make([]string, 0, 30000)
+	for i := 0; i < 30000; i++ {
+		elems = append(elems, fmt.Sprint(i))
+	}
+	source := fmt.Sprintf("if a:\n  [%s]\n", strings.Join(elems, ", "))
+	p := syntax.NewParser(strings.NewReader(source))
+	e := NewEmitter("dummy", NewInterner())
+	_, errs := e.Compile(p.Parse())
+	if len(errs) != 1 {
+		t.Fatalf("expected a single compilation error, got %v", errs)
+	}
+	if loc := errs[0].Location; loc.Beg.Line != 0 {
+		t.Errorf("expected the error to point at the if in line 0, got %d", loc.Beg.Line)
+	}
+}
+
 func codeFromBytes(cc int, bb []byte) *data.Code {
 	c := data.NewCode()
 	c.Instrs = bb
@@ -109,7 +210,6 @@ func codeFromBytes(cc int, bb []byte) *data.Code {
 		consts = append(consts, data.None)
 	}
 	c.Consts = consts
-	c.Lines = make([]int, len(bb))
 	return &c
 }
 
@@ -132,3 +232,37 @@ func matchResults(t *testing.T, table *etest) {
 		})
 	}
 }
+
+func TestEmittingLocations(t *testing.T) {
+	source := "let x = 1\nio.print (div x 0)\n"
+	p := syntax.NewParser(strings.NewReader(source))
+	e := NewEmitter("dummy", NewInterner())
+	c, errs := e.Compile(p.Parse())
+	if len(errs) > 0 {
+		t.Fatalf("Unexpected compilation errors %v", errs)
+	}
+	if len(c.Locations) >= len(c.Instrs) {
+		t.Errorf("expected locations to be run length encoded, got %d runs for %d bytes", len(c.Locations), len(c.Instrs))
+	}
+	// the call's location is the whole application
+	// and not the last of its arguments
+	want := map[string]bool{"div x 0": false, "io.print (div x 0)": false}
+	for _, r := range c.Locations {
+		frag := strings.TrimSpace(source[r.Beg:r.End])
+		if _, ok := want[frag]; !ok {
+			continue
+		}
+		want[frag] = true
+		if r.Line != 1 {
+			t.Errorf("expected %q in line 1, got %d", frag, r.Line)
+		}
+		if op := c.Instrs[r.Start]; op != isa.Call1 && op != isa.Call {
+			t.Errorf("expected %q to start with a call, got %d", frag, op)
+		}
+	}
+	for frag, found := range want {
+		if !found {
+			t.Errorf("no instructions emitted for %q", frag)
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"io"
+	"os"
 	"strings"
 
 	"github.com/gala377/MLLang/syntax/span"
@@ -15,6 +17,10 @@ type SourceError interface {
 }
 
 func printWithSourceLine(path string, source *bytes.Reader, srcerr SourceError) {
+	fprintWithSourceLine(os.Stdout, "Error", path, source, srcerr)
+}
+
+func fprintWithSourceLine(w io.Writer, kind string, path string, source *bytes.Reader, srcerr SourceError) {
 	source.Seek(0, 0)
 	loc := srcerr.SourceLoc()
 	line, col := loc.Beg.Line, loc.Beg.Column
@@ -31,9 +37,15 @@ func printWithSourceLine(path string, source *bytes.Reader, srcerr SourceError)
 		}
 	}
 	code := strings.Join(text, "\n")
-	fmt.Printf("[%s] Error at line %d, column %d\n", path, line+1, col)
-	fmt.Printf("%s\n\n", code)
-	fmt.Println(srcerr.Error())
+	fmt.Fprintf(w, "[%s] %s at line %d, column %d\n", path, kind, line+1, col)
+	fmt.Fprintf(w, "%s\n\n", code)
+	fmt.Fprintln(w, srcerr.Error())
 }
 
 var PrintWithSource = printWithSourceLine
+
+// PrintWarningWithSource writes to stderr so that warnings
+// do not mix with the output of the program.
+func PrintWarningWithSource(path string, source *bytes.Reader, srcerr SourceError) {
+	fprintWithSourceLine(os.Stderr, "Warning", path, source, srcerr)
+}
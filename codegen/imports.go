@@ -0,0 +1,61 @@
+package codegen
+
+import (
+	"fmt"
+
+	"github.com/gala377/MLLang/data"
+	"github.com/gala377/MLLang/isa"
+	"github.com/gala377/MLLang/syntax/ast"
+	"github.com/gala377/MLLang/syntax/span"
+)
+
+var IMPORT_PREFIX = "@import"
+
+func (e *Emitter) emitImportOp(path string, loc *span.Span) {
+	index := e.result.AddConstant(data.NewString(path))
+	e.locate(loc)
+	e.emitOp(isa.Import, index)
+}
+
+// emitImport binds the record exported by the module to a global name.
+func (e *Emitter) emitImport(node *ast.ImportDecl) {
+	if !e.scope.IsGlobal() {
+		panic("ICE: trying to emit import not in global scope")
+	}
+	e.emitImportOp(node.Path, node.Span)
+	e.bindGlobal(&ast.BindPattern{Span: node.Span, Name: node.Name})
+}
+
+// emitFromImport binds each of the imported names as a global
+// to the field of the record exported by the module.
+func (e *Emitter) emitFromImport(node *ast.FromImportDecl) {
+	if !e.scope.IsGlobal() {
+		panic("ICE: trying to emit import not in global scope")
+	}
+	e.emitImportOp(node.Path, node.Span)
+	slot := fmt.Sprint(IMPORT_PREFIX, e.nextCounterVal())
+	e.emitSymbolOp(isa.DefGlobal, slot, node.Span)
+	missing := []int{}
+	for _, n := range node.Names {
+		e.emitSymbolOp(isa.LoadDyn, slot, n.Span)
+		e.emitSymbolOp(isa.HasField, n.Name, n.Span)
+		missing = append(missing, e.emitJumpIfFalse())
+	}
+	for _, n := range node.Names {
+		e.emitSymbolOp(isa.LoadDyn, slot, n.Span)
+		e.emitSymbolOp(isa.GetField, n.Name, n.Span)
+		e.bindGlobal(&ast.BindPattern{Span: n.Span, Name: n.Name})
+	}
+	if len(missing) == 0 {
+		return
+	}
+	imported := e.emitJump()
+	for i, j := range missing {
+		n := node.Names[i]
+		e.patchJump(j, e.result.Len()-j)
+		e.locate(n.Span)
+		msg := fmt.Sprintf("module %s has no member %s", node.Path, n.Name)
+		e.emitOp(isa.Fail, e.result.AddConstant(data.NewString(msg)))
+	}
+	e.patchJump(imported, e.result.Len()-imported)
+}
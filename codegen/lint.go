@@ -0,0 +1,331 @@
+package codegen
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gala377/MLLang/syntax/ast"
+	"github.com/gala377/MLLang/syntax/span"
+)
+
+type lintVar struct {
+	loc  *span.Span
+	kind string
+	used bool
+	// only lets and parameters are reported if unused
+	report bool
+}
+
+type linter struct {
+	globals  map[string]bool
+	scopes   []map[string]*lintVar
+	warnings []CompilationError
+}
+
+// Lint resolves names used in the program and reports undefined
+// globals, unused local variables and function parameters, and locals
+// shadowing other variables. The env lists globals defined outside
+// of the program, like the standard library. Names starting with
+// an underscore are never reported as unused.
+func Lint(nodes []ast.Node, env []string) []CompilationError {
+	l := linter{
+		globals:  map[string]bool{},
+		warnings: []CompilationError{},
+	}
+	for _, name := range env {
+		l.globals[name] = true
+	}
+	for _, n := range nodes {
+		for _, name := range globalNames(n) {
+			l.globals[name] = true
+		}
+	}
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *ast.FuncDecl:
+			l.function(n.Args, n.Body)
+		case *ast.GlobalValDecl:
+			l.expr(n.Rhs)
+		case *ast.OperatorDecl:
+			l.expr(n.Rhs)
+		case *ast.GlobalPatternDecl:
+			l.expr(n.Rhs)
+		case ast.Stmt:
+			l.stmt(n)
+		}
+	}
+	return l.warnings
+}
+
+// globalNames returns names defined by the top level node.
+func globalNames(node ast.Node) []string {
+	switch n := node.(type) {
+	case *ast.FuncDecl:
+		return []string{n.Name}
+	case *ast.GlobalValDecl:
+		return []string{n.Name}
+	case *ast.EffectDecl:
+		return []string{n.Name}
+	case *ast.MacroDecl:
+		return []string{n.Name}
+	case *ast.OperatorDecl:
+		return []string{n.Name}
+	case *ast.ImportDecl:
+		return []string{n.Name}
+	case *ast.FromImportDecl:
+		names := []string{}
+		for _, id := range n.Names {
+			names = append(names, id.Name)
+		}
+		return names
+	case *ast.GlobalPatternDecl:
+		names := []string{}
+		for _, b := range ast.Bindings(n.Pattern) {
+			names = append(names, b.Name)
+		}
+		return names
+	}
+	return nil
+}
+
+func (l *linter) warn(loc *span.Span, format string, args ...interface{}) {
+	l.warnings = append(l.warnings, CompilationError{
+		Location: loc,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+func (l *linter) openScope() {
+	l.scopes = append(l.scopes, map[string]*lintVar{})
+}
+
+func (l *linter) closeScope() {
+	scope := l.scopes[len(l.scopes)-1]
+	l.scopes = l.scopes[:len(l.scopes)-1]
+	names := []string{}
+	for name, v := range scope {
+		if v.report && !v.used && !hiddenName(name) {
+			names = append(names, name)
+		}
+	}
+	// report in the order of definitions
+	sort.Slice(names, func(i, j int) bool {
+		a, b := scope[names[i]].loc.Beg, scope[names[j]].loc.Beg
+		return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+	})
+	for _, name := range names {
+		v := scope[name]
+		l.warn(v.loc, "unused %s %s", v.kind, name)
+	}
+}
+
+// hiddenName reports names that are either generated
+// or marked as deliberately unused.
+func hiddenName(name string) bool {
+	return strings.HasPrefix(name, "_") || strings.HasPrefix(name, "@")
+}
+
+func (l *linter) lookup(name string) *lintVar {
+	for i := len(l.scopes) - 1; i >= 0; i-- {
+		if v, ok := l.scopes[i][name]; ok {
+			return v
+		}
+	}
+	return nil
+}
+
+func (l *linter) define(name string, loc *span.Span, kind string, report bool) {
+	if !hiddenName(name) {
+		switch {
+		case kind == "parameter" && l.lookup(name) != nil:
+			l.warn(loc, "parameter %s shadows a local variable", name)
+		case kind == "variable" && l.lookup(name) == nil && l.globals[name]:
+			l.warn(loc, "local variable %s shadows a global one", name)
+		}
+	}
+	l.scopes[len(l.scopes)-1][name] = &lintVar{loc: loc, kind: kind, report: report}
+}
+
+func (l *linter) definePattern(pat ast.Pattern, kind string, report bool) {
+	for _, b := range ast.Bindings(pat) {
+		l.define(b.Name, b.Span, kind, report)
+	}
+}
+
+func (l *linter) use(id *ast.Identifier) {
+	if v := l.lookup(id.Name); v != nil {
+		v.used = true
+		return
+	}
+	if !l.globals[id.Name] {
+		l.warn(id.Span, "undefined variable %s", id.Name)
+	}
+}
+
+func (l *linter) function(args []*ast.FuncDeclArg, body ast.Expr) {
+	l.openScope()
+	for _, a := range args {
+		if a.Pattern != nil {
+			l.definePattern(a.Pattern, "parameter", true)
+			continue
+		}
+		l.define(a.Name, a.Span, "parameter", true)
+	}
+	l.expr(body)
+	l.closeScope()
+}
+
+func (l *linter) block(node *ast.Block) {
+	l.openScope()
+	for _, s := range node.Instr {
+		l.stmt(s)
+	}
+	l.closeScope()
+}
+
+func (l *linter) stmt(node ast.Stmt) {
+	switch n := node.(type) {
+	case *ast.StmtExpr:
+		l.expr(n.Expr)
+	case *ast.ValDecl:
+		if f, ok := n.Rhs.(*ast.LambdaExpr); ok && f.Name != "" {
+			// local functions can call themselves
+			l.define(n.Name, n.Span, "variable", true)
+			l.expr(n.Rhs)
+			return
+		}
+		l.expr(n.Rhs)
+		l.define(n.Name, n.Span, "variable", true)
+	case *ast.PatternDecl:
+		l.expr(n.Rhs)
+		l.definePattern(n.Pattern, "variable", true)
+	case *ast.Assignment:
+		l.expr(n.RValue)
+		l.expr(n.LValue)
+	case *ast.Return:
+		if n.Val != nil {
+			l.expr(n.Val)
+		}
+	case *ast.WhileStmt:
+		l.expr(n.Cond)
+		l.block(n.Body)
+	case *ast.ForStmt:
+		l.expr(n.Iterable)
+		l.openScope()
+		l.definePattern(n.Pattern, "binding", false)
+		l.block(n.Body)
+		l.closeScope()
+	}
+}
+
+func (l *linter) expr(node ast.Expr) {
+	switch n := node.(type) {
+	case *ast.Identifier:
+		l.use(n)
+	case *ast.TupleConst:
+		for _, v := range n.Vals {
+			l.expr(v)
+		}
+	case *ast.ListConst:
+		for _, v := range n.Vals {
+			l.expr(v)
+		}
+	case *ast.RecordConst:
+		for _, f := range n.Fields {
+			l.expr(f.Val)
+		}
+	case *ast.Access:
+		l.expr(n.Lhs)
+	case *ast.FuncApplication:
+		l.expr(n.Callee)
+		for _, a := range n.Args {
+			l.expr(a)
+		}
+		if n.Block != nil {
+			l.expr(n.Block)
+		}
+	case *ast.LambdaExpr:
+		l.function(n.Args, n.Body)
+	case *ast.Block:
+		l.block(n)
+	case *ast.IfExpr:
+		l.expr(n.Cond)
+		l.block(n.IfBranch)
+		if n.ElseBranch != nil {
+			l.expr(n.ElseBranch)
+		}
+	case *ast.Match:
+		l.expr(n.Scrutinee)
+		for _, arm := range n.Arms {
+			l.openScope()
+			l.pattern(arm.Pattern)
+			if arm.Guard != nil {
+				l.expr(arm.Guard)
+			}
+			l.block(arm.Body)
+			l.closeScope()
+		}
+	case *ast.Handle:
+		l.block(n.Body)
+		for _, arm := range n.Arms {
+			l.expr(arm.Effect)
+			l.openScope()
+			if arm.Arg != nil {
+				if arm.Arg.Pattern != nil {
+					l.definePattern(arm.Arg.Pattern, "binding", false)
+				} else {
+					l.define(arm.Arg.Name, arm.Arg.Span, "binding", false)
+				}
+			}
+			if arm.Continuation != nil {
+				l.define(arm.Continuation.Name, arm.Continuation.Span, "binding", false)
+			}
+			if arm.Guard != nil {
+				l.expr(arm.Guard)
+			}
+			l.block(arm.Body)
+			l.closeScope()
+		}
+		if n.Return != nil {
+			l.openScope()
+			l.define(n.Return.Arg.Name, n.Return.Arg.Span, "binding", false)
+			l.block(n.Return.Body)
+			l.closeScope()
+		}
+		if n.Finally != nil {
+			l.block(n.Finally)
+		}
+	case *ast.Resume:
+		l.expr(n.Cont)
+		if n.Arg != nil {
+			l.expr(n.Arg)
+		}
+	case *ast.LetExpr:
+		l.expr(n.Decls)
+		l.block(n.Body)
+	}
+}
+
+// pattern defines the bindings of the match arm
+// and resolves values the literal patterns compare with.
+func (l *linter) pattern(pat ast.Pattern) {
+	switch p := pat.(type) {
+	case *ast.LiteralPattern:
+		l.expr(p.Val)
+	case *ast.TuplePattern:
+		for _, e := range p.Elems {
+			l.pattern(e)
+		}
+	case *ast.ListPattern:
+		for _, e := range p.Elems {
+			l.pattern(e)
+		}
+	case *ast.RecordPattern:
+		for _, f := range p.Fields {
+			l.pattern(f.Pat)
+		}
+	case *ast.BindPattern:
+		l.define(p.Name, p.Span, "binding", false)
+	}
+}
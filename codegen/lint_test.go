@@ -0,0 +1,86 @@
+package codegen
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gala377/MLLang/syntax"
+)
+
+func lint(t *testing.T, source string) []CompilationError {
+	t.Helper()
+	p := syntax.NewParser(strings.NewReader(source))
+	nodes := p.Parse()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("unexpected syntax errors %v", p.Errors())
+	}
+	return Lint(nodes, []string{"io", "add"})
+}
+
+func TestLintWarnings(t *testing.T) {
+	table := []struct {
+		source string
+		want   []string
+	}{
+		{"io.print x\n", []string{"undefined variable x"}},
+		{"fn f = g 1\n", []string{"undefined variable g"}},
+		{"fn f:\n  if true:\n    prnt 1\n", []string{"undefined variable prnt"}},
+		{"x = 1\n", []string{"undefined variable x"}},
+		{"fn f x = 1\n", []string{"unused parameter x"}},
+		{"let f = do a b -> a\n", []string{"unused parameter b"}},
+		{"fn f:\n  let a = 1\n  let b = 2\n  b\n", []string{"unused variable a"}},
+		{"fn f:\n  let (a, b) = (1, 2)\n  a\n", []string{"unused variable b"}},
+		{"fn f:\n  fn g = 1\n  2\n", []string{"unused variable g"}},
+		{"fn f x:\n  let a = do x -> x\n  a x\n", []string{"parameter x shadows a local variable"}},
+		{"let a = 1\nfn f:\n  let a = 2\n  a\n", []string{"local variable a shadows a global one"}},
+		{"fn f:\n  let io = 2\n  io\n", []string{"local variable io shadows a global one"}},
+		{
+			"fn f x y:\n  let a = 1\n  let b = 2\n  none\n",
+			[]string{"unused variable a", "unused variable b", "unused parameter x", "unused parameter y"},
+		},
+	}
+	for _, test := range table {
+		t.Run(test.source, func(t *testing.T) {
+			ww := lint(t, test.source)
+			got := []string{}
+			for _, w := range ww {
+				got = append(got, w.Message)
+			}
+			if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("expected warnings %q, got %q", test.want, got)
+			}
+			for _, w := range ww {
+				if w.Location == nil {
+					t.Errorf("warning %q has no location", w.Message)
+				}
+			}
+		})
+	}
+}
+
+func TestLintAcceptsCorrectCode(t *testing.T) {
+	sources := []string{
+		"fn f x = add x 1\nio.print (f 1)\n",
+		// globals can be used before they are defined
+		"fn f = g!\nfn g = 1\n",
+		"effect Foo\nimport \"m\" as m\nfrom \"n\" import a, b\nio.print (Foo m a b)\n",
+		"let (a, b) = (1, 2)\nio.print a b\n",
+		// underscore marks deliberately unused names
+		"fn f _x = 1\n",
+		"fn f:\n  let _ = 1\n  none\n",
+		// bindings of match arms, loops and handlers are not reported
+		"fn f x:\n  match x:\n    case (a, b) -> 1\n",
+		"fn f xs:\n  for x in xs:\n    none\n",
+		"effect Foo\nhandle:\n  Foo 1\nwith Foo v -> k:\n  none\n",
+		"fn f:\n  fn g n = g n\n  g 1\n",
+		"fn f (a, b) = add a b\n",
+		"fn f:\n  let a = 1\n  a = 2\n",
+	}
+	for _, src := range sources {
+		t.Run(src, func(t *testing.T) {
+			if ww := lint(t, src); len(ww) > 0 {
+				t.Errorf("unexpected warnings %v", ww)
+			}
+		})
+	}
+}
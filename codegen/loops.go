@@ -0,0 +1,178 @@
+package codegen
+
+import (
+	"fmt"
+
+	"github.com/gala377/MLLang/data"
+	"github.com/gala377/MLLang/isa"
+	"github.com/gala377/MLLang/syntax/ast"
+	"github.com/gala377/MLLang/syntax/span"
+)
+
+var FOR_PREFIX = "@for"
+
+// emitFor compiles the for loop. Sequences are iterated by index.
+// Any other value is treated as an iterator and is started under
+// a handler for iter.Yield. The handler returns the yielded value
+// together with the continuation which is resumed to get the next
+// element. This way the loop's body is always emitted inline and
+// break and continue work the same in both cases. Breaking out of
+// the loop drops the continuation.
+func (e *Emitter) emitFor(node *ast.ForStmt) {
+	id := e.nextCounterVal()
+	src := fmt.Sprint(FOR_PREFIX, id, "src")
+	idx := fmt.Sprint(FOR_PREFIX, id, "idx")
+	state := fmt.Sprint(FOR_PREFIX, id, "state")
+	loc := node.Span
+	load := func(name string) {
+		e.emitSymbolOp(isa.LoadLocal, name, loc)
+	}
+	isSequence := func() int {
+		load(src)
+		e.emitByte(isa.IsSequence)
+		return e.emitJumpIfFalse()
+	}
+	e.emitExpr(node.Iterable)
+	e.locate(node.Span)
+	e.emitSymbolOp(isa.DefLocal, src, loc)
+	e.emitConstant(data.NewInt(0))
+	e.emitSymbolOp(isa.DefLocal, idx, loc)
+
+	// start the iterator
+	toHead := []int{}
+	start := isSequence()
+	toHead = append(toHead, e.emitJump())
+	e.patchJump(start, e.result.Len()-start)
+	e.emitIteratorStart(src, loc)
+	e.emitSymbolOp(isa.DefLocal, state, loc)
+	toHead = append(toHead, e.emitJump())
+
+	// advance the iterator, continue jumps here
+	advance := e.result.Len()
+	resume := isSequence()
+	toHead = append(toHead, e.emitJump())
+	e.patchJump(resume, e.result.Len()-resume)
+	load(state)
+	e.emitOp(isa.Index, 1)
+	e.emitByte(isa.Resume)
+	e.emitNone()
+	e.emitByte(isa.Call1)
+	e.emitByte(isa.PopHandler)
+	e.emitSymbolOp(isa.StoreLocal, state, loc)
+
+	// get the next element
+	for _, j := range toHead {
+		e.patchJump(j, e.result.Len()-j)
+	}
+	iterHead := isSequence()
+	load(src)
+	load(idx)
+	e.emitBytes(isa.IterNext, 0, 0)
+	seqExit := e.result.Len() - 3
+	e.emitSymbolOp(isa.StoreLocal, idx, loc)
+	toBind := e.emitJump()
+	e.patchJump(iterHead, e.result.Len()-iterHead)
+	load(state)
+	e.emitNone()
+	e.emitByte(isa.Equal)
+	hasElem := e.emitJumpIfFalse()
+	iterExit := e.emitJump()
+	e.patchJump(hasElem, e.result.Len()-hasElem)
+	load(state)
+	e.emitOp(isa.Index, 0)
+	e.patchJump(toBind, e.result.Len()-toBind)
+
+	outer := e.scope
+	e.scope = e.scope.Derive()
+	if b, ok := node.Pattern.(*ast.BindPattern); ok {
+		e.bindLocal(b)
+	} else {
+		elem := fmt.Sprint(FOR_PREFIX, id, "elem")
+		e.emitSymbolOp(isa.DefLocal, elem, loc)
+		e.emitDestructuring(node.Pattern, func() { load(elem) }, e.bindLocal)
+	}
+	l := &loop{beg: advance}
+	e.loops = append(e.loops, l)
+	e.emitStmtBlock(node.Body)
+	e.loops = e.loops[:len(e.loops)-1]
+	e.scope = outer
+	jb := e.emitJumpBack()
+	e.patchJump(jb, jb-advance)
+	exits := []int{seqExit, iterExit}
+	if len(l.breaks) > 0 {
+		for _, j := range l.breaks {
+			e.patchJump(j, e.result.Len()-j)
+		}
+		dropIter := isSequence()
+		exits = append(exits, e.emitJump())
+		e.patchJump(dropIter, e.result.Len()-dropIter)
+		e.emitIteratorDrop(state, loc)
+	}
+	for _, j := range exits {
+		e.patchJump(j, e.result.Len()-j)
+	}
+}
+
+// emitIteratorDrop drops the continuation of the iterator stored
+// in the state local when the loop is left with break, so that
+// the handles the iterator is in the middle of are finalized.
+func (e *Emitter) emitIteratorDrop(state string, loc *span.Span) {
+	e.emitExpr(&ast.Access{
+		Span:     loc,
+		Lhs:      &ast.Identifier{Span: loc, Name: "cont"},
+		Property: ast.Identifier{Span: loc, Name: "drop"},
+	})
+	e.emitSymbolOp(isa.LoadLocal, state, loc)
+	e.emitOp(isa.Index, 1)
+	e.emitByte(isa.Call1)
+	e.emitByte(isa.Pop)
+}
+
+// emitIteratorStart calls the iterator stored in the src local
+// under the iter.Yield handler. Pushes a tuple of the yielded value
+// and the continuation or none if the iterator did not yield.
+func (e *Emitter) emitIteratorStart(src string, loc *span.Span) {
+	arg := fmt.Sprint(FOR_PREFIX, "arg")
+	cont := fmt.Sprint(FOR_PREFIX, "cont")
+	it := fmt.Sprint(FOR_PREFIX, "it")
+	e.emitExpr(&ast.Access{
+		Span:     loc,
+		Lhs:      &ast.Identifier{Span: loc, Name: "iter"},
+		Property: ast.Identifier{Span: loc, Name: "Yield"},
+	})
+	// with iter.Yield arg -> cont: (arg, cont)
+	e.emitLambda(&ast.LambdaExpr{
+		Span: loc,
+		Args: []*ast.FuncDeclArg{
+			{Span: loc, Name: arg},
+			{Span: loc, Name: cont},
+		},
+		Body: &ast.TupleConst{
+			Span: loc,
+			Vals: []ast.Expr{
+				&ast.Identifier{Span: loc, Name: arg},
+				&ast.Identifier{Span: loc, Name: cont},
+			},
+		},
+	})
+	e.emitOp(isa.InstallHandler, 1)
+	// do it: it!; none
+	e.emitLambda(&ast.LambdaExpr{
+		Span: loc,
+		Args: []*ast.FuncDeclArg{{Span: loc, Name: it}},
+		Body: &ast.Block{
+			Span: loc,
+			Instr: []ast.Stmt{
+				&ast.StmtExpr{Expr: &ast.FuncApplication{
+					Span:   loc,
+					Callee: &ast.Identifier{Span: loc, Name: it},
+					Args:   []ast.Expr{},
+				}},
+				&ast.StmtExpr{Expr: &ast.NoneConst{Span: loc}},
+			},
+		},
+	})
+	e.emitSymbolOp(isa.LoadLocal, src, loc)
+	e.emitByte(isa.Call1)
+	e.emitByte(isa.PopHandler)
+}
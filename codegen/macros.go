@@ -0,0 +1,1221 @@
+package codegen
+
+import (
+	"fmt"
+
+	"github.com/gala377/MLLang/data"
+	"github.com/gala377/MLLang/syntax/ast"
+	"github.com/gala377/MLLang/syntax/span"
+)
+
+// Maximal number of nested expansions, stops
+// macros that keep expanding into themselves.
+const maxExpansionDepth = 256
+
+// Maximal depth of the code returned by a macro,
+// deeper values are most likely cyclic.
+const maxQuotedDepth = 4096
+
+type macro struct {
+	decl *ast.MacroDecl
+	fn   *data.Closure
+}
+
+type field struct {
+	key string
+	val data.Value
+}
+
+// expansion holds the state of converting
+// a single macro's result back into nodes.
+type expansion struct {
+	// location of the macro call, used for
+	// the nodes introduced by the macro
+	span *span.Span
+	// hygienic names of the bindings introduced by the macro
+	renames map[string]string
+	depth   int
+}
+
+type expander struct {
+	path     string
+	interner *Interner
+	vm       data.VmProxy
+	macros   map[string]*macro
+	errors   []CompilationError
+	// nodes passed to macros without being converted,
+	// referenced by their index
+	opaque []ast.Node
+	// nodes the records passed to macros were created from,
+	// used to keep the original locations of the user's code
+	origins map[*data.Record]ast.Node
+	gensymc int
+	depth   int
+	// number of functions the expanded code is in
+	functions int
+}
+
+// Names of the fields and kinds of the records representing
+// the code. They are interned before any macro runs so that
+// virtual machines running macros share them.
+var macroNames = []string{
+	"kind", "name", "value", "callee", "args", "block", "body", "cond",
+	"then", "else", "target", "property", "items", "fields", "id", "hygienic",
+	"identifier", "int", "float", "string", "bool", "none", "symbol", "call",
+	"lambda", "let", "assign", "if", "while", "access", "list", "tuple",
+	"record", "return", "opaque",
+}
+
+// ExpandMacros runs macros declared in the nodes on the code they are
+// called with and replaces the calls with the code the macros returned.
+// Macro declarations are removed from the result. Macros are run by
+// clones of the given virtual machine, so they can use its builtins.
+func ExpandMacros(path string, nodes []ast.Node, interner *Interner, vm data.VmProxy) ([]ast.Node, []CompilationError) {
+	if !hasMacros(nodes) {
+		return nodes, nil
+	}
+	e := expander{
+		path:     path,
+		interner: interner,
+		vm:       vm,
+		macros:   map[string]*macro{},
+		errors:   []CompilationError{},
+		opaque:   []ast.Node{},
+		origins:  map[*data.Record]ast.Node{},
+	}
+	for _, name := range macroNames {
+		interner.Intern(name)
+	}
+	res := make([]ast.Node, 0, len(nodes))
+	for _, n := range nodes {
+		if m, ok := n.(*ast.MacroDecl); ok {
+			e.declare(m)
+			continue
+		}
+		res = append(res, e.topLevel(n)...)
+	}
+	return res, e.errors
+}
+
+func hasMacros(nodes []ast.Node) bool {
+	for _, n := range nodes {
+		if _, ok := n.(*ast.MacroDecl); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *expander) error(loc *span.Span, format string, args ...interface{}) {
+	e.errors = append(e.errors, CompilationError{
+		Location: loc,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+func (e *expander) sym(name string) data.Symbol {
+	return data.NewSymbol(e.interner.Intern(name))
+}
+
+// declare compiles the macro's body into a closure
+// so that it can be called during the expansion.
+func (e *expander) declare(node *ast.MacroDecl) {
+	if _, ok := e.macros[node.Name]; ok {
+		e.error(node.Span, "redeclaration of macro %s", node.Name)
+		return
+	}
+	if e.vm == nil {
+		e.error(node.Span, "macros can only be used in code run by the virtual machine")
+		return
+	}
+	// the body can use macros declared before
+	body := e.function(node.Body)
+	lambda := &ast.LambdaExpr{
+		Span: node.Span,
+		Name: node.Name,
+		Args: node.Args,
+		Body: body,
+	}
+	em := NewEmitter(e.path, e.interner)
+	le := em.emitNestedLambda(lambda, false)
+	if len(em.errors) > 0 {
+		e.errors = append(e.errors, em.errors...)
+		return
+	}
+	le.result.Path = e.path
+	args := make([]data.Symbol, 0, len(node.Args))
+	for _, arg := range node.Args {
+		args = append(args, e.sym(arg.Name))
+	}
+	fn := data.NewLambda(e.sym(node.Name), data.NewEnv(), args, le.result)
+	e.macros[node.Name] = &macro{node, fn}
+}
+
+// topLevel expands macros in the top level node. Macros called
+// at the top level can return blocks, their statements are
+// spliced and variables they declare become globals.
+func (e *expander) topLevel(n ast.Node) []ast.Node {
+	switch n := n.(type) {
+	case *ast.FuncDecl:
+		n.Body = e.function(n.Body)
+	case *ast.GlobalValDecl:
+		n.Rhs = e.expr(n.Rhs)
+	case *ast.OperatorDecl:
+		n.Rhs = e.expr(n.Rhs)
+	case *ast.GlobalPatternDecl:
+		n.Rhs = e.expr(n.Rhs)
+	case *ast.StmtExpr:
+		app, ok := n.Expr.(*ast.FuncApplication)
+		if !ok {
+			return []ast.Node{e.stmt(n)}
+		}
+		m := e.macroCall(app)
+		if m == nil {
+			return []ast.Node{e.stmt(n)}
+		}
+		v, x, ok := e.call(m, app)
+		if !ok {
+			return []ast.Node{n}
+		}
+		nodes, err := e.toTopLevel(v, x)
+		if err != nil {
+			e.error(app.Span, "macro %s returned invalid code: %s", m.decl.Name, err)
+			return []ast.Node{n}
+		}
+		e.depth++
+		defer func() { e.depth-- }()
+		res := []ast.Node{}
+		for _, n := range nodes {
+			res = append(res, e.topLevel(n)...)
+		}
+		return res
+	case ast.Stmt:
+		return []ast.Node{e.stmt(n)}
+	}
+	return []ast.Node{n}
+}
+
+func (e *expander) stmt(n ast.Stmt) ast.Stmt {
+	switch n := n.(type) {
+	case *ast.StmtExpr:
+		if app, ok := n.Expr.(*ast.FuncApplication); ok {
+			if m := e.macroCall(app); m != nil {
+				return e.expandStmt(m, app)
+			}
+		}
+		n.Expr = e.expr(n.Expr)
+	case *ast.ValDecl:
+		n.Rhs = e.expr(n.Rhs)
+	case *ast.PatternDecl:
+		n.Rhs = e.expr(n.Rhs)
+	case *ast.Assignment:
+		n.LValue = e.expr(n.LValue)
+		n.RValue = e.expr(n.RValue)
+	case *ast.Return:
+		if n.Val != nil {
+			n.Val = e.expr(n.Val)
+		}
+	case *ast.WhileStmt:
+		n.Cond = e.expr(n.Cond)
+		e.block(n.Body)
+	case *ast.ForStmt:
+		n.Iterable = e.expr(n.Iterable)
+		e.block(n.Body)
+	}
+	return n
+}
+
+func (e *expander) expr(n ast.Expr) ast.Expr {
+	switch n := n.(type) {
+	case *ast.FuncApplication:
+		if m := e.macroCall(n); m != nil {
+			return e.expandExpr(m, n)
+		}
+		n.Callee = e.expr(n.Callee)
+		for i, arg := range n.Args {
+			n.Args[i] = e.expr(arg)
+		}
+		if n.Block != nil {
+			n.Block.Body = e.function(n.Block.Body)
+		}
+	case *ast.Identifier:
+		if _, ok := e.macros[n.Name]; ok {
+			e.error(n.Span, "macro %s can only be called", n.Name)
+		}
+	case *ast.LambdaExpr:
+		n.Body = e.function(n.Body)
+	case *ast.Block:
+		e.block(n)
+	case *ast.TupleConst:
+		for i, v := range n.Vals {
+			n.Vals[i] = e.expr(v)
+		}
+	case *ast.ListConst:
+		for i, v := range n.Vals {
+			n.Vals[i] = e.expr(v)
+		}
+	case *ast.RecordConst:
+		for i, f := range n.Fields {
+			n.Fields[i].Val = e.expr(f.Val)
+		}
+	case *ast.Access:
+		n.Lhs = e.expr(n.Lhs)
+	case *ast.IfExpr:
+		n.Cond = e.expr(n.Cond)
+		e.block(n.IfBranch)
+		if n.ElseBranch != nil {
+			n.ElseBranch = e.expr(n.ElseBranch)
+		}
+	case *ast.LetExpr:
+		n.Decls = e.expr(n.Decls)
+		e.block(n.Body)
+	case *ast.Handle:
+		e.block(n.Body)
+		for _, arm := range n.Arms {
+			arm.Effect = e.expr(arm.Effect)
+			if arm.Guard != nil {
+				arm.Guard = e.expr(arm.Guard)
+			}
+			e.block(arm.Body)
+		}
+		if n.Return != nil {
+			e.block(n.Return.Body)
+		}
+		if n.Finally != nil {
+			e.block(n.Finally)
+		}
+	case *ast.Resume:
+		n.Cont = e.expr(n.Cont)
+		if n.Arg != nil {
+			n.Arg = e.expr(n.Arg)
+		}
+	case *ast.Match:
+		n.Scrutinee = e.expr(n.Scrutinee)
+		for _, arm := range n.Arms {
+			if arm.Guard != nil {
+				arm.Guard = e.expr(arm.Guard)
+			}
+			e.block(arm.Body)
+		}
+	case *ast.QuasiQuote:
+		return e.quote(n.Node)
+	case *ast.Unquote:
+		e.error(n.Span, "unquote cannot be used inside of this part of a quasi-quote")
+	}
+	return n
+}
+
+func (e *expander) function(body ast.Expr) ast.Expr {
+	e.functions++
+	defer func() { e.functions-- }()
+	return e.expr(body)
+}
+
+func (e *expander) block(b *ast.Block) {
+	for i, s := range b.Instr {
+		b.Instr[i] = e.stmt(s)
+	}
+}
+
+// macroCall returns the macro called by the
+// application or nil if it is a function call.
+func (e *expander) macroCall(app *ast.FuncApplication) *macro {
+	if id, ok := app.Callee.(*ast.Identifier); ok {
+		return e.macros[id.Name]
+	}
+	return nil
+}
+
+func (e *expander) expandExpr(m *macro, app *ast.FuncApplication) ast.Expr {
+	v, x, ok := e.call(m, app)
+	if !ok {
+		return app
+	}
+	res, err := e.toExpr(v, x)
+	if err != nil {
+		e.error(app.Span, "macro %s returned invalid code: %s", m.decl.Name, err)
+		return app
+	}
+	if b, ok := res.(*ast.Block); ok && e.functions == 0 {
+		// variables cannot be declared in blocks outside of functions,
+		// so the block is evaluated by calling a lambda in place
+		lambda := &ast.LambdaExpr{Span: b.Span, Args: []*ast.FuncDeclArg{}, Body: b}
+		res = &ast.FuncApplication{Span: b.Span, Callee: lambda, Args: []ast.Expr{}}
+	}
+	e.depth++
+	defer func() { e.depth-- }()
+	return e.expr(res)
+}
+
+func (e *expander) expandStmt(m *macro, app *ast.FuncApplication) ast.Stmt {
+	v, x, ok := e.call(m, app)
+	if !ok {
+		return &ast.StmtExpr{Expr: app}
+	}
+	res, err := e.toStmt(v, x)
+	if err != nil {
+		e.error(app.Span, "macro %s returned invalid code: %s", m.decl.Name, err)
+		return &ast.StmtExpr{Expr: app}
+	}
+	e.depth++
+	defer func() { e.depth-- }()
+	return e.stmt(res)
+}
+
+// call runs the macro on the arguments of the application. The
+// trailing block, if there is one, is passed as the last argument.
+func (e *expander) call(m *macro, app *ast.FuncApplication) (data.Value, *expansion, bool) {
+	args := append([]ast.Expr{}, app.Args...)
+	if app.Block != nil {
+		args = append(args, app.Block)
+	}
+	if len(args) != len(m.decl.Args) {
+		e.error(app.Span, "macro %s expects %d arguments, got %d", m.decl.Name, len(m.decl.Args), len(args))
+		return nil, nil, false
+	}
+	if e.depth >= maxExpansionDepth {
+		e.error(app.Span, "macro %s is expanded too many times in a row", m.decl.Name)
+		return nil, nil, false
+	}
+	vals := make([]data.Value, 0, len(args))
+	for _, arg := range args {
+		vals = append(vals, e.toValue(arg))
+	}
+	v, err := e.run(m, vals)
+	if err != nil {
+		e.error(app.Span, "macro %s failed: %s", m.decl.Name, err)
+		return nil, nil, false
+	}
+	x := &expansion{span: app.Span, renames: map[string]string{}}
+	names := map[string]bool{}
+	if err := e.bindings(v, names, 0); err != nil {
+		e.error(app.Span, "macro %s returned invalid code: %s", m.decl.Name, err)
+		return nil, nil, false
+	}
+	for name := range names {
+		x.renames[name] = fmt.Sprintf("@%s@%d", name, e.gensymc)
+		e.gensymc++
+	}
+	return v, x, true
+}
+
+func (e *expander) run(m *macro, args []data.Value) (res data.Value, err error) {
+	defer func() {
+		// runtime errors are reported by the
+		// virtual machine before it panics
+		if r := recover(); r != nil {
+			res, err = nil, fmt.Errorf("%v", r)
+		}
+	}()
+	return e.vm.Clone().RunClosure(m.fn, args...), nil
+}
+
+// record creates the record representing the node.
+func (e *expander) record(n ast.Node, kind string, fields ...field) *data.Record {
+	r := data.EmptyRecord()
+	r.SetField(e.sym("kind"), e.sym(kind))
+	for _, f := range fields {
+		r.SetField(e.sym(f.key), f.val)
+	}
+	e.origins[r] = n
+	return r
+}
+
+func (e *expander) values(nodes []ast.Expr) *data.List {
+	vals := make([]data.Value, 0, len(nodes))
+	for _, n := range nodes {
+		vals = append(vals, e.toValue(n))
+	}
+	return data.NewList(vals)
+}
+
+func (e *expander) optionalValue(n ast.Node) data.Value {
+	if n == nil {
+		return data.None
+	}
+	return e.toValue(n)
+}
+
+// toValue converts the node into the data passed to macros.
+// Nodes without a representation are passed as opaque
+// records which can only be put back into the code.
+func (e *expander) toValue(n ast.Node) data.Value {
+	switch n := n.(type) {
+	case *ast.StmtExpr:
+		return e.toValue(n.Expr)
+	case *ast.Identifier:
+		return e.record(n, "identifier", field{"name", data.NewString(n.Name)})
+	case *ast.IntConst:
+		return e.record(n, "int", field{"value", data.NewInt(n.Val)})
+	case *ast.FloatConst:
+		return e.record(n, "float", field{"value", data.NewFloat(n.Val)})
+	case *ast.StringConst:
+		return e.record(n, "string", field{"value", data.NewString(n.Val)})
+	case *ast.BoolConst:
+		return e.record(n, "bool", field{"value", data.NewBool(n.Val)})
+	case *ast.NoneConst:
+		return e.record(n, "none")
+	case *ast.Symbol:
+		return e.record(n, "symbol", field{"name", data.NewString(n.Val)})
+	case *ast.FuncApplication:
+		var block data.Value = data.None
+		if n.Block != nil {
+			block = e.toValue(n.Block)
+		}
+		return e.record(n, "call",
+			field{"callee", e.toValue(n.Callee)},
+			field{"args", e.values(n.Args)},
+			field{"block", block})
+	case *ast.LambdaExpr:
+		args := []data.Value{}
+		for _, arg := range n.Args {
+			if arg.Pattern != nil {
+				return e.opaqueValue(n)
+			}
+			args = append(args, data.NewString(arg.Name))
+		}
+		var name data.Value = data.None
+		if n.Name != "" {
+			name = data.NewString(n.Name)
+		}
+		return e.record(n, "lambda",
+			field{"args", data.NewList(args)},
+			field{"body", e.toValue(n.Body)},
+			field{"name", name})
+	case *ast.Block:
+		stmts := make([]data.Value, 0, len(n.Instr))
+		for _, s := range n.Instr {
+			stmts = append(stmts, e.toValue(s))
+		}
+		return e.record(n, "block", field{"body", data.NewList(stmts)})
+	case *ast.ValDecl:
+		return e.record(n, "let",
+			field{"name", data.NewString(n.Name)},
+			field{"value", e.toValue(n.Rhs)})
+	case *ast.Assignment:
+		return e.record(n, "assign",
+			field{"target", e.toValue(n.LValue)},
+			field{"value", e.toValue(n.RValue)})
+	case *ast.IfExpr:
+		return e.record(n, "if",
+			field{"cond", e.toValue(n.Cond)},
+			field{"then", e.toValue(n.IfBranch)},
+			field{"else", e.optionalValue(n.ElseBranch)})
+	case *ast.WhileStmt:
+		return e.record(n, "while",
+			field{"cond", e.toValue(n.Cond)},
+			field{"body", e.toValue(n.Body)})
+	case *ast.Access:
+		return e.record(n, "access",
+			field{"target", e.toValue(n.Lhs)},
+			field{"property", data.NewString(n.Property.Name)})
+	case *ast.ListConst:
+		return e.record(n, "list", field{"items", e.values(n.Vals)})
+	case *ast.TupleConst:
+		return e.record(n, "tuple", field{"items", e.values(n.Vals)})
+	case *ast.RecordConst:
+		fields := make([]data.Value, 0, len(n.Fields))
+		for _, f := range n.Fields {
+			fields = append(fields, data.NewTuple([]data.Value{
+				data.NewString(f.Key), e.toValue(f.Val),
+			}))
+		}
+		return e.record(n, "record", field{"fields", data.NewList(fields)})
+	case *ast.Return:
+		return e.record(n, "return", field{"value", e.optionalValue(n.Val)})
+	}
+	return e.opaqueValue(n)
+}
+
+func (e *expander) opaqueValue(n ast.Node) data.Value {
+	return e.record(n, "opaque", field{"id", data.NewInt(e.addOpaque(n))})
+}
+
+func (e *expander) addOpaque(n ast.Node) int {
+	e.opaque = append(e.opaque, n)
+	return len(e.opaque) - 1
+}
+
+// elements returns values of the list or the tuple.
+func elements(v data.Value) ([]data.Value, bool) {
+	switch v := v.(type) {
+	case *data.List:
+		return v.RawValues(), true
+	case data.Tuple:
+		vals := make([]data.Value, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			el, _ := v.Get(data.NewInt(i))
+			vals = append(vals, el)
+		}
+		return vals, true
+	}
+	return nil, false
+}
+
+func (e *expander) kind(r *data.Record) (string, error) {
+	v, ok := r.GetField(e.sym("kind"))
+	if !ok {
+		return "", fmt.Errorf("records representing code need a kind field, got %s", r)
+	}
+	kind, ok := v.(data.Symbol)
+	if !ok {
+		return "", fmt.Errorf("kind of the node has to be a symbol, got %s", v)
+	}
+	return kind.String(), nil
+}
+
+func (e *expander) hygienic(r *data.Record) bool {
+	v, _ := r.GetField(e.sym("hygienic"))
+	b, ok := v.(data.Bool)
+	return ok && b.Val
+}
+
+func (e *expander) field(r *data.Record, kind, name string) (data.Value, error) {
+	v, ok := r.GetField(e.sym(name))
+	if !ok {
+		return nil, fmt.Errorf("%s node is missing the %s field", kind, name)
+	}
+	return v, nil
+}
+
+// optionalField returns nil if the field
+// is missing or its value is none.
+func (e *expander) optionalField(r *data.Record, name string) data.Value {
+	v, ok := r.GetField(e.sym(name))
+	if !ok || v == data.None {
+		return nil
+	}
+	return v
+}
+
+// stringField returns the value of the field
+// which can be either a string or a symbol.
+func (e *expander) stringField(r *data.Record, kind, name string) (string, error) {
+	v, err := e.field(r, kind, name)
+	if err != nil {
+		return "", err
+	}
+	switch v := v.(type) {
+	case data.String:
+		return v.Val, nil
+	case data.Symbol:
+		return v.String(), nil
+	}
+	return "", fmt.Errorf("%s field of %s node has to be a string, got %s", name, kind, v)
+}
+
+func (e *expander) listField(r *data.Record, kind, name string) ([]data.Value, error) {
+	v, err := e.field(r, kind, name)
+	if err != nil {
+		return nil, err
+	}
+	vals, ok := elements(v)
+	if !ok {
+		return nil, fmt.Errorf("%s field of %s node has to be a list, got %s", name, kind, v)
+	}
+	return vals, nil
+}
+
+// bindings collects names bound by the hygienic nodes, that is the ones
+// introduced by the macro's quasi-quotes. They are renamed so that
+// they do not capture or shadow names used by the macro's caller.
+func (e *expander) bindings(v data.Value, names map[string]bool, depth int) error {
+	if depth > maxQuotedDepth {
+		return fmt.Errorf("code is nested too deeply, it might be cyclic")
+	}
+	if vals, ok := elements(v); ok {
+		for _, el := range vals {
+			if err := e.bindings(el, names, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	r, ok := v.(*data.Record)
+	if !ok {
+		return nil
+	}
+	if e.hygienic(r) {
+		kind, _ := e.kind(r)
+		switch kind {
+		case "let":
+			if name, err := e.stringField(r, kind, "name"); err == nil {
+				names[name] = true
+			}
+		case "lambda":
+			args, _ := e.listField(r, kind, "args")
+			for _, arg := range args {
+				if name, ok := arg.(data.String); ok {
+					names[name.Val] = true
+				}
+			}
+		}
+	}
+	for _, key := range r.Keys() {
+		el, _ := r.GetField(key)
+		if err := e.bindings(el, names, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// name returns the name used in the hygienic node.
+func (x *expansion) name(hygienic bool, name string) string {
+	if renamed, ok := x.renames[name]; ok && hygienic {
+		return renamed
+	}
+	return name
+}
+
+func (e *expander) spanOf(r *data.Record, x *expansion) *span.Span {
+	if n, ok := e.origins[r]; ok {
+		return n.NodeSpan()
+	}
+	return x.span
+}
+
+func (e *expander) toExpr(v data.Value, x *expansion) (ast.Expr, error) {
+	n, err := e.toNode(v, x)
+	if err != nil {
+		return nil, err
+	}
+	expr, ok := n.(ast.Expr)
+	if !ok {
+		return nil, fmt.Errorf("%s cannot be used as an expression", v)
+	}
+	return expr, nil
+}
+
+func (e *expander) toStmt(v data.Value, x *expansion) (ast.Stmt, error) {
+	n, err := e.toNode(v, x)
+	if err != nil {
+		return nil, err
+	}
+	switch n := n.(type) {
+	case ast.Stmt:
+		return n, nil
+	case ast.Expr:
+		return &ast.StmtExpr{Expr: n}, nil
+	}
+	return nil, fmt.Errorf("%s cannot be used as a statement", v)
+}
+
+func (e *expander) toBlock(v data.Value, x *expansion) (*ast.Block, error) {
+	n, err := e.toNode(v, x)
+	if err != nil {
+		return nil, err
+	}
+	switch n := n.(type) {
+	case *ast.Block:
+		return n, nil
+	case ast.Stmt:
+		return &ast.Block{Span: n.NodeSpan(), Instr: []ast.Stmt{n}}, nil
+	case ast.Expr:
+		return &ast.Block{Span: n.NodeSpan(), Instr: []ast.Stmt{&ast.StmtExpr{Expr: n}}}, nil
+	}
+	return nil, fmt.Errorf("%s cannot be used as a block", v)
+}
+
+// toStmts converts statements of a block. Lists
+// are spliced into the block's statements.
+func (e *expander) toStmts(vals []data.Value, x *expansion) ([]ast.Stmt, error) {
+	stmts := []ast.Stmt{}
+	for _, v := range vals {
+		if l, ok := v.(*data.List); ok {
+			inner, err := e.toStmts(l.RawValues(), x)
+			if err != nil {
+				return nil, err
+			}
+			stmts = append(stmts, inner...)
+			continue
+		}
+		s, err := e.toStmt(v, x)
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, s)
+	}
+	return stmts, nil
+}
+
+func (e *expander) toExprs(vals []data.Value, x *expansion) ([]ast.Expr, error) {
+	exprs := make([]ast.Expr, 0, len(vals))
+	for _, v := range vals {
+		expr, err := e.toExpr(v, x)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+	}
+	return exprs, nil
+}
+
+// toTopLevel converts the code returned by a macro called at the top
+// level. Statements of a returned block are spliced into the top level.
+func (e *expander) toTopLevel(v data.Value, x *expansion) ([]ast.Node, error) {
+	vals := []data.Value{v}
+	if r, ok := v.(*data.Record); ok {
+		if kind, _ := e.kind(r); kind == "block" {
+			body, err := e.listField(r, kind, "body")
+			if err != nil {
+				return nil, err
+			}
+			vals = body
+		}
+	}
+	stmts, err := e.toStmts(vals, x)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]ast.Node, 0, len(stmts))
+	for _, s := range stmts {
+		if decl, ok := s.(*ast.ValDecl); ok {
+			nodes = append(nodes, &ast.GlobalValDecl{
+				Span: decl.Span,
+				Name: decl.Name,
+				Rhs:  decl.Rhs,
+			})
+			continue
+		}
+		nodes = append(nodes, s)
+	}
+	return nodes, nil
+}
+
+// toNode converts the data returned by a macro back into the code.
+// Records are converted based on their kind, other values become
+// literals representing them.
+func (e *expander) toNode(v data.Value, x *expansion) (ast.Node, error) {
+	x.depth++
+	defer func() { x.depth-- }()
+	if x.depth > maxQuotedDepth {
+		return nil, fmt.Errorf("code is nested too deeply, it might be cyclic")
+	}
+	switch v := v.(type) {
+	case data.Int:
+		return &ast.IntConst{Span: x.span, Val: v.Val}, nil
+	case data.Float:
+		return &ast.FloatConst{Span: x.span, Val: v.Val}, nil
+	case data.String:
+		return &ast.StringConst{Span: x.span, Val: v.Val}, nil
+	case data.Bool:
+		return &ast.BoolConst{Span: x.span, Val: v.Val}, nil
+	case data.Symbol:
+		return &ast.Symbol{Span: x.span, Val: v.String()}, nil
+	case *data.List:
+		vals, err := e.toExprs(v.RawValues(), x)
+		if err != nil {
+			return nil, err
+		}
+		return &ast.ListConst{Span: x.span, Vals: vals}, nil
+	case data.Tuple:
+		els, _ := elements(v)
+		vals, err := e.toExprs(els, x)
+		if err != nil {
+			return nil, err
+		}
+		return &ast.TupleConst{Span: x.span, Vals: vals}, nil
+	case *data.Record:
+		return e.recordToNode(v, x)
+	}
+	if v == data.None {
+		return &ast.NoneConst{Span: x.span}, nil
+	}
+	return nil, fmt.Errorf("%s cannot be turned into code", v)
+}
+
+func (e *expander) recordToNode(r *data.Record, x *expansion) (ast.Node, error) {
+	kind, err := e.kind(r)
+	if err != nil {
+		return nil, err
+	}
+	loc := e.spanOf(r, x)
+	hygienic := e.hygienic(r)
+	switch kind {
+	case "identifier":
+		name, err := e.stringField(r, kind, "name")
+		if err != nil {
+			return nil, err
+		}
+		return &ast.Identifier{Span: loc, Name: x.name(hygienic, name)}, nil
+	case "int", "float", "string", "bool":
+		v, err := e.field(r, kind, "value")
+		if err != nil {
+			return nil, err
+		}
+		return e.toNode(v, x)
+	case "none":
+		return &ast.NoneConst{Span: loc}, nil
+	case "symbol":
+		name, err := e.stringField(r, kind, "name")
+		if err != nil {
+			return nil, err
+		}
+		return &ast.Symbol{Span: loc, Val: name}, nil
+	case "call":
+		callee, err := e.field(r, kind, "callee")
+		if err != nil {
+			return nil, err
+		}
+		fn, err := e.toExpr(callee, x)
+		if err != nil {
+			return nil, err
+		}
+		vals, err := e.listField(r, kind, "args")
+		if err != nil {
+			return nil, err
+		}
+		args, err := e.toExprs(vals, x)
+		if err != nil {
+			return nil, err
+		}
+		app := &ast.FuncApplication{Span: loc, Callee: fn, Args: args}
+		if b := e.optionalField(r, "block"); b != nil {
+			block, err := e.toNode(b, x)
+			if err != nil {
+				return nil, err
+			}
+			lambda, ok := block.(*ast.LambdaExpr)
+			if !ok {
+				return nil, fmt.Errorf("block of the call node has to be a lambda, got %s", b)
+			}
+			app.Block = lambda
+		}
+		return app, nil
+	case "lambda":
+		vals, err := e.listField(r, kind, "args")
+		if err != nil {
+			return nil, err
+		}
+		args := make([]*ast.FuncDeclArg, 0, len(vals))
+		for _, v := range vals {
+			name, ok := v.(data.String)
+			if !ok {
+				return nil, fmt.Errorf("lambda arguments have to be strings, got %s", v)
+			}
+			args = append(args, &ast.FuncDeclArg{
+				Span: loc,
+				Name: x.name(hygienic, name.Val),
+				Lift: true,
+			})
+		}
+		b, err := e.field(r, kind, "body")
+		if err != nil {
+			return nil, err
+		}
+		body, err := e.toExpr(b, x)
+		if err != nil {
+			return nil, err
+		}
+		lambda := &ast.LambdaExpr{Span: loc, Args: args, Body: body}
+		if name, ok := e.optionalField(r, "name").(data.String); ok {
+			lambda.Name = name.Val
+		}
+		return lambda, nil
+	case "block":
+		vals, err := e.listField(r, kind, "body")
+		if err != nil {
+			return nil, err
+		}
+		stmts, err := e.toStmts(vals, x)
+		if err != nil {
+			return nil, err
+		}
+		if len(stmts) == 0 {
+			return nil, fmt.Errorf("blocks need at least one statement")
+		}
+		return &ast.Block{Span: loc, Instr: stmts}, nil
+	case "let":
+		name, err := e.stringField(r, kind, "name")
+		if err != nil {
+			return nil, err
+		}
+		v, err := e.field(r, kind, "value")
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := e.toExpr(v, x)
+		if err != nil {
+			return nil, err
+		}
+		// lifting is not known for the generated code,
+		// lifted variables work in every context
+		return &ast.ValDecl{Span: loc, Name: x.name(hygienic, name), Rhs: rhs, Lift: true}, nil
+	case "assign":
+		t, err := e.field(r, kind, "target")
+		if err != nil {
+			return nil, err
+		}
+		target, err := e.toExpr(t, x)
+		if err != nil {
+			return nil, err
+		}
+		v, err := e.field(r, kind, "value")
+		if err != nil {
+			return nil, err
+		}
+		val, err := e.toExpr(v, x)
+		if err != nil {
+			return nil, err
+		}
+		return &ast.Assignment{Span: loc, LValue: target, RValue: val}, nil
+	case "if":
+		c, err := e.field(r, kind, "cond")
+		if err != nil {
+			return nil, err
+		}
+		cond, err := e.toExpr(c, x)
+		if err != nil {
+			return nil, err
+		}
+		t, err := e.field(r, kind, "then")
+		if err != nil {
+			return nil, err
+		}
+		then, err := e.toBlock(t, x)
+		if err != nil {
+			return nil, err
+		}
+		node := &ast.IfExpr{Span: loc, Cond: cond, IfBranch: then}
+		if el := e.optionalField(r, "else"); el != nil {
+			if node.ElseBranch, err = e.toExpr(el, x); err != nil {
+				return nil, err
+			}
+		}
+		return node, nil
+	case "while":
+		c, err := e.field(r, kind, "cond")
+		if err != nil {
+			return nil, err
+		}
+		cond, err := e.toExpr(c, x)
+		if err != nil {
+			return nil, err
+		}
+		b, err := e.field(r, kind, "body")
+		if err != nil {
+			return nil, err
+		}
+		body, err := e.toBlock(b, x)
+		if err != nil {
+			return nil, err
+		}
+		return &ast.WhileStmt{Span: loc, Cond: cond, Body: body}, nil
+	case "access":
+		t, err := e.field(r, kind, "target")
+		if err != nil {
+			return nil, err
+		}
+		target, err := e.toExpr(t, x)
+		if err != nil {
+			return nil, err
+		}
+		prop, err := e.stringField(r, kind, "property")
+		if err != nil {
+			return nil, err
+		}
+		return &ast.Access{Span: loc, Lhs: target, Property: ast.Identifier{Span: loc, Name: prop}}, nil
+	case "list", "tuple":
+		vals, err := e.listField(r, kind, "items")
+		if err != nil {
+			return nil, err
+		}
+		items, err := e.toExprs(vals, x)
+		if err != nil {
+			return nil, err
+		}
+		if kind == "list" {
+			return &ast.ListConst{Span: loc, Vals: items}, nil
+		}
+		return &ast.TupleConst{Span: loc, Vals: items}, nil
+	case "record":
+		vals, err := e.listField(r, kind, "fields")
+		if err != nil {
+			return nil, err
+		}
+		fields := make([]ast.RecordField, 0, len(vals))
+		for _, v := range vals {
+			pair, ok := elements(v)
+			if !ok || len(pair) != 2 {
+				return nil, fmt.Errorf("record fields have to be (name, value) pairs, got %s", v)
+			}
+			var key string
+			switch k := pair[0].(type) {
+			case data.String:
+				key = k.Val
+			case data.Symbol:
+				key = k.String()
+			default:
+				return nil, fmt.Errorf("record field names have to be strings, got %s", k)
+			}
+			val, err := e.toExpr(pair[1], x)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, ast.RecordField{Key: key, Val: val})
+		}
+		return &ast.RecordConst{Span: loc, Fields: fields}, nil
+	case "return":
+		ret := &ast.Return{Span: loc, Val: &ast.NoneConst{Span: loc}}
+		if v := e.optionalField(r, "value"); v != nil {
+			val, err := e.toExpr(v, x)
+			if err != nil {
+				return nil, err
+			}
+			ret.Val = val
+		}
+		return ret, nil
+	case "opaque":
+		v, err := e.field(r, kind, "id")
+		if err != nil {
+			return nil, err
+		}
+		id, ok := v.(data.Int)
+		if !ok || id.Val < 0 || id.Val >= len(e.opaque) {
+			return nil, fmt.Errorf("unknown opaque node %s", v)
+		}
+		return e.opaque[id.Val], nil
+	}
+	return nil, fmt.Errorf("unknown kind of node %s", kind)
+}
+
+// quote turns the quasi-quoted code into an expression building
+// the records that represent it. Unquoted expressions are put in
+// as they are. Nodes binding names are marked as hygienic so that
+// the names can be renamed when the macro's result is expanded.
+func (e *expander) quote(n ast.Node) ast.Expr {
+	loc := n.NodeSpan()
+	switch n := n.(type) {
+	case *ast.Unquote:
+		return e.expr(n.Expr)
+	case *ast.StmtExpr:
+		return e.quote(n.Expr)
+	case *ast.Identifier:
+		return quoted(loc, "identifier", true, quotedField("name", quotedString(loc, n.Name)))
+	case *ast.IntConst:
+		return quoted(loc, "int", false, quotedField("value", n))
+	case *ast.FloatConst:
+		return quoted(loc, "float", false, quotedField("value", n))
+	case *ast.StringConst:
+		return quoted(loc, "string", false, quotedField("value", n))
+	case *ast.BoolConst:
+		return quoted(loc, "bool", false, quotedField("value", n))
+	case *ast.NoneConst:
+		return quoted(loc, "none", false)
+	case *ast.Symbol:
+		return quoted(loc, "symbol", false, quotedField("name", quotedString(loc, n.Val)))
+	case *ast.FuncApplication:
+		var block ast.Expr = &ast.NoneConst{Span: loc}
+		if n.Block != nil {
+			block = e.quote(n.Block)
+		}
+		return quoted(loc, "call", false,
+			quotedField("callee", e.quote(n.Callee)),
+			quotedField("args", e.quoteAll(loc, n.Args)),
+			quotedField("block", block))
+	case *ast.LambdaExpr:
+		args := make([]ast.Expr, 0, len(n.Args))
+		for _, arg := range n.Args {
+			if arg.Pattern != nil {
+				return e.quoteOpaque(n)
+			}
+			args = append(args, quotedString(loc, arg.Name))
+		}
+		var name ast.Expr = &ast.NoneConst{Span: loc}
+		if n.Name != "" {
+			name = quotedString(loc, n.Name)
+		}
+		return quoted(loc, "lambda", true,
+			quotedField("args", &ast.ListConst{Span: loc, Vals: args}),
+			quotedField("body", e.quote(n.Body)),
+			quotedField("name", name))
+	case *ast.Block:
+		stmts := make([]ast.Expr, 0, len(n.Instr))
+		for _, s := range n.Instr {
+			stmts = append(stmts, e.quote(s))
+		}
+		return quoted(loc, "block", false, quotedField("body", &ast.ListConst{Span: loc, Vals: stmts}))
+	case *ast.ValDecl:
+		return quoted(loc, "let", true,
+			quotedField("name", quotedString(loc, n.Name)),
+			quotedField("value", e.quote(n.Rhs)))
+	case *ast.Assignment:
+		return quoted(loc, "assign", false,
+			quotedField("target", e.quote(n.LValue)),
+			quotedField("value", e.quote(n.RValue)))
+	case *ast.IfExpr:
+		var el ast.Expr = &ast.NoneConst{Span: loc}
+		if n.ElseBranch != nil {
+			el = e.quote(n.ElseBranch)
+		}
+		return quoted(loc, "if", false,
+			quotedField("cond", e.quote(n.Cond)),
+			quotedField("then", e.quote(n.IfBranch)),
+			quotedField("else", el))
+	case *ast.WhileStmt:
+		return quoted(loc, "while", false,
+			quotedField("cond", e.quote(n.Cond)),
+			quotedField("body", e.quote(n.Body)))
+	case *ast.Access:
+		return quoted(loc, "access", false,
+			quotedField("target", e.quote(n.Lhs)),
+			quotedField("property", quotedString(loc, n.Property.Name)))
+	case *ast.ListConst:
+		return quoted(loc, "list", false, quotedField("items", e.quoteAll(loc, n.Vals)))
+	case *ast.TupleConst:
+		return quoted(loc, "tuple", false, quotedField("items", e.quoteAll(loc, n.Vals)))
+	case *ast.RecordConst:
+		fields := make([]ast.Expr, 0, len(n.Fields))
+		for _, f := range n.Fields {
+			fields = append(fields, &ast.TupleConst{
+				Span: loc,
+				Vals: []ast.Expr{quotedString(loc, f.Key), e.quote(f.Val)},
+			})
+		}
+		return quoted(loc, "record", false, quotedField("fields", &ast.ListConst{Span: loc, Vals: fields}))
+	case *ast.Return:
+		var val ast.Expr = &ast.NoneConst{Span: loc}
+		if n.Val != nil {
+			val = e.quote(n.Val)
+		}
+		return quoted(loc, "return", false, quotedField("value", val))
+	case *ast.QuasiQuote:
+		e.error(loc, "quasi-quotes cannot be nested")
+		return &ast.NoneConst{Span: loc}
+	}
+	return e.quoteOpaque(n)
+}
+
+func (e *expander) quoteAll(loc *span.Span, nodes []ast.Expr) ast.Expr {
+	vals := make([]ast.Expr, 0, len(nodes))
+	for _, n := range nodes {
+		vals = append(vals, e.quote(n))
+	}
+	return &ast.ListConst{Span: loc, Vals: vals}
+}
+
+// quoteOpaque quotes the node without a representation. It is put
+// back into the code as it is, unquotes inside of it are not allowed.
+func (e *expander) quoteOpaque(n ast.Node) ast.Expr {
+	loc := n.NodeSpan()
+	id := &ast.IntConst{Span: loc, Val: e.addOpaque(n)}
+	return quoted(loc, "opaque", false, quotedField("id", id))
+}
+
+func quoted(loc *span.Span, kind string, hygienic bool, fields ...ast.RecordField) ast.Expr {
+	ff := []ast.RecordField{{Key: "kind", Val: &ast.Symbol{Span: loc, Val: kind}}}
+	ff = append(ff, fields...)
+	if hygienic {
+		ff = append(ff, ast.RecordField{Key: "hygienic", Val: &ast.BoolConst{Span: loc, Val: true}})
+	}
+	return &ast.RecordConst{Span: loc, Fields: ff}
+}
+
+func quotedField(key string, val ast.Expr) ast.RecordField {
+	return ast.RecordField{Key: key, Val: val}
+}
+
+func quotedString(loc *span.Span, s string) ast.Expr {
+	return &ast.StringConst{Span: loc, Val: s}
+}
@@ -0,0 +1,545 @@
+package codegen
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/gala377/MLLang/data"
+	"github.com/gala377/MLLang/isa"
+)
+
+// Optimize enables the optimization of the compiled code.
+// Set it to false to run the code exactly as it has been emitted.
+var Optimize = true
+
+// instr is a decoded instruction of the code being optimized.
+type instr struct {
+	op isa.Op
+	// 4 bytes long if the instruction is prefixed with Wide
+	args []byte
+	loc  data.Location
+	// index of the instruction jumped to or -1 if the
+	// instruction is not a jump. Index equal to the number
+	// of instructions means the end of the code.
+	target int
+}
+
+// pureNative is a std native without side effects which
+// can be called on constant arguments at compile time.
+type pureNative struct {
+	arity int
+	// fold returns false if the call would fail,
+	// so that the error is still reported at runtime.
+	fold func([]data.Value) (data.Value, bool)
+}
+
+// pureNatives are the natives folded by the optimizer.
+// The operators are bound to them by the prelude.
+var pureNatives = map[string]pureNative{
+	"add": foldNumOp(data.AddOp, false),
+	"+":   foldNumOp(data.AddOp, false),
+	"sub": foldNumOp(data.SubOpp, false),
+	"-":   foldNumOp(data.SubOpp, false),
+	"mul": foldNumOp(data.MulOp, false),
+	"*":   foldNumOp(data.MulOp, false),
+	"div": foldNumOp(data.DevideOp, true),
+	"/":   foldNumOp(data.DevideOp, true),
+	"mod": {2, foldModulo},
+	"%":   {2, foldModulo},
+	"neg": {1, foldNeg},
+}
+
+func foldNumOp(op data.NumOp, divides bool) pureNative {
+	return pureNative{2, func(vv []data.Value) (data.Value, bool) {
+		a, ok := vv[0].(data.Number)
+		if !ok {
+			return nil, false
+		}
+		b, ok := vv[1].(data.Number)
+		if !ok {
+			return nil, false
+		}
+		if divides && isZero(b) {
+			return nil, false
+		}
+		return data.CallNumOp(a, op, b), true
+	}}
+}
+
+func foldModulo(vv []data.Value) (data.Value, bool) {
+	a, ok := vv[0].(data.Int)
+	if !ok {
+		return nil, false
+	}
+	b, ok := vv[1].(data.Int)
+	if !ok || b.Val == 0 {
+		return nil, false
+	}
+	return data.NewInt(a.Val % b.Val), true
+}
+
+func foldNeg(vv []data.Value) (data.Value, bool) {
+	a, ok := vv[0].(data.Number)
+	if !ok {
+		return nil, false
+	}
+	return a.Neg(), true
+}
+
+func isZero(n data.Number) bool {
+	switch v := n.(type) {
+	case data.Int:
+		return v.Val == 0
+	case data.Float:
+		return v.Val == 0
+	}
+	return false
+}
+
+type optimizer struct {
+	code *data.Code
+	ins  []instr
+	// globals defined by the optimized program. Natives
+	// shadowed by them cannot be folded.
+	globals map[string]bool
+}
+
+// OptimizeCode rewrites the code and every function defined
+// within it in place. Arithmetic on constants is folded,
+// unreachable code is removed, jumps to jumps are threaded
+// and values pushed only to be popped are dropped.
+// Instructions left keep the locations they have been emitted for.
+func OptimizeCode(c *data.Code) {
+	codes := collectCode(c, nil, make(map[*data.Code]bool))
+	globals := make(map[string]bool)
+	oo := make([]*optimizer, 0, len(codes))
+	for _, c := range codes {
+		o := &optimizer{code: c, globals: globals}
+		if o.decode() {
+			o.definedGlobals()
+			oo = append(oo, o)
+		}
+	}
+	for _, o := range oo {
+		o.run()
+	}
+}
+
+func collectCode(c *data.Code, acc []*data.Code, seen map[*data.Code]bool) []*data.Code {
+	if seen[c] {
+		return acc
+	}
+	seen[c] = true
+	acc = append(acc, c)
+	for _, v := range c.Consts {
+		if f, ok := v.(*data.Closure); ok {
+			acc = collectCode(f.Body, acc, seen)
+		}
+	}
+	return acc
+}
+
+// definedGlobals adds names of the globals defined
+// or assigned to within the code to the set.
+func (o *optimizer) definedGlobals() {
+	for _, in := range o.ins {
+		switch in.op {
+		case isa.DefGlobal, isa.StoreDyn:
+			o.globals[o.code.Consts[in.arg()].String()] = true
+		}
+	}
+}
+
+func (o *optimizer) run() {
+	for changed := true; changed; {
+		changed = o.fold()
+		changed = o.threadJumps() || changed
+		changed = o.removeUnreachable() || changed
+		changed = o.removeUnusedValues() || changed
+	}
+	o.encode()
+}
+
+// decode splits the code into instructions. Returns false
+// if a jump does not land on an instruction's boundary
+// in which case the code is left as it is.
+func (o *optimizer) decode() bool {
+	c := o.code
+	index := make(map[int]int)
+	offsets := []int{}
+	for off := 0; off < len(c.Instrs); {
+		start := off + 1
+		op := c.Instrs[off]
+		n := isa.ArgCount(op)
+		if op == isa.Wide {
+			op = c.Instrs[start]
+			start++
+			n = 2 * isa.ArgCount(op)
+		}
+		index[off] = len(o.ins)
+		offsets = append(offsets, off)
+		o.ins = append(o.ins, instr{
+			op:     op,
+			args:   append([]byte{}, c.Instrs[start:start+n]...),
+			loc:    c.Location(off),
+			target: -1,
+		})
+		off = start + n
+	}
+	index[len(c.Instrs)] = len(o.ins)
+	for i := range o.ins {
+		in := &o.ins[i]
+		if !isJump(in.op) {
+			continue
+		}
+		dist := in.arg()
+		to := offsets[i] + dist
+		if in.op == isa.JumpBack {
+			to = offsets[i] - dist
+		}
+		t, ok := index[to]
+		if !ok {
+			return false
+		}
+		in.target = t
+	}
+	return true
+}
+
+// encode writes the instructions back to the code. The code is left
+// as it has been emitted if a jump does not fit in its argument.
+func (o *optimizer) encode() {
+	offsets := o.offsets()
+	for i, in := range o.ins {
+		if in.target >= 0 && !fitsJump(offsets[in.target]-offsets[i]) {
+			return
+		}
+	}
+	c := o.code
+	c.Instrs = make([]byte, 0, offsets[len(o.ins)])
+	c.Locations = make([]data.LocationRun, 0)
+	for i, in := range o.ins {
+		if in.target >= 0 {
+			dist := offsets[in.target] - offsets[i]
+			if isUnconditionalJump(in.op) {
+				in.op = isa.Jump
+				if dist < 0 {
+					in.op = isa.JumpBack
+					dist = -dist
+				}
+			}
+			binary.BigEndian.PutUint16(in.args, uint16(dist))
+		}
+		if in.wide() {
+			c.WriteByte(isa.Wide, in.loc)
+		}
+		c.WriteByte(in.op, in.loc)
+		for _, b := range in.args {
+			c.WriteByte(b, in.loc)
+		}
+	}
+}
+
+// offsets returns the offsets the instructions would be encoded at,
+// the last one being the length of the code.
+func (o *optimizer) offsets() []int {
+	offsets := make([]int, len(o.ins)+1)
+	for i, in := range o.ins {
+		offsets[i+1] = offsets[i] + in.len()
+	}
+	return offsets
+}
+
+// fitsJump returns true if the distance of
+// the jump can be written in its argument.
+func fitsJump(dist int) bool {
+	return dist >= -math.MaxUint16 && dist <= math.MaxUint16
+}
+
+// remove drops the marked instructions. Jumps to the removed
+// instruction land on the first instruction kept after it.
+func (o *optimizer) remove(dead []bool) bool {
+	index := make([]int, len(o.ins)+1)
+	kept := 0
+	for i := range o.ins {
+		index[i] = kept
+		if !dead[i] {
+			kept++
+		}
+	}
+	index[len(o.ins)] = kept
+	if kept == len(o.ins) {
+		return false
+	}
+	ins := make([]instr, 0, kept)
+	for i, in := range o.ins {
+		if dead[i] {
+			continue
+		}
+		if in.target >= 0 {
+			in.target = index[in.target]
+		}
+		ins = append(ins, in)
+	}
+	o.ins = ins
+	return true
+}
+
+// targets marks instructions jumped to.
+func (o *optimizer) targets() []bool {
+	tt := make([]bool, len(o.ins)+1)
+	for _, in := range o.ins {
+		if in.target >= 0 {
+			tt[in.target] = true
+		}
+	}
+	return tt
+}
+
+// fold replaces calls of the pure natives with constant
+// arguments with their results. The call is emitted as
+// the native's lookup followed by the arguments and a call
+// taking all of them.
+func (o *optimizer) fold() bool {
+	targets := o.targets()
+	dead := make([]bool, len(o.ins))
+	changed := false
+	for i := 0; i < len(o.ins); i++ {
+		native, ok := o.pureNative(o.ins[i])
+		if !ok {
+			continue
+		}
+		last := i + native.arity + 1
+		if last >= len(o.ins) || !callsWith(o.ins[last], native.arity) {
+			continue
+		}
+		args := make([]data.Value, 0, native.arity)
+		for j := i + 1; j < last && ok; j++ {
+			arg, isConst := o.constantValue(o.ins[j])
+			ok = isConst && !targets[j]
+			args = append(args, arg)
+		}
+		if !ok || targets[last] {
+			continue
+		}
+		res, ok := native.fold(args)
+		if !ok {
+			continue
+		}
+		folded, ok := o.constant(res, o.ins[last].loc)
+		if !ok {
+			continue
+		}
+		o.ins[i] = folded
+		for j := i + 1; j <= last; j++ {
+			dead[j] = true
+		}
+		changed = true
+		i = last
+	}
+	return o.remove(dead) || changed
+}
+
+func (o *optimizer) pureNative(in instr) (pureNative, bool) {
+	if in.op != isa.LoadDyn {
+		return pureNative{}, false
+	}
+	name := o.code.Consts[in.arg()].String()
+	if o.globals[name] {
+		return pureNative{}, false
+	}
+	n, ok := pureNatives[name]
+	return n, ok
+}
+
+func (o *optimizer) constantValue(in instr) (data.Value, bool) {
+	switch in.op {
+	case isa.Constant, isa.Constant2:
+		return o.code.Consts[in.arg()], true
+	}
+	return nil, false
+}
+
+// constant returns an instruction pushing the value.
+// Returns false if the constant pool is full.
+func (o *optimizer) constant(v data.Value, loc data.Location) (instr, bool) {
+	if int64(len(o.code.Consts)) > math.MaxUint32 {
+		return instr{}, false
+	}
+	index := o.code.AddConstant(v)
+	switch {
+	case index <= 255:
+		return instr{op: isa.Constant, args: []byte{byte(index)}, loc: loc, target: -1}, true
+	case index <= math.MaxUint16:
+		args := []byte{0, 0}
+		binary.BigEndian.PutUint16(args, uint16(index))
+		return instr{op: isa.Constant2, args: args, loc: loc, target: -1}, true
+	}
+	args := []byte{0, 0, 0, 0}
+	binary.BigEndian.PutUint32(args, uint32(index))
+	return instr{op: isa.Constant2, args: args, loc: loc, target: -1}, true
+}
+
+// threadJumps makes jumps to unconditional jumps go straight
+// to their final destination, unless it is too far to jump to.
+// Unconditional jumps to Return are replaced by it and jumps
+// to the next instruction are removed.
+func (o *optimizer) threadJumps() bool {
+	changed := false
+	dead := make([]bool, len(o.ins))
+	offsets := o.offsets()
+	for i := range o.ins {
+		in := &o.ins[i]
+		if in.target < 0 {
+			continue
+		}
+		t := o.destination(in.target)
+		if !fitsJump(offsets[t] - offsets[i]) {
+			t = in.target
+		}
+		if !isUnconditionalJump(in.op) {
+			// conditional jumps can only go forward
+			if t > i && t != in.target {
+				in.target = t
+				changed = true
+			}
+			continue
+		}
+		switch {
+		case t < len(o.ins) && o.ins[t].op == isa.Return:
+			*in = instr{op: isa.Return, loc: in.loc, target: -1}
+			changed = true
+		case t == i+1:
+			dead[i] = true
+		case t != in.target:
+			in.target = t
+			changed = true
+		}
+	}
+	return o.remove(dead) || changed
+}
+
+// destination follows the chain of unconditional
+// jumps starting at the instruction.
+func (o *optimizer) destination(t int) int {
+	for steps := 0; steps < len(o.ins); steps++ {
+		if t >= len(o.ins) || !isUnconditionalJump(o.ins[t].op) {
+			return t
+		}
+		t = o.ins[t].target
+	}
+	return t
+}
+
+// removeUnreachable drops instructions which cannot be reached
+// from the beginning of the code, like the ones after Return.
+func (o *optimizer) removeUnreachable() bool {
+	reached := make([]bool, len(o.ins)+1)
+	work := []int{0}
+	for len(work) > 0 {
+		i := work[len(work)-1]
+		work = work[:len(work)-1]
+		for ; i < len(o.ins) && !reached[i]; i++ {
+			reached[i] = true
+			in := o.ins[i]
+			if in.target >= 0 {
+				work = append(work, in.target)
+			}
+			if in.op == isa.Return || in.op == isa.LoopSignal || isUnconditionalJump(in.op) {
+				break
+			}
+		}
+	}
+	dead := make([]bool, len(o.ins))
+	for i := range o.ins {
+		dead[i] = !reached[i]
+	}
+	return o.remove(dead)
+}
+
+// removeUnusedValues drops values pushed only to be popped.
+// Values below them popped after Rotate are popped
+// before the push instead.
+func (o *optimizer) removeUnusedValues() bool {
+	targets := o.targets()
+	dead := make([]bool, len(o.ins))
+	changed := false
+	for i := 0; i+1 < len(o.ins); i++ {
+		a, b := o.ins[i], o.ins[i+1]
+		if targets[i+1] {
+			continue
+		}
+		switch {
+		case pushesPure(a.op) && b.op == isa.Pop:
+			dead[i], dead[i+1] = true, true
+			i++
+		case a.op == isa.Rotate && b.op == isa.Rotate:
+			dead[i], dead[i+1] = true, true
+			i++
+		case pushesPure(a.op) && b.op == isa.Rotate &&
+			i+2 < len(o.ins) && o.ins[i+2].op == isa.Pop && !targets[i+2]:
+			o.ins[i] = instr{op: isa.Pop, loc: o.ins[i+2].loc, target: -1}
+			o.ins[i+1] = a
+			dead[i+2] = true
+			changed = true
+			i += 2
+		}
+	}
+	return o.remove(dead) || changed
+}
+
+// pushesPure returns true if the instruction only
+// pushes a value without any other effects.
+func pushesPure(op isa.Op) bool {
+	switch op {
+	case isa.Constant, isa.Constant2, isa.PushNone, isa.LoadLocal:
+		return true
+	}
+	return false
+}
+
+func (in instr) arg() int {
+	switch len(in.args) {
+	case 1:
+		return int(in.args[0])
+	case 2:
+		return int(binary.BigEndian.Uint16(in.args))
+	}
+	return int(binary.BigEndian.Uint32(in.args))
+}
+
+func (in instr) wide() bool {
+	return len(in.args) == 4
+}
+
+// len returns the number of bytes the instruction is encoded with.
+func (in instr) len() int {
+	if in.wide() {
+		return 2 + len(in.args)
+	}
+	return 1 + len(in.args)
+}
+
+// callsWith returns true if the instruction
+// is a call with argc arguments.
+func callsWith(in instr, argc int) bool {
+	switch in.op {
+	case isa.Call1, isa.TailCall1:
+		return argc == 1
+	case isa.Call, isa.TailCall:
+		return in.arg() == argc
+	}
+	return false
+}
+
+func isJump(op isa.Op) bool {
+	switch op {
+	case isa.Jump, isa.JumpBack, isa.JumpIfFalse, isa.IterNext:
+		return true
+	}
+	return false
+}
+
+func isUnconditionalJump(op isa.Op) bool {
+	return op == isa.Jump || op == isa.JumpBack
+}
@@ -0,0 +1,225 @@
+package codegen
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/gala377/MLLang/data"
+	"github.com/gala377/MLLang/isa"
+	"github.com/gala377/MLLang/syntax"
+)
+
+func TestOptimizingEmittedCode(t *testing.T) {
+	test := etest{
+		{
+			"10",
+			codeFromBytes(0, []byte{}),
+		},
+		{
+			"io.print (add 1 2)",
+			codeFromBytes(0, []byte{
+				isa.LoadDyn, 0, 0,
+				isa.GetField, 0, 1,
+				isa.Constant, 5,
+				isa.Call1,
+				isa.Pop,
+			}),
+		},
+		{
+			"io.print (1 + 2 * 3)",
+			codeFromBytes(0, []byte{
+				isa.LoadDyn, 0, 0,
+				isa.GetField, 0, 1,
+				isa.Constant, 7,
+				isa.Call1,
+				isa.Pop,
+			}),
+		},
+		{
+			// division by zero is left to fail at runtime
+			"io.print (div 1 0)",
+			codeFromBytes(0, []byte{
+				isa.LoadDyn, 0, 0,
+				isa.GetField, 0, 1,
+				isa.LoadDyn, 0, 2,
+				isa.Constant, 3,
+				isa.Constant, 4,
+				isa.Call, 2,
+				isa.Call1,
+				isa.Pop,
+			}),
+		},
+		{
+			// natives redefined by the program are not folded
+			"let neg = 1\nio.print (neg 2)",
+			codeFromBytes(0, []byte{
+				isa.Constant, 0,
+				isa.DefGlobal, 0, 1,
+				isa.LoadDyn, 0, 2,
+				isa.GetField, 0, 3,
+				isa.LoadDyn, 0, 1,
+				isa.Constant, 4,
+				isa.Call1,
+				isa.Call1,
+				isa.Pop,
+			}),
+		},
+	}
+	matchOptimized(t, &test)
+}
+
+func TestOptimizingJumps(t *testing.T) {
+	table := []struct {
+		name   string
+		code   []byte
+		expect []byte
+	}{
+		{
+			"jump to jump",
+			[]byte{
+				isa.Constant, 0,
+				isa.JumpIfFalse, 0, 4,
+				isa.Return,
+				isa.Jump, 0, 4,
+				isa.Return,
+				isa.Constant, 0,
+				isa.Return,
+			},
+			[]byte{
+				isa.Constant, 0,
+				isa.JumpIfFalse, 0, 4,
+				isa.Return,
+				isa.Constant, 0,
+				isa.Return,
+			},
+		},
+		{
+			"jump to return",
+			[]byte{
+				isa.Constant, 0,
+				isa.Jump, 0, 4,
+				isa.Pop,
+				isa.Return,
+			},
+			[]byte{
+				isa.Constant, 0,
+				isa.Return,
+			},
+		},
+		{
+			"jump back to jump",
+			[]byte{
+				isa.Constant, 0,
+				isa.JumpIfFalse, 0, 6,
+				isa.Jump, 0, 6,
+				isa.JumpBack, 0, 3,
+				isa.Constant, 0,
+				isa.Return,
+			},
+			[]byte{
+				isa.Constant, 0,
+				isa.JumpIfFalse, 0, 3,
+				isa.Constant, 0,
+				isa.Return,
+			},
+		},
+	}
+	for _, test := range table {
+		t.Run(test.name, func(t *testing.T) {
+			got := codeFromBytes(1, test.code)
+			want := codeFromBytes(1, test.expect)
+			OptimizeCode(got)
+			if !bytes.Equal(got.Instrs, want.Instrs) {
+				t.Logf("Want:\n%s", isa.DisassembleCode(want))
+				t.Logf("\nGot:\n%s\n", isa.DisassembleCode(got))
+				t.FailNow()
+			}
+		})
+	}
+}
+
+func TestThreadingLongJumps(t *testing.T) {
+	// calls, so that the blocks are not optimized away
+	block := bytes.Repeat([]byte{isa.Constant, 0, isa.Call0, isa.Pop}, 10000)
+	jump := func(op isa.Op, dist int) []byte {
+		return []byte{op, byte(dist >> 8), byte(dist)}
+	}
+	code := []byte{isa.Constant, 0}
+	code = append(code, jump(isa.JumpIfFalse, 6)...)
+	// jumps over the first block to the jump over the second one
+	x := len(code)
+	code = append(code, jump(isa.Jump, 3+len(block)+1)...)
+	code = append(code, block...)
+	code = append(code, isa.Return)
+	j := len(code)
+	code = append(code, jump(isa.Jump, 3+len(block)+1)...)
+	b := len(code)
+	code = append(code, block...)
+	code = append(code, isa.Return)
+	end := len(code)
+	code = append(code, isa.Constant, 0)
+	code = append(code, jump(isa.JumpIfFalse, 6)...)
+	code = append(code, jump(isa.JumpBack, len(code)-b)...)
+	code = append(code, isa.Return)
+	got := codeFromBytes(1, code)
+	OptimizeCode(got)
+	if !bytes.Equal(got.Instrs, code) {
+		t.Logf("\nGot:\n%s\n", isa.DisassembleCode(got))
+		t.Fatalf("expected the code not to change, the jump at %d would have to go to %d", x, end)
+	}
+	if j-x > math.MaxUint16 || end-x <= math.MaxUint16 {
+		t.Fatalf("wrong test setup, jump from %d to %d should not fit", x, end)
+	}
+}
+
+func TestOptimizingKeepsLocations(t *testing.T) {
+	source := "let x = 1\nio.print (add x (mul 2 3))\n"
+	p := syntax.NewParser(strings.NewReader(source))
+	e := NewEmitter("dummy", NewInterner())
+	c, errs := e.Compile(p.Parse())
+	if len(errs) > 0 {
+		t.Fatalf("Unexpected compilation errors %v", errs)
+	}
+	OptimizeCode(c)
+	// the folded call is replaced by its result
+	// located where the call has been
+	want := map[string]byte{"mul 2 3": isa.Constant, "add x (mul 2 3)": isa.Call}
+	for _, r := range c.Locations {
+		frag := strings.TrimSpace(source[r.Beg:r.End])
+		op, ok := want[frag]
+		if !ok {
+			continue
+		}
+		delete(want, frag)
+		if r.Line != 1 {
+			t.Errorf("expected %q in line 1, got %d", frag, r.Line)
+		}
+		if got := c.Instrs[r.Start]; got != op {
+			t.Errorf("expected %q to start with %d, got %d", frag, op, got)
+		}
+	}
+	for frag := range want {
+		t.Errorf("no instructions located at %q", frag)
+	}
+}
+
+func matchOptimized(t *testing.T, table *etest) {
+	for _, test := range *table {
+		t.Run(test.source, func(t *testing.T) {
+			p := syntax.NewParser(strings.NewReader(test.source))
+			e := NewEmitter("dummy", NewInterner())
+			got, errs := e.Compile(p.Parse())
+			if len(errs) > 0 {
+				t.Fatalf("Unexpected compilation errors %v", errs)
+			}
+			OptimizeCode(got)
+			if !bytes.Equal(got.Instrs, test.expect.Instrs) {
+				t.Logf("Want:\n%s", isa.DisassembleCode(&data.Code{Instrs: test.expect.Instrs, Consts: got.Consts}))
+				t.Logf("\nGot:\n%s\n", isa.DisassembleCode(got))
+				t.FailNow()
+			}
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package codegen
+
+import (
+	"fmt"
+
+	"github.com/gala377/MLLang/data"
+	"github.com/gala377/MLLang/isa"
+	"github.com/gala377/MLLang/syntax/ast"
+	"github.com/gala377/MLLang/syntax/span"
+)
+
+var MATCH_PREFIX = "@match"
+
+// valueLoader emits code pushing the value currently being
+// matched on the stack.
+type valueLoader = func()
+
+// binder emits code storing the value on top of the stack
+// under the name bound by the pattern.
+type binder = func(*ast.BindPattern)
+
+// patternFailure is a jump taken when part of the pattern
+// does not match. Msg and load are used to report the
+// mismatch when the pattern is used for destructuring.
+type patternFailure struct {
+	jump int
+	msg  string
+	load valueLoader
+}
+
+// emitMatch compiles match expression into a chain of tests.
+// Scrutinee is stored in a hidden local so that every arm can
+// load it again. Each failed test jumps to the next arm.
+// If no arm matched the runtime error is raised.
+func (e *Emitter) emitMatch(node *ast.Match, tailpos bool) {
+	e.emitExpr(node.Scrutinee)
+	slot := fmt.Sprint(MATCH_PREFIX, e.nextCounterVal())
+	e.locate(node.Span)
+	e.emitSymbolOp(isa.DefLocal, slot, node.Span)
+	load := func() {
+		e.emitSymbolOp(isa.LoadLocal, slot, node.Span)
+	}
+	exits := []int{}
+	for _, arm := range node.Arms {
+		outer := e.scope
+		e.scope = e.scope.Derive()
+		e.locate(arm.Span)
+		fails := e.emitPatternTest(arm.Pattern, load)
+		e.emitPatternBindings(arm.Pattern, load, e.bindLocal)
+		if arm.Guard != nil {
+			e.emitExpr(arm.Guard)
+			fails = append(fails, patternFailure{jump: e.emitJumpIfFalse()})
+		}
+		e.emitBlock(arm.Body, tailpos)
+		exits = append(exits, e.emitJump())
+		for _, f := range fails {
+			e.patchJump(f.jump, e.result.Len()-f.jump)
+		}
+		e.scope = outer
+	}
+	e.locate(node.Span)
+	load()
+	e.emitMatchFail("no case arm matched the value", node.Span)
+	for _, j := range exits {
+		e.patchJump(j, e.result.Len()-j)
+	}
+	e.checkExhaustiveness(node)
+}
+
+// emitPatternTest emits code checking if the value pushed by the loader
+// matches the pattern. Returns the jumps that are taken when the match
+// fails so that the caller can patch them.
+func (e *Emitter) emitPatternTest(pat ast.Pattern, load valueLoader) []patternFailure {
+	fails := []patternFailure{}
+	fail := func(msg string) {
+		fails = append(fails, patternFailure{e.emitJumpIfFalse(), msg, load})
+	}
+	switch v := pat.(type) {
+	case *ast.WildcardPattern, *ast.BindPattern:
+		// always matches
+	case *ast.LiteralPattern:
+		load()
+		e.emitExpr(v.Val)
+		e.emitByte(isa.Equal)
+		fail(fmt.Sprintf("expected value %s", literalRepr(v.Val)))
+	case *ast.TuplePattern:
+		fails = e.emitSequencePatternTest(isa.MatchTuple, "tuple", v.Elems, load, v.Span)
+	case *ast.ListPattern:
+		fails = e.emitSequencePatternTest(isa.MatchList, "list", v.Elems, load, v.Span)
+	case *ast.RecordPattern:
+		load()
+		e.emitByte(isa.MatchRecord)
+		fail("expected a record")
+		for _, f := range v.Fields {
+			load()
+			e.emitSymbolOp(isa.HasField, f.Key, v.Span)
+			fail(fmt.Sprintf("missing record field %s", f.Key))
+			fails = append(fails, e.emitPatternTest(f.Pat, e.fieldLoader(load, f.Key, v.Span))...)
+		}
+	default:
+		e.error(pat.NodeSpan(), "Pattern cannot be emitted. Not supported")
+	}
+	return fails
+}
+
+func (e *Emitter) emitSequencePatternTest(
+	instr isa.Op, kind string, elems []ast.Pattern, load valueLoader, loc *span.Span) []patternFailure {
+	load()
+	e.emitOp(instr, len(elems))
+	msg := fmt.Sprintf("expected a %s of %d elements", kind, len(elems))
+	fails := []patternFailure{{e.emitJumpIfFalse(), msg, load}}
+	for i, elem := range elems {
+		fails = append(fails, e.emitPatternTest(elem, e.indexLoader(load, i))...)
+	}
+	return fails
+}
+
+// emitDestructuring binds names from the pattern to the parts of the
+// value pushed by the loader. If the value does not match the
+// pattern a runtime error describing the mismatch is raised.
+func (e *Emitter) emitDestructuring(pat ast.Pattern, load valueLoader, bind binder) {
+	fails := e.emitPatternTest(pat, load)
+	if len(fails) > 0 {
+		matched := e.emitJump()
+		for _, f := range fails {
+			e.patchJump(f.jump, e.result.Len()-f.jump)
+			f.load()
+			e.emitMatchFail("cannot destructure value: "+f.msg, pat.NodeSpan())
+		}
+		e.patchJump(matched, e.result.Len()-matched)
+	}
+	e.emitPatternBindings(pat, load, bind)
+}
+
+func literalRepr(lit ast.Expr) string {
+	switch v := lit.(type) {
+	case *ast.IntConst:
+		return fmt.Sprint(v.Val)
+	case *ast.FloatConst:
+		return fmt.Sprint(v.Val)
+	case *ast.BoolConst:
+		return fmt.Sprint(v.Val)
+	case *ast.StringConst:
+		return fmt.Sprintf("%q", v.Val)
+	case *ast.NoneConst:
+		return "none"
+	case *ast.Symbol:
+		return "`" + v.Val
+	}
+	return lit.String()
+}
+
+// emitPatternBindings binds every name in the pattern to the
+// corresponding part of the value. Assumes the value matches.
+func (e *Emitter) emitPatternBindings(pat ast.Pattern, load valueLoader, bind binder) {
+	switch v := pat.(type) {
+	case *ast.BindPattern:
+		load()
+		bind(v)
+	case *ast.TuplePattern:
+		for i, elem := range v.Elems {
+			e.emitPatternBindings(elem, e.indexLoader(load, i), bind)
+		}
+	case *ast.ListPattern:
+		for i, elem := range v.Elems {
+			e.emitPatternBindings(elem, e.indexLoader(load, i), bind)
+		}
+	case *ast.RecordPattern:
+		for _, f := range v.Fields {
+			e.emitPatternBindings(f.Pat, e.fieldLoader(load, f.Key, v.Span), bind)
+		}
+	}
+}
+
+func (e *Emitter) bindLocal(b *ast.BindPattern) {
+	if b.Lift {
+		e.emitByte(isa.MakeCell)
+	}
+	e.emitSymbolOp(isa.DefLocal, b.Name, b.Span)
+	e.scope.InsertBinding(b)
+}
+
+func (e *Emitter) bindGlobal(b *ast.BindPattern) {
+	if e.scope.Lookup(b.Name) != nil {
+		e.error(b.Span, fmt.Sprintf("redeclaration of name %s", b.Name))
+		return
+	}
+	e.scope.Insert(b.Name)
+	e.emitSymbolOp(isa.DefGlobal, b.Name, b.Span)
+}
+
+// emitPatternDecl compiles local destructuring declaration.
+func (e *Emitter) emitPatternDecl(node *ast.PatternDecl) {
+	if e.scope.IsGlobal() {
+		panic("ICE: trying to emit local pattern declaration in global scope")
+	}
+	for _, b := range ast.Bindings(node.Pattern) {
+		if e.scope.LookupInFunction(b.Name) != nil {
+			e.error(b.Span, fmt.Sprintf("redeclaration of local name %s", b.Name))
+			return
+		}
+	}
+	e.emitExpr(node.Rhs)
+	e.locate(node.Span)
+	slot := fmt.Sprint(MATCH_PREFIX, e.nextCounterVal())
+	e.emitSymbolOp(isa.DefLocal, slot, node.Span)
+	e.emitDestructuring(node.Pattern, func() {
+		e.emitSymbolOp(isa.LoadLocal, slot, node.Span)
+	}, e.bindLocal)
+}
+
+// emitGlobalPatternDecl compiles top level destructuring declaration.
+// The value is kept in a hidden global while being destructured.
+func (e *Emitter) emitGlobalPatternDecl(node *ast.GlobalPatternDecl) {
+	if !e.scope.IsGlobal() {
+		panic("ICE: trying to emit global pattern declaration not in global scope")
+	}
+	e.emitExpr(node.Rhs)
+	e.locate(node.Span)
+	slot := fmt.Sprint(MATCH_PREFIX, e.nextCounterVal())
+	e.emitSymbolOp(isa.DefGlobal, slot, node.Span)
+	e.emitDestructuring(node.Pattern, func() {
+		e.emitSymbolOp(isa.LoadDyn, slot, node.Span)
+	}, e.bindGlobal)
+}
+
+// emitArgsDestructuring destructures function arguments
+// declared with patterns at the beginning of the function body.
+func (e *Emitter) emitArgsDestructuring(args []*ast.FuncDeclArg) {
+	for _, arg := range args {
+		if arg.Pattern == nil {
+			continue
+		}
+		e.locate(arg.Span)
+		name := arg.Name
+		e.emitDestructuring(arg.Pattern, func() {
+			e.emitSymbolOp(isa.LoadLocal, name, arg.Span)
+		}, e.bindLocal)
+	}
+}
+
+func (e *Emitter) indexLoader(load valueLoader, i int) valueLoader {
+	return func() {
+		load()
+		e.emitOp(isa.Index, i)
+	}
+}
+
+func (e *Emitter) fieldLoader(load valueLoader, key string, loc *span.Span) valueLoader {
+	return func() {
+		load()
+		e.emitSymbolOp(isa.GetField, key, loc)
+	}
+}
+
+func (e *Emitter) emitMatchFail(msg string, loc *span.Span) {
+	e.emitOp(isa.MatchFail, e.result.AddConstant(data.NewString(msg)))
+}
+
+// checkExhaustiveness warns if every arm of the match has a literal
+// pattern or a guard. It is a heuristic, the type of the matched value
+// is not known so the literals are assumed not to cover it, unless
+// they are both true and false. Matches with structural patterns are
+// not analysed and are never warned about.
+func (e *Emitter) checkExhaustiveness(node *ast.Match) {
+	bools := map[bool]bool{}
+	for _, arm := range node.Arms {
+		if arm.Guard != nil {
+			continue
+		}
+		switch v := arm.Pattern.(type) {
+		case *ast.WildcardPattern, *ast.BindPattern:
+			return
+		case *ast.LiteralPattern:
+			if b, ok := v.Val.(*ast.BoolConst); ok {
+				bools[b.Val] = true
+			}
+		default:
+			return
+		}
+	}
+	if bools[true] && bools[false] {
+		return
+	}
+	e.warn(node.Span, "match might not be exhaustive, its literal patterns are assumed not to cover every value. Consider adding \"case _\" arm")
+}
+
+func (e *Emitter) emitSymbolOp(instr isa.Op, name string, loc *span.Span) {
+	e.emitOp(instr, e.addSymbol(name))
+}
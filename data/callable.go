@@ -54,6 +54,13 @@ type (
 		Ip      int
 		Env     *Env
 		Stack   []Value
+		// Environment of the function with the handle.
+		// Its cells are not copied when cloning.
+		Outer *Env
+		// Effect that has captured the continuation.
+		Effect  Type
+		resumed bool
+		dropped bool
 	}
 )
 
@@ -230,13 +237,14 @@ func (f *Closure) Equal(o Value) bool {
 	return false
 }
 
-func NewContinuation(stack []Value, handler *Handler, ip int, code *Code, env *Env) *Continuation {
+func NewContinuation(stack []Value, handler *Handler, ip int, code *Code, env, outer *Env) *Continuation {
 	return &Continuation{
 		Stack:   stack,
 		Handler: handler,
 		Code:    code,
 		Ip:      ip,
 		Env:     env,
+		Outer:   outer,
 	}
 }
 
@@ -245,8 +253,19 @@ func (c *Continuation) Arity() int {
 }
 
 func (c *Continuation) Call(_ VmProxy, vv ...Value) (Value, Trampoline) {
-	// return arg and stored stack
-	ret := NewTuple([]Value{vv[0], NewList(c.Stack)})
+	// The captured frames share their local variables
+	// with the resumed computation so resuming again
+	// would observe its assignments.
+	if c.resumed {
+		return NewString("continuation has already been resumed, use cont.clone to resume it more than once"), ErrorTramp
+	}
+	if c.dropped {
+		return NewString("continuation has been dropped and cannot be resumed"), ErrorTramp
+	}
+	c.resumed = true
+	// return arg and stored stack, the continuation
+	// itself is there for debugging
+	ret := NewTuple([]Value{vv[0], NewList(c.Stack), c})
 	return ret, Trampoline{
 		Kind: RestoreContinuation,
 		Ip:   c.Ip,
@@ -266,6 +285,156 @@ func (c *Continuation) String() string {
 	return "<captured continuation>"
 }
 
+// Resumed returns true if the continuation has been resumed.
+func (c *Continuation) Resumed() bool {
+	return c.resumed
+}
+
+// Dropped returns true if the continuation has been dropped.
+func (c *Continuation) Dropped() bool {
+	return c.dropped
+}
+
+// Drop marks the continuation as never to be resumed and returns
+// the finalizers of the handles it has captured that still have to
+// be run, the innermost ones first. The handles are marked as
+// finalized so their finalizers are returned only once.
+func (c *Continuation) Drop() []Callable {
+	c.dropped = true
+	var fins []Callable
+	for i := len(c.Stack) - 1; i >= 0; i-- {
+		if h, ok := c.Stack[i].(*Handler); ok {
+			if fin := h.Finalize(); fin != nil {
+				fins = append(fins, fin)
+			}
+		}
+	}
+	return fins
+}
+
+// Clone returns a continuation that can be resumed
+// independently of this one. Local variables of the
+// captured frames are copied, values on the heap like
+// lists and records are shared. The continuation has
+// to be cloned before it is resumed.
+func (c *Continuation) Clone() *Continuation {
+	cl := cloner{
+		cells:    map[*Cell]*Cell{},
+		envs:     map[*Env]*Env{},
+		closures: map[*Closure]*Closure{},
+		handlers: map[*Handler]*Handler{},
+	}
+	if c.Outer != nil {
+		// cells of the function with the handle are not
+		// a part of the continuation, they stay shared.
+		for _, v := range c.Outer.Vals {
+			if cell, ok := v.(*Cell); ok {
+				cl.cells[cell] = cell
+			}
+		}
+	}
+	stack := make([]Value, len(c.Stack))
+	for i, v := range c.Stack {
+		stack[i] = cl.value(v)
+	}
+	return &Continuation{
+		Stack:   stack,
+		Handler: c.Handler,
+		Code:    c.Code,
+		Ip:      c.Ip,
+		Env:     cl.env(c.Env),
+		Outer:   c.Outer,
+		Effect:  c.Effect,
+	}
+}
+
+// cloner copies the values holding local variables
+// preserving sharing between them.
+type cloner struct {
+	cells    map[*Cell]*Cell
+	envs     map[*Env]*Env
+	closures map[*Closure]*Closure
+	handlers map[*Handler]*Handler
+}
+
+func (cl *cloner) value(v Value) Value {
+	switch v := v.(type) {
+	case *Cell:
+		return cl.cell(v)
+	case *Env:
+		return cl.env(v)
+	case *Closure:
+		return cl.closure(v)
+	case *Handler:
+		return cl.handler(v)
+	}
+	return v
+}
+
+func (cl *cloner) cell(c *Cell) *Cell {
+	if res, ok := cl.cells[c]; ok {
+		return res
+	}
+	res := NewCell(nil)
+	cl.cells[c] = res
+	res.Val = cl.value(c.Val)
+	return res
+}
+
+func (cl *cloner) env(e *Env) *Env {
+	if e == nil {
+		return nil
+	}
+	if res, ok := cl.envs[e]; ok {
+		return res
+	}
+	res := NewEnv()
+	cl.envs[e] = res
+	e.lock.RLock()
+	vals := make(map[Symbol]Value, len(e.Vals))
+	for k, v := range e.Vals {
+		vals[k] = v
+	}
+	e.lock.RUnlock()
+	for k, v := range vals {
+		res.Vals[k] = cl.value(v)
+	}
+	return res
+}
+
+func (cl *cloner) closure(f *Closure) *Closure {
+	if res, ok := cl.closures[f]; ok {
+		return res
+	}
+	res := NewLambda(f.Name, nil, f.Args, f.Body)
+	cl.closures[f] = res
+	res.Env = cl.env(f.Env)
+	return res
+}
+
+func (cl *cloner) handler(h *Handler) *Handler {
+	if res, ok := cl.handlers[h]; ok {
+		return res
+	}
+	res := NewHandler(map[Type]Callable{})
+	res.Code, res.Ip, res.Env = h.Code, h.Ip, cl.env(h.Env)
+	res.finalized = h.finalized
+	cl.handlers[h] = res
+	if f, ok := h.Return.(*Closure); ok {
+		res.Return = cl.closure(f)
+	}
+	if f, ok := h.Finally.(*Closure); ok {
+		res.Finally = cl.closure(f)
+	}
+	for typ, clause := range h.Clauses {
+		if f, ok := clause.(*Closure); ok {
+			clause = cl.closure(f)
+		}
+		res.Clauses[typ] = clause
+	}
+	return res
+}
+
 var ReturnTramp = Trampoline{Kind: Returned}
 var ErrorTramp = Trampoline{Kind: Error}
 var EffectTramp = Trampoline{Kind: Effect}
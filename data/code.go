@@ -1,30 +1,114 @@
 package data
 
+import (
+	"math"
+	"sort"
+)
+
 type Code struct {
 	Instrs []byte
 	Consts []Value
-	// todo: change Lines to something like runing sum encoding or so.
-	Lines []int
-	Path  string
+	// Source locations of the instructions. Consecutive bytes
+	// emitted for the same location share a single run.
+	Locations []LocationRun
+	Path      string
+	// Global environment of the module the code has been loaded from.
+	// Nil for the main program which uses the vm's globals.
+	Globals *Env
+	// indexes of the deduplicated constants
+	constIndex map[interface{}]int
+}
+
+// Location is a fragment of the source code
+// an instruction has been emitted for.
+type Location struct {
+	// Line and column of the fragment's beginning
+	// as reported by the parser.
+	Line   int
+	Column int
+	// Byte offsets of the fragment within the source.
+	Beg int
+	End int
+}
+
+// LocationRun marks that the instructions starting from
+// the Start offset have been emitted for the location.
+// The run lasts until the start of the next one.
+type LocationRun struct {
+	Start int
+	Location
 }
 
 func NewCode() Code {
 	c := Code{
-		Instrs: make([]byte, 0),
-		Consts: make([]Value, 0),
-		Lines:  make([]int, 0),
+		Instrs:    make([]byte, 0),
+		Consts:    make([]Value, 0),
+		Locations: make([]LocationRun, 0),
 	}
 	return c
 }
 
+// AddConstant returns the index of the value in the constant pool.
+// Numbers, booleans, strings and symbols equal to the ones already
+// in the pool are not added again.
 func (c *Code) AddConstant(v Value) int {
+	key, dedup := constKey(v)
+	if !dedup {
+		c.Consts = append(c.Consts, v)
+		return len(c.Consts) - 1
+	}
+	if c.constIndex == nil {
+		c.constIndex = make(map[interface{}]int)
+		for i, v := range c.Consts {
+			if k, ok := constKey(v); ok {
+				c.constIndex[k] = i
+			}
+		}
+	}
+	if i, ok := c.constIndex[key]; ok {
+		return i
+	}
 	c.Consts = append(c.Consts, v)
+	c.constIndex[key] = len(c.Consts) - 1
 	return len(c.Consts) - 1
 }
 
-func (c *Code) WriteByte(b byte, line int) {
+// floatBits keys floats by their representation
+// so that 0.0 and -0.0 are kept apart.
+type floatBits uint64
+
+func constKey(v Value) (interface{}, bool) {
+	switch c := v.(type) {
+	case Int, Bool, String, Symbol:
+		return c, true
+	case Float:
+		return floatBits(math.Float64bits(c.Val)), true
+	}
+	return nil, false
+}
+
+func (c *Code) WriteByte(b byte, loc Location) {
+	if n := len(c.Locations); n == 0 || c.Locations[n-1].Location != loc {
+		c.Locations = append(c.Locations, LocationRun{Start: len(c.Instrs), Location: loc})
+	}
 	c.Instrs = append(c.Instrs, b)
-	c.Lines = append(c.Lines, line)
+}
+
+// Location returns the location of the instruction at the offset.
+// Offsets past the code return the location of the last instruction.
+func (c *Code) Location(offset int) Location {
+	i := sort.Search(len(c.Locations), func(i int) bool {
+		return c.Locations[i].Start > offset
+	})
+	if i == 0 {
+		return Location{}
+	}
+	return c.Locations[i-1].Location
+}
+
+// Line returns the line of the instruction at the offset.
+func (c *Code) Line(offset int) int {
+	return c.Location(offset).Line
 }
 
 func (c *Code) ReadByte(offset int) byte {
@@ -35,10 +119,21 @@ func (c *Code) GetConstant(i byte) Value {
 	return c.Consts[i]
 }
 
-func (c *Code) GetConstant2(i uint16) Value {
+func (c *Code) GetConstant2(i int) Value {
 	return c.Consts[i]
 }
 
+// SetGlobals sets the global environment for the code
+// and every function defined within it.
+func (c *Code) SetGlobals(env *Env) {
+	c.Globals = env
+	for _, v := range c.Consts {
+		if f, ok := v.(*Closure); ok {
+			f.Body.SetGlobals(env)
+		}
+	}
+}
+
 func (c *Code) Len() int {
 	return len(c.Instrs)
 }
@@ -13,6 +13,28 @@ type (
 		// Maps effect types to handlers
 		// Handlers have to be functions accepting either one or 2 arguments
 		Clauses map[Type]Callable
+		// Function applied to the value returned by
+		// the handled block, nil if it does not have one.
+		Return Callable
+		// Nullary function run when the control leaves
+		// the handle, nil if it does not have one.
+		Finally Callable
+		// Code and the instruction pointer past the instruction
+		// that has installed the handler, for debugging.
+		Code *Code
+		Ip   int
+		// Environment of the function with the handle, used to
+		// find its frame when the body breaks out of a loop.
+		Env *Env
+		// set once the finalizer has been taken to be run
+		finalized bool
+	}
+
+	// LoopSignal is left at the site of a handle when its body
+	// breaks or continues the loop the handle is in. Only the vm
+	// creates it so it never mixes with the values of the program.
+	LoopSignal struct {
+		Continue bool
 	}
 )
 
@@ -24,7 +46,7 @@ func NewType(name Symbol) Type {
 }
 
 func NewHandler(clauses map[Type]Callable) *Handler {
-	return &Handler{clauses}
+	return &Handler{Clauses: clauses}
 }
 
 func (e Type) String() string {
@@ -58,6 +80,28 @@ func (e *Handler) Equal(o Value) bool {
 	return false
 }
 
+// Finalize returns the finalizer of the handler and marks the handler
+// as finalized. Returns nil if the handler does not have a finalizer or
+// it has already been returned, so that it is never run twice.
+func (e *Handler) Finalize() Callable {
+	if e.finalized {
+		return nil
+	}
+	e.finalized = true
+	return e.Finally
+}
+
+func (s *LoopSignal) String() string {
+	if s.Continue {
+		return "<continue>"
+	}
+	return "<break>"
+}
+
+func (s *LoopSignal) Equal(o Value) bool {
+	return s == o
+}
+
 func HandlerCapturesContinuation(h Callable) bool {
 	return h.Arity() == 2
 }
@@ -89,6 +89,11 @@ func (r *Record) Append(v Value) error {
 	return nil
 }
 
+// Keys returns the record's keys in the order they were added.
+func (r *Record) Keys() []Symbol {
+	return append([]Symbol{}, r.keys...)
+}
+
 func (r *Record) Len() int {
 	return len(r.keys)
 }
@@ -12,11 +12,13 @@ import (
 var instNames = [...]string{
 	Return:         "Return",
 	Constant:       "Constant",
+	Constant2:      "Constant2",
 	Call:           "Call",
 	Call0:          "Call0",
 	Call1:          "Call1",
 	TailCall0:      "TailCall0",
 	TailCall1:      "TailCall1",
+	TailCall:       "TailCall",
 	Jump:           "Jump",
 	JumpBack:       "JumbpBack",
 	JumpIfFalse:    "JumpIfFalse",
@@ -41,10 +43,27 @@ var instNames = [...]string{
 	InstallHandler: "InstallHandler",
 	PerformEffect:  "PerformEffect",
 	PopHandler:     "PopHandler",
+	SetReturn:      "SetReturn",
+	SetFinally:     "SetFinally",
+	Finalize:       "Finalize",
+	LoopSignal:     "LoopSignal",
+	IsLoopSignal:   "IsLoopSignal",
 	Resume:         "Resume",
 	TailResume0:    "TailResume0",
 	TailResume1:    "TailResume1",
 	Rotate:         "Rotate",
+	Equal:          "Equal",
+	MatchTuple:     "MatchTuple",
+	MatchList:      "MatchList",
+	MatchRecord:    "MatchRecord",
+	HasField:       "HasField",
+	Index:          "Index",
+	MatchFail:      "MatchFail",
+	Fail:           "Fail",
+	IsSequence:     "IsSequence",
+	IterNext:       "IterNext",
+	Import:         "Import",
+	Wide:           "Wide",
 }
 
 const opCount = len(instNames)
@@ -58,6 +77,7 @@ var instArguments = [opCount]int{
 	TailCall0:      0,
 	Call1:          0,
 	TailCall1:      0,
+	TailCall:       1,
 	Jump:           2,
 	JumpBack:       2,
 	JumpIfFalse:    2,
@@ -81,10 +101,33 @@ var instArguments = [opCount]int{
 	InstallHandler: 2,
 	PerformEffect:  0,
 	PopHandler:     0,
+	SetReturn:      0,
+	SetFinally:     0,
+	Finalize:       0,
+	LoopSignal:     1,
+	IsLoopSignal:   1,
 	Rotate:         0,
 	Resume:         0,
 	TailResume0:    0,
 	TailResume1:    0,
+	Equal:          0,
+	MatchTuple:     2,
+	MatchList:      2,
+	MatchRecord:    0,
+	HasField:       2,
+	Index:          2,
+	MatchFail:      2,
+	Fail:           2,
+	IsSequence:     0,
+	IterNext:       2,
+	Import:         2,
+	Wide:           0,
+}
+
+// ArgCount returns the number of bytes of the
+// arguments following the instruction's opcode.
+func ArgCount(op Op) int {
+	return instArguments[op]
 }
 
 type additionalInfoFunc = func(*data.Code, []byte) string
@@ -110,6 +153,14 @@ var instSpecificInfos = [opCount]additionalInfoFunc{
 	GetField:       writeConstantWide,
 	SetField:       writeConstantWide,
 	InstallHandler: writeUint16,
+	MatchTuple:     writeUint16,
+	MatchList:      writeUint16,
+	HasField:       writeConstantWide,
+	Index:          writeUint16,
+	MatchFail:      writeConstantWide,
+	Fail:           writeConstantWide,
+	IterNext:       writeUint16,
+	Import:         writeConstantWide,
 }
 
 func PrintCode(code *data.Code, name string) {
@@ -121,7 +172,7 @@ func DisassembleCode(code *data.Code) string {
 	line := -1
 	for i := 0; i < len(code.Instrs); {
 		di, o := DisassembleInstr(code, i, line)
-		line = code.Lines[i]
+		line = code.Line(i)
 		i += o
 		c.WriteString(di)
 		c.WriteRune('\n')
@@ -133,23 +184,31 @@ func DisassembleInstr(code *data.Code, offset int, lline int) (string, int) {
 	var b strings.Builder
 	op := code.Instrs[offset]
 	line := "    |"
-	if lline != code.Lines[offset] {
-		line = fmt.Sprintf("%5d", code.Lines[offset])
+	if lline != code.Line(offset) {
+		line = fmt.Sprintf("%5d", code.Line(offset))
 	}
-	b.WriteString(fmt.Sprintf("%04d %s %s", offset, line, instNames[op]))
+	name := instNames[op]
+	start := offset + 1
 	args := instArguments[op]
+	if op == Wide {
+		op = code.Instrs[start]
+		name = fmt.Sprintf("%s %s", name, instNames[op])
+		start++
+		args = 2 * instArguments[op]
+	}
+	b.WriteString(fmt.Sprintf("%04d %s %s", offset, line, name))
 	if args > 0 {
 		aa := make([]string, 0, args)
-		for i := 1; i <= int(args); i++ {
-			a := code.Instrs[offset+i]
+		for i := 0; i < args; i++ {
+			a := code.Instrs[start+i]
 			aa = append(aa, strconv.Itoa(int(a)))
 		}
 		b.WriteString(fmt.Sprintf("(%s)", strings.Join(aa, ",")))
 		if s := instSpecificInfos[op]; s != nil {
-			b.WriteString(s(code, code.Instrs[offset+1:offset+args+1]))
+			b.WriteString(s(code, code.Instrs[start:start+args]))
 		}
 	}
-	return b.String(), 1 + args
+	return b.String(), start - offset + args
 }
 
 func writeConstant(code *data.Code, args []byte) string {
@@ -157,11 +216,18 @@ func writeConstant(code *data.Code, args []byte) string {
 }
 
 func writeConstantWide(code *data.Code, args []byte) string {
-	i := binary.BigEndian.Uint16(args)
-	return fmt.Sprintf("%16s", code.Consts[i])
+	return fmt.Sprintf("%16s", code.Consts[readArg(args)])
 }
 
 func writeUint16(code *data.Code, args []byte) string {
-	o := binary.BigEndian.Uint16(args)
-	return fmt.Sprintf("%16d", o)
+	return fmt.Sprintf("%16d", readArg(args))
+}
+
+// readArg reads the argument which is 4 bytes
+// long if its instruction has been widened.
+func readArg(args []byte) int {
+	if len(args) == 4 {
+		return int(binary.BigEndian.Uint32(args))
+	}
+	return int(binary.BigEndian.Uint16(args))
 }
@@ -10,7 +10,10 @@ func TestDisassembling(t *testing.T) {
 	want := "0000     1 Return\n0001     2 Return\n"
 	c := &data.Code{
 		Instrs: []byte{Return, Return},
-		Lines:  []int{1, 2},
+		Locations: []data.LocationRun{
+			{Start: 0, Location: data.Location{Line: 1}},
+			{Start: 1, Location: data.Location{Line: 2}},
+		},
 	}
 	got := DisassembleCode(c)
 	if want != got {
@@ -23,7 +26,23 @@ func TestDisassemblingArgs(t *testing.T) {
 	c := &data.Code{
 		Instrs: []byte{Constant, 0, Return},
 		Consts: []data.Value{data.NewInt(123)},
-		Lines:  []int{1, 1, 1},
+		Locations: []data.LocationRun{
+			{Start: 0, Location: data.Location{Line: 1}},
+		},
+	}
+	got := DisassembleCode(c)
+	if want != got {
+		t.Errorf("Wrong disassembling.\nWant:\n%s\nGot:\n%s", want, got)
+	}
+}
+
+func TestDisassemblingWideArgs(t *testing.T) {
+	want := "0000     1 Wide MakeList(0,1,0,0)           65536\n0006     | Return\n"
+	c := &data.Code{
+		Instrs: []byte{Wide, MakeList, 0, 1, 0, 0, Return},
+		Locations: []data.LocationRun{
+			{Start: 0, Location: data.Location{Line: 1}},
+		},
 	}
 	got := DisassembleCode(c)
 	if want != got {
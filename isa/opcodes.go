@@ -8,7 +8,9 @@ const (
 	Constant2
 	// Calls function with n arguments
 	// where n is this instructions argument.
-	// Pops n+1 values from the stack and pushes 1
+	// Pops n+1 values from the stack and pushes 1.
+	// Arguments the function does not take are
+	// applied to its result.
 	Call
 	// Specialised call. Has no arguments.
 	// Calls function on top of the stack with no arguments.
@@ -18,6 +20,8 @@ const (
 	Call1
 	TailCall0
 	TailCall1
+	// Call with n arguments reusing the caller's frame.
+	TailCall
 	Jump
 	JumpIfFalse
 	JumpBack
@@ -49,8 +53,26 @@ const (
 	InstallHandler
 	// Pops two values from the stack.
 	// Expects second one to be an effect handler.
-	// Then pushes the first value again on the stack
+	// Then pushes the first value again on the stack,
+	// applying the handler's return clause to it if it has one.
 	PopHandler
+	// Pops a function and sets it as the return clause
+	// of the handler on top of the stack.
+	SetReturn
+	// Pops a function and sets it as the finalizer
+	// of the handler on top of the stack.
+	SetFinally
+	// Pops a handler and pushes its finalizer, or a function
+	// doing nothing if it has already been finalized.
+	Finalize
+	// Unwinds the stack from the body of a handle to the handle's
+	// site and pushes the loop signal given as the argument there,
+	// BreakSignal or ContinueSignal. The handler stays on the stack
+	// if the body has not been resumed.
+	LoopSignal
+	// Pops a value and pushes a boolean telling if it is
+	// the loop signal given as the argument.
+	IsLoopSignal
 	PerformEffect
 	// Inspects a continuation on top of the stack
 	// and installs the handler that the continuation
@@ -60,4 +82,44 @@ const (
 	// Pops previous stack frame before calling a continuation.
 	TailResume0
 	TailResume1
+	// Pops two values from the stack and pushes
+	// a boolean telling if they are equal.
+	Equal
+	// Pops a value and pushes a boolean telling if it is
+	// a tuple of the length given as the argument.
+	MatchTuple
+	// Same as MatchTuple but checks for a list.
+	MatchList
+	// Pops a value and pushes a boolean telling if it is a record.
+	MatchRecord
+	// Pops a value and pushes a boolean telling if it is a record
+	// with the field named by the constant given as the argument.
+	HasField
+	// Pops a sequence and pushes its element at
+	// the index given as the argument.
+	Index
+	// Pops a value and raises a runtime error with the message
+	// taken from the constant given as the argument.
+	MatchFail
+	// Raises a runtime error with the message taken
+	// from the constant given as the argument.
+	Fail
+	// Pops a value and pushes a boolean telling if it is a sequence.
+	IsSequence
+	// Pops an index and a sequence. If the index is in bounds
+	// pushes the element at the index and the next index.
+	// Otherwise jumps forward by the offset given as the argument.
+	IterNext
+	// Evaluates the module at the path taken from the constant given
+	// as the argument and pushes its exported record.
+	Import
+	// Prefix making the 2 byte argument of the next
+	// instruction 4 bytes long. Jumps cannot be widened.
+	Wide
+)
+
+// Arguments of LoopSignal and IsLoopSignal.
+const (
+	BreakSignal byte = iota
+	ContinueSignal
 )
@@ -25,7 +25,7 @@ func AstEqual(n1 Node, n2 Node) bool {
 
 func (g *GlobalValDecl) Equal(o Node) bool {
 	if og, ok := o.(*GlobalValDecl); ok {
-		if og.Name != g.Name {
+		if og.Name != g.Name || !schemesEqual(g.Type, og.Type) {
 			return false
 		}
 		return AstEqual(g.Rhs, og.Rhs)
@@ -35,14 +35,14 @@ func (g *GlobalValDecl) Equal(o Node) bool {
 
 func (f *FuncDecl) Equal(o Node) bool {
 	if of, ok := o.(*FuncDecl); ok {
-		if f.Name != of.Name {
+		if f.Name != of.Name || !schemesEqual(f.Type, of.Type) || !effectSetsEqual(f.Effects, of.Effects) {
 			return false
 		}
 		if len(f.Args) != len(of.Args) {
 			return false
 		}
 		for i, arg := range f.Args {
-			if arg.Name != of.Args[i].Name {
+			if !arg.equal(of.Args[i]) {
 				return false
 			}
 		}
@@ -51,9 +51,75 @@ func (f *FuncDecl) Equal(o Node) bool {
 	return false
 }
 
+// Generated names of destructured arguments are not compared.
+func (a *FuncDeclArg) equal(o *FuncDeclArg) bool {
+	if a.Pattern != nil || o.Pattern != nil {
+		return AstEqual(a.Pattern, o.Pattern)
+	}
+	return a.Name == o.Name
+}
+
+func (op *OperatorDecl) Equal(o Node) bool {
+	if oo, ok := o.(*OperatorDecl); ok {
+		return op.Name == oo.Name && op.Fixity == oo.Fixity && AstEqual(op.Rhs, oo.Rhs)
+	}
+	return false
+}
+
+func (m *MacroDecl) Equal(o Node) bool {
+	if om, ok := o.(*MacroDecl); ok {
+		if m.Name != om.Name || len(m.Args) != len(om.Args) {
+			return false
+		}
+		for i, arg := range m.Args {
+			if !arg.equal(om.Args[i]) {
+				return false
+			}
+		}
+		return AstEqual(m.Body, om.Body)
+	}
+	return false
+}
+
+func (i *ImportDecl) Equal(o Node) bool {
+	if oi, ok := o.(*ImportDecl); ok {
+		return i.Path == oi.Path && i.Name == oi.Name
+	}
+	return false
+}
+
+func (f *FromImportDecl) Equal(o Node) bool {
+	if of, ok := o.(*FromImportDecl); ok {
+		if f.Path != of.Path || len(f.Names) != len(of.Names) {
+			return false
+		}
+		for i, n := range f.Names {
+			if n.Name != of.Names[i].Name {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (g *GlobalPatternDecl) Equal(o Node) bool {
+	if og, ok := o.(*GlobalPatternDecl); ok {
+		return AstEqual(g.Pattern, og.Pattern) && AstEqual(g.Rhs, og.Rhs)
+	}
+	return false
+}
+
+func (p *PatternDecl) Equal(o Node) bool {
+	if op, ok := o.(*PatternDecl); ok {
+		return AstEqual(p.Pattern, op.Pattern) && AstEqual(p.Rhs, op.Rhs)
+	}
+	return false
+}
+
 func (v *ValDecl) Equal(o Node) bool {
 	if ov, ok := o.(*ValDecl); ok {
-		if ov.Name != v.Name {
+		if ov.Name != v.Name || !schemesEqual(v.Type, ov.Type) || !effectSetsEqual(v.Effects, ov.Effects) {
 			return false
 		}
 		return AstEqual(v.Rhs, ov.Rhs)
@@ -61,6 +127,16 @@ func (v *ValDecl) Equal(o Node) bool {
 	return false
 }
 
+func (b *Break) Equal(o Node) bool {
+	_, ok := o.(*Break)
+	return ok
+}
+
+func (c *Continue) Equal(o Node) bool {
+	_, ok := o.(*Continue)
+	return ok
+}
+
 func (s *StmtExpr) Equal(o Node) bool {
 	if os, ok := o.(*StmtExpr); ok {
 		return AstEqual(s.Expr, os.Expr)
@@ -134,7 +210,7 @@ func (l *ListConst) Equal(o Node) bool {
 			return false
 		}
 		for i, v := range l.Vals {
-			if !AstEqual(v, l.Vals[i]) {
+			if !AstEqual(v, ol.Vals[i]) {
 				return false
 			}
 		}
@@ -149,7 +225,7 @@ func (t *TupleConst) Equal(o Node) bool {
 			return false
 		}
 		for i, v := range t.Vals {
-			if !AstEqual(v, t.Vals[i]) {
+			if !AstEqual(v, ot.Vals[i]) {
 				return false
 			}
 		}
@@ -165,7 +241,7 @@ func (r *RecordConst) Equal(o Node) bool {
 		}
 		for i, field := range r.Fields {
 			of := or.Fields[i]
-			if field.Key == of.Key && !AstEqual(field.Val, of.Val) {
+			if field.Key != of.Key || !AstEqual(field.Val, of.Val) {
 				return false
 			}
 		}
@@ -183,7 +259,16 @@ func (i *IfExpr) Equal(o Node) bool {
 
 func (w *WhileStmt) Equal(o Node) bool {
 	if ow, ok := o.(*WhileStmt); ok {
-		return AstEqual(w.Cond, ow.Cond) && AstEqual(w.Body, w.Body)
+		return AstEqual(w.Cond, ow.Cond) && AstEqual(w.Body, ow.Body)
+	}
+	return false
+}
+
+func (f *ForStmt) Equal(o Node) bool {
+	if of, ok := o.(*ForStmt); ok {
+		return AstEqual(f.Pattern, of.Pattern) &&
+			AstEqual(f.Iterable, of.Iterable) &&
+			AstEqual(f.Body, of.Body)
 	}
 	return false
 }
@@ -210,11 +295,11 @@ func (i *Identifier) Equal(o Node) bool {
 
 func (l *LambdaExpr) Equal(o Node) bool {
 	if ol, ok := o.(*LambdaExpr); ok {
-		if len(l.Args) != len(ol.Args) {
+		if l.Name != ol.Name || len(l.Args) != len(ol.Args) {
 			return false
 		}
 		for i, arg := range l.Args {
-			if arg.Name != ol.Args[i].Name {
+			if !arg.equal(ol.Args[i]) {
 				return false
 			}
 		}
@@ -258,6 +343,27 @@ func (a *Symbol) Equal(o Node) bool {
 	return false
 }
 
+func (q *QuasiQuote) Equal(o Node) bool {
+	if oq, ok := o.(*QuasiQuote); ok {
+		return AstEqual(q.Node, oq.Node)
+	}
+	return false
+}
+
+func (u *Unquote) Equal(o Node) bool {
+	if ou, ok := o.(*Unquote); ok {
+		return AstEqual(u.Expr, ou.Expr)
+	}
+	return false
+}
+
+func (r *Return) Equal(o Node) bool {
+	if or, ok := o.(*Return); ok {
+		return AstEqual(r.Val, or.Val)
+	}
+	return false
+}
+
 func (h *Handle) Equal(o Node) bool {
 	if oh, ok := o.(*Handle); ok {
 		if !AstEqual(h.Body, oh.Body) {
@@ -298,6 +404,24 @@ func (h *Handle) Equal(o Node) bool {
 				return false
 			}
 		}
+		if (h.Return == nil) != (oh.Return == nil) {
+			log.Print("Return clauses differ")
+			return false
+		}
+		if h.Return != nil {
+			if h.Return.Arg.Name != oh.Return.Arg.Name || !AstEqual(h.Return.Body, oh.Return.Body) {
+				log.Print("Return clauses differ")
+				return false
+			}
+		}
+		if (h.Finally == nil) != (oh.Finally == nil) {
+			log.Print("Finally clauses differ")
+			return false
+		}
+		if h.Finally != nil && !AstEqual(h.Finally, oh.Finally) {
+			log.Print("Finally clauses differ")
+			return false
+		}
 		return true
 	}
 	return false
@@ -329,3 +453,94 @@ func (r *Resume) Equal(o Node) bool {
 	}
 	return false
 }
+
+func (m *Match) Equal(o Node) bool {
+	if om, ok := o.(*Match); ok {
+		if !AstEqual(m.Scrutinee, om.Scrutinee) {
+			return false
+		}
+		if len(m.Arms) != len(om.Arms) {
+			return false
+		}
+		for i, arm := range m.Arms {
+			oarm := om.Arms[i]
+			if !AstEqual(arm.Pattern, oarm.Pattern) {
+				log.Print("Patterns differ")
+				return false
+			}
+			if (arm.Guard == nil) != (oarm.Guard == nil) {
+				return false
+			}
+			if arm.Guard != nil && !AstEqual(arm.Guard, oarm.Guard) {
+				return false
+			}
+			if !AstEqual(arm.Body, oarm.Body) {
+				log.Print("Bodies differ")
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (w *WildcardPattern) Equal(o Node) bool {
+	_, ok := o.(*WildcardPattern)
+	return ok
+}
+
+func (b *BindPattern) Equal(o Node) bool {
+	if ob, ok := o.(*BindPattern); ok {
+		return b.Name == ob.Name
+	}
+	return false
+}
+
+func (l *LiteralPattern) Equal(o Node) bool {
+	if ol, ok := o.(*LiteralPattern); ok {
+		return AstEqual(l.Val, ol.Val)
+	}
+	return false
+}
+
+func (t *TuplePattern) Equal(o Node) bool {
+	if ot, ok := o.(*TuplePattern); ok {
+		return patternsEqual(t.Elems, ot.Elems)
+	}
+	return false
+}
+
+func (l *ListPattern) Equal(o Node) bool {
+	if ol, ok := o.(*ListPattern); ok {
+		return patternsEqual(l.Elems, ol.Elems)
+	}
+	return false
+}
+
+func (r *RecordPattern) Equal(o Node) bool {
+	if or, ok := o.(*RecordPattern); ok {
+		if len(r.Fields) != len(or.Fields) {
+			return false
+		}
+		for i, f := range r.Fields {
+			of := or.Fields[i]
+			if f.Key != of.Key || !AstEqual(f.Pat, of.Pat) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func patternsEqual(pp1, pp2 []Pattern) bool {
+	if len(pp1) != len(pp2) {
+		return false
+	}
+	for i, p := range pp1 {
+		if !AstEqual(p, pp2[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -34,10 +34,17 @@ type (
 		Values() []Expr
 	}
 
+	Pattern interface {
+		Node
+		patternNode()
+	}
+
 	GlobalValDecl struct {
 		*span.Span
 		Name string
 		Rhs  Expr
+		// optional, can be nil
+		Type *TypeScheme
 	}
 
 	ValDecl struct {
@@ -45,6 +52,47 @@ type (
 		Name string
 		Rhs  Expr
 		Lift bool
+		// optional, can be nil
+		Type *TypeScheme
+		// optional, only set for local functions
+		Effects *EffectSet
+	}
+
+	Break struct {
+		*span.Span
+	}
+
+	Continue struct {
+		*span.Span
+	}
+
+	// Destructuring declaration at the top level, like
+	// "let (a, b) = pair". Every bound name becomes a global.
+	GlobalPatternDecl struct {
+		*span.Span
+		Pattern Pattern
+		Rhs     Expr
+	}
+
+	// Local destructuring declaration.
+	PatternDecl struct {
+		*span.Span
+		Pattern Pattern
+		Rhs     Expr
+	}
+
+	// import "path" as Name
+	ImportDecl struct {
+		*span.Span
+		Path string
+		Name string
+	}
+
+	// from "path" import a, b
+	FromImportDecl struct {
+		*span.Span
+		Path  string
+		Names []*Identifier
 	}
 
 	EffectDecl struct {
@@ -52,6 +100,24 @@ type (
 		Name string
 	}
 
+	// "macro name args: body" declaration. Macros are run during
+	// the compilation on the nodes they are applied to.
+	MacroDecl struct {
+		*span.Span
+		Name string
+		Args []*FuncDeclArg
+		Body Expr
+	}
+
+	// "infixl prec op = rhs" declaration. Binds the operator
+	// to the value of rhs and sets its precedence.
+	OperatorDecl struct {
+		*span.Span
+		Name   string
+		Fixity Fixity
+		Rhs    Expr
+	}
+
 	LocalEffect struct {
 		*span.Span
 		Name string
@@ -66,12 +132,18 @@ type (
 		Name string
 		Args []*FuncDeclArg
 		Body Expr
+		// optional, can be nil
+		Type    *TypeScheme
+		Effects *EffectSet
 	}
 
 	FuncDeclArg struct {
 		*span.Span
 		Name string
 		Lift bool
+		// optional, can be nil. If set the argument is
+		// destructured and Name is a generated hidden name.
+		Pattern Pattern
 	}
 
 	Block struct {
@@ -137,6 +209,16 @@ type (
 		Body *Block
 	}
 
+	// "for pattern in iterable:" loop. Iterates over sequences
+	// by index and over iterators by handling their iter.Yield
+	// effects.
+	ForStmt struct {
+		*span.Span
+		Pattern  Pattern
+		Iterable Expr
+		Body     *Block
+	}
+
 	LetExpr struct {
 		*span.Span
 		Decls Expr // Expected to be something that evaluates to a record
@@ -183,11 +265,32 @@ type (
 		Val Expr
 	}
 
+	// Quasi-quoted code, written as "`(expr)" or "`:" followed
+	// by a block. Evaluates to the data representing the code.
+	QuasiQuote struct {
+		*span.Span
+		Node Expr
+	}
+
+	// "~expr" inside of a quasi-quote, the value of
+	// the expression is put into the quoted code.
+	Unquote struct {
+		*span.Span
+		Expr Expr
+	}
+
 	Handle struct {
 		*span.Span
 		Body      *Block
 		Arms      []*WithClause
 		HasGuards bool
+		// Applied to the value returned by the body,
+		// nil if there is no return clause.
+		// Its Effect and Continuation are nil.
+		Return *WithClause
+		// Run when the control leaves the handle,
+		// nil if there is no finally clause.
+		Finally *Block
 	}
 
 	WithClause struct {
@@ -205,17 +308,79 @@ type (
 		// optional, can be nil
 		Arg Expr
 	}
-)
 
-func (g *GlobalValDecl) declNode() {}
-func (f *FuncDecl) declNode()      {}
-func (e *EffectDecl) declNode()    {}
+	Match struct {
+		*span.Span
+		Scrutinee Expr
+		Arms      []*MatchArm
+	}
 
-func (v *ValDecl) stmtNode()    {}
-func (w *WhileStmt) stmtNode()  {}
-func (s *StmtExpr) stmtNode()   {}
-func (a *Assignment) stmtNode() {}
-func (r *Return) stmtNode()     {}
+	MatchArm struct {
+		*span.Span
+		Pattern Pattern
+		// optional, can be nil
+		Guard Expr
+		Body  *Block
+	}
+
+	// Matches anything without binding it, written as "_".
+	WildcardPattern struct {
+		*span.Span
+	}
+
+	// Matches anything and binds it to the name.
+	BindPattern struct {
+		*span.Span
+		Name string
+		Lift bool
+	}
+
+	// Matches values equal to the constant.
+	// Val is one of the constant nodes or a symbol.
+	LiteralPattern struct {
+		*span.Span
+		Val Expr
+	}
+
+	TuplePattern struct {
+		*span.Span
+		Elems []Pattern
+	}
+
+	ListPattern struct {
+		*span.Span
+		Elems []Pattern
+	}
+
+	RecordPattern struct {
+		*span.Span
+		Fields []RecordFieldPattern
+	}
+
+	RecordFieldPattern struct {
+		Key string
+		Pat Pattern
+	}
+)
+
+func (g *GlobalValDecl) declNode()     {}
+func (g *GlobalPatternDecl) declNode() {}
+func (i *ImportDecl) declNode()        {}
+func (f *FromImportDecl) declNode()    {}
+func (f *FuncDecl) declNode()          {}
+func (e *EffectDecl) declNode()        {}
+func (m *MacroDecl) declNode()         {}
+func (o *OperatorDecl) declNode()      {}
+
+func (v *ValDecl) stmtNode()     {}
+func (p *PatternDecl) stmtNode() {}
+func (b *Break) stmtNode()       {}
+func (c *Continue) stmtNode()    {}
+func (w *WhileStmt) stmtNode()   {}
+func (f *ForStmt) stmtNode()     {}
+func (s *StmtExpr) stmtNode()    {}
+func (a *Assignment) stmtNode()  {}
+func (r *Return) stmtNode()      {}
 
 func (b *Block) exprNode()           {}
 func (f *FuncApplication) exprNode() {}
@@ -236,6 +401,16 @@ func (s *Symbol) exprNode()          {}
 func (h *Handle) exprNode()          {}
 func (e *LocalEffect) exprNode()     {}
 func (r *Resume) exprNode()          {}
+func (m *Match) exprNode()           {}
+func (q *QuasiQuote) exprNode()      {}
+func (u *Unquote) exprNode()         {}
+
+func (w *WildcardPattern) patternNode() {}
+func (b *BindPattern) patternNode()     {}
+func (l *LiteralPattern) patternNode()  {}
+func (t *TuplePattern) patternNode()    {}
+func (l *ListPattern) patternNode()     {}
+func (r *RecordPattern) patternNode()   {}
 
 func (l *ListConst) Values() []Expr {
 	return l.Vals
@@ -253,6 +428,30 @@ func (f *FuncDecl) NodeSpan() *span.Span {
 	return f.Span
 }
 
+func (i *ImportDecl) NodeSpan() *span.Span {
+	return i.Span
+}
+
+func (f *FromImportDecl) NodeSpan() *span.Span {
+	return f.Span
+}
+
+func (g *GlobalPatternDecl) NodeSpan() *span.Span {
+	return g.Span
+}
+
+func (p *PatternDecl) NodeSpan() *span.Span {
+	return p.Span
+}
+
+func (b *Break) NodeSpan() *span.Span {
+	return b.Span
+}
+
+func (c *Continue) NodeSpan() *span.Span {
+	return c.Span
+}
+
 func (v *ValDecl) NodeSpan() *span.Span {
 	return v.Span
 }
@@ -261,6 +460,14 @@ func (e *EffectDecl) NodeSpan() *span.Span {
 	return e.Span
 }
 
+func (m *MacroDecl) NodeSpan() *span.Span {
+	return m.Span
+}
+
+func (o *OperatorDecl) NodeSpan() *span.Span {
+	return o.Span
+}
+
 func (e *LocalEffect) NodeSpan() *span.Span {
 	return e.Span
 }
@@ -305,6 +512,10 @@ func (i *IfExpr) NodeSpan() *span.Span {
 	return i.Span
 }
 
+func (f *ForStmt) NodeSpan() *span.Span {
+	return f.Span
+}
+
 func (w *WhileStmt) NodeSpan() *span.Span {
 	return w.Span
 }
@@ -353,6 +564,46 @@ func (r *Resume) NodeSpan() *span.Span {
 	return r.Span
 }
 
+func (m *Match) NodeSpan() *span.Span {
+	return m.Span
+}
+
+func (q *QuasiQuote) NodeSpan() *span.Span {
+	return q.Span
+}
+
+func (u *Unquote) NodeSpan() *span.Span {
+	return u.Span
+}
+
+func (a *FuncDeclArg) NodeSpan() *span.Span {
+	return a.Span
+}
+
+func (w *WildcardPattern) NodeSpan() *span.Span {
+	return w.Span
+}
+
+func (b *BindPattern) NodeSpan() *span.Span {
+	return b.Span
+}
+
+func (l *LiteralPattern) NodeSpan() *span.Span {
+	return l.Span
+}
+
+func (t *TuplePattern) NodeSpan() *span.Span {
+	return t.Span
+}
+
+func (l *ListPattern) NodeSpan() *span.Span {
+	return l.Span
+}
+
+func (r *RecordPattern) NodeSpan() *span.Span {
+	return r.Span
+}
+
 func (g *GlobalValDecl) String() string {
 	return fmt.Sprintf(
 		`GlobalVar{
@@ -361,11 +612,37 @@ func (g *GlobalValDecl) String() string {
 }`, g.Name, g.Rhs)
 }
 
+func (g *GlobalPatternDecl) String() string {
+	return fmt.Sprintf(
+		`GlobalPatternDecl{
+	pattern=%s
+	rhs=%s
+}`, g.Pattern, g.Rhs)
+}
+
+func (i *ImportDecl) String() string {
+	return fmt.Sprintf("Import{%q as %s}", i.Path, i.Name)
+}
+
+func (f *FromImportDecl) String() string {
+	names := []string{}
+	for _, n := range f.Names {
+		names = append(names, n.Name)
+	}
+	return fmt.Sprintf("FromImport{%q import %s}", f.Path, strings.Join(names, ", "))
+}
+
 func (f *FuncDecl) String() string {
 	msg := "FnDecl{" + f.Name
 	for _, arg := range f.Args {
 		msg += " " + arg.Name
 	}
+	if f.Type != nil {
+		msg += " :: " + f.Type.String()
+	}
+	if f.Effects != nil {
+		msg += " " + f.Effects.String()
+	}
 	msg += "} "
 	msg += f.Body.String()
 	return msg
@@ -375,6 +652,20 @@ func (e *EffectDecl) String() string {
 	return fmt.Sprintf("EffectDecl{%s}", e.Name)
 }
 
+func (m *MacroDecl) String() string {
+	msg := "MacroDecl{" + m.Name
+	for _, arg := range m.Args {
+		msg += " " + arg.Name
+	}
+	msg += "} "
+	msg += m.Body.String()
+	return msg
+}
+
+func (o *OperatorDecl) String() string {
+	return fmt.Sprintf("OperatorDecl{%s %s %d %s}", o.Fixity.Assoc, o.Name, o.Fixity.Prec, o.Rhs)
+}
+
 func (e *LocalEffect) String() string {
 	return fmt.Sprintf("LocalEffect{%s}", e.Name)
 }
@@ -396,6 +687,22 @@ func (g *ValDecl) String() string {
 }`, g.Name, g.Rhs, g.Lift)
 }
 
+func (p *PatternDecl) String() string {
+	return fmt.Sprintf(
+		`PatternDecl{
+	pattern=%s
+	rhs=%s
+}`, p.Pattern, p.Rhs)
+}
+
+func (b *Break) String() string {
+	return "Break"
+}
+
+func (c *Continue) String() string {
+	return "Continue"
+}
+
 func (s *StmtExpr) String() string {
 	return fmt.Sprintf("Stmt{%s}", s.Expr)
 }
@@ -454,6 +761,10 @@ func (w *WhileStmt) String() string {
 	return fmt.Sprintf("While{%s} %s", w.Cond, w.Body)
 }
 
+func (f *ForStmt) String() string {
+	return fmt.Sprintf("For{%s in %s} %s", f.Pattern, f.Iterable, f.Body)
+}
+
 func (l *LetExpr) String() string {
 	return "Unsupported"
 }
@@ -498,6 +809,14 @@ func (r *Return) String() string {
 	return fmt.Sprintf("Return{%s}", r.Val)
 }
 
+func (q *QuasiQuote) String() string {
+	return fmt.Sprintf("QuasiQuote{%s}", q.Node)
+}
+
+func (u *Unquote) String() string {
+	return fmt.Sprintf("Unquote{%s}", u.Expr)
+}
+
 func (r *Resume) String() string {
 	arg := "nil"
 	if r.Arg != nil {
@@ -517,5 +836,77 @@ func (h *Handle) String() string {
 		repr += arm.Body.String()
 		repr += "\n}\n"
 	}
+	if h.Return != nil {
+		repr += fmt.Sprintf("With{Return Arg{%s}} Body {\n%s\n}\n", h.Return.Arg.Name, h.Return.Body)
+	}
+	if h.Finally != nil {
+		repr += fmt.Sprintf("Finally {\n%s\n}\n", h.Finally)
+	}
 	return repr
 }
+
+func (m *Match) String() string {
+	repr := fmt.Sprintf("Match{%s}\n", m.Scrutinee)
+	for _, arm := range m.Arms {
+		repr += fmt.Sprintf("Case{%s}", arm.Pattern)
+		if arm.Guard != nil {
+			repr += fmt.Sprintf(" If{%s}", arm.Guard)
+		}
+		repr += " " + arm.Body.String()
+	}
+	return repr
+}
+
+func (w *WildcardPattern) String() string {
+	return "_"
+}
+
+func (a *FuncDeclArg) String() string {
+	return fmt.Sprintf("Arg{%s}", a.Name)
+}
+
+func (b *BindPattern) String() string {
+	return fmt.Sprintf("Bind{%s}", b.Name)
+}
+
+func (l *LiteralPattern) String() string {
+	return fmt.Sprintf("Lit{%s}", l.Val)
+}
+
+func (t *TuplePattern) String() string {
+	return fmt.Sprintf("TuplePat%v", t.Elems)
+}
+
+func (l *ListPattern) String() string {
+	return fmt.Sprintf("ListPat%v", l.Elems)
+}
+
+func (r *RecordPattern) String() string {
+	return fmt.Sprintf("RecordPat%v", r.Fields)
+}
+
+// Associativity of the operator.
+type Assoc int
+
+const (
+	AssocLeft Assoc = iota
+	AssocRight
+	AssocNone
+)
+
+func (a Assoc) String() string {
+	switch a {
+	case AssocRight:
+		return "infixr"
+	case AssocNone:
+		return "infix"
+	}
+	return "infixl"
+}
+
+// Fixity describes how the operator groups with its operands.
+// Operators with higher precedence bind tighter.
+type Fixity struct {
+	Assoc Assoc
+	Prec  int
+}
@@ -0,0 +1,37 @@
+package ast
+
+// Bindings returns all of the names bound by the pattern
+// in the order they appear in the source.
+func Bindings(p Pattern) []*BindPattern {
+	bb := []*BindPattern{}
+	var walk func(Pattern)
+	walk = func(p Pattern) {
+		switch v := p.(type) {
+		case *BindPattern:
+			bb = append(bb, v)
+		case *TuplePattern:
+			for _, e := range v.Elems {
+				walk(e)
+			}
+		case *ListPattern:
+			for _, e := range v.Elems {
+				walk(e)
+			}
+		case *RecordPattern:
+			for _, f := range v.Fields {
+				walk(f.Pat)
+			}
+		}
+	}
+	walk(p)
+	return bb
+}
+
+// IsIrrefutable returns true if the pattern matches every value.
+func IsIrrefutable(p Pattern) bool {
+	switch p.(type) {
+	case *WildcardPattern, *BindPattern:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,267 @@
+package ast
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gala377/MLLang/syntax/span"
+)
+
+// Type annotations as written in the source. They are only used
+// by the type checker and do not change how the code is compiled.
+type (
+	TypeExpr interface {
+		Node
+		typeNode()
+	}
+
+	// a b => {a -> b -> a}
+	TypeScheme struct {
+		*span.Span
+		Vars []string
+		Type TypeExpr
+	}
+
+	// Either a type variable, a builtin type like int
+	// or a named type applied to its arguments like Seq a.
+	TypeName struct {
+		*span.Span
+		Name string
+		Args []TypeExpr
+	}
+
+	// {a -> b -> c}, nullary functions are written as {c}
+	// and have no arguments.
+	TypeFunc struct {
+		*span.Span
+		Args []TypeExpr
+		Ret  TypeExpr
+	}
+
+	TypeTuple struct {
+		*span.Span
+		Elems []TypeExpr
+	}
+
+	TypeList struct {
+		*span.Span
+		Elem TypeExpr
+	}
+
+	// {a: int}, open records written as {a: int, ..}
+	// can also have other fields.
+	TypeRecord struct {
+		*span.Span
+		Fields []TypeRecordField
+		Open   bool
+	}
+
+	TypeRecordField struct {
+		Key  string
+		Type TypeExpr
+	}
+
+	// ! {io, iter.Yield} effects the function is allowed
+	// to perform.
+	EffectSet struct {
+		*span.Span
+		Names []string
+	}
+)
+
+func (t *TypeScheme) typeNode() {}
+func (t *TypeName) typeNode()   {}
+func (t *TypeFunc) typeNode()   {}
+func (t *TypeTuple) typeNode()  {}
+func (t *TypeList) typeNode()   {}
+func (t *TypeRecord) typeNode() {}
+
+func (t *TypeScheme) NodeSpan() *span.Span {
+	return t.Span
+}
+
+func (t *TypeName) NodeSpan() *span.Span {
+	return t.Span
+}
+
+func (t *TypeFunc) NodeSpan() *span.Span {
+	return t.Span
+}
+
+func (t *TypeTuple) NodeSpan() *span.Span {
+	return t.Span
+}
+
+func (t *TypeList) NodeSpan() *span.Span {
+	return t.Span
+}
+
+func (t *TypeRecord) NodeSpan() *span.Span {
+	return t.Span
+}
+
+func (e *EffectSet) NodeSpan() *span.Span {
+	return e.Span
+}
+
+func (e *EffectSet) String() string {
+	return fmt.Sprintf("! {%s}", strings.Join(e.Names, ", "))
+}
+
+func (e *EffectSet) Equal(o Node) bool {
+	if oe, ok := o.(*EffectSet); ok {
+		if len(e.Names) != len(oe.Names) {
+			return false
+		}
+		for i, n := range e.Names {
+			if n != oe.Names[i] {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (t *TypeScheme) String() string {
+	if len(t.Vars) == 0 {
+		return t.Type.String()
+	}
+	return fmt.Sprintf("%s => %s", strings.Join(t.Vars, " "), t.Type)
+}
+
+func (t *TypeName) String() string {
+	if len(t.Args) == 0 {
+		return t.Name
+	}
+	args := []string{t.Name}
+	for _, a := range t.Args {
+		s := a.String()
+		if n, ok := a.(*TypeName); ok && len(n.Args) > 0 {
+			s = "(" + s + ")"
+		}
+		args = append(args, s)
+	}
+	return strings.Join(args, " ")
+}
+
+func (t *TypeFunc) String() string {
+	parts := []string{}
+	for _, a := range t.Args {
+		parts = append(parts, a.String())
+	}
+	parts = append(parts, t.Ret.String())
+	return fmt.Sprintf("{%s}", strings.Join(parts, " -> "))
+}
+
+func (t *TypeTuple) String() string {
+	elems := []string{}
+	for _, e := range t.Elems {
+		elems = append(elems, e.String())
+	}
+	if len(elems) == 1 {
+		return fmt.Sprintf("(%s,)", elems[0])
+	}
+	return fmt.Sprintf("(%s)", strings.Join(elems, ", "))
+}
+
+func (t *TypeList) String() string {
+	return fmt.Sprintf("[%s]", t.Elem)
+}
+
+func (t *TypeRecord) String() string {
+	fields := []string{}
+	for _, f := range t.Fields {
+		fields = append(fields, fmt.Sprintf("%s: %s", f.Key, f.Type))
+	}
+	if t.Open {
+		fields = append(fields, "..")
+	}
+	return fmt.Sprintf("{%s}", strings.Join(fields, ", "))
+}
+
+func (t *TypeScheme) Equal(o Node) bool {
+	if ot, ok := o.(*TypeScheme); ok {
+		if len(t.Vars) != len(ot.Vars) {
+			return false
+		}
+		for i, v := range t.Vars {
+			if v != ot.Vars[i] {
+				return false
+			}
+		}
+		return AstEqual(t.Type, ot.Type)
+	}
+	return false
+}
+
+func (t *TypeName) Equal(o Node) bool {
+	if ot, ok := o.(*TypeName); ok {
+		return t.Name == ot.Name && typesEqual(t.Args, ot.Args)
+	}
+	return false
+}
+
+func (t *TypeFunc) Equal(o Node) bool {
+	if ot, ok := o.(*TypeFunc); ok {
+		return typesEqual(t.Args, ot.Args) && AstEqual(t.Ret, ot.Ret)
+	}
+	return false
+}
+
+func (t *TypeTuple) Equal(o Node) bool {
+	if ot, ok := o.(*TypeTuple); ok {
+		return typesEqual(t.Elems, ot.Elems)
+	}
+	return false
+}
+
+func (t *TypeList) Equal(o Node) bool {
+	if ot, ok := o.(*TypeList); ok {
+		return AstEqual(t.Elem, ot.Elem)
+	}
+	return false
+}
+
+func (t *TypeRecord) Equal(o Node) bool {
+	if ot, ok := o.(*TypeRecord); ok {
+		if len(t.Fields) != len(ot.Fields) || t.Open != ot.Open {
+			return false
+		}
+		for i, f := range t.Fields {
+			of := ot.Fields[i]
+			if f.Key != of.Key || !AstEqual(f.Type, of.Type) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func typesEqual(a, b []TypeExpr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !AstEqual(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// schemesEqual compares optional annotations.
+func schemesEqual(a, b *TypeScheme) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(b)
+}
+
+func effectSetsEqual(a, b *EffectSet) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(b)
+}
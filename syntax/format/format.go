@@ -0,0 +1,977 @@
+// Package format pretty prints funk source code in the canonical style.
+//
+// Blocks are indented with two spaces, lambdas drop the optional pipes
+// around their arguments and blocks passed as the last argument use the
+// trailing block syntax. Records and lists are kept on one line unless
+// they do not fit, contain comments or blocks, or were written with a
+// line break after the opening bracket. Comments are kept in place.
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gala377/MLLang/syntax"
+	"github.com/gala377/MLLang/syntax/ast"
+	"github.com/gala377/MLLang/syntax/token"
+)
+
+const (
+	indentWidth = 2
+	// records and lists longer than that are split into lines
+	maxWidth = 80
+)
+
+// Precedence of the expressions, used to decide
+// when the expression has to be put in parenthesis.
+const (
+	// any expression, including if, match, handle and lambdas
+	levelExpr = iota
+	// application with "f $ x"
+	levelBinary
+	// operator application "x + y"
+	levelOperator
+	// infix application "x :f y"
+	levelInfix
+	// application "f x y"
+	levelApp
+	// constants, names, accesses and nullary applications
+	levelSimple
+)
+
+// Source formats the funk source code. The source is returned
+// unchanged with the errors if it could not be parsed.
+func Source(src []byte) ([]byte, []syntax.SyntaxError) {
+	return SourceWithOperators(src, nil)
+}
+
+// SourceWithOperators formats the source using operators declared
+// outside of it. Operands of operators with unknown fixities are kept
+// in parenthesis, as it is not known how they would be grouped.
+func SourceWithOperators(src []byte, ops syntax.Operators) ([]byte, []syntax.SyntaxError) {
+	p := syntax.NewParser(bytes.NewReader(src))
+	p.UseOperators(ops)
+	nodes := p.Parse()
+	if errs := p.Errors(); len(errs) > 0 {
+		return src, errs
+	}
+	pr := newPrinter(src, p.Comments())
+	pr.operators = p.Operators()
+	pr.program(nodes)
+	return []byte(pr.out.String()), nil
+}
+
+type printer struct {
+	src []byte
+	out strings.Builder
+	// indentation of the new lines
+	indent int
+	// column of the next written character
+	col int
+	// new lines to write before the next text
+	newlines int
+	// offset in the output of the comment ending
+	// the last line, zero if it does not end with one
+	lineComment int
+	// comments that have not been printed yet
+	comments []token.Token
+	all      []token.Token
+	// flat printers are used to measure nodes, they
+	// do not print comments nor split records and lists
+	flat bool
+	// cached results of mustBreak
+	breaks map[ast.Node]bool
+	// fixities of the operators used by the source
+	operators syntax.Operators
+}
+
+func newPrinter(src []byte, comments []token.Token) *printer {
+	return &printer{
+		src:      src,
+		comments: comments,
+		all:      comments,
+		breaks:   map[ast.Node]bool{},
+	}
+}
+
+func (p *printer) write(s string) {
+	if p.newlines > 0 {
+		if p.out.Len() > 0 {
+			p.out.WriteString(strings.Repeat("\n", p.newlines))
+		}
+		p.out.WriteString(strings.Repeat(" ", p.indent))
+		p.col = p.indent
+		p.newlines = 0
+		p.lineComment = 0
+	}
+	p.out.WriteString(s)
+	p.col += utf8.RuneCountInString(s)
+}
+
+// close writes the closing token. If the previous expression ended
+// with a block the token is put at the end of its last line, because
+// the parser would end the enclosing expression on the new line.
+// The token goes before the comment ending the line, if there is one.
+func (p *printer) close(s string) {
+	if p.lineComment > 0 {
+		// the line still has to end after the comment
+		out := p.out.String()
+		p.out.Reset()
+		p.out.WriteString(out[:p.lineComment] + s + out[p.lineComment:])
+		p.lineComment += len(s)
+		return
+	}
+	if p.newlines == 0 || p.out.Len() == 0 {
+		p.write(s)
+		return
+	}
+	p.out.WriteString(s)
+	p.newlines = 0
+	out := p.out.String()
+	p.col = utf8.RuneCountInString(out[strings.LastIndexByte(out, '\n')+1:])
+}
+
+// line makes the next text start on a new line.
+func (p *printer) line() {
+	if p.newlines == 0 {
+		p.newlines = 1
+	}
+}
+
+func (p *printer) blankLine() {
+	p.newlines = 2
+}
+
+func (p *printer) program(nodes []ast.Node) {
+	for i, n := range nodes {
+		p.line()
+		p.startLine(offset(n), i == 0)
+		p.node(n)
+	}
+	p.flushComments(len(p.src)+1, len(nodes) == 0)
+	if p.out.Len() > 0 {
+		p.out.WriteString("\n")
+	}
+}
+
+// startLine prints comments placed before the node starting at
+// the offset and keeps one empty line before it if there was any.
+func (p *printer) startLine(offset int, first bool) {
+	if p.flat {
+		return
+	}
+	if p.flushComments(offset, first) {
+		first = false
+	}
+	if !first && !p.trailing(offset) && p.blankBefore(offset) {
+		p.blankLine()
+	}
+}
+
+// flushComments prints comments placed before the offset.
+// Returns true if any of them was printed in its own line.
+func (p *printer) flushComments(offset int, first bool) bool {
+	printed := false
+	for len(p.comments) > 0 && int(p.comments[0].Span.Beg.Offset) < offset {
+		if p.comment(first && !printed) {
+			printed = true
+		}
+	}
+	return printed
+}
+
+// flushInner prints comments that are placed before the end
+// offset and are indented at least as much as the column.
+// Comments at the end of blocks are kept in them this way.
+func (p *printer) flushInner(end int, column int) {
+	for len(p.comments) > 0 {
+		c := int(p.comments[0].Span.Beg.Offset)
+		if c >= end || (!p.trailing(c) && c-p.lineStart(c) < column) {
+			return
+		}
+		p.comment(false)
+	}
+}
+
+// comment prints the first of the remaining comments. Comments
+// following code in the same line are kept at the end of the line.
+// Returns true if the comment has been printed in its own line.
+func (p *printer) comment(first bool) bool {
+	c := p.comments[0]
+	p.comments = p.comments[1:]
+	offset := int(c.Span.Beg.Offset)
+	text := ";" + strings.TrimRight(c.Val, " \t\r")
+	if p.trailing(offset) && p.out.Len() > 0 {
+		// comments are flushed only after whole statements
+		// and elements, so the line can be ended here
+		p.lineComment = p.out.Len()
+		p.out.WriteString(" " + text)
+		p.line()
+		return false
+	}
+	p.line()
+	if !first && p.blankBefore(offset) {
+		p.blankLine()
+	}
+	p.write(text)
+	p.line()
+	return true
+}
+
+func (p *printer) lineStart(offset int) int {
+	if offset > len(p.src) {
+		offset = len(p.src)
+	}
+	return bytes.LastIndexByte(p.src[:offset], '\n') + 1
+}
+
+// trailing returns true if there is code before
+// the offset in the same line.
+func (p *printer) trailing(offset int) bool {
+	return len(bytes.TrimSpace(p.src[p.lineStart(offset):offset])) > 0
+}
+
+// blankBefore returns true if the line before
+// the one with the offset is empty.
+func (p *printer) blankBefore(offset int) bool {
+	beg := p.lineStart(offset)
+	if beg == 0 {
+		return false
+	}
+	prev := p.lineStart(beg - 1)
+	return len(bytes.TrimSpace(p.src[prev:beg])) == 0
+}
+
+// newlineBetween returns true if the source has a line break between
+// the offsets. Used to keep records and lists the way they were written.
+func (p *printer) newlineBetween(beg, end int) bool {
+	if end > len(p.src) {
+		end = len(p.src)
+	}
+	return beg < end && bytes.IndexByte(p.src[beg:end], '\n') != -1
+}
+
+func offset(n ast.Node) int {
+	return int(n.NodeSpan().Beg.Offset)
+}
+
+func endOffset(n ast.Node) int {
+	return int(n.NodeSpan().End.Offset)
+}
+
+func (p *printer) node(n ast.Node) {
+	switch n := n.(type) {
+	case *ast.FuncDecl:
+		p.write("fn " + n.Name)
+		p.function(n.Args, n.Type, n.Effects, n.Body)
+	case *ast.GlobalValDecl:
+		p.write("let " + n.Name)
+		p.typeAnnotation(n.Type)
+		p.write(" = ")
+		p.expr(n.Rhs, levelExpr)
+	case *ast.GlobalPatternDecl:
+		p.write("let ")
+		p.pattern(n.Pattern)
+		p.write(" = ")
+		p.expr(n.Rhs, levelExpr)
+	case *ast.EffectDecl:
+		p.write("effect " + n.Name)
+	case *ast.OperatorDecl:
+		p.write(fmt.Sprintf("%s %d %s = ", n.Fixity.Assoc, n.Fixity.Prec, n.Name))
+		p.expr(n.Rhs, levelExpr)
+	case *ast.MacroDecl:
+		p.write("macro " + n.Name)
+		p.function(n.Args, nil, nil, n.Body)
+	case *ast.ImportDecl:
+		p.write(fmt.Sprintf("import %s as %s", quote(n.Path), n.Name))
+	case *ast.FromImportDecl:
+		names := []string{}
+		for _, n := range n.Names {
+			names = append(names, n.Name)
+		}
+		p.write(fmt.Sprintf("from %s import %s", quote(n.Path), strings.Join(names, ", ")))
+	case ast.Stmt:
+		p.stmt(n)
+	default:
+		panic(fmt.Sprintf("ICE: cannot format node %T", n))
+	}
+}
+
+// function prints arguments, annotations and the body of
+// the function declaration, after its name.
+func (p *printer) function(args []*ast.FuncDeclArg, typ *ast.TypeScheme, effects *ast.EffectSet, body ast.Expr) {
+	for _, a := range args {
+		p.write(" ")
+		p.arg(a)
+	}
+	p.typeAnnotation(typ)
+	if effects != nil {
+		p.write(" " + effects.String())
+	}
+	if b, ok := body.(*ast.Block); ok {
+		p.block(b)
+		return
+	}
+	p.write(" = ")
+	p.expr(body, levelExpr)
+}
+
+func (p *printer) typeAnnotation(typ *ast.TypeScheme) {
+	if typ != nil {
+		p.write(" :: " + typ.String())
+	}
+}
+
+func (p *printer) arg(a *ast.FuncDeclArg) {
+	switch a.Pattern.(type) {
+	case nil:
+		p.write(a.Name)
+	case *ast.TuplePattern, *ast.ListPattern, *ast.RecordPattern:
+		p.pattern(a.Pattern)
+	default:
+		// only the destructuring patterns can be written without parenthesis
+		p.write("(")
+		p.pattern(a.Pattern)
+		p.write(")")
+	}
+}
+
+// block prints the colon and the statements of the block
+// in the following lines.
+func (p *printer) block(b *ast.Block) {
+	p.write(":")
+	p.indent += indentWidth
+	for i, s := range b.Instr {
+		p.line()
+		p.startLine(offset(s), i == 0)
+		p.stmt(s)
+	}
+	if len(b.Instr) > 0 && !p.flat {
+		first := offset(b.Instr[0])
+		p.flushInner(endOffset(b), first-p.lineStart(first))
+	}
+	p.indent -= indentWidth
+	p.line()
+}
+
+func (p *printer) stmt(s ast.Stmt) {
+	switch s := s.(type) {
+	case *ast.StmtExpr:
+		p.expr(s.Expr, levelExpr)
+	case *ast.ValDecl:
+		switch rhs := s.Rhs.(type) {
+		case *ast.LambdaExpr:
+			if rhs.Name != "" && rhs.Name == s.Name {
+				p.write("fn " + s.Name)
+				p.function(rhs.Args, s.Type, s.Effects, rhs.Body)
+				return
+			}
+		case *ast.LocalEffect:
+			p.write("effect " + rhs.Name)
+			return
+		}
+		p.write("let " + s.Name)
+		p.typeAnnotation(s.Type)
+		p.write(" = ")
+		p.expr(s.Rhs, levelExpr)
+	case *ast.PatternDecl:
+		p.write("let ")
+		p.pattern(s.Pattern)
+		p.write(" = ")
+		p.expr(s.Rhs, levelExpr)
+	case *ast.Assignment:
+		p.expr(s.LValue, levelExpr)
+		p.write(" = ")
+		p.expr(s.RValue, levelExpr)
+	case *ast.Return:
+		p.write("return")
+		// bare return has none sharing its span
+		if n, ok := s.Val.(*ast.NoneConst); ok && n.Span == s.Span {
+			return
+		}
+		p.write(" ")
+		p.expr(s.Val, levelExpr)
+	case *ast.Break:
+		p.write("break")
+	case *ast.Continue:
+		p.write("continue")
+	case *ast.WhileStmt:
+		p.write("while ")
+		p.expr(s.Cond, levelBinary)
+		p.block(s.Body)
+	case *ast.ForStmt:
+		p.write("for ")
+		p.pattern(s.Pattern)
+		p.write(" in ")
+		p.expr(s.Iterable, levelBinary)
+		p.block(s.Body)
+	default:
+		panic(fmt.Sprintf("ICE: cannot format statement %T", s))
+	}
+}
+
+// level returns the precedence of the form
+// the expression is going to be printed in.
+func (p *printer) level(e ast.Expr) int {
+	switch e := e.(type) {
+	case *ast.IfExpr, *ast.Handle, *ast.Match, *ast.LambdaExpr, *ast.Resume:
+		return levelExpr
+	case *ast.FuncApplication:
+		switch {
+		case p.isOperator(e):
+			return levelOperator
+		case p.isInfix(e):
+			return levelInfix
+		case p.isDollar(e):
+			return levelBinary
+		case len(e.Args) == 0 && e.Block == nil:
+			return levelSimple
+		}
+		return levelApp
+	case *ast.QuasiQuote:
+		if _, ok := e.Node.(*ast.Block); ok {
+			return levelExpr
+		}
+	}
+	return levelSimple
+}
+
+// expr prints the expression, in parenthesis if its
+// precedence is lower than the one expected.
+func (p *printer) expr(e ast.Expr, level int) {
+	if p.level(e) < level {
+		p.write("(")
+		p.expr(e, levelExpr)
+		p.close(")")
+		return
+	}
+	switch e := e.(type) {
+	case *ast.IntConst:
+		p.write(strconv.Itoa(e.Val))
+	case *ast.FloatConst:
+		p.write(formatFloat(e.Val))
+	case *ast.StringConst:
+		p.write(quote(e.Val))
+	case *ast.BoolConst:
+		p.write(strconv.FormatBool(e.Val))
+	case *ast.NoneConst:
+		p.write("none")
+	case *ast.Symbol:
+		p.write("`" + e.Val)
+	case *ast.Identifier:
+		if isOperatorName(e.Name) {
+			p.write("(" + e.Name + ")")
+			break
+		}
+		p.write(e.Name)
+	case *ast.Access:
+		p.expr(e.Lhs, levelSimple)
+		p.write("." + e.Property.Name)
+	case *ast.TupleConst:
+		p.write("(")
+		for i, v := range e.Vals {
+			if i > 0 {
+				p.close(",")
+				p.write(" ")
+			}
+			p.expr(v, levelExpr)
+		}
+		if len(e.Vals) == 1 {
+			p.close(",")
+		}
+		p.close(")")
+	case *ast.ListConst:
+		p.sequence("[", "]", e, len(e.Vals), func(i int) ast.Node { return e.Vals[i] }, func(i int) {
+			p.expr(e.Vals[i], levelExpr)
+		})
+	case *ast.RecordConst:
+		p.sequence("{", "}", e, len(e.Fields), func(i int) ast.Node { return e.Fields[i].Val }, func(i int) {
+			p.field(e.Fields[i])
+		})
+	case *ast.FuncApplication:
+		p.application(e)
+	case *ast.LambdaExpr:
+		p.lambda(e)
+	case *ast.IfExpr:
+		p.ifExpr(e)
+	case *ast.Handle:
+		p.handle(e)
+	case *ast.Match:
+		p.match(e)
+	case *ast.Resume:
+		p.write("resume ")
+		p.expr(e.Cont, levelSimple)
+		if e.Arg != nil {
+			p.write(" ")
+			p.expr(e.Arg, levelSimple)
+		}
+	case *ast.QuasiQuote:
+		p.write("`")
+		switch n := e.Node.(type) {
+		case *ast.Block:
+			p.block(n)
+		case *ast.TupleConst:
+			p.expr(n, levelExpr)
+		default:
+			p.write("(")
+			p.expr(n, levelExpr)
+			p.close(")")
+		}
+	case *ast.Unquote:
+		p.write("~")
+		switch e.Expr.(type) {
+		case *ast.Access, *ast.FuncApplication:
+			// postfix forms would be applied to the unquote itself
+			p.write("(")
+			p.expr(e.Expr, levelExpr)
+			p.close(")")
+		default:
+			p.expr(e.Expr, levelSimple)
+		}
+	default:
+		panic(fmt.Sprintf("ICE: cannot format expression %T", e))
+	}
+}
+
+func (p *printer) field(f ast.RecordField) {
+	switch v := f.Val.(type) {
+	case *ast.Identifier:
+		if v.Name == f.Key {
+			p.write(f.Key)
+			return
+		}
+	case *ast.LambdaExpr:
+		if v.Name != "" && v.Name == f.Key {
+			p.write("fn " + f.Key)
+			p.function(v.Args, nil, nil, v.Body)
+			return
+		}
+	}
+	p.write(f.Key + ": ")
+	p.expr(f.Val, levelExpr)
+}
+
+// sequence prints elements of a record or a list between the brackets.
+func (p *printer) sequence(lbracket, rbracket string, n ast.Node, length int, elem func(int) ast.Node, print func(int)) {
+	if length == 0 {
+		p.write(lbracket + rbracket)
+		return
+	}
+	inline := func() {
+		p.write(lbracket)
+		for i := 0; i < length; i++ {
+			if i > 0 {
+				p.close(",")
+				p.write(" ")
+			}
+			print(i)
+		}
+		p.close(rbracket)
+	}
+	if !p.mustBreak(n, length, elem, print) {
+		if p.flat {
+			inline()
+			return
+		}
+		saved := p.swapOut()
+		p.flat = true
+		inline()
+		width := utf8.RuneCountInString(p.out.String())
+		p.restoreOut(saved)
+		if p.col+width <= maxWidth {
+			inline()
+			return
+		}
+	}
+	p.write(lbracket)
+	p.indent += indentWidth
+	for i := 0; i < length; i++ {
+		p.line()
+		p.startLine(offset(elem(i)), i == 0)
+		print(i)
+		// the comma can be skipped after the last
+		// element, so it is not put after its block
+		if i < length-1 || p.newlines == 0 {
+			p.close(",")
+		}
+	}
+	if !p.flat {
+		p.flushComments(p.lineStart(endOffset(n)), false)
+	}
+	p.indent -= indentWidth
+	p.line()
+	p.write(rbracket)
+}
+
+// mustBreak returns true if the sequence cannot be printed in one line.
+// That is if it contains blocks or comments or was written with a line
+// break after the opening bracket.
+func (p *printer) mustBreak(n ast.Node, length int, elem func(int) ast.Node, print func(int)) bool {
+	if b, ok := p.breaks[n]; ok {
+		return b
+	}
+	beg, end := offset(n), endOffset(n)
+	res := p.newlineBetween(beg, offset(elem(0)))
+	for _, c := range p.all {
+		if c := int(c.Span.Beg.Offset); c > beg && c < p.lineStart(end) {
+			res = true
+		}
+	}
+	if !res {
+		for i := 0; i < length && !res; i++ {
+			saved := p.swapOut()
+			p.flat = true
+			print(i)
+			res = strings.Contains(p.out.String(), "\n")
+			p.restoreOut(saved)
+		}
+	}
+	p.breaks[n] = res
+	return res
+}
+
+type savedOutput struct {
+	out      strings.Builder
+	col      int
+	newlines int
+	indent   int
+	flat     bool
+	comments []token.Token
+	// see printer.lineComment
+	lineComment int
+}
+
+// swapOut makes the printer write to an empty output
+// without comments, so that it can measure nodes.
+func (p *printer) swapOut() *savedOutput {
+	s := &savedOutput{
+		col:         p.col,
+		newlines:    p.newlines,
+		indent:      p.indent,
+		flat:        p.flat,
+		comments:    p.comments,
+		lineComment: p.lineComment,
+	}
+	s.out.WriteString(p.out.String())
+	p.out.Reset()
+	p.col, p.newlines, p.indent, p.comments, p.lineComment = 0, 0, 0, nil, 0
+	return s
+}
+
+func (p *printer) restoreOut(s *savedOutput) {
+	p.out.Reset()
+	p.out.WriteString(s.out.String())
+	p.col, p.newlines, p.indent, p.flat, p.comments, p.lineComment = s.col, s.newlines, s.indent, s.flat, s.comments, s.lineComment
+}
+
+// isInfix returns true if the application was written as "x :f y".
+func (p *printer) isInfix(f *ast.FuncApplication) bool {
+	callee, ok := f.Callee.(*ast.Identifier)
+	if !ok || len(f.Args) == 0 {
+		return false
+	}
+	at := offset(callee)
+	return at > offset(f.Args[0]) && at < len(p.src) && p.src[at] == ':'
+}
+
+// isOperator returns true if the application has
+// been written as "x op y" in the source.
+func (p *printer) isOperator(f *ast.FuncApplication) bool {
+	callee, ok := f.Callee.(*ast.Identifier)
+	if !ok || len(f.Args) != 2 || f.Block != nil || !isOperatorName(callee.Name) {
+		return false
+	}
+	return offset(callee) > offset(f.Args[0])
+}
+
+// isOperatorName returns true if the name is an operator,
+// identifiers start with a letter or an underscore.
+func isOperatorName(name string) bool {
+	r, _ := utf8.DecodeRuneInString(name)
+	return name != "" && r != '_' && !unicode.IsLetter(r)
+}
+
+func (p *printer) fixity(f *ast.FuncApplication) (ast.Fixity, bool) {
+	fixity, ok := p.operators[f.Callee.(*ast.Identifier).Name]
+	return fixity, ok
+}
+
+// operand prints the operand of the operator with the given
+// fixity, in parenthesis if it would not be parsed as one.
+func (p *printer) operand(e ast.Expr, f ast.Fixity, known bool, left bool) {
+	o, ok := e.(*ast.FuncApplication)
+	if !ok || !p.isOperator(o) {
+		p.expr(e, levelInfix)
+		return
+	}
+	of, oknown := p.fixity(o)
+	assoc := ast.AssocRight
+	if left {
+		assoc = ast.AssocLeft
+	}
+	if known && oknown && (of.Prec > f.Prec || of.Prec == f.Prec && of.Assoc == f.Assoc && f.Assoc == assoc) {
+		p.expr(e, levelOperator)
+		return
+	}
+	p.write("(")
+	p.expr(e, levelExpr)
+	p.close(")")
+}
+
+// isDollar returns true if the application has been written
+// as "f $ x" in the source.
+func (p *printer) isDollar(f *ast.FuncApplication) bool {
+	if len(f.Args) != 1 || f.Block != nil || p.isInfix(f) {
+		return false
+	}
+	at := offset(f.Args[0]) - 1
+	for at >= 0 && at < len(p.src) && (p.src[at] == ' ' || p.src[at] == '\t') {
+		at--
+	}
+	return at >= 0 && at < len(p.src) && p.src[at] == '$'
+}
+
+func (p *printer) application(f *ast.FuncApplication) {
+	switch {
+	case p.isOperator(f):
+		fixity, known := p.fixity(f)
+		p.operand(f.Args[0], fixity, known, true)
+		p.write(" " + f.Callee.(*ast.Identifier).Name + " ")
+		p.operand(f.Args[1], fixity, known, false)
+		return
+	case p.isInfix(f):
+		p.expr(f.Args[0], levelInfix)
+		callee := f.Callee.(*ast.Identifier)
+		op := ":"
+		if at := offset(callee) + 1; at < len(p.src) && p.src[at] == ':' {
+			op = "::"
+		}
+		p.write(" " + op + callee.Name)
+		for _, a := range f.Args[1:] {
+			p.write(" ")
+			p.expr(a, levelSimple)
+		}
+	case p.isDollar(f):
+		p.expr(f.Callee, levelInfix)
+		p.write(" $ ")
+		p.expr(f.Args[0], levelBinary)
+		return
+	default:
+		if len(f.Args) == 0 && f.Block == nil {
+			// "f!!" would be lexed as an operator
+			if c, ok := f.Callee.(*ast.FuncApplication); ok && p.level(c) == levelSimple {
+				p.write("(")
+				p.expr(c, levelSimple)
+				p.write(")!")
+				return
+			}
+			p.expr(f.Callee, levelSimple)
+			p.write("!")
+			return
+		}
+		p.expr(f.Callee, levelSimple)
+		for _, a := range f.Args {
+			p.write(" ")
+			p.expr(a, levelSimple)
+		}
+	}
+	if f.Block == nil {
+		return
+	}
+	// blocks without arguments are passed as "f x:"
+	if b, ok := f.Block.Body.(*ast.Block); ok && len(f.Block.Args) == 0 {
+		p.block(b)
+		return
+	}
+	p.write(" ")
+	p.lambda(f.Block)
+}
+
+func (p *printer) lambda(l *ast.LambdaExpr) {
+	p.write("do")
+	for _, a := range l.Args {
+		p.write(" ")
+		p.arg(a)
+	}
+	if b, ok := l.Body.(*ast.Block); ok {
+		p.block(b)
+		return
+	}
+	p.write(" -> ")
+	p.expr(l.Body, levelExpr)
+}
+
+func (p *printer) ifExpr(i *ast.IfExpr) {
+	p.write("if ")
+	p.expr(i.Cond, levelBinary)
+	p.block(i.IfBranch)
+	if i.ElseBranch == nil {
+		return
+	}
+	p.line()
+	if !p.flat {
+		p.flushComments(offset(i.ElseBranch), false)
+	}
+	p.write("else")
+	switch e := i.ElseBranch.(type) {
+	case *ast.IfExpr:
+		p.write(" ")
+		p.ifExpr(e)
+	case *ast.Block:
+		p.block(e)
+	}
+}
+
+func (p *printer) handle(h *ast.Handle) {
+	p.write("handle")
+	p.block(h.Body)
+	arms := h.Arms
+	if h.Return != nil {
+		// the return clause is kept where it was written
+		arms = make([]*ast.WithClause, 0, len(h.Arms)+1)
+		placed := false
+		for _, w := range h.Arms {
+			if !placed && h.Return.Span.Beg.Offset < w.Span.Beg.Offset {
+				arms = append(arms, h.Return)
+				placed = true
+			}
+			arms = append(arms, w)
+		}
+		if !placed {
+			arms = append(arms, h.Return)
+		}
+	}
+	for _, w := range arms {
+		p.line()
+		p.startLine(int(w.Span.Beg.Offset), false)
+		if w.Effect == nil {
+			p.write("with return " + w.Arg.Name)
+			p.block(w.Body)
+			continue
+		}
+		p.write("with ")
+		p.expr(w.Effect, levelSimple)
+		p.write(" " + w.Arg.Name)
+		if w.Continuation != nil {
+			p.write(" -> " + w.Continuation.Name)
+		}
+		if w.Guard != nil {
+			p.write(" if ")
+			p.expr(w.Guard, levelExpr)
+		}
+		p.block(w.Body)
+	}
+	if h.Finally == nil {
+		return
+	}
+	p.line()
+	if !p.flat {
+		p.flushComments(offset(h.Finally), false)
+	}
+	p.write("finally")
+	p.block(h.Finally)
+}
+
+func (p *printer) match(m *ast.Match) {
+	p.write("match ")
+	p.expr(m.Scrutinee, levelBinary)
+	p.write(":")
+	p.indent += indentWidth
+	for i, arm := range m.Arms {
+		p.line()
+		p.startLine(int(arm.Span.Beg.Offset), i == 0)
+		p.write("case ")
+		p.pattern(arm.Pattern)
+		if arm.Guard != nil {
+			p.write(" if ")
+			p.expr(arm.Guard, levelExpr)
+		}
+		// arms written as "case p -> e" have a block
+		// sharing the span with its only expression
+		if len(arm.Body.Instr) == 1 {
+			if s, ok := arm.Body.Instr[0].(*ast.StmtExpr); ok && s.NodeSpan() == arm.Body.Span {
+				p.write(" -> ")
+				p.expr(s.Expr, levelExpr)
+				continue
+			}
+		}
+		p.block(arm.Body)
+	}
+	if !p.flat {
+		first := int(m.Arms[0].Span.Beg.Offset)
+		p.flushInner(endOffset(m), first-p.lineStart(first))
+	}
+	p.indent -= indentWidth
+	p.line()
+}
+
+func (p *printer) pattern(pat ast.Pattern) {
+	switch pat := pat.(type) {
+	case *ast.WildcardPattern:
+		p.write("_")
+	case *ast.BindPattern:
+		p.write(pat.Name)
+	case *ast.LiteralPattern:
+		p.expr(pat.Val, levelSimple)
+	case *ast.TuplePattern:
+		p.write("(")
+		p.patterns(pat.Elems)
+		if len(pat.Elems) == 1 {
+			p.write(",")
+		}
+		p.write(")")
+	case *ast.ListPattern:
+		p.write("[")
+		p.patterns(pat.Elems)
+		p.write("]")
+	case *ast.RecordPattern:
+		p.write("{")
+		for i, f := range pat.Fields {
+			if i > 0 {
+				p.write(", ")
+			}
+			if b, ok := f.Pat.(*ast.BindPattern); ok && b.Name == f.Key {
+				p.write(f.Key)
+				continue
+			}
+			p.write(f.Key + ": ")
+			p.pattern(f.Pat)
+		}
+		p.write("}")
+	default:
+		panic(fmt.Sprintf("ICE: cannot format pattern %T", pat))
+	}
+}
+
+func (p *printer) patterns(pp []ast.Pattern) {
+	for i, e := range pp {
+		if i > 0 {
+			p.write(", ")
+		}
+		p.pattern(e)
+	}
+}
+
+func formatFloat(v float64) string {
+	s := strconv.FormatFloat(v, 'f', -1, 64)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
+
+// quote returns the string literal with the value.
+// Single quotes are used if the value contains double quotes
+// as there is no way to escape them.
+func quote(s string) string {
+	q := "\""
+	if strings.Contains(s, q) && !strings.Contains(s, "'") {
+		q = "'"
+	}
+	s = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\t", "\\t").Replace(s)
+	return q + s + q
+}
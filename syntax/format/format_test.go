@@ -0,0 +1,263 @@
+package format
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gala377/MLLang/syntax"
+	"github.com/gala377/MLLang/syntax/ast"
+)
+
+type ftable []struct {
+	source string
+	want   string
+}
+
+func TestFormatting(t *testing.T) {
+	table := ftable{
+		{
+			"fn f x:\n    let y = add x 1\n    y\n",
+			"fn f x:\n  let y = add x 1\n  y\n",
+		},
+		{
+			"let f = do |a b|:\n  add a b\n",
+			"let f = do a b:\n  add a b\n",
+		},
+		{
+			"let f = do |(a, b)| -> add a b\n",
+			"let f = do (a, b) -> add a b\n",
+		},
+		{
+			"foreach xs do:\n  io.print 1\n",
+			"foreach xs:\n  io.print 1\n",
+		},
+		{
+			"let r = { a: 1,b : 2,c }\n",
+			"let r = {a: 1, b: 2, c}\n",
+		},
+		{
+			"let r = {\n    a: 1, b: 2 }\n",
+			"let r = {\n  a: 1,\n  b: 2,\n}\n",
+		},
+		{
+			"let l = [ 1,2,\n  3 ]\n",
+			"let l = [1, 2, 3]\n",
+		},
+		{
+			"let l = [\"aaaaaaaaaaaaaaaaaaaa\", \"bbbbbbbbbbbbbbbbbbbb\", \"cccccccccccccccccccc\", \"dddd\"]\n",
+			"let l = [\n  \"aaaaaaaaaaaaaaaaaaaa\",\n  \"bbbbbbbbbbbbbbbbbbbb\",\n  \"cccccccccccccccccccc\",\n  \"dddd\",\n]\n",
+		},
+		{
+			"let r = {\n  fn f x = x,\n  fn g:\n     1\n}\n",
+			"let r = {\n  fn f x = x,\n  fn g:\n    1\n}\n",
+		},
+		{
+			"io.print $ add 1 $ add 2 3\nio.print (add 1 (add 2 3))\n",
+			"io.print $ add 1 $ add 2 3\nio.print (add 1 (add 2 3))\n",
+		},
+		{
+			"x :add 1 ::sub 2\n",
+			"x :add 1 ::sub 2\n",
+		},
+		{
+			"io.print ((f!)!)\n",
+			"io.print (f!)!\n",
+		},
+		{
+			"if x:\n  1\nelse  if y:\n  2\nelse:\n  3\n",
+			"if x:\n  1\nelse if y:\n  2\nelse:\n  3\n",
+		},
+		{
+			"match x:\n  case (a, _) if a -> 1\n  case {a, b: [c]}:\n    c\n",
+			"match x:\n  case (a, _) if a -> 1\n  case {a, b: [c]}:\n    c\n",
+		},
+		{
+			"handle:\n  f!\nwith Eff v -> k if v:\n  resume k v\nwith other.Eff _:\n  none\n",
+			"handle:\n  f!\nwith Eff v -> k if v:\n  resume k v\nwith other.Eff _:\n  none\n",
+		},
+		{
+			"handle:\n  f!\nwith Eff v:\n  none\nfinally:\n  close h\n",
+			"handle:\n  f!\nwith Eff v:\n  none\nfinally:\n  close h\n",
+		},
+		{
+			"handle:\n  f!\nwith Eff v:\n  none\nwith return  v:\n  (v, 1)\n",
+			"handle:\n  f!\nwith Eff v:\n  none\nwith return v:\n  (v, 1)\n",
+		},
+		{
+			"fn f (a, b) :: a => {(a, a) -> a} ! {error}:\n  return\n",
+			"fn f (a, b) :: a => {(a, a) -> a} ! {error}:\n  return\n",
+		},
+		{
+			"let s = \"a\\tb\\n\"\nlet q = '\"'\nlet fl = 1.\n",
+			"let s = \"a\\tb\\n\"\nlet q = '\"'\nlet fl = 1.0\n",
+		},
+		{
+			"(do exit:\n  exit 1\n  io.print 2) exit\n",
+			"(do exit:\n  exit 1\n  io.print 2) exit\n",
+		},
+		{
+			"let r = {\n  f: do:\n    1,\n  g: 2,\n}\n",
+			"let r = {\n  f: do:\n    1,\n  g: 2,\n}\n",
+		},
+		{
+			"while (do -> true)!:\n  break\nfor (a, b) in [(1, 2)]:\n  continue\n",
+			"while (do -> true)!:\n  break\nfor (a, b) in [(1, 2)]:\n  continue\n",
+		},
+		{
+			"infixl 6 + = add\ninfixl 7 * = mul\nio.print ((1+2)*3 + (4*5))\n",
+			"infixl 6 + = add\ninfixl 7 * = mul\nio.print ((1 + 2) * 3 + 4 * 5)\n",
+		},
+		{
+			"infixr 5 ++ = concat\nio.print ((a ++ b) ++ (c ++ d))\nfold xs 0 (++)\n",
+			"infixr 5 ++ = concat\nio.print ((a ++ b) ++ c ++ d)\nfold xs 0 (++)\n",
+		},
+		{
+			"io.print (a + b + c)\n",
+			"io.print ((a + b) + c)\n",
+		},
+	}
+	matchFormattingWithTable(t, table)
+}
+
+func TestFormattingKeepsComments(t *testing.T) {
+	table := ftable{
+		{
+			"; header\n\n\n\nfn f:   ; trailing\n  ; first\n  1\n\n  ; inner\n  2\n  ; last\n\n; next\nf!\n",
+			"; header\n\nfn f: ; trailing\n  ; first\n  1\n\n  ; inner\n  2\n  ; last\n\n; next\nf!\n",
+		},
+		{
+			"let r = {a: 1, ; first\n b: 2}\n",
+			"let r = {\n  a: 1, ; first\n  b: 2,\n}\n",
+		},
+		{
+			"let l = [\n  1,\n  ; two\n  2,\n  ; end\n]\n",
+			"let l = [\n  1,\n  ; two\n  2,\n  ; end\n]\n",
+		},
+		{
+			"match x:\n  ; one\n  case 1 -> 1 ; trailing\n  ; any\n  case _ -> 2\n",
+			"match x:\n  ; one\n  case 1 -> 1 ; trailing\n  ; any\n  case _ -> 2\n",
+		},
+		{
+			"; only comments\n",
+			"; only comments\n",
+		},
+		{
+			"fn f:\n  let x = 1 ; c2\n  x ; c3\n",
+			"fn f:\n  let x = 1 ; c2\n  x ; c3\n",
+		},
+		{
+			"if x:\n  1 ; then\nelse:\n  2 ; else\nlet l = [\n  1, ; a\n  2, ; b\n]\n",
+			"if x:\n  1 ; then\nelse:\n  2 ; else\nlet l = [\n  1, ; a\n  2, ; b\n]\n",
+		},
+		{
+			"let r = {\n  fn g:\n    1 ; c\n}\n",
+			"let r = {\n  fn g:\n    1 ; c\n}\n",
+		},
+		{
+			"io.print (f (do x:\n  x ; c\n))\n",
+			"io.print (f (do x:\n  x)) ; c\n",
+		},
+	}
+	matchFormattingWithTable(t, table)
+}
+
+func TestFormattingReportsSyntaxErrors(t *testing.T) {
+	source := []byte("fn f x =\n")
+	res, errs := Source(source)
+	if len(errs) == 0 {
+		t.Fatalf("expected syntax errors")
+	}
+	if !bytes.Equal(res, source) {
+		t.Errorf("expected source to be returned unchanged, got %q", res)
+	}
+}
+
+// TestFormattingKeepsAst formats the sources found in the repository
+// and checks that they parse to the same ast and are formatted
+// the same way the second time.
+func TestFormattingKeepsAst(t *testing.T) {
+	files := []string{}
+	for _, pattern := range []string{"../../tests/*.fnk", "../../tests/modules/*.fnk", "../../cmd/funk/std/*.fnk", "../../examples/*.fnk"} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, matches...)
+	}
+	if len(files) == 0 {
+		t.Fatal("no source files found")
+	}
+	for _, path := range files {
+		t.Run(path, func(t *testing.T) {
+			source, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// end to end tests start with the expected output
+			if i := bytes.Index(source, []byte("@SOURCE\n")); i != -1 {
+				source = source[i+len("@SOURCE\n"):]
+			}
+			want, errs := parse(source)
+			if len(errs) > 0 {
+				t.Skipf("source does not parse %v", errs)
+			}
+			formatted, errs := Source(source)
+			if len(errs) > 0 {
+				t.Fatalf("could not format %v", errs)
+			}
+			got, errs := parse(formatted)
+			if len(errs) > 0 {
+				t.Fatalf("formatted source does not parse %v:\n%s", errs, formatted)
+			}
+			if len(got) != len(want) {
+				t.Fatalf("expected %d nodes got %d:\n%s", len(want), len(got), formatted)
+			}
+			for i := range want {
+				if !ast.AstEqual(want[i], got[i]) {
+					t.Errorf("node %d differs after formatting\nwant: %s\ngot:  %s", i, want[i], got[i])
+				}
+			}
+			again, _ := Source(formatted)
+			if !bytes.Equal(again, formatted) {
+				t.Errorf("formatting is not idempotent\nfirst:\n%s\nsecond:\n%s", formatted, again)
+			}
+		})
+	}
+}
+
+func parse(source []byte) ([]ast.Node, []syntax.SyntaxError) {
+	p := syntax.NewParser(bytes.NewReader(source))
+	nodes := p.Parse()
+	return nodes, p.Errors()
+}
+
+func matchFormattingWithTable(t *testing.T, table ftable) {
+	for _, test := range table {
+		t.Run(test.source, func(t *testing.T) {
+			got, errs := Source([]byte(test.source))
+			if len(errs) > 0 {
+				t.Fatalf("unexpected syntax errors %v", errs)
+			}
+			if string(got) != test.want {
+				t.Errorf("wrong formatting\nwant:\n%s\ngot:\n%s", test.want, got)
+			}
+			again, _ := Source(got)
+			if !bytes.Equal(again, got) {
+				t.Errorf("formatting is not idempotent, second pass:\n%s", again)
+			}
+			want, _ := parse([]byte(test.source))
+			nodes, _ := parse(got)
+			if len(nodes) != len(want) {
+				t.Fatalf("expected %d nodes got %d", len(want), len(nodes))
+			}
+			for i := range want {
+				if !ast.AstEqual(want[i], nodes[i]) {
+					t.Errorf("node %d differs after formatting: %s", i, strings.TrimSpace(nodes[i].String()))
+				}
+			}
+		})
+	}
+}
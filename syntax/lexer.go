@@ -43,6 +43,8 @@ type (
 
 		curr token.Token
 		peek token.Token
+		// comments skipped when they are not returned as tokens
+		comments []token.Token
 	}
 
 	ErrorHandler = func(beg, end span.Position, msg string)
@@ -82,6 +84,11 @@ func (l *Lexer) Peek() token.Token {
 	return l.peek
 }
 
+// Comments returns the comments skipped so far.
+func (l *Lexer) Comments() []token.Token {
+	return l.comments
+}
+
 func (l *Lexer) moveToNextTok() {
 	if l.position.Column > 1 {
 		l.skipSpaces()
@@ -106,6 +113,9 @@ func (l *Lexer) scanNextToken() token.Token {
 	case unicode.IsSpace(ch):
 		tok.Typ = token.Indent
 		tok.Val = l.scanIndent()
+		if l.ch == ';' && !l.GetMode(returnComments) {
+			return l.skipComment(true)
+		}
 	case isValidFirstIdentifierChar(ch):
 		val := l.scanIdentifier()
 		tok.Typ = token.Lookup(val)
@@ -121,19 +131,25 @@ func (l *Lexer) scanNextToken() token.Token {
 	case ch == '"' || ch == '\'':
 		tok.Typ = token.String
 		tok.Val, err = l.scanStringLit()
+	case ch == '|' && (l.peekRune() == '>' || l.peekRune() == '|'):
+		// "|" on its own delimits lambda's arguments
+		// but it can start operators like "|>" or "||"
+		tok.Typ = token.Operator
+		tok.Val = l.scanOperator()
 	case isValidInOperator(ch):
 		val := l.scanOperator()
 		tok.Typ = token.LookupOperator(val)
 		tok.Val = val
+		if val == "~" && (isValidFirstIdentifierChar(l.ch) || l.ch == '(') {
+			// "~" directly followed by an expression is an unquote
+			tok.Typ = token.Unquote
+		}
 	case ch == ';':
-		tok.Val = l.scanComment()
-		tok.Typ = token.Comment
 		if !l.GetMode(returnComments) {
-			if l.eof {
-				return token.NewEof(l.position)
-			}
-			return l.scanNextToken()
+			return l.skipComment(bpos.Column == 1)
 		}
+		tok.Val = l.scanComment()
+		tok.Typ = token.Comment
 	case ch == ':':
 		nch := l.readRune()
 		if isValidFirstIdentifierChar(nch) {
@@ -145,6 +161,12 @@ func (l *Lexer) scanNextToken() token.Token {
 			tok.Val = val
 		} else if nch == ':' {
 			nch = l.readRune()
+			if unicode.IsSpace(nch) || l.eof {
+				// type annotation
+				tok.Typ = token.DoubleColon
+				tok.Val = token.IdToString(tok.Typ)
+				break
+			}
 			if !isValidFirstIdentifierChar(nch) {
 				err = fmt.Errorf("expected identifier in local lookup infix call")
 				break
@@ -227,6 +249,17 @@ func (l *Lexer) readRune() rune {
 	return r
 }
 
+// peekRune returns the character after the current one
+// without moving the lexer, -1 is returned at the eof.
+func (l *Lexer) peekRune() rune {
+	r, _, err := l.reader.ReadRune()
+	if err != nil {
+		return -1
+	}
+	l.reader.UnreadRune()
+	return r
+}
+
 func (l *Lexer) movePositionByRune(current rune) {
 	if current == '\n' {
 		l.position = span.Position{Line: l.position.Line + 1, Column: 0, Offset: 0}
@@ -267,6 +300,8 @@ func (l *Lexer) scanNumber() (val string, isfloat bool, err error) {
 			l.readRune()
 			err = l.scanNumbersFractionPart(&b)
 			val = b.String()
+		default:
+			err = fmt.Errorf("numbers cannot have leading zeros")
 		}
 		return
 	}
@@ -344,7 +379,7 @@ func (l *Lexer) scanStringLit() (string, error) {
 func (l *Lexer) scanOperator() string {
 	var b strings.Builder
 	ch := l.ch
-	for isValidInOperator(ch) {
+	for isValidInOperator(ch) || ch == '|' {
 		b.WriteRune(ch)
 		ch = l.readRune()
 	}
@@ -361,6 +396,26 @@ func (l *Lexer) scanComment() string {
 	return b.String()
 }
 
+// skipComment records the comment starting at the current character
+// and returns the token following it. If the comment is the only thing
+// in its line the whole line is skipped, so that comments do not take
+// part in the indentation of the code around them.
+func (l *Lexer) skipComment(wholeLine bool) token.Token {
+	tok := l.newToken()
+	tok.Typ = token.Comment
+	tok.Val = l.scanComment()
+	tok.Span.End = l.position
+	tok.Span.End.Offset = uint(l.offset - 1)
+	l.comments = append(l.comments, tok)
+	if wholeLine && l.ch == '\n' {
+		l.readRune()
+	}
+	if l.eof {
+		return token.NewEof(l.position)
+	}
+	return l.scanNextToken()
+}
+
 func (l *Lexer) recover() string {
 	var b strings.Builder
 	ch := l.ch
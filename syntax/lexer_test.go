@@ -166,6 +166,29 @@ func TestScanningOperators(t *testing.T) {
 				{"??", token.Operator, 24, 26},
 			},
 		},
+		{
+			"|> || |a|->",
+			[]it{
+				{"|>", token.Operator, 0, 2},
+				{"||", token.Operator, 3, 5},
+				{"|", token.Pipe, 6, 7},
+				{"a", token.Identifier, 7, 8},
+				{"|", token.Pipe, 8, 9},
+				{"->", token.Arrow, 9, 11},
+			},
+		},
+		{
+			"f :: a => {a}",
+			[]it{
+				{"f", token.Identifier, 0, 1},
+				{"::", token.DoubleColon, 2, 4},
+				{"a", token.Identifier, 5, 6},
+				{"=>", token.FatArrow, 7, 9},
+				{"{", token.LBracket, 10, 11},
+				{"a", token.Identifier, 11, 12},
+				{"}", token.RBracket, 12, 13},
+			},
+		},
 	}
 	matchAllTestWithTable(t, &table)
 }
@@ -252,6 +275,18 @@ func TestSkippingLineComments(t *testing.T) {
 	if eof.Typ != token.Eof {
 		t.Errorf("Expected EOF token, got: %v", eof)
 	}
+	comments := l.Comments()
+	if len(comments) != 2 {
+		t.Fatalf("Expected 2 skipped comments, got: %v", comments)
+	}
+	for i, want := range []it{
+		{"this is a line comment", token.Comment, 1, 24},
+		{"another line comment", token.Comment, 26, 47},
+	} {
+		if got := comments[i]; got.Val != want.N || got.Span.Beg.Offset != want.B {
+			t.Errorf("Wrong comment - want: %#v got: %#v", want, got)
+		}
+	}
 }
 
 func matchAllTestWithTable(t *testing.T, table *tablet) {
@@ -305,3 +340,28 @@ func tokensEqual(t1 *token.Token, t2 *token.Token) bool {
 // func matchErrorsWithTable
 // test operators
 // test special so : and parenthesis and all
+
+func TestSkippingCommentOnlyLines(t *testing.T) {
+	table := tablet{
+		{
+			"a\n    ; deeper\n  b\n; at zero\n  c",
+			[]it{
+				{"a", token.Identifier, 0, 1},
+				{"\n", token.NewLine, 1, 2},
+				{"2", token.Indent, 15, 17},
+				{"b", token.Identifier, 17, 18},
+				{"\n", token.NewLine, 18, 19},
+				{"2", token.Indent, 29, 31},
+				{"c", token.Identifier, 31, 32},
+			},
+		},
+		{
+			"a\n  ; trailing",
+			[]it{
+				{"a", token.Identifier, 0, 1},
+				{"\n", token.NewLine, 1, 2},
+			},
+		},
+	}
+	matchAllTestWithTable(t, &table)
+}
@@ -12,6 +12,9 @@ import (
 	"github.com/gala377/MLLang/syntax/token"
 )
 
+// Prefix of the generated names for destructured function arguments.
+const ARG_PREFIX = "@arg"
+
 type parseExprFn = func() (ast.Expr, bool)
 type parseStmtFn = func() (ast.Stmt, bool)
 type SyntaxError struct {
@@ -36,8 +39,38 @@ type Parser struct {
 	exprSpecialForms    [token.Eof + 1]parseExprFn
 	parseTrailingBlocks bool
 	scope               *Scope
+	argCounter          int
+	// true if break and continue statements are allowed.
+	// They are only allowed inside of the loop's body
+	// and not within nested expressions or functions.
+	inLoop bool
+	// type of the token before the current one,
+	// used to find the start of the line while recovering.
+	prev token.Id
+	// true after a syntax error has been reported and
+	// the parser did not get to the next statement yet.
+	// Errors are not reported in this mode as they are most
+	// likely caused by the first one.
+	panicking bool
+	// true while parsing a macro's body, the only place
+	// where quasi-quotes are allowed.
+	inMacro bool
+	// number of quasi-quotes the parser is in,
+	// unquoting is only allowed inside of them.
+	quasiDepth int
+	// fixities of the operators declared so far
+	operators Operators
 }
 
+// Operators maps operators to their fixities.
+type Operators map[string]ast.Fixity
+
+// Fixity of the operators used without a declaration.
+var DefaultFixity = ast.Fixity{Assoc: ast.AssocLeft, Prec: 9}
+
+// Highest precedence an operator can be declared with.
+const MaxPrecedence = 9
+
 func NewParser(source io.Reader) *Parser {
 	log.Println("==============Creating new parser===============")
 	var p Parser
@@ -50,6 +83,7 @@ func NewParser(source io.Reader) *Parser {
 	l := NewLexer(source, handler)
 	p.l = &l
 	p.curr = l.Next()
+	p.prev = token.NewLine
 	p.indents = []int{0}
 	p.errors = make([]SyntaxError, 0)
 	p.exprSpecialForms = [token.Eof + 1]parseExprFn{
@@ -57,34 +91,56 @@ func NewParser(source io.Reader) *Parser {
 		token.If:     p.parseIf,
 		token.Handle: p.parseHandle,
 		token.Resume: p.parseResume,
+		token.Match:  p.parseMatch,
+		token.Quote:  p.parseQuotedBlock,
 		token.Else: func() (ast.Expr, bool) {
-			p.error(p.position(), p.position(), "else expected only after while")
+			p.error(p.curr.Span.Beg, p.curr.Span.End, "else expected only after if")
 			p.recover()
 			return nil, false
 		},
 		token.With: func() (ast.Expr, bool) {
-			p.error(p.position(), p.position(), "with expected only after handle")
+			p.error(p.curr.Span.Beg, p.curr.Span.End, "with expected only after handle")
+			p.recover()
+			return nil, false
+		},
+		token.Case: func() (ast.Expr, bool) {
+			p.error(p.curr.Span.Beg, p.curr.Span.End, "case expected only inside match")
 			p.recover()
 			return nil, false
 		},
 	}
 	p.stmtSpecialForms = [token.Eof + 1]parseStmtFn{
-		token.While:  p.parseWhile,
-		token.Let:    p.parseValDecl,
-		token.Return: p.parseReturn,
+		token.While:    p.parseWhile,
+		token.Let:      p.parseValDecl,
+		token.Return:   p.parseReturn,
+		token.For:      p.parseFor,
+		token.Break:    p.parseBreak,
+		token.Continue: p.parseContinue,
 		token.Fn: func() (ast.Stmt, bool) {
-			fn, ok := p.parseLocalFnDecl()
+			fn, typ, effects, ok := p.parseLocalFnDecl()
 			if fn == nil || !ok {
 				return nil, ok
 			}
 			decl := ast.ValDecl{
-				Span: fn.Span,
-				Name: fn.Name,
-				Rhs:  fn,
+				Span:    fn.Span,
+				Name:    fn.Name,
+				Rhs:     fn,
+				Type:    typ,
+				Effects: effects,
 			}
 			p.scope.InsertVal(&decl)
 			return &decl, true
 		},
+		token.Import: p.misplacedImport,
+		token.From:   p.misplacedImport,
+		token.Macro: func() (ast.Stmt, bool) {
+			p.error(p.position(), p.position(), "macros are only allowed at the top level")
+			p.recover()
+			return nil, false
+		},
+		token.Infixl: p.misplacedOperatorDecl,
+		token.Infixr: p.misplacedOperatorDecl,
+		token.Infix:  p.misplacedOperatorDecl,
 		token.Effect: func() (ast.Stmt, bool) {
 			eff, ok := p.parseLocalEffectDecl()
 			if eff == nil || !ok {
@@ -101,32 +157,55 @@ func NewParser(source io.Reader) *Parser {
 	}
 	p.parseTrailingBlocks = true
 	p.scope = NewScope(nil)
+	p.operators = Operators{}
 	return &p
 }
 
+// UseOperators makes the parser use fixities of the operators
+// declared outside of the parsed source, for example by the prelude.
+func (p *Parser) UseOperators(ops Operators) {
+	for op, fixity := range ops {
+		p.operators[op] = fixity
+	}
+}
+
+// Operators returns fixities of the operators known to the parser,
+// including the ones declared in the parsed source.
+func (p *Parser) Operators() Operators {
+	return p.operators
+}
+
 func (p *Parser) Errors() []SyntaxError {
 	return p.errors
 }
 
+// Comments returns comments found in the source in the order
+// of their appearance. Their values do not contain the leading ';'.
+func (p *Parser) Comments() []token.Token {
+	return p.l.Comments()
+}
+
 func (p *Parser) Parse() []ast.Node {
 	log.Println("Parse")
 	nodes := make([]ast.Node, 0)
 	for !p.eof() {
 		log.Println("Parse top level loop")
+		p.panicking = false
+		beg := p.curr
 		var n ast.Node
 		var ok bool
 		n, ok = p.parseTopLevelDecl()
-		if n != nil || !ok {
-			if n != nil {
-				nodes = append(nodes, n)
-			}
+		if n == nil && ok {
+			n, ok = p.parseTopLevelStmt()
+		}
+		if !ok {
+			// nodes that failed to parse are dropped so the
+			// returned tree only holds complete declarations
+			p.synchronize(beg)
 			continue
 		}
-		n, ok = p.parseTopLevelStmt()
-		if n != nil || !ok {
-			if n != nil {
-				nodes = append(nodes, n)
-			}
+		if n != nil {
+			nodes = append(nodes, n)
 			continue
 		}
 		switch p.curr.Typ {
@@ -135,12 +214,12 @@ func (p *Parser) Parse() []ast.Node {
 		case token.NewLine:
 			p.bump()
 		case token.Indent:
-			p.error(p.curr.Span.Beg, p.position(), "Unexpected indentantion at the top level")
+			t := p.peek()
+			p.error(t.Span.Beg, t.Span.End, "unexpected indentation at the top level")
 			p.recover()
 		default:
-			bp := p.position()
-			p.recover()
-			p.error(bp, p.position(), "expected declaration or expression")
+			p.error(p.curr.Span.Beg, p.curr.Span.End, "expected declaration or expression")
+			p.synchronize(beg)
 		}
 	}
 	log.Println("Eof")
@@ -161,6 +240,18 @@ func (p *Parser) parseTopLevelDecl() (ast.Decl, bool) {
 	if enode != nil || !ok {
 		return enode, ok
 	}
+	inode, ok := p.parseImport()
+	if inode != nil || !ok {
+		return inode, ok
+	}
+	mnode, ok := p.parseMacroDecl()
+	if mnode != nil || !ok {
+		return mnode, ok
+	}
+	onode, ok := p.parseOperatorDecl()
+	if onode != nil || !ok {
+		return onode, ok
+	}
 	return nil, true
 }
 
@@ -184,10 +275,23 @@ func (p *Parser) parseGlobalFnDecl() (*ast.FuncDecl, bool) {
 	defer p.closeScope()
 
 	args := []*ast.FuncDeclArg{}
-	for arg := p.parseIdentifier(); arg != nil; arg = p.parseIdentifier() {
-		farg := &ast.FuncDeclArg{Span: arg.Span, Name: arg.Name}
+	for {
+		farg, ok := p.parseFuncArg()
+		if !ok {
+			return nil, false
+		}
+		if farg == nil {
+			break
+		}
 		args = append(args, farg)
-		p.scope.InsertFuncArg(farg)
+	}
+	typ, ok := p.parseTypeAnnotation()
+	if !ok {
+		return nil, false
+	}
+	effects, ok := p.parseEffectAnnotation()
+	if !ok {
+		return nil, false
 	}
 	var fbody ast.Expr
 	body, ok := p.parseBlock()
@@ -216,43 +320,216 @@ func (p *Parser) parseGlobalFnDecl() (*ast.FuncDecl, bool) {
 	}
 	span := span.NewSpan(beg, p.position())
 	fn := ast.FuncDecl{
+		Span:    &span,
+		Name:    name.Name,
+		Args:    args,
+		Body:    fbody,
+		Type:    typ,
+		Effects: effects,
+	}
+	return &fn, true
+}
+
+// parseMacroDecl parses "macro name args: body" which is declared
+// like a function but can use quasi-quotes inside of its body.
+func (p *Parser) parseMacroDecl() (*ast.MacroDecl, bool) {
+	log.Println("Parse macro decl")
+	beg := p.position()
+	if t := p.match(token.Macro); t == nil {
+		return nil, true
+	}
+	name := p.parseIdentifier()
+	if name == nil {
+		p.error(beg, p.position(), "expected macro name")
+		p.recover()
+		return nil, false
+	}
+	p.scope.Insert(name.Name)
+	p.openScope()
+	defer p.closeScope()
+	p.inMacro = true
+	defer func() { p.inMacro = false }()
+	args := []*ast.FuncDeclArg{}
+	for {
+		farg, ok := p.parseFuncArg()
+		if !ok {
+			return nil, false
+		}
+		if farg == nil {
+			break
+		}
+		args = append(args, farg)
+	}
+	var mbody ast.Expr
+	body, ok := p.parseBlock()
+	if !ok {
+		return nil, false
+	}
+	if body == nil {
+		if t := p.match(token.Assignment); t == nil {
+			p.error(beg, p.position(), "expected colon or assignment in macro definition")
+			p.recover()
+			return nil, false
+		}
+		ebody, ok := p.parseExpr()
+		if !ok {
+			return nil, false
+		}
+		if ebody == nil {
+			p.error(beg, p.position(), "expected expression as a macro body")
+			p.recover()
+			return nil, false
+		}
+		mbody = ebody
+	} else {
+		mbody = body
+	}
+	span := span.NewSpan(beg, p.position())
+	return &ast.MacroDecl{
 		Span: &span,
 		Name: name.Name,
 		Args: args,
-		Body: fbody,
+		Body: mbody,
+	}, true
+}
+
+// parseOperatorDecl parses "infixl prec op = rhs". The declared
+// fixity is used for the rest of the source.
+func (p *Parser) parseOperatorDecl() (*ast.OperatorDecl, bool) {
+	log.Println("Parse operator decl")
+	beg := p.position()
+	var assoc ast.Assoc
+	switch p.curr.Typ {
+	case token.Infixl:
+		assoc = ast.AssocLeft
+	case token.Infixr:
+		assoc = ast.AssocRight
+	case token.Infix:
+		assoc = ast.AssocNone
+	default:
+		return nil, true
 	}
-	return &fn, true
+	p.bump()
+	prec := p.match(token.Integer)
+	if prec == nil {
+		p.error(beg, p.position(), "expected precedence in operator declaration")
+		p.recover()
+		return nil, false
+	}
+	val, err := strconv.Atoi(prec.Val)
+	if err != nil || val > MaxPrecedence {
+		p.error(prec.Span.Beg, prec.Span.End, fmt.Sprintf("operator precedence has to be between 0 and %d", MaxPrecedence))
+		p.recover()
+		return nil, false
+	}
+	op := p.match(token.Operator)
+	if op == nil {
+		p.error(beg, p.position(), "expected operator in operator declaration")
+		p.recover()
+		return nil, false
+	}
+	if t := p.match(token.Assignment); t == nil {
+		p.error(beg, p.position(), "expected '=' operator in operator declaration")
+		p.recover()
+		return nil, false
+	}
+	expr, ok := p.parseExpr()
+	if !ok {
+		return nil, false
+	}
+	if expr == nil {
+		p.error(beg, p.position(), "expected expression after '=' in operator declaration")
+		p.recover()
+		return nil, false
+	}
+	fixity := ast.Fixity{Assoc: assoc, Prec: val}
+	p.operators[op.Val] = fixity
+	p.scope.Insert(op.Val)
+	span := span.NewSpan(beg, p.position())
+	return &ast.OperatorDecl{
+		Span:   &span,
+		Name:   op.Val,
+		Fixity: fixity,
+		Rhs:    expr,
+	}, true
 }
 
-func (p *Parser) parseGlobalValDecl() (*ast.GlobalValDecl, bool) {
+func (p *Parser) misplacedOperatorDecl() (ast.Stmt, bool) {
+	p.error(p.curr.Span.Beg, p.curr.Span.End, "operators can only be declared at the top level")
+	p.recover()
+	return nil, false
+}
+
+func (p *Parser) parseGlobalValDecl() (ast.Decl, bool) {
 	log.Println("Parsing val decl")
 	beg := p.position()
 	if t := p.match(token.Let); t == nil {
 		return nil, true
 	}
+	if p.checkDestructuring() {
+		return p.parseGlobalPatternDecl(beg)
+	}
 	name := p.match(token.Identifier)
 	if name == nil {
 		p.error(beg, p.position(), "expected identifier in variable declaration")
 		p.recover()
 		return nil, false
 	}
+	typ, ok := p.parseTypeAnnotation()
+	if !ok {
+		return nil, false
+	}
 	if t := p.match(token.Assignment); t == nil {
 		p.error(beg, p.position(), "expected '=' operator in variable declaration")
 		p.recover()
 		return nil, false
 	}
 	expr, ok := p.parseExpr()
+	if !ok {
+		return nil, false
+	}
+	if expr == nil {
+		p.error(beg, p.position(), "expected expression after '=' in variable declaration")
+		p.recover()
+		return nil, false
+	}
 	span := span.NewSpan(beg, p.position())
 	node := ast.GlobalValDecl{
 		Span: &span,
 		Name: name.Val,
 		Rhs:  expr,
+		Type: typ,
 	}
 	if !p.scope.IsGlobal() {
 		panic("ICE: expected global scope")
 	}
 	p.scope.Insert(node.Name)
-	return &node, ok
+	return &node, true
+}
+
+func (p *Parser) parseGlobalPatternDecl(beg span.Position) (ast.Decl, bool) {
+	pat, rhs, ok := p.parseDestructuring(beg)
+	if !ok {
+		return nil, false
+	}
+	if !p.scope.IsGlobal() {
+		panic("ICE: expected global scope")
+	}
+	seen := map[string]bool{}
+	for _, b := range ast.Bindings(pat) {
+		if seen[b.Name] {
+			p.report(b.Beg, b.End, fmt.Sprintf("name %s bound more than once in the pattern", b.Name))
+			continue
+		}
+		seen[b.Name] = true
+		p.scope.Insert(b.Name)
+	}
+	span := span.NewSpan(beg, p.position())
+	return &ast.GlobalPatternDecl{
+		Span:    &span,
+		Pattern: pat,
+		Rhs:     rhs,
+	}, true
 }
 
 func (p *Parser) parseTopLevelEffectDecl() (*ast.EffectDecl, bool) {
@@ -276,6 +553,75 @@ func (p *Parser) parseTopLevelEffectDecl() (*ast.EffectDecl, bool) {
 	}, true
 }
 
+// parseImport parses both forms of the import declaration:
+//
+//	import "path" as name
+//	from "path" import a, b
+func (p *Parser) parseImport() (ast.Decl, bool) {
+	beg := p.position()
+	switch p.curr.Typ {
+	case token.Import:
+		p.bump()
+		path := p.match(token.String)
+		if path == nil {
+			p.error(beg, p.position(), "expected module path after import")
+			p.recover()
+			return nil, false
+		}
+		if t := p.curr; t.Typ != token.Identifier || t.Val != "as" {
+			p.error(beg, p.position(), "expected 'as' after the module path")
+			p.recover()
+			return nil, false
+		}
+		p.bump()
+		name := p.parseIdentifier()
+		if name == nil {
+			p.error(beg, p.position(), "expected name to bind the module to")
+			p.recover()
+			return nil, false
+		}
+		span := span.NewSpan(beg, p.position())
+		p.scope.Insert(name.Name)
+		return &ast.ImportDecl{Span: &span, Path: path.Val, Name: name.Name}, true
+	case token.From:
+		p.bump()
+		path := p.match(token.String)
+		if path == nil {
+			p.error(beg, p.position(), "expected module path after from")
+			p.recover()
+			return nil, false
+		}
+		if p.match(token.Import) == nil {
+			p.error(beg, p.position(), "expected 'import' after the module path")
+			p.recover()
+			return nil, false
+		}
+		names := []*ast.Identifier{}
+		for {
+			name := p.parseIdentifier()
+			if name == nil {
+				p.error(beg, p.position(), "expected name of the imported value")
+				p.recover()
+				return nil, false
+			}
+			p.scope.Insert(name.Name)
+			names = append(names, name)
+			if p.match(token.Comma) == nil {
+				break
+			}
+		}
+		span := span.NewSpan(beg, p.position())
+		return &ast.FromImportDecl{Span: &span, Path: path.Val, Names: names}, true
+	}
+	return nil, true
+}
+
+func (p *Parser) misplacedImport() (ast.Stmt, bool) {
+	p.error(p.position(), p.position(), "imports are only allowed at the top level")
+	p.recover()
+	return nil, false
+}
+
 func (p *Parser) parseTopLevelStmt() (ast.Stmt, bool) {
 	log.Println("Parse top level expr")
 	return p.parseStmt()
@@ -294,7 +640,9 @@ func (p *Parser) parseStmt() (ast.Stmt, bool) {
 			if id, ok := lval.(*ast.Identifier); ok {
 				p.tryLiftVar(id.Name)
 			}
+			inLoop := p.setLoopContext(false)
 			rval, ok := p.parseExpr()
+			p.setLoopContext(inLoop)
 			if rval == nil || !ok {
 				if ok {
 					p.error(t.Span.Beg, p.position(), "expected expression after assigment operator")
@@ -331,17 +679,21 @@ func (p *Parser) parseExpr() (ast.Expr, bool) {
 }
 
 func (p *Parser) parseBinaryExpression() (ast.Expr, bool) {
+	// break and continue within a nested expression would leave
+	// partial results on the stack so they are not allowed.
+	defer p.setLoopContext(p.setLoopContext(false))
 	beg := p.position()
-	fapp, ok := p.parseInfixFunctionApp()
+	fapp, ok := p.parseOperatorExpr(0)
 	if fapp == nil || !ok {
 		return fapp, ok
 	}
 	applications := []ast.Expr{fapp}
 	for p.match(token.Dollar) != nil {
-		fapp, ok := p.parseInfixFunctionApp()
+		fapp, ok := p.parseOperatorExpr(0)
 		if fapp == nil || !ok {
 			p.error(beg, p.position(), "expected expression after binary operator")
-			return fapp, ok
+			p.recover()
+			return nil, false
 		}
 		applications = append(applications, fapp)
 	}
@@ -358,6 +710,58 @@ func (p *Parser) parseBinaryExpression() (ast.Expr, bool) {
 	return app, true
 }
 
+// parseOperatorExpr parses operator applications using precedence
+// climbing, only operators with precedence of at least minPrec are
+// parsed. Operators bind looser than infix calls but tighter than '$'.
+func (p *Parser) parseOperatorExpr(minPrec int) (ast.Expr, bool) {
+	lhs, ok := p.parseInfixFunctionApp()
+	if lhs == nil || !ok {
+		return lhs, ok
+	}
+	// precedence of the last non associative operator
+	nonAssoc := -1
+	for p.curr.Typ == token.Operator {
+		op := p.curr
+		fixity, ok := p.operators[op.Val]
+		if !ok {
+			fixity = DefaultFixity
+		}
+		if fixity.Prec < minPrec {
+			break
+		}
+		if fixity.Prec == nonAssoc {
+			p.error(op.Span.Beg, op.Span.End, fmt.Sprintf("non associative operator %s cannot be chained, use parenthesis", op.Val))
+			p.recover()
+			return nil, false
+		}
+		p.bump()
+		p.tryLiftVar(op.Val)
+		next := fixity.Prec + 1
+		if fixity.Assoc == ast.AssocRight {
+			next = fixity.Prec
+		}
+		rhs, ok := p.parseOperatorExpr(next)
+		if !ok {
+			return nil, false
+		}
+		if rhs == nil {
+			p.error(op.Span.Beg, p.position(), fmt.Sprintf("expected expression after operator %s", op.Val))
+			p.recover()
+			return nil, false
+		}
+		if fixity.Assoc == ast.AssocNone {
+			nonAssoc = fixity.Prec
+		}
+		span := span.NewSpan(lhs.NodeSpan().Beg, rhs.NodeSpan().End)
+		lhs = &ast.FuncApplication{
+			Span:   &span,
+			Callee: &ast.Identifier{Span: op.Span, Name: op.Val},
+			Args:   []ast.Expr{lhs, rhs},
+		}
+	}
+	return lhs, true
+}
+
 func (p *Parser) parseBlock() (*ast.Block, bool) {
 	log.Println("Parsing block")
 	beg := p.position()
@@ -370,6 +774,7 @@ func (p *Parser) parseBlock() (*ast.Block, bool) {
 		p.match(token.NewLine)
 		return nil, false
 	}
+	p.skipEmptyLines()
 	indent, err := p.pushNextIndent()
 	if err != nil {
 		p.error(beg, p.position(), "expected block instructions to be indented")
@@ -377,25 +782,36 @@ func (p *Parser) parseBlock() (*ast.Block, bool) {
 		return nil, false
 	}
 	defer p.popIndent(indent)
-	parseStmt := func() (ast.Stmt, bool) {
+	exprs := []ast.Stmt{}
+	for {
 		p.skipEmptyLines()
 		log.Printf("%d running wrapped parse", indent)
-		if t := p.matchIndent(indent); !t {
+		if p.checkIndentWith(func(v int) bool { return v > indent }) {
+			p.panicking = false
+			t := p.peek()
+			p.error(t.Span.Beg, t.Span.End, "unexpected indentation")
+			p.recover()
+			continue
+		}
+		if !p.matchIndent(indent) {
 			log.Println("Indentation does not match")
-			return nil, true
+			break
 		}
 		log.Println("Parse stmt for block")
-		return p.parseStmt()
-	}
-	exprs := []ast.Stmt{}
-	var e ast.Stmt = nil
-	ok := true
-	for e, ok = parseStmt(); e != nil && ok; e, ok = parseStmt() {
+		p.panicking = false
+		stmtBeg := p.curr
+		e, ok := p.parseStmt()
+		if !ok {
+			p.synchronize(stmtBeg)
+			continue
+		}
+		if e == nil {
+			p.error(p.curr.Span.Beg, p.curr.Span.End, "expected statement")
+			p.synchronize(stmtBeg)
+			continue
+		}
 		exprs = append(exprs, e)
 	}
-	if !ok {
-		return nil, false
-	}
 	span := span.NewSpan(beg, p.position())
 	node := ast.Block{
 		Span:  &span,
@@ -584,6 +1000,14 @@ func (p *Parser) parsePrimaryExpr() (ast.Expr, bool) {
 	case token.LParen:
 		// todo: make parenthesis as well as tuple multiline
 		p.bump()
+		if op := p.check(token.Operator); op != nil && p.peek().Typ == token.RParen {
+			// operator used as a value "(+)"
+			p.bump()
+			p.bump()
+			p.tryLiftVar(op.Val)
+			span := span.NewSpan(beg, p.position())
+			return &ast.Identifier{Span: &span, Name: op.Val}, true
+		}
 		node, ok := p.parseExpr()
 		if !ok {
 			return nil, false
@@ -593,6 +1017,11 @@ func (p *Parser) parsePrimaryExpr() (ast.Expr, bool) {
 			log.Println("Empty tuple")
 			return p.emptyTuple(beg), true
 		}
+		if node == nil {
+			p.error(beg, p.position(), "expected expression after opening parenthesis")
+			p.recover()
+			return nil, false
+		}
 		if t == nil {
 			log.Println("Parsing tuple")
 			if t = p.match(token.Comma); t == nil {
@@ -661,18 +1090,82 @@ func (p *Parser) parsePrimaryExpr() (ast.Expr, bool) {
 		return &node, true
 	case token.Quote:
 		p.bump()
+		if p.check(token.LParen) != nil {
+			return p.parseQuasiQuote(beg)
+		}
 		id := p.match(token.Identifier)
 		if id == nil {
 			p.error(beg, p.position(), "Only identifiers can be quoted")
 			return nil, false
 		}
 		return &ast.Symbol{Span: id.Span, Val: id.Val}, true
+	case token.Unquote:
+		p.bump()
+		if p.quasiDepth == 0 {
+			p.report(beg, p.position(), "unquote can only be used inside of a quasi-quote")
+		} else {
+			// quasi-quotes can be nested inside of the unquoted expression
+			p.quasiDepth--
+			defer func() { p.quasiDepth++ }()
+		}
+		expr, ok := p.parsePrimaryExpr()
+		if !ok {
+			return nil, false
+		}
+		if expr == nil {
+			p.error(beg, p.position(), "expected expression after unquote")
+			p.recover()
+			return nil, false
+		}
+		span := span.NewSpan(beg, p.position())
+		return &ast.Unquote{Span: &span, Expr: expr}, true
 	default:
 		log.Println("Not a primary")
 		return nil, true
 	}
 }
 
+// parseQuasiQuote parses the code quoted either as "`(expr)"
+// or as "`:" followed by a block. The quote has been already
+// consumed at this point.
+// parseQuotedBlock parses quasi-quoted block which, like other
+// expressions ending with a block, cannot be applied to arguments.
+func (p *Parser) parseQuotedBlock() (ast.Expr, bool) {
+	if p.peek().Typ != token.Colon {
+		return p.parseBinaryExpression()
+	}
+	beg := p.position()
+	p.bump()
+	return p.parseQuasiQuote(beg)
+}
+
+func (p *Parser) parseQuasiQuote(beg span.Position) (ast.Expr, bool) {
+	if !p.inMacro {
+		p.report(beg, p.position(), "quasi-quotes can only be used inside of macros")
+	}
+	p.quasiDepth++
+	defer func() { p.quasiDepth-- }()
+	// names bound by the quoted code are not visible outside of it
+	p.openScope()
+	defer p.closeScope()
+	var node ast.Expr
+	if p.check(token.Colon) != nil {
+		block, ok := p.parseBlock()
+		if !ok {
+			return nil, false
+		}
+		node = block
+	} else {
+		expr, ok := p.parsePrimaryExpr()
+		if !ok {
+			return nil, false
+		}
+		node = expr
+	}
+	span := span.NewSpan(beg, p.position())
+	return &ast.QuasiQuote{Span: &span, Node: node}, true
+}
+
 func (p *Parser) parseWhile() (ast.Stmt, bool) {
 	beg := p.position()
 	log.Printf("Parsing while, curr token is %s", token.IdToString(p.curr.Typ))
@@ -690,7 +1183,9 @@ func (p *Parser) parseWhile() (ast.Stmt, bool) {
 		p.recover()
 		return nil, false
 	}
+	inLoop := p.setLoopContext(true)
 	body, ok := p.parseBlock()
+	p.setLoopContext(inLoop)
 	if !ok {
 		return nil, false
 	}
@@ -708,34 +1203,86 @@ func (p *Parser) parseWhile() (ast.Stmt, bool) {
 	return &node, true
 }
 
-func (p *Parser) parseIf() (ast.Expr, bool) {
+func (p *Parser) parseFor() (ast.Stmt, bool) {
 	beg := p.position()
-	if t := p.match(token.If); t == nil {
+	if t := p.match(token.For); t == nil {
 		return nil, true
 	}
-	p.disallowTrailingBlocks()
-	cond, ok := p.parseExpr()
-	p.allowTrailingBlocks()
+	pat, ok := p.parsePattern()
 	if !ok {
 		return nil, false
 	}
-	if cond == nil {
-		p.error(beg, p.position(), "if expects an expression as its condition")
-		p.recoverWithTokens(token.Colon)
-	}
+	if pat == nil {
+		p.error(beg, p.position(), "for expects a name or a pattern to bind elements to")
+		p.recover()
+		return nil, false
+	}
+	if p.match(token.In) == nil {
+		p.error(beg, p.position(), "expected 'in' after the for's pattern")
+		p.recover()
+		return nil, false
+	}
+	p.disallowTrailingBlocks()
+	iterable, ok := p.parseExpr()
+	p.allowTrailingBlocks()
+	if !ok {
+		return nil, false
+	}
+	if iterable == nil {
+		p.error(beg, p.position(), "for expects an expression to iterate over")
+		p.recover()
+		return nil, false
+	}
+	p.openScope()
+	defer p.closeScope()
+	p.insertBindings(pat)
+	inLoop := p.setLoopContext(true)
 	body, ok := p.parseBlock()
+	p.setLoopContext(inLoop)
 	if !ok {
 		return nil, false
 	}
 	if body == nil {
-		p.error(beg, p.position(), "if expects a block as its body")
+		p.error(beg, p.position(), "for expects a block as its body")
 		p.recover()
+		return nil, false
+	}
+	span := span.NewSpan(beg, p.position())
+	return &ast.ForStmt{
+		Span:     &span,
+		Pattern:  pat,
+		Iterable: iterable,
+		Body:     body,
+	}, true
+}
+
+func (p *Parser) parseIf() (ast.Expr, bool) {
+	beg := p.position()
+	if t := p.match(token.If); t == nil {
 		return nil, true
 	}
-	elseb, ok := p.parseElse()
+	p.disallowTrailingBlocks()
+	cond, ok := p.parseExpr()
+	p.allowTrailingBlocks()
+	if !ok {
+		return nil, false
+	}
+	if cond == nil {
+		p.error(beg, p.position(), "if expects an expression as its condition")
+		p.recoverWithTokens(token.Colon)
+	}
+	body, ok := p.parseBlock()
 	if !ok {
+		return nil, false
+	}
+	if body == nil {
+		p.error(beg, p.position(), "if expects a block as its body")
 		p.recover()
-		return nil, true
+		return nil, false
+	}
+	elseb, ok := p.parseElse()
+	if !ok || cond == nil {
+		return nil, false
 	}
 	span := span.NewSpan(beg, p.position())
 	node := ast.IfExpr{
@@ -761,7 +1308,16 @@ func (p *Parser) parseElse() (ast.Expr, bool) {
 	if p.curr.Typ == token.If {
 		return p.parseIf()
 	}
-	return p.parseBlock()
+	beg := p.position()
+	body, ok := p.parseBlock()
+	if body == nil {
+		if ok {
+			p.error(beg, p.position(), "else expects a block as its body")
+			p.recover()
+		}
+		return nil, false
+	}
+	return body, true
 }
 
 func (p *Parser) parseHandle() (ast.Expr, bool) {
@@ -779,15 +1335,23 @@ func (p *Parser) parseHandle() (ast.Expr, bool) {
 	}
 	if body == nil {
 		p.error(beg, p.position(), "handle expects a block as its body")
-		return nil, true
+		return nil, false
 	}
 	hasguards := false
 	ww := make([]*ast.WithClause, 0, 1)
+	var ret *ast.WithClause
 	cw, ok := p.parseWith()
-	for cw != nil {
+	for cw != nil || !ok {
 		if !ok {
-			p.error(beg, p.position(), "handle expects at least one with")
-			return nil, true
+			return nil, false
+		}
+		if cw.Effect == nil {
+			if ret != nil {
+				p.error(cw.Span.Beg, cw.Span.End, "handle can only have one return clause")
+			}
+			ret = cw
+			cw, ok = p.parseWith()
+			continue
 		}
 		ww = append(ww, cw)
 		if cw.Guard != nil {
@@ -795,15 +1359,80 @@ func (p *Parser) parseHandle() (ast.Expr, bool) {
 		}
 		cw, ok = p.parseWith()
 	}
+	finally, ok := p.parseFinally()
+	if !ok {
+		return nil, false
+	}
 	span := span.NewSpan(beg, p.position())
 	return &ast.Handle{
 		Span:      &span,
 		Body:      body,
 		Arms:      ww,
 		HasGuards: hasguards,
+		Return:    ret,
+		Finally:   finally,
+	}, true
+}
+
+// parseReturnClause parses the rest of the "with return"
+// clause. It is returned as a with clause without an effect.
+func (p *Parser) parseReturnClause(beg span.Position) (*ast.WithClause, bool) {
+	defer p.setLoopContext(p.setLoopContext(false))
+	p.openScope()
+	defer p.closeScope()
+	argid := p.parseIdentifier()
+	if argid == nil {
+		p.error(beg, p.position(), "expected return value's name")
+		p.recover()
+		return nil, false
+	}
+	arg := &ast.FuncDeclArg{Span: argid.Span, Name: argid.Name}
+	p.scope.InsertFuncArg(arg)
+	b, ok := p.parseBlock()
+	if b == nil && ok {
+		p.error(beg, p.position(), "Expected block as return clause's body")
+		p.recover()
+		return nil, false
+	}
+	if !ok {
+		return nil, false
+	}
+	span := span.NewSpan(beg, p.position())
+	return &ast.WithClause{
+		Span: &span,
+		Arg:  arg,
+		Body: b,
 	}, true
 }
 
+// parseFinally parses the optional finally clause
+// of the handle returning nil if there is none.
+func (p *Parser) parseFinally() (*ast.Block, bool) {
+	beg := p.position()
+	if p.match(token.Finally) == nil {
+		if !p.checkIndent(p.currentIndent()) {
+			return nil, true
+		}
+		if p.peek().Typ != token.Finally {
+			return nil, true
+		}
+		p.bump()
+		p.bump()
+	}
+	// finally is not a part of the loop
+	// the handle is in, same as with clauses
+	defer p.setLoopContext(p.setLoopContext(false))
+	p.openScope()
+	defer p.closeScope()
+	b, ok := p.parseBlock()
+	if b == nil && ok {
+		p.error(beg, p.position(), "Expected block as finally's body")
+		p.recover()
+		return nil, false
+	}
+	return b, ok
+}
+
 func (p *Parser) parseWith() (*ast.WithClause, bool) {
 	beg := p.position()
 	if p.match(token.With) == nil {
@@ -816,17 +1445,26 @@ func (p *Parser) parseWith() (*ast.WithClause, bool) {
 		p.bump()
 		p.bump()
 	}
+	if p.match(token.Return) != nil {
+		return p.parseReturnClause(beg)
+	}
+	// the clause is parsed to the end even if it is invalid
+	// so its body is checked for errors as well
+	failed := false
 	effect, ok := p.parsePath()
 	if effect == nil || !ok {
 		p.error(beg, p.position(), "Expected effect to handle in with clause")
 		p.recoverWithTokens(token.Colon)
+		failed = true
 	}
+	defer p.setLoopContext(p.setLoopContext(false))
 	p.openScope()
 	argid := p.parseIdentifier()
 	arg := &ast.FuncDeclArg{}
 	if argid == nil {
 		p.error(beg, p.position(), "expected effect's value name")
 		p.recoverWithTokens(token.Colon)
+		failed = true
 	} else {
 		arg.Span = argid.Span
 		arg.Name = argid.Name
@@ -839,6 +1477,7 @@ func (p *Parser) parseWith() (*ast.WithClause, bool) {
 		if contid == nil {
 			p.error(beg, p.position(), "Expected name for the continuation")
 			p.recoverWithTokens(token.Colon)
+			failed = true
 		} else {
 			cont = &ast.FuncDeclArg{
 				Span: contid.Span,
@@ -856,6 +1495,7 @@ func (p *Parser) parseWith() (*ast.WithClause, bool) {
 		if g == nil || !ok {
 			p.error(beg, p.position(), "Expected an expression for the handler guard")
 			p.recoverWithTokens(token.Colon)
+			failed = true
 		} else {
 			guard = g
 		}
@@ -871,9 +1511,11 @@ func (p *Parser) parseWith() (*ast.WithClause, bool) {
 	b, ok := p.parseBlock()
 	if b == nil && ok {
 		p.error(beg, p.position(), "Expected block as with stmt's body")
-		p.recoverWithTokens(token.NewLine)
-		p.match(token.NewLine)
-		return nil, true
+		p.recover()
+		return nil, false
+	}
+	if failed {
+		return nil, false
 	}
 	span := span.NewSpan(beg, p.position())
 	return &ast.WithClause{
@@ -921,11 +1563,316 @@ loop:
 	return node, true
 }
 
+func (p *Parser) parseMatch() (ast.Expr, bool) {
+	log.Println("Parsing match")
+	beg := p.position()
+	if p.match(token.Match) == nil {
+		return nil, true
+	}
+	p.disallowTrailingBlocks()
+	scrutinee, ok := p.parseExpr()
+	p.allowTrailingBlocks()
+	if !ok {
+		return nil, false
+	}
+	if scrutinee == nil {
+		p.error(beg, p.position(), "match expects an expression to match on")
+		p.recoverWithTokens(token.Colon)
+	}
+	if p.match(token.Colon) == nil {
+		p.error(beg, p.position(), "expected colon after matched expression")
+		p.recover()
+		return nil, false
+	}
+	if p.match(token.NewLine) == nil {
+		p.error(beg, p.position(), "expected new line before match arms")
+		p.recoverWithTokens(token.NewLine)
+		p.match(token.NewLine)
+		return nil, false
+	}
+	p.skipEmptyLines()
+	indent, err := p.pushNextIndent()
+	if err != nil {
+		p.error(beg, p.position(), "expected match arms to be indented")
+		p.recover()
+		return nil, false
+	}
+	defer p.popIndent(indent)
+	arms := []*ast.MatchArm{}
+	failed := false
+	for {
+		p.skipEmptyLines()
+		if !p.matchIndent(indent) {
+			break
+		}
+		// arms are synchronized on like statements so
+		// errors in each of them are reported
+		p.panicking = false
+		armBeg := p.curr
+		arm, ok := p.parseMatchArm()
+		if !ok {
+			failed = true
+			p.synchronize(armBeg)
+			continue
+		}
+		arms = append(arms, arm)
+	}
+	span := span.NewSpan(beg, p.position())
+	if scrutinee == nil || failed && len(arms) == 0 {
+		return nil, false
+	}
+	if len(arms) == 0 {
+		p.error(beg, p.position(), "match expects at least one case arm")
+		return nil, false
+	}
+	return &ast.Match{
+		Span:      &span,
+		Scrutinee: scrutinee,
+		Arms:      arms,
+	}, true
+}
+
+func (p *Parser) parseMatchArm() (*ast.MatchArm, bool) {
+	beg := p.position()
+	if p.match(token.Case) == nil {
+		p.error(beg, p.position(), "expected case arm in match expression")
+		p.recover()
+		return nil, false
+	}
+	p.openScope()
+	defer p.closeScope()
+	pat, ok := p.parsePattern()
+	if !ok {
+		p.recover()
+		return nil, false
+	}
+	if pat == nil {
+		p.error(beg, p.position(), "expected pattern after case")
+		p.recover()
+		return nil, false
+	}
+	p.insertBindings(pat)
+	var guard ast.Expr = nil
+	hasGuard := p.match(token.If) != nil
+	if hasGuard {
+		p.disallowTrailingBlocks()
+		g, ok := p.parseExpr()
+		p.allowTrailingBlocks()
+		if !ok {
+			return nil, false
+		}
+		if g == nil {
+			p.error(beg, p.position(), "expected an expression for the case guard")
+			p.recoverWithTokens(token.Colon, token.Arrow)
+		}
+		guard = g
+	}
+	var body *ast.Block
+	if p.check(token.Colon) != nil {
+		b, ok := p.parseBlock()
+		if !ok {
+			return nil, false
+		}
+		body = b
+	} else if p.match(token.Arrow) != nil {
+		e, ok := p.parseExpr()
+		if !ok {
+			return nil, false
+		}
+		if e == nil {
+			p.error(beg, p.position(), "expected expression after -> in case arm")
+			p.recover()
+			return nil, false
+		}
+		p.match(token.NewLine)
+		body = &ast.Block{
+			Span:  e.NodeSpan(),
+			Instr: []ast.Stmt{&ast.StmtExpr{Expr: e}},
+		}
+	}
+	if body == nil {
+		p.error(beg, p.position(), "expected block or -> after case pattern")
+		p.recover()
+		return nil, false
+	}
+	if guard == nil && hasGuard {
+		return nil, false
+	}
+	span := span.NewSpan(beg, p.position())
+	return &ast.MatchArm{
+		Span:    &span,
+		Pattern: pat,
+		Guard:   guard,
+		Body:    body,
+	}, true
+}
+
+// parsePattern parses a pattern used to destructure values.
+// Returns nil if current token cannot begin a pattern.
+func (p *Parser) parsePattern() (ast.Pattern, bool) {
+	log.Println("Parsing pattern")
+	beg := p.position()
+	tok := p.curr
+	switch tok.Typ {
+	case token.Identifier:
+		p.bump()
+		if tok.Val == "_" {
+			return &ast.WildcardPattern{Span: tok.Span}, true
+		}
+		return &ast.BindPattern{Span: tok.Span, Name: tok.Val}, true
+	case token.Integer, token.Float, token.String, token.True, token.False, token.None, token.Quote:
+		lit, ok := p.parsePrimaryExpr()
+		if lit == nil || !ok {
+			return nil, false
+		}
+		return &ast.LiteralPattern{Span: lit.NodeSpan(), Val: lit}, true
+	case token.Operator:
+		if tok.Val != "-" {
+			return nil, true
+		}
+		p.bump()
+		lit, ok := p.parsePrimaryExpr()
+		if !ok {
+			return nil, false
+		}
+		span := span.NewSpan(beg, p.position())
+		switch v := lit.(type) {
+		case *ast.IntConst:
+			return &ast.LiteralPattern{Span: &span, Val: &ast.IntConst{Span: &span, Val: -v.Val}}, true
+		case *ast.FloatConst:
+			return &ast.LiteralPattern{Span: &span, Val: &ast.FloatConst{Span: &span, Val: -v.Val}}, true
+		}
+		p.error(beg, p.position(), "only numbers can be negated in patterns")
+		return nil, false
+	case token.LParen:
+		p.bump()
+		if p.match(token.RParen) != nil {
+			span := span.NewSpan(beg, p.position())
+			return &ast.TuplePattern{Span: &span, Elems: []ast.Pattern{}}, true
+		}
+		first, ok := p.parsePattern()
+		if !ok {
+			return nil, false
+		}
+		if first == nil {
+			p.error(beg, p.position(), "expected pattern after opening parenthesis")
+			return nil, false
+		}
+		if p.match(token.RParen) != nil {
+			return first, true
+		}
+		if p.match(token.Comma) == nil {
+			p.error(beg, p.position(), "missing closing parenthesis ')' in pattern")
+			return nil, false
+		}
+		elems, ok := p.parsePatternList(first)
+		if !ok {
+			return nil, false
+		}
+		if p.match(token.RParen) == nil {
+			p.error(beg, p.position(), "Expected ) to close a tuple pattern")
+			return nil, false
+		}
+		span := span.NewSpan(beg, p.position())
+		return &ast.TuplePattern{Span: &span, Elems: elems}, true
+	case token.LSquareParen:
+		p.bump()
+		elems, ok := p.parsePatternList(nil)
+		if !ok {
+			return nil, false
+		}
+		if p.match(token.RSquareParen) == nil {
+			p.error(beg, p.position(), "Expected ] to close a list pattern")
+			return nil, false
+		}
+		span := span.NewSpan(beg, p.position())
+		return &ast.ListPattern{Span: &span, Elems: elems}, true
+	case token.LBracket:
+		p.bump()
+		return p.parseRecordPattern(beg)
+	}
+	return nil, true
+}
+
+// parsePatternList parses comma separated patterns.
+// Trailing comma is allowed.
+func (p *Parser) parsePatternList(first ast.Pattern) ([]ast.Pattern, bool) {
+	elems := []ast.Pattern{}
+	if first != nil {
+		elems = append(elems, first)
+	}
+	for {
+		pat, ok := p.parsePattern()
+		if !ok {
+			return nil, false
+		}
+		if pat == nil {
+			break
+		}
+		elems = append(elems, pat)
+		if p.match(token.Comma) == nil {
+			break
+		}
+	}
+	return elems, true
+}
+
+func (p *Parser) parseRecordPattern(beg span.Position) (*ast.RecordPattern, bool) {
+	fields := []ast.RecordFieldPattern{}
+	for {
+		key := p.parseIdentifier()
+		if key == nil {
+			break
+		}
+		if p.match(token.Colon) == nil {
+			// same name binding sugar
+			fields = append(fields, ast.RecordFieldPattern{
+				Key: key.Name,
+				Pat: &ast.BindPattern{Span: key.Span, Name: key.Name},
+			})
+		} else {
+			pat, ok := p.parsePattern()
+			if !ok {
+				return nil, false
+			}
+			if pat == nil {
+				p.error(beg, p.position(), "expected pattern after colon in record pattern")
+				return nil, false
+			}
+			fields = append(fields, ast.RecordFieldPattern{Key: key.Name, Pat: pat})
+		}
+		if p.match(token.Comma) == nil {
+			break
+		}
+	}
+	if p.match(token.RBracket) == nil {
+		p.error(beg, p.position(), "missing closing bracket in record pattern")
+		return nil, false
+	}
+	span := span.NewSpan(beg, p.position())
+	return &ast.RecordPattern{Span: &span, Fields: fields}, true
+}
+
+// insertBindings declares names bound by the pattern
+// in the current scope.
+func (p *Parser) insertBindings(pat ast.Pattern) {
+	seen := map[string]bool{}
+	for _, b := range ast.Bindings(pat) {
+		if seen[b.Name] {
+			p.report(b.Beg, b.End, fmt.Sprintf("name %s bound more than once in the pattern", b.Name))
+			continue
+		}
+		seen[b.Name] = true
+		p.scope.InsertBinding(b)
+	}
+}
+
 func (p *Parser) parseLambda() (ast.Expr, bool) {
 	log.Println("Parsing lambda")
 	beg := p.position()
 	p.openScope()
 	defer p.closeScope()
+	defer p.setLoopContext(p.setLoopContext(false))
 	if p.match(token.Do) == nil {
 		log.Println("Not a lambda")
 		return nil, true
@@ -934,42 +1881,38 @@ func (p *Parser) parseLambda() (ast.Expr, bool) {
 	if t := p.match(token.Pipe); t != nil {
 		log.Println("Parsing lambda arguments")
 		for pt := p.match(token.Pipe); pt == nil; pt = p.match(token.Pipe) {
-			arg := p.parseIdentifier()
-			if arg == nil {
-				p.error(beg, p.position(), "Lambda argument has to be an identifier")
+			a, ok := p.parseFuncArg()
+			if !ok {
+				return nil, false
+			}
+			if a == nil {
+				p.error(beg, p.position(), "Lambda argument has to be an identifier or a pattern")
 				p.recoverWithTokens(token.Pipe, token.Colon, token.Arrow)
 				p.match(token.Pipe)
 				break
 			}
-			a := &ast.FuncDeclArg{
-				Span: arg.Span,
-				Name: arg.Name,
-			}
 			log.Printf("Parsed parameter %s", a.Name)
 			args = append(args, a)
-			p.scope.InsertFuncArg(a)
 		}
 	} else {
 		log.Println("Parsing lambda arguments witout pipe")
 		for {
-			arg := p.parseIdentifier()
-			if arg == nil {
+			a, ok := p.parseFuncArg()
+			if !ok {
+				return nil, false
+			}
+			if a == nil {
 				if p.check(token.Colon) != nil || p.check(token.Arrow) != nil {
 					break
 				} else {
-					p.error(beg, p.position(), "Lambda argument has to be an identifier")
+					p.error(beg, p.position(), "Lambda argument has to be an identifier or a pattern")
 					p.recoverWithTokens(token.Pipe, token.Colon, token.Arrow)
 					p.match(token.Pipe)
 					break
 				}
 			}
-			a := &ast.FuncDeclArg{
-				Span: arg.Span,
-				Name: arg.Name,
-			}
 			log.Printf("Parsed parameter %s", a.Name)
 			args = append(args, a)
-			p.scope.InsertFuncArg(a)
 		}
 	}
 	log.Println("Parsed lambda arguments")
@@ -1012,47 +1955,61 @@ func (p *Parser) parseLambda() (ast.Expr, bool) {
 
 }
 
-func (p *Parser) parseLocalFnDecl() (*ast.LambdaExpr, bool) {
+func (p *Parser) parseLocalFnDecl() (*ast.LambdaExpr, *ast.TypeScheme, *ast.EffectSet, bool) {
 	log.Println("Parse local fn decl")
 	beg := p.position()
 	if t := p.match(token.Fn); t == nil {
-		return nil, true
+		return nil, nil, nil, true
 	}
 	name := p.parseIdentifier()
 	if name == nil {
 		p.error(beg, p.position(), "expected function name")
 		p.recover()
-		return nil, false
+		return nil, nil, nil, false
 	}
 	p.openScope()
 	p.scope.Insert(name.Name)
 	defer p.closeScope()
+	defer p.setLoopContext(p.setLoopContext(false))
 
 	args := []*ast.FuncDeclArg{}
-	for arg := p.parseIdentifier(); arg != nil; arg = p.parseIdentifier() {
-		farg := &ast.FuncDeclArg{Span: arg.Span, Name: arg.Name}
+	for {
+		farg, ok := p.parseFuncArg()
+		if !ok {
+			return nil, nil, nil, false
+		}
+		if farg == nil {
+			break
+		}
 		args = append(args, farg)
-		p.scope.InsertFuncArg(farg)
+	}
+	typ, ok := p.parseTypeAnnotation()
+	if !ok {
+		return nil, nil, nil, false
+	}
+	effects, ok := p.parseEffectAnnotation()
+	if !ok {
+		return nil, nil, nil, false
 	}
 	var fbody ast.Expr
 	body, ok := p.parseBlock()
 	if !ok {
-		return nil, false
+		return nil, nil, nil, false
 	}
 	if body == nil {
 		if t := p.match(token.Assignment); t == nil {
 			p.error(beg, p.position(), "expected colon or assignment in function definition")
 			p.recover()
-			return nil, false
+			return nil, nil, nil, false
 		} else {
 			ebody, ok := p.parseExpr()
 			if !ok {
-				return nil, false
+				return nil, nil, nil, false
 			}
 			if ebody == nil {
 				p.error(beg, p.position(), "expected expression as a function body")
 				p.recover()
-				return nil, false
+				return nil, nil, nil, false
 			}
 			fbody = ebody
 		}
@@ -1066,7 +2023,7 @@ func (p *Parser) parseLocalFnDecl() (*ast.LambdaExpr, bool) {
 		Args: args,
 		Body: fbody,
 	}
-	return &fn, true
+	return &fn, typ, effects, true
 }
 
 func (p *Parser) parseValDecl() (ast.Stmt, bool) {
@@ -1075,27 +2032,364 @@ func (p *Parser) parseValDecl() (ast.Stmt, bool) {
 	if t := p.match(token.Let); t == nil {
 		return nil, true
 	}
+	if p.checkDestructuring() {
+		return p.parsePatternDecl(beg)
+	}
 	name := p.match(token.Identifier)
 	if name == nil {
 		p.error(beg, p.position(), "expected identifier in variable declaration")
 		p.recover()
 		return nil, false
 	}
+	typ, ok := p.parseTypeAnnotation()
+	if !ok {
+		return nil, false
+	}
 	if t := p.match(token.Assignment); t == nil {
 		p.error(beg, p.position(), "expected '=' operator in variable declaration")
 		p.recover()
 		return nil, false
 	}
 	expr, ok := p.parseExpr()
+	if !ok {
+		return nil, false
+	}
+	if expr == nil {
+		p.error(beg, p.position(), "expected expression after '=' in variable declaration")
+		p.recover()
+		return nil, false
+	}
 	p.match(token.NewLine)
 	span := span.NewSpan(beg, p.position())
 	node := ast.ValDecl{
 		Span: &span,
 		Name: name.Val,
 		Rhs:  expr,
+		Type: typ,
 	}
 	p.scope.InsertVal(&node)
-	return &node, ok
+	return &node, true
+}
+
+func (p *Parser) parsePatternDecl(beg span.Position) (ast.Stmt, bool) {
+	pat, rhs, ok := p.parseDestructuring(beg)
+	if !ok {
+		return nil, false
+	}
+	p.match(token.NewLine)
+	// bindings are inserted after the right hand side has been
+	// parsed, so that it still refers to the outer names.
+	p.insertBindings(pat)
+	span := span.NewSpan(beg, p.position())
+	return &ast.PatternDecl{
+		Span:    &span,
+		Pattern: pat,
+		Rhs:     rhs,
+	}, true
+}
+
+// checkDestructuring reports if the current token starts
+// a destructuring pattern in a declaration.
+func (p *Parser) checkDestructuring() bool {
+	switch p.curr.Typ {
+	case token.LParen, token.LSquareParen, token.LBracket:
+		return true
+	}
+	return false
+}
+
+// parseDestructuring parses "pattern = expr" part of the declaration.
+func (p *Parser) parseDestructuring(beg span.Position) (ast.Pattern, ast.Expr, bool) {
+	pat, ok := p.parsePattern()
+	if !ok {
+		return nil, nil, false
+	}
+	if t := p.match(token.Assignment); t == nil {
+		p.error(beg, p.position(), "expected '=' operator in variable declaration")
+		p.recover()
+		return nil, nil, false
+	}
+	rhs, ok := p.parseExpr()
+	if !ok {
+		return nil, nil, false
+	}
+	if rhs == nil {
+		p.error(beg, p.position(), "expected expression after '=' in variable declaration")
+		p.recover()
+		return nil, nil, false
+	}
+	return pat, rhs, true
+}
+
+// parseFuncArg parses a single function argument. Arguments are either
+// identifiers or destructuring patterns which get a generated name.
+// Returns nil if the current token does not start an argument.
+func (p *Parser) parseFuncArg() (*ast.FuncDeclArg, bool) {
+	if arg := p.parseIdentifier(); arg != nil {
+		farg := &ast.FuncDeclArg{Span: arg.Span, Name: arg.Name}
+		p.scope.InsertFuncArg(farg)
+		return farg, true
+	}
+	if !p.checkDestructuring() {
+		return nil, true
+	}
+	pat, ok := p.parsePattern()
+	if !ok {
+		return nil, false
+	}
+	farg := &ast.FuncDeclArg{
+		Span:    pat.NodeSpan(),
+		Name:    fmt.Sprint(ARG_PREFIX, p.argCounter),
+		Pattern: pat,
+	}
+	p.argCounter++
+	p.scope.InsertFuncArg(farg)
+	p.insertBindings(pat)
+	return farg, true
+}
+
+// parseEffectAnnotation parses an optional list of effects
+// the function can perform, like "fn read path ! {io, error}:".
+func (p *Parser) parseEffectAnnotation() (*ast.EffectSet, bool) {
+	beg := p.position()
+	if p.match(token.Exclamation) == nil {
+		return nil, true
+	}
+	if p.match(token.LBracket) == nil {
+		p.error(beg, p.position(), "expected '{' after '!' in effect annotation")
+		p.recover()
+		return nil, false
+	}
+	names := []string{}
+	for p.check(token.RBracket) == nil {
+		name := p.parseIdentifier()
+		if name == nil {
+			p.error(beg, p.position(), "expected effect name in effect annotation")
+			p.recover()
+			return nil, false
+		}
+		path := name.Name
+		for p.match(token.Access) != nil {
+			name = p.parseIdentifier()
+			if name == nil {
+				p.error(beg, p.position(), "expected effect name after '.'")
+				p.recover()
+				return nil, false
+			}
+			path += "." + name.Name
+		}
+		names = append(names, path)
+		if p.match(token.Comma) == nil {
+			break
+		}
+	}
+	if p.match(token.RBracket) == nil {
+		p.error(beg, p.position(), "expected '}' closing effect annotation")
+		p.recover()
+		return nil, false
+	}
+	span := span.NewSpan(beg, p.position())
+	return &ast.EffectSet{Span: &span, Names: names}, true
+}
+
+// parseTypeAnnotation parses an optional type annotation
+// of a declaration, like "fn f x :: a => {a -> a}:".
+func (p *Parser) parseTypeAnnotation() (*ast.TypeScheme, bool) {
+	beg := p.position()
+	if p.match(token.DoubleColon) == nil {
+		return nil, true
+	}
+	typ, ok := p.parseType()
+	if !ok || typ == nil {
+		if ok {
+			p.error(beg, p.position(), "expected type after '::'")
+		}
+		p.recover()
+		return nil, false
+	}
+	vars := []string{}
+	if p.match(token.FatArrow) != nil {
+		// what we parsed are the quantified variables "a b =>"
+		// which looks just like a type application
+		name, ok := typ.(*ast.TypeName)
+		if !ok {
+			p.error(beg, p.position(), "expected type variables before '=>'")
+			p.recover()
+			return nil, false
+		}
+		vars = append(vars, name.Name)
+		for _, arg := range name.Args {
+			v, ok := arg.(*ast.TypeName)
+			if !ok || len(v.Args) > 0 {
+				p.error(beg, p.position(), "expected type variables before '=>'")
+				p.recover()
+				return nil, false
+			}
+			vars = append(vars, v.Name)
+		}
+		typ, ok = p.parseType()
+		if !ok || typ == nil {
+			if ok {
+				p.error(beg, p.position(), "expected type after '=>'")
+			}
+			p.recover()
+			return nil, false
+		}
+	}
+	span := span.NewSpan(beg, p.position())
+	return &ast.TypeScheme{Span: &span, Vars: vars, Type: typ}, true
+}
+
+// parseType parses a type which can be a named type
+// applied to its arguments like "Seq a".
+func (p *Parser) parseType() (ast.TypeExpr, bool) {
+	beg := p.position()
+	name := p.parseIdentifier()
+	if name == nil {
+		return p.parseTypeAtom()
+	}
+	args := []ast.TypeExpr{}
+	for {
+		arg, ok := p.parseTypeAtom()
+		if !ok {
+			return nil, false
+		}
+		if arg == nil {
+			break
+		}
+		args = append(args, arg)
+	}
+	span := span.NewSpan(beg, p.position())
+	return &ast.TypeName{Span: &span, Name: name.Name, Args: args}, true
+}
+
+func (p *Parser) parseTypeAtom() (ast.TypeExpr, bool) {
+	beg := p.position()
+	switch p.curr.Typ {
+	case token.Identifier:
+		name := p.parseIdentifier()
+		return &ast.TypeName{Span: name.Span, Name: name.Name, Args: []ast.TypeExpr{}}, true
+	case token.None:
+		// none is a keyword but also the name of its type
+		p.bump()
+		span := span.NewSpan(beg, p.position())
+		return &ast.TypeName{Span: &span, Name: "none", Args: []ast.TypeExpr{}}, true
+	case token.LParen:
+		p.bump()
+		elems := []ast.TypeExpr{}
+		trailingComma := false
+		for p.check(token.RParen) == nil {
+			elem, ok := p.expectType(beg)
+			if !ok {
+				return nil, false
+			}
+			elems = append(elems, elem)
+			trailingComma = p.match(token.Comma) != nil
+			if !trailingComma {
+				break
+			}
+		}
+		if p.match(token.RParen) == nil {
+			p.error(beg, p.position(), "expected closing parenthesis in tuple type")
+			return nil, false
+		}
+		span := span.NewSpan(beg, p.position())
+		if len(elems) == 1 && !trailingComma {
+			return elems[0], true
+		}
+		return &ast.TypeTuple{Span: &span, Elems: elems}, true
+	case token.LSquareParen:
+		p.bump()
+		elem, ok := p.expectType(beg)
+		if !ok {
+			return nil, false
+		}
+		if p.match(token.RSquareParen) == nil {
+			p.error(beg, p.position(), "expected closing bracket in list type")
+			return nil, false
+		}
+		span := span.NewSpan(beg, p.position())
+		return &ast.TypeList{Span: &span, Elem: elem}, true
+	case token.LBracket:
+		p.bump()
+		if p.check(token.RBracket) != nil || (p.check(token.Identifier) != nil && p.l.Peek().Typ == token.Colon) {
+			return p.parseRecordType(beg)
+		}
+		return p.parseFuncType(beg)
+	}
+	return nil, true
+}
+
+func (p *Parser) expectType(beg span.Position) (ast.TypeExpr, bool) {
+	typ, ok := p.parseType()
+	if ok && typ == nil {
+		p.error(beg, p.position(), "expected type")
+		return nil, false
+	}
+	return typ, ok
+}
+
+// parseRecordType parses "{a: int, b: string}"
+// the opening bracket has already been consumed.
+func (p *Parser) parseRecordType(beg span.Position) (ast.TypeExpr, bool) {
+	fields := []ast.TypeRecordField{}
+	open := false
+	for p.check(token.RBracket) == nil {
+		if p.match(token.Access) != nil {
+			// {a: int, ..} is a record with at least the listed fields
+			if p.match(token.Access) == nil || p.check(token.RBracket) == nil {
+				p.error(beg, p.position(), "expected '..' at the end of the record type")
+				return nil, false
+			}
+			open = true
+			break
+		}
+		key := p.parseIdentifier()
+		if key == nil || p.match(token.Colon) == nil {
+			p.error(beg, p.position(), "expected 'name: type' in record type")
+			return nil, false
+		}
+		typ, ok := p.expectType(beg)
+		if !ok {
+			return nil, false
+		}
+		fields = append(fields, ast.TypeRecordField{Key: key.Name, Type: typ})
+		if p.match(token.Comma) == nil {
+			break
+		}
+	}
+	if p.match(token.RBracket) == nil {
+		p.error(beg, p.position(), "expected closing bracket in record type")
+		return nil, false
+	}
+	span := span.NewSpan(beg, p.position())
+	return &ast.TypeRecord{Span: &span, Fields: fields, Open: open}, true
+}
+
+// parseFuncType parses "{a -> b -> c}"
+// the opening bracket has already been consumed.
+func (p *Parser) parseFuncType(beg span.Position) (ast.TypeExpr, bool) {
+	types := []ast.TypeExpr{}
+	for {
+		typ, ok := p.expectType(beg)
+		if !ok {
+			return nil, false
+		}
+		types = append(types, typ)
+		if p.match(token.Arrow) == nil {
+			break
+		}
+	}
+	if p.match(token.RBracket) == nil {
+		p.error(beg, p.position(), "expected closing bracket in function type")
+		return nil, false
+	}
+	span := span.NewSpan(beg, p.position())
+	return &ast.TypeFunc{
+		Span: &span,
+		Args: types[:len(types)-1],
+		Ret:  types[len(types)-1],
+	}, true
 }
 
 func (p *Parser) parseLocalEffectDecl() (*ast.LocalEffect, bool) {
@@ -1135,15 +2429,54 @@ func (p *Parser) parseReturn() (ast.Stmt, bool) {
 	return ret, ok
 }
 
+func (p *Parser) parseBreak() (ast.Stmt, bool) {
+	beg := p.position()
+	if p.match(token.Break) == nil {
+		return nil, true
+	}
+	span := span.NewSpan(beg, p.position())
+	if !p.inLoop {
+		p.error(beg, p.position(), "break can only be used as a statement inside of a loop")
+		p.recoverWithTokens(token.NewLine)
+		return nil, false
+	}
+	p.match(token.NewLine)
+	return &ast.Break{Span: &span}, true
+}
+
+func (p *Parser) parseContinue() (ast.Stmt, bool) {
+	beg := p.position()
+	if p.match(token.Continue) == nil {
+		return nil, true
+	}
+	span := span.NewSpan(beg, p.position())
+	if !p.inLoop {
+		p.error(beg, p.position(), "continue can only be used as a statement inside of a loop")
+		p.recoverWithTokens(token.NewLine)
+		return nil, false
+	}
+	p.match(token.NewLine)
+	return &ast.Continue{Span: &span}, true
+}
+
+// setLoopContext sets if break and continue are allowed
+// and returns the previous setting so it can be restored.
+func (p *Parser) setLoopContext(inLoop bool) bool {
+	prev := p.inLoop
+	p.inLoop = inLoop
+	return prev
+}
+
 func (p *Parser) parseResume() (ast.Expr, bool) {
 	beg := p.position()
 	if p.match(token.Resume) == nil {
 		return nil, true
 	}
+	defer p.setLoopContext(p.setLoopContext(false))
 	cont, ok := p.parseSimpleExpr()
-	if !ok {
+	if cont == nil || !ok {
 		p.error(beg, p.position(), "Resume expects at least a continuation to run with")
-		p.recoverWithTokens(token.NewLine)
+		p.recover()
 		return nil, false
 	}
 	arg, ok := p.parseSimpleExpr()
@@ -1184,6 +2517,7 @@ func (p *Parser) parseRecordConst(beg span.Position) (*ast.RecordConst, bool) {
 			i, err := p.pushNextIndent()
 			if err != nil {
 				p.error(beg, p.position(), "expected indentation as record continuation")
+				return false
 			}
 			log.Printf("Got new line, indentation for this expression is %d\n", i)
 			continuationIndent = i
@@ -1220,7 +2554,7 @@ func (p *Parser) parseRecordConst(beg span.Position) (*ast.RecordConst, bool) {
 			}
 		} else {
 			// function syntax sugar
-			f, ok := p.parseLocalFnDecl()
+			f, _, _, ok := p.parseLocalFnDecl()
 			if !ok {
 				log.Println("Error while parsing fn declaration sugar in record")
 				p.recoverWithTokens(token.Comma, token.RBracket)
@@ -1243,14 +2577,13 @@ func (p *Parser) parseRecordConst(beg span.Position) (*ast.RecordConst, bool) {
 		p.popIndent(continuationIndent)
 	}
 	if p.match(token.RBracket) == nil {
-		if p.checkIndent(p.currentIndent()) {
-			if p.peek().Typ == token.RBracket {
-				p.bump()
-				p.bump()
-			} else {
-				p.error(beg, p.position(), "missing closing bracket in record literal")
-			}
+		if !p.checkIndent(p.currentIndent()) || p.peek().Typ != token.RBracket {
+			p.error(beg, p.position(), "missing closing bracket in record literal")
+			p.recover()
+			return nil, false
 		}
+		p.bump()
+		p.bump()
 	}
 	span := span.NewSpan(beg, p.position())
 	rec := ast.RecordConst{
@@ -1275,6 +2608,7 @@ func (p *Parser) parseListConst(beg span.Position) (*ast.ListConst, bool) {
 			i, err := p.pushNextIndent()
 			if err != nil {
 				p.error(beg, p.position(), "expected indentation as a list continuation.\nMaybe you meant empty list? \"[]\"")
+				return false
 			}
 			log.Printf("Got new line, indentation for this expression is %d\n", i)
 			continuationIndent = i
@@ -1306,14 +2640,13 @@ func (p *Parser) parseListConst(beg span.Position) (*ast.ListConst, bool) {
 		p.popIndent(continuationIndent)
 	}
 	if p.match(token.RSquareParen) == nil {
-		if p.checkIndent(p.currentIndent()) {
-			if p.peek().Typ == token.RSquareParen {
-				p.bump()
-				p.bump()
-			} else {
-				p.error(beg, p.position(), "Expected ] to close a list literal")
-			}
+		if !p.checkIndent(p.currentIndent()) || p.peek().Typ != token.RSquareParen {
+			p.error(beg, p.position(), "Expected ] to close a list literal")
+			p.recover()
+			return nil, false
 		}
+		p.bump()
+		p.bump()
 	}
 	span := span.NewSpan(beg, p.position())
 	list := &ast.ListConst{
@@ -1421,6 +2754,7 @@ func (p *Parser) matchIndentWith(pred func(int) bool) bool {
 }
 
 func (p *Parser) bump() {
+	p.prev = p.curr.Typ
 	p.curr = p.l.Next()
 }
 
@@ -1456,7 +2790,25 @@ func (p *Parser) popIndent(n int) {
 	p.indents = p.indents[:len(p.indents)-1]
 }
 
+// error reports a syntax error and puts the parser in the panic mode.
+// Errors reported in this mode are dropped until the parser
+// synchronizes on the next statement.
 func (p *Parser) error(beg, end span.Position, msg string) {
+	if p.panicking {
+		return
+	}
+	p.panicking = true
+	// the lexer has already reported the invalid token
+	if p.curr.Typ == token.Error {
+		return
+	}
+	p.report(beg, end, msg)
+}
+
+// report records the error without entering the panic mode.
+// It is used for errors that do not influence how
+// the following tokens are parsed.
+func (p *Parser) report(beg, end span.Position, msg string) {
 	p.errors = append(p.errors, SyntaxError{
 		pos: span.NewSpan(beg, end),
 		msg: msg,
@@ -1467,28 +2819,75 @@ func (p *Parser) recover() {
 	p.recoverWithTokens()
 }
 
-// recoverWithTokens eats tokens until it sees any of
-// the passed control tokens. It does not eat the control token
-// unless it hit end of top level item.
+// recoverWithTokens eats tokens until it sees any of the passed
+// control tokens or gets to a synchronization point, which is
+// the start of the line that is not indented more than the
+// currently parsed block. Lines indented deeper are treated
+// as a part of the erroneous statement. The control token is not eaten.
+// Recovering is a no-op if the parser is already synchronized
+// so it is safe to recover multiple times after the same error.
 func (p *Parser) recoverWithTokens(rtt ...token.Id) {
 	log.Println("In recover")
 	defer p.l.UnsetMode(skipErrorReporting)
 	p.l.SetMode(skipErrorReporting)
-	var t token.Token
-	eat := false
-	for t = p.l.curr; !p.eof() && !isRecoveryToken(t, rtt); t = p.l.Next() {
+	for !p.eof() && !isRecoveryToken(p.curr, rtt) && !p.atSyncPoint() {
 		log.Println("Recovering")
-		if t.Typ == token.NewLine && p.l.Peek().Typ != token.Indent {
-			eat = true
-			break
-		}
-	}
-	if eat {
 		p.bump()
 	}
 	log.Println("Recovered")
 }
 
+// synchronize skips to the next statement after the one starting
+// with beg could not be parsed. If parsing the statement did not eat
+// any tokens the first one is skipped so the parser always progresses.
+func (p *Parser) synchronize(beg token.Token) {
+	if p.curr == beg && !p.eof() {
+		p.bump()
+	}
+	p.recover()
+	// a misplaced clause does not continue anything
+	if beg.Typ == token.Else || beg.Typ == token.With {
+		return
+	}
+	for p.continuesStmt() {
+		p.bump()
+		p.recover()
+	}
+}
+
+// continuesStmt returns true if the line starts with an else or with
+// clause at the current indentation. Such clauses are a part of the
+// preceding statement so they are skipped together with it.
+func (p *Parser) continuesStmt() bool {
+	t := p.curr
+	if t.Typ == token.Indent {
+		if !p.checkIndent(p.currentIndent()) {
+			return false
+		}
+		t = *p.peek()
+	}
+	return t.Typ == token.Else || t.Typ == token.With
+}
+
+// atSyncPoint returns true if the current token starts a line
+// that is not indented deeper than the current block.
+// Empty lines are not synchronization points.
+func (p *Parser) atSyncPoint() bool {
+	if p.prev != token.NewLine {
+		return false
+	}
+	switch p.curr.Typ {
+	case token.NewLine:
+		return false
+	case token.Indent:
+		if p.peek().Typ == token.NewLine {
+			return false
+		}
+		return p.checkIndentWith(func(v int) bool { return v <= p.currentIndent() })
+	}
+	return true
+}
+
 func isRecoveryToken(t token.Token, rtt []token.Id) bool {
 	for _, r := range rtt {
 		if t.Typ == r {
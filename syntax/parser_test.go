@@ -375,6 +375,350 @@ func TestParsingWhile(t *testing.T) {
 	matchAstWithTable(t, &table)
 }
 
+func TestParsingBreakAndContinue(t *testing.T) {
+	table := ptable{
+		{
+			"while a:\n" +
+				"  if b:\n" +
+				"    break\n" +
+				"  continue\n",
+			[]an{
+				&ast.WhileStmt{
+					Cond: &ast.Identifier{Name: "a"},
+					Body: &ast.Block{
+						Instr: []ast.Stmt{
+							&ast.StmtExpr{
+								Expr: &ast.IfExpr{
+									Cond: &ast.Identifier{Name: "b"},
+									IfBranch: &ast.Block{
+										Instr: []ast.Stmt{&ast.Break{}},
+									},
+								},
+							},
+							&ast.Continue{},
+						},
+					},
+				},
+			},
+		},
+	}
+	matchAstWithTable(t, &table)
+}
+
+func TestParsingFor(t *testing.T) {
+	table := ptable{
+		{
+			"for x in xs:\n" +
+				"  f x\n",
+			[]an{
+				&ast.ForStmt{
+					Pattern:  &ast.BindPattern{Name: "x"},
+					Iterable: &ast.Identifier{Name: "xs"},
+					Body: &ast.Block{
+						Instr: []ast.Stmt{
+							&ast.StmtExpr{Expr: &ast.FuncApplication{
+								Callee: &ast.Identifier{Name: "f"},
+								Args:   []ast.Expr{&ast.Identifier{Name: "x"}},
+							}},
+						},
+					},
+				},
+			},
+		},
+		{
+			"for (k, v) in r:\n" +
+				"  break\n",
+			[]an{
+				&ast.ForStmt{
+					Pattern: &ast.TuplePattern{
+						Elems: []ast.Pattern{
+							&ast.BindPattern{Name: "k"},
+							&ast.BindPattern{Name: "v"},
+						},
+					},
+					Iterable: &ast.Identifier{Name: "r"},
+					Body: &ast.Block{
+						Instr: []ast.Stmt{&ast.Break{}},
+					},
+				},
+			},
+		},
+	}
+	matchAstWithTable(t, &table)
+}
+
+func TestParsingTypeAnnotations(t *testing.T) {
+	name := func(n string, args ...ast.TypeExpr) *ast.TypeName {
+		return &ast.TypeName{Name: n, Args: args}
+	}
+	table := ptable{
+		{
+			"fn f x y :: {int -> int -> int} = x",
+			[]an{
+				&ast.FuncDecl{
+					Name: "f",
+					Args: []*ast.FuncDeclArg{{Name: "x"}, {Name: "y"}},
+					Body: &ast.Identifier{Name: "x"},
+					Type: &ast.TypeScheme{
+						Vars: []string{},
+						Type: &ast.TypeFunc{
+							Args: []ast.TypeExpr{name("int"), name("int")},
+							Ret:  name("int"),
+						},
+					},
+				},
+			},
+		},
+		{
+			"fn f q :: a => {Queue a -> {a}}:\n" +
+				"  q\n",
+			[]an{
+				&ast.FuncDecl{
+					Name: "f",
+					Args: []*ast.FuncDeclArg{{Name: "q"}},
+					Body: &ast.Block{Instr: []ast.Stmt{
+						&ast.StmtExpr{Expr: &ast.Identifier{Name: "q"}},
+					}},
+					Type: &ast.TypeScheme{
+						Vars: []string{"a"},
+						Type: &ast.TypeFunc{
+							Args: []ast.TypeExpr{name("Queue", name("a"))},
+							Ret: &ast.TypeFunc{
+								Args: []ast.TypeExpr{},
+								Ret:  name("a"),
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			"fn f x :: {none -> none} = x",
+			[]an{
+				&ast.FuncDecl{
+					Name: "f",
+					Args: []*ast.FuncDeclArg{{Name: "x"}},
+					Body: &ast.Identifier{Name: "x"},
+					Type: &ast.TypeScheme{
+						Vars: []string{},
+						Type: &ast.TypeFunc{
+							Args: []ast.TypeExpr{name("none")},
+							Ret:  name("none"),
+						},
+					},
+				},
+			},
+		},
+		{
+			"let a :: ([int], {x: float, ..}, (string,)) = b",
+			[]an{
+				&ast.GlobalValDecl{
+					Name: "a",
+					Rhs:  &ast.Identifier{Name: "b"},
+					Type: &ast.TypeScheme{
+						Vars: []string{},
+						Type: &ast.TypeTuple{Elems: []ast.TypeExpr{
+							&ast.TypeList{Elem: name("int")},
+							&ast.TypeRecord{
+								Fields: []ast.TypeRecordField{{Key: "x", Type: name("float")}},
+								Open:   true,
+							},
+							&ast.TypeTuple{Elems: []ast.TypeExpr{name("string")}},
+						}},
+					},
+				},
+			},
+		},
+		{
+			"fn f:\n" +
+				"  let a :: {} = {}\n",
+			[]an{
+				&ast.FuncDecl{
+					Name: "f",
+					Args: []*ast.FuncDeclArg{},
+					Body: &ast.Block{Instr: []ast.Stmt{
+						&ast.ValDecl{
+							Name: "a",
+							Rhs:  &ast.RecordConst{Fields: []ast.RecordField{}},
+							Type: &ast.TypeScheme{
+								Vars: []string{},
+								Type: &ast.TypeRecord{Fields: []ast.TypeRecordField{}},
+							},
+						},
+					}},
+				},
+			},
+		},
+	}
+	matchAstWithTable(t, &table)
+}
+
+func TestTypeAnnotationErrors(t *testing.T) {
+	sources := []string{
+		"fn f x :: = x\n",
+		"fn f x :: {int -> } = x\n",
+		"fn f x :: {a: int -> int} = x\n",
+		"fn f x :: {int, ..} = x\n",
+		"let a :: (int = 1\n",
+		"let a :: {int} -> int = 1\n",
+		"fn f x :: {a} => {a} = x\n",
+	}
+	for _, src := range sources {
+		t.Run(src, func(t *testing.T) {
+			p := NewParser(strings.NewReader(src))
+			p.Parse()
+			if len(p.Errors()) == 0 {
+				t.Errorf("expected parsing errors")
+			}
+		})
+	}
+}
+
+func TestParsingEffectAnnotations(t *testing.T) {
+	table := ptable{
+		{
+			"fn read path ! {io, errors.error} = path",
+			[]an{
+				&ast.FuncDecl{
+					Name:    "read",
+					Args:    []*ast.FuncDeclArg{{Name: "path"}},
+					Body:    &ast.Identifier{Name: "path"},
+					Effects: &ast.EffectSet{Names: []string{"io", "errors.error"}},
+				},
+			},
+		},
+		{
+			"fn f x :: {int -> int} ! {} = x",
+			[]an{
+				&ast.FuncDecl{
+					Name: "f",
+					Args: []*ast.FuncDeclArg{{Name: "x"}},
+					Body: &ast.Identifier{Name: "x"},
+					Type: &ast.TypeScheme{
+						Vars: []string{},
+						Type: &ast.TypeFunc{
+							Args: []ast.TypeExpr{&ast.TypeName{Name: "int"}},
+							Ret:  &ast.TypeName{Name: "int"},
+						},
+					},
+					Effects: &ast.EffectSet{Names: []string{}},
+				},
+			},
+		},
+		{
+			"fn f:\n" +
+				"  fn g ! {Yield}:\n" +
+				"    Yield 1\n",
+			[]an{
+				&ast.FuncDecl{
+					Name: "f",
+					Args: []*ast.FuncDeclArg{},
+					Body: &ast.Block{Instr: []ast.Stmt{
+						&ast.ValDecl{
+							Name: "g",
+							Rhs: &ast.LambdaExpr{
+								Name: "g",
+								Args: []*ast.FuncDeclArg{},
+								Body: &ast.Block{Instr: []ast.Stmt{
+									&ast.StmtExpr{Expr: &ast.FuncApplication{
+										Callee: &ast.Identifier{Name: "Yield"},
+										Args:   []ast.Expr{&ast.IntConst{Val: 1}},
+									}},
+								}},
+							},
+							Effects: &ast.EffectSet{Names: []string{"Yield"}},
+						},
+					}},
+				},
+			},
+		},
+	}
+	matchAstWithTable(t, &table)
+}
+
+func TestEffectAnnotationErrors(t *testing.T) {
+	sources := []string{
+		"fn f x ! = x\n",
+		"fn f x ! {io = x\n",
+		"fn f x ! {io,, error} = x\n",
+		"fn f x ! {io.} = x\n",
+	}
+	for _, src := range sources {
+		t.Run(src, func(t *testing.T) {
+			p := NewParser(strings.NewReader(src))
+			p.Parse()
+			if len(p.Errors()) == 0 {
+				t.Errorf("expected parsing errors")
+			}
+		})
+	}
+}
+
+func TestParsingImports(t *testing.T) {
+	table := ptable{
+		{
+			"import \"lib/list\" as list\n",
+			[]an{&ast.ImportDecl{Path: "lib/list", Name: "list"}},
+		},
+		{
+			"from \"lib/list\" import map, filter\n" +
+				"map",
+			[]an{
+				&ast.FromImportDecl{
+					Path: "lib/list",
+					Names: []*ast.Identifier{
+						{Name: "map"},
+						{Name: "filter"},
+					},
+				},
+				&ast.Identifier{Name: "map"},
+			},
+		},
+	}
+	matchAstWithTable(t, &table)
+}
+
+func TestImportErrors(t *testing.T) {
+	sources := []string{
+		"import lib as lib\n",
+		"import \"lib\"\n",
+		"import \"lib\" as\n",
+		"from \"lib\" a, b\n",
+		"from \"lib\" import\n",
+		"fn f:\n  import \"lib\" as lib\n",
+	}
+	for _, src := range sources {
+		t.Run(src, func(t *testing.T) {
+			p := NewParser(strings.NewReader(src))
+			p.Parse()
+			if len(p.Errors()) == 0 {
+				t.Errorf("expected parsing errors")
+			}
+		})
+	}
+}
+
+func TestBreakAndContinueOutsideOfLoop(t *testing.T) {
+	sources := []string{
+		"break\n",
+		"fn f:\n  continue\n",
+		"while a:\n  let f = do:\n    break\n",
+		"while a:\n  f (if b:\n    break\n  )\n",
+		"while a:\n  handle:\n    1\n  with e v:\n    break\n",
+		"for x in xs:\n  let f = do -> continue\n",
+		"for x xs:\n  1\n",
+	}
+	for _, src := range sources {
+		t.Run(src, func(t *testing.T) {
+			p := NewParser(strings.NewReader(src))
+			p.Parse()
+			if len(p.Errors()) == 0 {
+				t.Errorf("expected parsing errors")
+			}
+		})
+	}
+}
+
 func TestParsingBlocks(t *testing.T) {
 	table := ptable{
 		{
@@ -1102,6 +1446,83 @@ func TestParsingHandle(t *testing.T) {
 				},
 			},
 		},
+		{
+			"handle:\n 1\nwith e a:\n 2\nfinally:\n 3\n",
+			[]an{
+				&ast.Handle{
+					Body: &ast.Block{
+						Instr: []ast.Stmt{
+							&ast.StmtExpr{Expr: &ast.IntConst{Val: 1}},
+						},
+					},
+					Arms: []*ast.WithClause{
+						{
+							Effect: &ast.Identifier{Name: "e"},
+							Arg:    &ast.FuncDeclArg{Name: "a"},
+							Body: &ast.Block{
+								Instr: []ast.Stmt{
+									&ast.StmtExpr{Expr: &ast.IntConst{Val: 2}},
+								},
+							},
+						},
+					},
+					Finally: &ast.Block{
+						Instr: []ast.Stmt{
+							&ast.StmtExpr{Expr: &ast.IntConst{Val: 3}},
+						},
+					},
+				},
+			},
+		},
+		{
+			"handle:\n 1\nwith return v:\n v\nwith e a:\n 2\n",
+			[]an{
+				&ast.Handle{
+					Body: &ast.Block{
+						Instr: []ast.Stmt{
+							&ast.StmtExpr{Expr: &ast.IntConst{Val: 1}},
+						},
+					},
+					Arms: []*ast.WithClause{
+						{
+							Effect: &ast.Identifier{Name: "e"},
+							Arg:    &ast.FuncDeclArg{Name: "a"},
+							Body: &ast.Block{
+								Instr: []ast.Stmt{
+									&ast.StmtExpr{Expr: &ast.IntConst{Val: 2}},
+								},
+							},
+						},
+					},
+					Return: &ast.WithClause{
+						Arg: &ast.FuncDeclArg{Name: "v"},
+						Body: &ast.Block{
+							Instr: []ast.Stmt{
+								&ast.StmtExpr{Expr: &ast.Identifier{Name: "v"}},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			"handle:\n 1\nfinally:\n 2\n",
+			[]an{
+				&ast.Handle{
+					Body: &ast.Block{
+						Instr: []ast.Stmt{
+							&ast.StmtExpr{Expr: &ast.IntConst{Val: 1}},
+						},
+					},
+					Arms: []*ast.WithClause{},
+					Finally: &ast.Block{
+						Instr: []ast.Stmt{
+							&ast.StmtExpr{Expr: &ast.IntConst{Val: 2}},
+						},
+					},
+				},
+			},
+		},
 	}
 	matchAstWithTable(t, &table)
 }
@@ -1120,6 +1541,185 @@ func TestParsingEffects(t *testing.T) {
 	matchAstWithTable(t, &table)
 }
 
+func TestParsingMatch(t *testing.T) {
+	table := ptable{
+		{
+			"match a:\n case 1 -> 2\n case _:\n  3\n",
+			[]an{
+				&ast.Match{
+					Scrutinee: &ast.Identifier{Name: "a"},
+					Arms: []*ast.MatchArm{
+						{
+							Pattern: &ast.LiteralPattern{Val: &ast.IntConst{Val: 1}},
+							Body: &ast.Block{
+								Instr: []ast.Stmt{
+									&ast.StmtExpr{Expr: &ast.IntConst{Val: 2}},
+								},
+							},
+						},
+						{
+							Pattern: &ast.WildcardPattern{},
+							Body: &ast.Block{
+								Instr: []ast.Stmt{
+									&ast.StmtExpr{Expr: &ast.IntConst{Val: 3}},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			"match a:\n case (x, [y, _]) if f x -> y\n",
+			[]an{
+				&ast.Match{
+					Scrutinee: &ast.Identifier{Name: "a"},
+					Arms: []*ast.MatchArm{
+						{
+							Pattern: &ast.TuplePattern{
+								Elems: []ast.Pattern{
+									&ast.BindPattern{Name: "x"},
+									&ast.ListPattern{
+										Elems: []ast.Pattern{
+											&ast.BindPattern{Name: "y"},
+											&ast.WildcardPattern{},
+										},
+									},
+								},
+							},
+							Guard: &ast.FuncApplication{
+								Callee: &ast.Identifier{Name: "f"},
+								Args:   []ast.Expr{&ast.Identifier{Name: "x"}},
+							},
+							Body: &ast.Block{
+								Instr: []ast.Stmt{
+									&ast.StmtExpr{Expr: &ast.Identifier{Name: "y"}},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			"match a:\n case {name, age: -1, tag: `t} -> name\n",
+			[]an{
+				&ast.Match{
+					Scrutinee: &ast.Identifier{Name: "a"},
+					Arms: []*ast.MatchArm{
+						{
+							Pattern: &ast.RecordPattern{
+								Fields: []ast.RecordFieldPattern{
+									{Key: "name", Pat: &ast.BindPattern{Name: "name"}},
+									{Key: "age", Pat: &ast.LiteralPattern{Val: &ast.IntConst{Val: -1}}},
+									{Key: "tag", Pat: &ast.LiteralPattern{Val: &ast.Symbol{Val: "t"}}},
+								},
+							},
+							Body: &ast.Block{
+								Instr: []ast.Stmt{
+									&ast.StmtExpr{Expr: &ast.Identifier{Name: "name"}},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	matchAstWithTable(t, &table)
+}
+
+func TestParsingDestructuring(t *testing.T) {
+	table := ptable{
+		{
+			"let (a, b) = c",
+			[]an{
+				&ast.GlobalPatternDecl{
+					Pattern: &ast.TuplePattern{
+						Elems: []ast.Pattern{
+							&ast.BindPattern{Name: "a"},
+							&ast.BindPattern{Name: "b"},
+						},
+					},
+					Rhs: &ast.Identifier{Name: "c"},
+				},
+			},
+		},
+		{
+			"fn f [x, _] {name}:\n  let (y) = x\n",
+			[]an{
+				&ast.FuncDecl{
+					Name: "f",
+					Args: []*ast.FuncDeclArg{
+						{
+							Pattern: &ast.ListPattern{
+								Elems: []ast.Pattern{
+									&ast.BindPattern{Name: "x"},
+									&ast.WildcardPattern{},
+								},
+							},
+						},
+						{
+							Pattern: &ast.RecordPattern{
+								Fields: []ast.RecordFieldPattern{
+									{Key: "name", Pat: &ast.BindPattern{Name: "name"}},
+								},
+							},
+						},
+					},
+					Body: &ast.Block{
+						Instr: []ast.Stmt{
+							&ast.PatternDecl{
+								Pattern: &ast.BindPattern{Name: "y"},
+								Rhs:     &ast.Identifier{Name: "x"},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			"do |(a, b) c| -> a",
+			[]an{
+				&ast.LambdaExpr{
+					Args: []*ast.FuncDeclArg{
+						{
+							Pattern: &ast.TuplePattern{
+								Elems: []ast.Pattern{
+									&ast.BindPattern{Name: "a"},
+									&ast.BindPattern{Name: "b"},
+								},
+							},
+						},
+						{Name: "c"},
+					},
+					Body: &ast.Identifier{Name: "a"},
+				},
+			},
+		},
+	}
+	matchAstWithTable(t, &table)
+}
+
+func TestPatternErrors(t *testing.T) {
+	sources := []string{
+		"match a:\n case (x, x) -> x\n",
+		"match a:\n 1\n",
+		"case 1 -> 2\n",
+		"let (a, a) = b\n",
+		"fn f (x, {y: x}) = x\n",
+	}
+	for _, src := range sources {
+		t.Run(src, func(t *testing.T) {
+			p := NewParser(strings.NewReader(src))
+			p.Parse()
+			if len(p.Errors()) == 0 {
+				t.Errorf("expected parsing errors")
+			}
+		})
+	}
+}
+
 func matchAstWithTable(t *testing.T, table *ptable) {
 	for _, test := range *table {
 		t.Run(test.source, func(t *testing.T) {
@@ -1145,3 +1745,169 @@ func matchAstWithTable(t *testing.T, table *ptable) {
 		})
 	}
 }
+
+func TestParsingMacros(t *testing.T) {
+	table := ptable{
+		{
+			"macro id e = e\n",
+			[]an{
+				&ast.MacroDecl{
+					Name: "id",
+					Args: []*ast.FuncDeclArg{{Name: "e"}},
+					Body: &ast.Identifier{Name: "e"},
+				},
+			},
+		},
+		{
+			"macro twice e = `(f ~e ~e)\n",
+			[]an{
+				&ast.MacroDecl{
+					Name: "twice",
+					Args: []*ast.FuncDeclArg{{Name: "e"}},
+					Body: &ast.QuasiQuote{
+						Node: &ast.FuncApplication{
+							Callee: &ast.Identifier{Name: "f"},
+							Args: []ast.Expr{
+								&ast.Unquote{Expr: &ast.Identifier{Name: "e"}},
+								&ast.Unquote{Expr: &ast.Identifier{Name: "e"}},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			"macro m e = `:\n  ~e\n\nm 1\n",
+			[]an{
+				&ast.MacroDecl{
+					Name: "m",
+					Args: []*ast.FuncDeclArg{{Name: "e"}},
+					Body: &ast.QuasiQuote{
+						Node: &ast.Block{
+							Instr: []ast.Stmt{
+								&ast.StmtExpr{
+									Expr: &ast.Unquote{Expr: &ast.Identifier{Name: "e"}},
+								},
+							},
+						},
+					},
+				},
+				&ast.FuncApplication{
+					Callee: &ast.Identifier{Name: "m"},
+					Args:   []ast.Expr{&ast.IntConst{Val: 1}},
+				},
+			},
+		},
+	}
+	matchAstWithTable(t, &table)
+}
+
+func TestMacroErrors(t *testing.T) {
+	sources := []string{
+		"fn f:\n  macro m = 1\n",
+		"macro = 1\n",
+		"macro m\n",
+		"let a = `(f 1)\n",
+		"macro m = ~a\n",
+	}
+	for _, src := range sources {
+		t.Run(src, func(t *testing.T) {
+			p := NewParser(strings.NewReader(src))
+			p.Parse()
+			if len(p.Errors()) == 0 {
+				t.Errorf("expected parsing errors")
+			}
+		})
+	}
+}
+
+func TestParsingOperators(t *testing.T) {
+	op := func(name string, lhs, rhs ast.Expr) ast.Expr {
+		return &ast.FuncApplication{
+			Callee: &ast.Identifier{Name: name},
+			Args:   []ast.Expr{lhs, rhs},
+		}
+	}
+	id := func(name string) ast.Expr {
+		return &ast.Identifier{Name: name}
+	}
+	decls := "infixl 6 + = add\ninfixl 7 * = mul\ninfixr 5 ++ = concat\n"
+	declNodes := []an{
+		&ast.OperatorDecl{
+			Name:   "+",
+			Fixity: ast.Fixity{Assoc: ast.AssocLeft, Prec: 6},
+			Rhs:    id("add"),
+		},
+		&ast.OperatorDecl{
+			Name:   "*",
+			Fixity: ast.Fixity{Assoc: ast.AssocLeft, Prec: 7},
+			Rhs:    id("mul"),
+		},
+		&ast.OperatorDecl{
+			Name:   "++",
+			Fixity: ast.Fixity{Assoc: ast.AssocRight, Prec: 5},
+			Rhs:    id("concat"),
+		},
+	}
+	table := ptable{
+		{
+			decls + "a + b * c\n",
+			append(declNodes, op("+", id("a"), op("*", id("b"), id("c")))),
+		},
+		{
+			decls + "a * b + c\n",
+			append(declNodes, op("+", op("*", id("a"), id("b")), id("c"))),
+		},
+		{
+			decls + "a + b + c\n",
+			append(declNodes, op("+", op("+", id("a"), id("b")), id("c"))),
+		},
+		{
+			decls + "a ++ b ++ c\n",
+			append(declNodes, op("++", id("a"), op("++", id("b"), id("c")))),
+		},
+		{
+			decls + "f a + g b\n",
+			append(declNodes, op("+",
+				&ast.FuncApplication{Callee: id("f"), Args: []ast.Expr{id("a")}},
+				&ast.FuncApplication{Callee: id("g"), Args: []ast.Expr{id("b")}},
+			)),
+		},
+		{
+			decls + "f $ a + b\n",
+			append(declNodes, &ast.FuncApplication{
+				Callee: id("f"),
+				Args:   []ast.Expr{op("+", id("a"), id("b"))},
+			}),
+		},
+		{
+			decls + "fold xs 0 (+)\n",
+			append(declNodes, &ast.FuncApplication{
+				Callee: id("fold"),
+				Args:   []ast.Expr{id("xs"), &ast.IntConst{Val: 0}, id("+")},
+			}),
+		},
+	}
+	matchAstWithTable(t, &table)
+}
+
+func TestOperatorErrors(t *testing.T) {
+	sources := []string{
+		"infixl + = add\n",
+		"infixl 10 + = add\n",
+		"infixl 6 = add\n",
+		"infixl 6 + add\n",
+		"fn f:\n  infixl 6 + = add\n",
+		"infix 4 == = eq?\na == b == c\n",
+		"a +\n",
+	}
+	for _, src := range sources {
+		t.Run(src, func(t *testing.T) {
+			p := NewParser(strings.NewReader(src))
+			p.Parse()
+			if len(p.Errors()) == 0 {
+				t.Errorf("expected parsing errors")
+			}
+		})
+	}
+}
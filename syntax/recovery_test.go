@@ -0,0 +1,159 @@
+package syntax
+
+import (
+	"strings"
+	"testing"
+)
+
+type perr struct {
+	line uint
+	msg  string
+}
+
+type rtable []struct {
+	source string
+	errors []perr
+	// number of top level nodes the parser should still return
+	nodes int
+}
+
+func TestRecoveryReportsEveryError(t *testing.T) {
+	table := rtable{
+		{
+			"fn f x:\n  let = 1\n  io.print x\n  let y 2\n  x\n\nfn g = 1\n",
+			[]perr{
+				{1, "expected identifier in variable declaration"},
+				{3, "expected '=' operator in variable declaration"},
+			},
+			2,
+		},
+		{
+			"fn k:\n  if x\n    1\n  2\n\nk!\n",
+			[]perr{
+				{1, "if expects a block as its body"},
+			},
+			2,
+		},
+		{
+			"let a = (1, \nlet b = 2\nlet c = [1, 2\nlet d = 3\n",
+			[]perr{
+				{0, "Expected ) to close a tuple literal"},
+				{2, "Expected ] to close a list literal"},
+			},
+			3,
+		},
+		{
+			"fn f:\n  1\n    2\n  3\n  do |1| -> 2\n",
+			[]perr{
+				{2, "unexpected indentation"},
+				{4, "Lambda argument has to be an identifier or a pattern"},
+			},
+			1,
+		},
+		{
+			"  indented\n    more\nlet x = 1\n)\nlet y = 2\n",
+			[]perr{
+				{0, "unexpected indentation at the top level"},
+				{3, "expected declaration or expression"},
+			},
+			2,
+		},
+		{
+			"match x:\n  case -> 1\n  case 2 -> 2\n  case 3 ->\n  case 4 -> 4\n",
+			[]perr{
+				{1, "expected pattern after case"},
+				{3, "expected expression after -> in case arm"},
+			},
+			1,
+		},
+		{
+			"handle:\n  let = 1\n  2\nwith Eff:\n  3\nlet z = 1\n",
+			[]perr{
+				{1, "expected identifier in variable declaration"},
+				{3, "expected effect's value name"},
+			},
+			1,
+		},
+		{
+			"fn f:\n  while x:\n    let a =\n    for in xs:\n      1\n  else:\n    2\n  with\n  io.print 1 $\n\nimport\nfrom a import\nlet ok = 1\n",
+			[]perr{
+				{2, "expected expression after '=' in variable declaration"},
+				{3, "for expects a name or a pattern to bind elements to"},
+				{5, "else expected only after if"},
+				{7, "with expected only after handle"},
+				{8, "expected expression after binary operator"},
+				{10, "expected module path after import"},
+				{11, "expected module path after from"},
+			},
+			2,
+		},
+		{
+			"fn f:\n  resume\n  io.print (, 1)\n  if x:\n    1\n  else 2\n",
+			[]perr{
+				{1, "Resume expects at least a continuation to run with"},
+				{2, "expected expression after opening parenthesis"},
+				{5, "else expects a block as its body"},
+			},
+			1,
+		},
+		{
+			// the failing statement is skipped together with its else clause
+			"fn f:\n  if (:\n    1\n  else:\n    2\n  3\n",
+			[]perr{
+				{1, "expected expression after opening parenthesis"},
+			},
+			1,
+		},
+		{
+			"let x = 00\nlet y = {\n  a: 1,\n  b: ,\n}\nlet z = 1\n",
+			[]perr{
+				{0, "numbers cannot have leading zeros"},
+				{1, "record literal expects an expression as its values"},
+			},
+			2,
+		},
+		{
+			"let r = {a: 1\nlet l = [1\n",
+			[]perr{
+				{0, "missing comma (,) in record literal"},
+				{1, "Expected ] to close a list literal"},
+			},
+			0,
+		},
+		{
+			"fn f x =\nfn g x:\n\n  x\n",
+			[]perr{
+				{0, "expected expression as a function body"},
+			},
+			1,
+		},
+	}
+	matchErrorsWithTable(t, table)
+}
+
+func matchErrorsWithTable(t *testing.T, table rtable) {
+	for _, test := range table {
+		t.Run(test.source, func(t *testing.T) {
+			p := NewParser(strings.NewReader(test.source))
+			nodes := p.Parse()
+			errs := p.Errors()
+			if len(errs) != len(test.errors) {
+				t.Fatalf("expected %d errors, got %v", len(test.errors), errs)
+			}
+			for i, want := range test.errors {
+				got := errs[i]
+				if line := got.SourceLoc().Beg.Line; line != want.line || got.Error() != want.msg {
+					t.Errorf("wrong error %d\nwant: %d %s\ngot:  %d %s", i, want.line, want.msg, line, got.Error())
+				}
+			}
+			if len(nodes) != test.nodes {
+				t.Errorf("expected %d nodes, got %d: %v", test.nodes, len(nodes), nodes)
+			}
+			for i, n := range nodes {
+				if n == nil {
+					t.Errorf("node %d is nil", i)
+				}
+			}
+		})
+	}
+}
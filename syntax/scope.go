@@ -10,11 +10,17 @@ type (
 	ScopeInfo interface {
 		Lift()
 		IsLifted() bool
+		// Definition returns the node defining the name
+		// or nil if it is not known.
+		Definition() ast.Node
 	}
 
 	Scope struct {
 		parent *Scope
 		names  map[string]ScopeInfo
+		// function is set for scopes introduced by a function
+		// or a lambda body, as opposed to blocks within them.
+		function bool
 	}
 
 	emptyScopeInfo struct{}
@@ -24,6 +30,12 @@ type (
 	fnArgScopeInfo struct {
 		inner *ast.FuncDeclArg
 	}
+	bindScopeInfo struct {
+		inner *ast.BindPattern
+	}
+	declScopeInfo struct {
+		inner ast.Node
+	}
 )
 
 const (
@@ -48,9 +60,35 @@ func (a fnArgScopeInfo) Lift() {
 func (a fnArgScopeInfo) IsLifted() bool {
 	return a.inner.Lift
 }
+func (b bindScopeInfo) Lift() {
+	b.inner.Lift = true
+}
+func (b bindScopeInfo) IsLifted() bool {
+	return b.inner.Lift
+}
+func (d declScopeInfo) Lift() {}
+func (d declScopeInfo) IsLifted() bool {
+	return false
+}
+
+func (e emptyScopeInfo) Definition() ast.Node {
+	return nil
+}
+func (v varScopeInfo) Definition() ast.Node {
+	return v.inner
+}
+func (a fnArgScopeInfo) Definition() ast.Node {
+	return a.inner
+}
+func (b bindScopeInfo) Definition() ast.Node {
+	return b.inner
+}
+func (d declScopeInfo) Definition() ast.Node {
+	return d.inner
+}
 
 func NewScope(parent *Scope) *Scope {
-	return &Scope{parent, make(map[string]ScopeInfo)}
+	return &Scope{parent: parent, names: make(map[string]ScopeInfo)}
 }
 
 func (s *Scope) Insert(name string) {
@@ -65,10 +103,28 @@ func (s *Scope) InsertFuncArg(arg *ast.FuncDeclArg) {
 	s.names[arg.Name] = fnArgScopeInfo{arg}
 }
 
+func (s *Scope) InsertBinding(b *ast.BindPattern) {
+	s.names[b.Name] = bindScopeInfo{b}
+}
+
+// InsertDecl inserts the name defined by the node which
+// cannot be lifted, like a global declaration.
+func (s *Scope) InsertDecl(name string, node ast.Node) {
+	s.names[name] = declScopeInfo{node}
+}
+
 func (s *Scope) Derive() *Scope {
 	return NewScope(s)
 }
 
+// DeriveFunction derives a scope for the body of a function.
+// Names declared in it can shadow the ones from enclosing functions.
+func (s *Scope) DeriveFunction() *Scope {
+	f := NewScope(s)
+	f.function = true
+	return f
+}
+
 func (s *Scope) IsGlobal() bool {
 	return s.parent == nil
 }
@@ -93,6 +149,21 @@ func (s *Scope) LookupLocal(name string) ScopeInfo {
 	return s.parent.LookupLocal(name)
 }
 
+// LookupInFunction works like LookupLocal but does not look
+// past the scope of the innermost enclosing function.
+func (s *Scope) LookupInFunction(name string) ScopeInfo {
+	if s.parent == nil {
+		return nil
+	}
+	if si, ok := s.names[name]; ok {
+		return si
+	}
+	if s.function {
+		return nil
+	}
+	return s.parent.LookupInFunction(name)
+}
+
 func (s *Scope) RelativeScope(name string) (RelativeScope, ScopeInfo) {
 	si, ok := s.names[name]
 	if s.parent == nil {
@@ -25,6 +25,7 @@ const (
 	Float
 	String
 	Colon
+	DoubleColon
 	Comma
 	LParen
 	RParen
@@ -39,6 +40,7 @@ const (
 	Pipe
 	Access
 	Quote
+	Unquote
 
 	keywords_beg
 	Fn
@@ -53,8 +55,21 @@ const (
 	Return
 	Handle
 	With
+	Finally
 	Effect
 	Resume
+	Match
+	Case
+	Break
+	Continue
+	For
+	In
+	Import
+	From
+	Macro
+	Infixl
+	Infixr
+	Infix
 	keywords_end
 
 	operators_beg
@@ -62,6 +77,7 @@ const (
 	Exclamation
 	Arrow
 	Dollar
+	FatArrow
 	operators_end
 
 	Eof
@@ -81,6 +97,7 @@ var tokens = [...]string{
 	String:                    "STRING",
 	Comment:                   "COMMENT",
 	Colon:                     ":",
+	DoubleColon:               "::",
 	Comma:                     ",",
 	LParen:                    "(",
 	RParen:                    ")",
@@ -94,26 +111,41 @@ var tokens = [...]string{
 	Operator:                  "OPERATOR",
 	Access:                    ".",
 	Quote:                     "`",
-
-	Fn:     "fn",
-	If:     "if",
-	Else:   "else",
-	While:  "while",
-	Let:    "let",
-	True:   "true",
-	False:  "false",
-	None:   "none",
-	Return: "return",
-	Handle: "handle",
-	With:   "with",
-	Effect: "effect",
-	Do:     "do",
-	Resume: "resume",
+	Unquote:                   "~",
+
+	Fn:       "fn",
+	If:       "if",
+	Else:     "else",
+	While:    "while",
+	Let:      "let",
+	True:     "true",
+	False:    "false",
+	None:     "none",
+	Return:   "return",
+	Handle:   "handle",
+	With:     "with",
+	Finally:  "finally",
+	Effect:   "effect",
+	Do:       "do",
+	Resume:   "resume",
+	Match:    "match",
+	Case:     "case",
+	Break:    "break",
+	Continue: "continue",
+	For:      "for",
+	In:       "in",
+	Import:   "import",
+	From:     "from",
+	Macro:    "macro",
+	Infixl:   "infixl",
+	Infixr:   "infixr",
+	Infix:    "infix",
 
 	Assignment:  "=",
 	Exclamation: "!",
 	Arrow:       "->",
 	Dollar:      "$",
+	FatArrow:    "=>",
 
 	Eof: "EOF",
 }
@@ -21,6 +21,7 @@ FNK_BINARY_NAME = "funk"
 
 tests_dir = Path(__file__).parent
 root_dir = tests_dir.parent
+modules_dir = tests_dir / "modules"
 
 def run(args):
     pat = args.filter[0] if args.filter else None
@@ -73,7 +74,11 @@ def run_tests(binary: Path, tests: list[Path]):
             test_file = test_path
             test_path = test_file.name
         try:
-            proc = subprocess.run([binary, "-panic_on_error", test_path], check=True, capture_output=True)
+            proc = subprocess.run(
+                [binary, "-panic_on_error", test_path],
+                check=True,
+                capture_output=True,
+                env={**os.environ, "FUNK_PATH": str(modules_dir)})
             if test_output:
                 output = proc.stdout.splitlines()
                 output = list(map(lambda s: s.decode("utf-8"), output))
@@ -0,0 +1,710 @@
+package types
+
+import (
+	"fmt"
+
+	"github.com/gala377/MLLang/syntax/ast"
+	"github.com/gala377/MLLang/syntax/span"
+)
+
+type TypeError struct {
+	pos span.Span
+	msg string
+}
+
+func (e TypeError) SourceLoc() span.Span {
+	return e.pos
+}
+
+func (e TypeError) Error() string {
+	return e.msg
+}
+
+// Checker infers types of the program using Hindley-Milner
+// style inference. Values it knows nothing about, like most
+// of the standard library or effects, are given fresh type
+// variables on every use, so that they never produce errors.
+type Checker struct {
+	errors []TypeError
+	scopes []map[string]*Scheme
+	// current let nesting, used for generalization
+	level   int
+	counter int
+	// expected return types of the enclosing functions
+	returns []Type
+	// annotations are converted more than once,
+	// errors in them are reported only when checking
+	quiet bool
+}
+
+func NewChecker() *Checker {
+	c := &Checker{
+		errors: []TypeError{},
+		scopes: []map[string]*Scheme{builtins()},
+	}
+	c.openScope()
+	return c
+}
+
+// builtins returns types of the few natives the checker knows about.
+func builtins() map[string]*Scheme {
+	a := &Var{level: 1}
+	b := &Var{level: 1}
+	pred := &Scheme{Vars: []*Var{a}, Type: &Func{Arg: a, Ret: Bool}}
+	return map[string]*Scheme{
+		"not":       {Type: &Func{Arg: Bool, Ret: Bool}},
+		"and":       {Type: &Func{Arg: Bool, Ret: &Func{Arg: Bool, Ret: Bool}}},
+		"or":        {Type: &Func{Arg: Bool, Ret: &Func{Arg: Bool, Ret: Bool}}},
+		"concat":    {Type: &Func{Arg: String, Ret: &Func{Arg: String, Ret: String}}},
+		"panic":     {Vars: []*Var{a, b}, Type: &Func{Arg: a, Ret: b}},
+		"int?":      pred,
+		"float?":    pred,
+		"string?":   pred,
+		"symbol?":   pred,
+		"bool?":     pred,
+		"list?":     pred,
+		"tuple?":    pred,
+		"record?":   pred,
+		"seq?":      pred,
+		"function?": pred,
+	}
+}
+
+// Check infers types of all of the top level nodes
+// and returns found type errors.
+func (c *Checker) Check(nodes []ast.Node) []TypeError {
+	c.declareGlobals(nodes)
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case ast.Decl:
+			c.checkDecl(n)
+		case ast.Stmt:
+			c.checkStmt(n, false)
+		}
+	}
+	return c.errors
+}
+
+// TypeOf returns the type of the global as a string.
+func (c *Checker) TypeOf(name string) (string, bool) {
+	s, ok := c.scopes[1][name]
+	if !ok {
+		return "", false
+	}
+	return s.String(), true
+}
+
+func (c *Checker) errorf(loc *span.Span, format string, args ...interface{}) {
+	err := TypeError{msg: fmt.Sprintf(format, args...)}
+	if loc != nil {
+		err.pos = *loc
+	}
+	c.errors = append(c.errors, err)
+}
+
+// expect unifies the types reporting an error
+// with the given context if they do not match.
+func (c *Checker) expect(loc *span.Span, expected, actual Type, context string) bool {
+	p := newPrinter()
+	err := c.unifyWith(p, expected, actual)
+	if err == nil {
+		return true
+	}
+	msg := fmt.Sprintf("%s: expected %s, got %s", context, p.print(expected), p.print(actual))
+	if detail := err.Error(); detail != fmt.Sprintf("%s is not %s", p.print(expected), p.print(actual)) &&
+		detail != fmt.Sprintf("%s is not %s", p.print(actual), p.print(expected)) {
+		msg += "\n" + detail
+	}
+	c.errorf(loc, "%s", msg)
+	return false
+}
+
+func (c *Checker) fresh() *Var {
+	c.counter++
+	return &Var{id: c.counter, level: c.level}
+}
+
+func (c *Checker) openScope() {
+	c.scopes = append(c.scopes, map[string]*Scheme{})
+}
+
+func (c *Checker) closeScope() {
+	c.scopes = c.scopes[:len(c.scopes)-1]
+}
+
+func (c *Checker) define(name string, s *Scheme) {
+	c.scopes[len(c.scopes)-1][name] = s
+}
+
+func (c *Checker) defineMono(name string, t Type) {
+	c.define(name, &Scheme{Type: t})
+}
+
+func (c *Checker) lookup(name string) (*Scheme, bool) {
+	for i := len(c.scopes) - 1; i >= 0; i-- {
+		if s, ok := c.scopes[i][name]; ok {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// declareGlobals defines all of the globals before checking
+// so that functions can refer to globals defined after them.
+func (c *Checker) declareGlobals(nodes []ast.Node) {
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *ast.FuncDecl:
+			c.declareGlobal(n.Name, n.Type)
+		case *ast.GlobalValDecl:
+			c.declareGlobal(n.Name, n.Type)
+		case *ast.OperatorDecl:
+			c.declareGlobal(n.Name, nil)
+		case *ast.EffectDecl:
+			c.define(n.Name, &Scheme{})
+		case *ast.ImportDecl:
+			c.define(n.Name, &Scheme{})
+		case *ast.MacroDecl:
+			// macro calls are expanded before they are run
+			// so their types are not known until then
+			c.define(n.Name, &Scheme{})
+		case *ast.FromImportDecl:
+			for _, name := range n.Names {
+				c.define(name.Name, &Scheme{})
+			}
+		}
+	}
+}
+
+func (c *Checker) declareGlobal(name string, annotation *ast.TypeScheme) {
+	if annotation != nil {
+		c.define(name, c.annotationScheme(annotation))
+		return
+	}
+	c.level++
+	c.defineMono(name, c.fresh())
+	c.level--
+}
+
+func (c *Checker) checkDecl(node ast.Decl) {
+	switch n := node.(type) {
+	case *ast.FuncDecl:
+		c.checkLet(n.Name, n.Type, n.Span, func() Type {
+			return c.inferFunction(n.Args, n.Body)
+		}, true)
+	case *ast.GlobalValDecl:
+		c.checkLet(n.Name, n.Type, n.Span, func() Type {
+			return c.inferExpr(n.Rhs)
+		}, isValue(n.Rhs))
+	case *ast.OperatorDecl:
+		c.checkLet(n.Name, nil, n.Span, func() Type {
+			return c.inferExpr(n.Rhs)
+		}, isValue(n.Rhs))
+	case *ast.GlobalPatternDecl:
+		c.bindPattern(n.Pattern, c.inferExpr(n.Rhs))
+	}
+}
+
+// isValue reports if the expression can be generalized, that is
+// it does not compute anything, like a function or other variable.
+func isValue(node ast.Expr) bool {
+	switch node.(type) {
+	case *ast.LambdaExpr, *ast.Identifier, *ast.Access, *ast.LocalEffect:
+		return true
+	}
+	return false
+}
+
+// checkLet infers the type of the declared value and binds it.
+// Functions are generalized, other values are not as they
+// could be reassigned later.
+func (c *Checker) checkLet(name string, annotation *ast.TypeScheme, loc *span.Span, infer func() Type, generalize bool) {
+	declared, isDeclared := c.scopes[len(c.scopes)-1][name]
+	if annotation != nil {
+		declared = c.annotationScheme(annotation)
+		c.define(name, declared)
+	}
+	if generalize {
+		c.level++
+	}
+	t := infer()
+	if generalize {
+		c.level--
+	}
+	if annotation != nil {
+		c.level++
+		rigid := c.annotationType(annotation, true)
+		c.level--
+		c.expect(loc, rigid, t, fmt.Sprintf("definition of %s does not match its declared type", name))
+		return
+	}
+	if len(c.scopes) == 2 && isDeclared && declared.Type != nil && len(declared.Vars) == 0 {
+		// predeclared global, might have been used already
+		c.expect(loc, declared.Type, t, fmt.Sprintf("conflicting uses of %s", name))
+	}
+	if generalize {
+		c.define(name, c.generalize(t))
+	} else {
+		c.defineMono(name, t)
+	}
+}
+
+// Annotations
+
+func (c *Checker) annotationScheme(s *ast.TypeScheme) *Scheme {
+	c.level++
+	c.quiet = true
+	t := c.annotationType(s, false)
+	c.quiet = false
+	c.level--
+	return c.generalize(t)
+}
+
+// annotationType converts the annotation into a type. When rigid is
+// set the type variables can only be unified with themselves, this
+// is used to check that definitions are as general as declared.
+func (c *Checker) annotationType(s *ast.TypeScheme, rigid bool) Type {
+	vars := map[string]Type{}
+	for _, name := range s.Vars {
+		v := c.fresh()
+		if rigid {
+			v.rigid = name
+		}
+		vars[name] = v
+	}
+	return c.fromTypeExpr(s.Type, vars)
+}
+
+func (c *Checker) fromTypeExpr(node ast.TypeExpr, vars map[string]Type) Type {
+	switch n := node.(type) {
+	case *ast.TypeName:
+		if v, ok := vars[n.Name]; ok && len(n.Args) == 0 {
+			return v
+		}
+		if b, ok := builtinTypes[n.Name]; ok && len(n.Args) == 0 {
+			return b
+		}
+		first := []rune(n.Name)[0]
+		if first < 'A' || first > 'Z' {
+			if c.quiet {
+				return c.fresh()
+			}
+			c.errorf(n.Span, "unknown type %s, type variables have to be declared with '%s =>'", n.Name, n.Name)
+			return c.fresh()
+		}
+		args := []Type{}
+		for _, a := range n.Args {
+			args = append(args, c.fromTypeExpr(a, vars))
+		}
+		return &Con{Name: n.Name, Args: args}
+	case *ast.TypeFunc:
+		var t Type = c.fromTypeExpr(n.Ret, vars)
+		if len(n.Args) == 0 {
+			return &Func{Ret: t}
+		}
+		for i := len(n.Args) - 1; i >= 0; i-- {
+			t = &Func{Arg: c.fromTypeExpr(n.Args[i], vars), Ret: t}
+		}
+		return t
+	case *ast.TypeTuple:
+		elems := []Type{}
+		for _, e := range n.Elems {
+			elems = append(elems, c.fromTypeExpr(e, vars))
+		}
+		return NewTuple(elems...)
+	case *ast.TypeList:
+		return NewList(c.fromTypeExpr(n.Elem, vars))
+	case *ast.TypeRecord:
+		r := &Record{Fields: map[string]Type{}}
+		for _, f := range n.Fields {
+			r.Fields[f.Key] = c.fromTypeExpr(f.Type, vars)
+		}
+		if n.Open {
+			r.Rest = c.fresh()
+		}
+		return r
+	}
+	panic("unreachable")
+}
+
+// Statements
+
+// checkStmt returns the type of the value the statement evaluates
+// to. used is false if the value is discarded.
+func (c *Checker) checkStmt(node ast.Stmt, used bool) Type {
+	switch n := node.(type) {
+	case *ast.StmtExpr:
+		return c.inferExprUsed(n.Expr, used)
+	case *ast.ValDecl:
+		c.checkLet(n.Name, n.Type, n.Span, func() Type {
+			return c.inferExpr(n.Rhs)
+		}, isValue(n.Rhs))
+	case *ast.PatternDecl:
+		c.bindPattern(n.Pattern, c.inferExpr(n.Rhs))
+	case *ast.Assignment:
+		rhs := c.inferExpr(n.RValue)
+		lhs := c.inferExpr(n.LValue)
+		c.expect(n.Span, lhs, rhs, "assigned value does not match the type of the variable")
+	case *ast.Return:
+		var t Type = c.fresh()
+		if n.Val != nil {
+			t = c.inferExpr(n.Val)
+		}
+		if len(c.returns) > 0 {
+			c.expect(n.Span, c.returns[len(c.returns)-1], t, "returned value does not match other returns")
+		}
+		// return does not evaluate to anything
+		return c.fresh()
+	case *ast.Break, *ast.Continue:
+		return c.fresh()
+	case *ast.WhileStmt:
+		c.expect(n.Cond.NodeSpan(), Bool, c.inferExpr(n.Cond), "while condition should be a bool")
+		c.inferBlock(n.Body, false)
+		if b, ok := n.Cond.(*ast.BoolConst); ok && b.Val {
+			// infinite loop, can only be left with return
+			return c.fresh()
+		}
+	case *ast.ForStmt:
+		it := c.inferExpr(n.Iterable)
+		var elem Type = c.fresh()
+		if l, ok := prune(it).(*Con); ok && l.Name == list {
+			elem = l.Args[0]
+		}
+		c.openScope()
+		c.bindPattern(n.Pattern, elem)
+		c.inferBlock(n.Body, false)
+		c.closeScope()
+	}
+	return c.fresh()
+}
+
+func (c *Checker) inferBlock(node *ast.Block, used bool) Type {
+	c.openScope()
+	defer c.closeScope()
+	var t Type = c.fresh()
+	for i, s := range node.Instr {
+		t = c.checkStmt(s, used && i == len(node.Instr)-1)
+	}
+	return t
+}
+
+// Expressions
+
+func (c *Checker) inferExpr(node ast.Expr) Type {
+	return c.inferExprUsed(node, true)
+}
+
+func (c *Checker) inferExprUsed(node ast.Expr, used bool) Type {
+	switch n := node.(type) {
+	case *ast.IntConst:
+		return Int
+	case *ast.FloatConst:
+		return Float
+	case *ast.StringConst:
+		return String
+	case *ast.BoolConst:
+		return Bool
+	case *ast.NoneConst:
+		// none is used like null in other languages,
+		// so it is accepted wherever a value is expected
+		return c.fresh()
+	case *ast.Symbol:
+		return Symbol
+	case *ast.Identifier:
+		if s, ok := c.lookup(n.Name); ok {
+			return c.instantiate(s)
+		}
+		return c.fresh()
+	case *ast.TupleConst:
+		elems := []Type{}
+		for _, v := range n.Vals {
+			elems = append(elems, c.inferExpr(v))
+		}
+		return NewTuple(elems...)
+	case *ast.ListConst:
+		elem := c.fresh()
+		for _, v := range n.Vals {
+			c.expect(v.NodeSpan(), elem, c.inferExpr(v), "list elements should have the same type")
+		}
+		return NewList(elem)
+	case *ast.RecordConst:
+		r := &Record{Fields: map[string]Type{}}
+		for _, f := range n.Fields {
+			r.Fields[f.Key] = c.inferExpr(f.Val)
+		}
+		return r
+	case *ast.Access:
+		field := c.fresh()
+		rec := c.inferExpr(n.Lhs)
+		expected := &Record{Fields: map[string]Type{n.Property.Name: field}, Rest: c.fresh()}
+		if err := c.unify(expected, rec); err != nil {
+			c.errorf(n.Span, "cannot access field %s of %s\n%s", n.Property.Name, TypeString(rec), err)
+		}
+		return field
+	case *ast.FuncApplication:
+		return c.inferApplication(n)
+	case *ast.LambdaExpr:
+		if n.Name == "" {
+			return c.inferFunction(n.Args, n.Body)
+		}
+		// local function that can call itself
+		c.openScope()
+		defer c.closeScope()
+		self := c.fresh()
+		c.defineMono(n.Name, self)
+		t := c.inferFunction(n.Args, n.Body)
+		c.expect(n.Span, self, t, fmt.Sprintf("conflicting uses of %s", n.Name))
+		return t
+	case *ast.Block:
+		return c.inferBlock(n, used)
+	case *ast.IfExpr:
+		c.expect(n.Cond.NodeSpan(), Bool, c.inferExpr(n.Cond), "if condition should be a bool")
+		then := c.inferBlock(n.IfBranch, used)
+		if n.ElseBranch == nil {
+			return c.fresh()
+		}
+		otherwise := c.inferExprUsed(n.ElseBranch, used)
+		if !used {
+			return c.fresh()
+		}
+		c.expect(n.ElseBranch.NodeSpan(), then, otherwise, "branches of if have different types")
+		return then
+	case *ast.Match:
+		scrutinee := c.inferExpr(n.Scrutinee)
+		uniform := samePatternShapes(n.Arms)
+		res := c.fresh()
+		for _, arm := range n.Arms {
+			c.openScope()
+			if uniform {
+				c.bindPattern(arm.Pattern, scrutinee)
+			} else {
+				// matching on values of different types,
+				// every arm has to be checked on its own
+				c.bindPattern(arm.Pattern, c.fresh())
+			}
+			if arm.Guard != nil {
+				c.expect(arm.Guard.NodeSpan(), Bool, c.inferExpr(arm.Guard), "match guard should be a bool")
+			}
+			t := c.inferBlock(arm.Body, used)
+			if used {
+				c.expect(arm.Span, res, t, "match arms have different types")
+			}
+			c.closeScope()
+		}
+		if !used {
+			return c.fresh()
+		}
+		return res
+	case *ast.Handle:
+		return c.inferHandle(n)
+	case *ast.Resume:
+		k := c.inferExpr(n.Cont)
+		var arg Type = c.fresh()
+		if n.Arg != nil {
+			arg = c.inferExpr(n.Arg)
+		}
+		res := c.fresh()
+		c.expect(n.Span, &Func{Arg: arg, Ret: res}, k, "continuation cannot be resumed with this value")
+		return res
+	case *ast.LetExpr:
+		c.inferExpr(n.Decls)
+		return c.inferBlock(n.Body, used)
+	}
+	return c.fresh()
+}
+
+func (c *Checker) inferApplication(node *ast.FuncApplication) Type {
+	callee := c.inferExpr(node.Callee)
+	args := []ast.Expr{}
+	args = append(args, node.Args...)
+	if node.Block != nil {
+		args = append(args, node.Block)
+	}
+	if len(args) == 0 {
+		res := c.fresh()
+		if err := c.unify(callee, &Func{Ret: res}); err != nil {
+			c.errorf(node.Span, "%s cannot be called without arguments\n%s", TypeString(callee), err)
+		}
+		return res
+	}
+	t := callee
+	for i, a := range args {
+		arg := c.inferExpr(a)
+		res := c.fresh()
+		p := newPrinter()
+		switch f := prune(t).(type) {
+		case *Var:
+		case *Record:
+			// applying a record to another merges them
+			return c.fresh()
+		case *Func:
+			if f.Arg == nil {
+				c.errorf(node.Span, "function of type %s does not take any arguments", p.print(callee))
+				return c.fresh()
+			}
+		default:
+			if i == 0 {
+				c.errorf(node.Span, "value of type %s is not a function", p.print(t))
+			} else {
+				c.errorf(node.Span, "too many arguments, function of type %s takes only %d", p.print(callee), i)
+			}
+			return c.fresh()
+		}
+		if err := c.unifyWith(p, t, &Func{Arg: arg, Ret: res}); err != nil {
+			c.errorf(a.NodeSpan(), "argument %d has type %s which does not match %s\n%s",
+				i+1, p.print(arg), p.print(callee), err)
+			return c.fresh()
+		}
+		t = res
+	}
+	return t
+}
+
+// inferFunction infers the type of the curried function.
+func (c *Checker) inferFunction(args []*ast.FuncDeclArg, body ast.Expr) Type {
+	c.openScope()
+	defer c.closeScope()
+	argTypes := []Type{}
+	for _, a := range args {
+		t := c.fresh()
+		c.defineMono(a.Name, t)
+		if a.Pattern != nil {
+			c.bindPattern(a.Pattern, t)
+		}
+		argTypes = append(argTypes, t)
+	}
+	ret := c.inferReturning(body)
+	var t Type = &Func{Ret: ret}
+	if len(argTypes) > 0 {
+		t = ret
+		for i := len(argTypes) - 1; i >= 0; i-- {
+			t = &Func{Arg: argTypes[i], Ret: t}
+		}
+	}
+	return t
+}
+
+// inferReturning infers the type of the body that can be left
+// with the return statement, like the function's body.
+func (c *Checker) inferReturning(body ast.Expr) Type {
+	ret := c.fresh()
+	c.returns = append(c.returns, ret)
+	t := c.inferExpr(body)
+	c.returns = c.returns[:len(c.returns)-1]
+	c.expect(body.NodeSpan(), ret, t, "returned value does not match other returns")
+	return ret
+}
+
+func (c *Checker) inferHandle(node *ast.Handle) Type {
+	// the body and every clause are functions at runtime,
+	// their results become the result of the handle.
+	res := c.inferReturning(node.Body)
+	if node.Return != nil {
+		// the return clause maps the body's result
+		c.openScope()
+		c.defineMono(node.Return.Arg.Name, res)
+		res = c.inferReturning(node.Return.Body)
+		c.closeScope()
+	}
+	for _, arm := range node.Arms {
+		c.inferExpr(arm.Effect)
+		c.openScope()
+		if arm.Arg != nil {
+			arg := c.fresh()
+			c.defineMono(arm.Arg.Name, arg)
+			if arm.Arg.Pattern != nil {
+				c.bindPattern(arm.Arg.Pattern, arg)
+			}
+		}
+		if arm.Continuation != nil {
+			c.defineMono(arm.Continuation.Name, &Func{Arg: c.fresh(), Ret: res})
+		}
+		if arm.Guard != nil {
+			c.expect(arm.Guard.NodeSpan(), Bool, c.inferExpr(arm.Guard), "handler guard should be a bool")
+		}
+		t := c.inferReturning(arm.Body)
+		c.expect(arm.Span, res, t, "handler clause does not match the type of the handled block")
+		c.closeScope()
+	}
+	if node.Finally != nil {
+		// the value of the finally clause is discarded
+		c.inferReturning(node.Finally)
+	}
+	return res
+}
+
+// Patterns
+
+// samePatternShapes reports if all of the refutable patterns
+// of the arms match on values of the same type.
+func samePatternShapes(arms []*ast.MatchArm) bool {
+	shape := ""
+	for _, arm := range arms {
+		s := patternShape(arm.Pattern)
+		if s == "" {
+			continue
+		}
+		if shape != "" && s != shape {
+			return false
+		}
+		shape = s
+	}
+	return true
+}
+
+func patternShape(pat ast.Pattern) string {
+	switch p := pat.(type) {
+	case *ast.LiteralPattern:
+		if _, ok := p.Val.(*ast.NoneConst); ok {
+			return ""
+		}
+		return fmt.Sprintf("%T", p.Val)
+	case *ast.TuplePattern:
+		return fmt.Sprintf("tuple%d", len(p.Elems))
+	case *ast.ListPattern:
+		return "list"
+	case *ast.RecordPattern:
+		return "record"
+	}
+	return ""
+}
+
+func (c *Checker) bindPattern(pat ast.Pattern, t Type) {
+	switch p := pat.(type) {
+	case *ast.BindPattern:
+		c.defineMono(p.Name, t)
+	case *ast.LiteralPattern:
+		c.expect(p.Span, t, c.inferExpr(p.Val), "pattern cannot match the value")
+	case *ast.TuplePattern:
+		elems := []Type{}
+		for range p.Elems {
+			elems = append(elems, c.fresh())
+		}
+		if !c.expect(p.Span, t, NewTuple(elems...), "pattern cannot match the value") {
+			elems = elems[:0]
+			for range p.Elems {
+				elems = append(elems, c.fresh())
+			}
+		}
+		for i, e := range p.Elems {
+			c.bindPattern(e, elems[i])
+		}
+	case *ast.ListPattern:
+		var elem Type = c.fresh()
+		if !c.expect(p.Span, t, NewList(elem), "pattern cannot match the value") {
+			elem = c.fresh()
+		}
+		for _, e := range p.Elems {
+			c.bindPattern(e, elem)
+		}
+	case *ast.RecordPattern:
+		r := &Record{Fields: map[string]Type{}, Rest: c.fresh()}
+		for _, f := range p.Fields {
+			r.Fields[f.Key] = c.fresh()
+		}
+		c.expect(p.Span, t, r, "pattern cannot match the value")
+		for _, f := range p.Fields {
+			c.bindPattern(f.Pat, r.Fields[f.Key])
+		}
+	}
+}
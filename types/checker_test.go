@@ -0,0 +1,157 @@
+package types
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gala377/MLLang/syntax"
+)
+
+func check(t *testing.T, source string) (*Checker, []TypeError) {
+	t.Helper()
+	p := syntax.NewParser(strings.NewReader(source))
+	nodes := p.Parse()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("unexpected syntax errors %v", p.Errors())
+	}
+	c := NewChecker()
+	return c, c.Check(nodes)
+}
+
+func TestInferringTypes(t *testing.T) {
+	table := []struct {
+		source string
+		name   string
+		want   string
+	}{
+		{"let a = 1", "a", "int"},
+		{"let a = (1, \"a\", true)", "a", "(int, string, bool)"},
+		{"let a = [`a, `b]", "a", "[symbol]"},
+		{"let a = {x: 1, y: 2.0}", "a", "{x: int, y: float}"},
+		{"fn id x = x", "id", "a => {a -> a}"},
+		{"fn const a b = a", "const", "a b => {a -> b -> a}"},
+		{"fn compose f g x = f (g x)", "compose", "a b c => {{a -> b} -> {c -> a} -> c -> b}"},
+		{"fn get r = r.x", "get", "a => {{x: a, ..} -> a}"},
+		{"fn thunk = 1", "thunk", "{int}"},
+		{"fn call f = f!", "call", "a => {{a} -> a}"},
+		{"fn neg x = not x", "neg", "{bool -> bool}"},
+		{"fn first (a, b) = a", "first", "a b => {(a, b) -> a}"},
+		{
+			"fn f x:\n" +
+				"  if x:\n" +
+				"    return 1\n" +
+				"  2\n",
+			"f", "{bool -> int}",
+		},
+		{
+			"fn f x:\n" +
+				"  match x:\n" +
+				"    case (a, 1) -> a\n" +
+				"    case (_, b) -> b\n",
+			"f", "{(int, int) -> int}",
+		},
+		{
+			"fn f x:\n" +
+				"  let g = do y -> y\n" +
+				"  (g 1, g \"a\")\n",
+			"f", "a => {a -> (int, string)}",
+		},
+		{
+			"let f = g\n" +
+				"fn g x :: a => {a -> [a]} = [x]\n",
+			"g", "a => {a -> [a]}",
+		},
+		{"fn f x :: {{a: int, ..} -> int} = x.a", "f", "{{a: int, ..} -> int}"},
+		{"fn f :: {{int -> int}} = do x -> x", "f", "{{int -> int}}"},
+		{"fn f x :: {int -> none} = none", "f", "{int -> none}"},
+		{"fn f x = io.print x", "f", "a b => {a -> b}"},
+		{
+			"fn f x:\n" +
+				"  handle:\n" +
+				"    x\n" +
+				"  with return v:\n" +
+				"    (v, 1)\n",
+			"f", "a => {a -> (a, int)}",
+		},
+	}
+	for _, test := range table {
+		t.Run(test.source, func(t *testing.T) {
+			c, errs := check(t, test.source)
+			if len(errs) > 0 {
+				t.Fatalf("unexpected type errors %v", errs)
+			}
+			got, ok := c.TypeOf(test.name)
+			if !ok {
+				t.Fatalf("%s is not defined", test.name)
+			}
+			if got != test.want {
+				t.Errorf("expected type %s, got %s", test.want, got)
+			}
+		})
+	}
+}
+
+func TestTypeErrors(t *testing.T) {
+	table := []struct {
+		source string
+		want   string
+	}{
+		{"let a = [1, \"a\"]", "list elements should have the same type: expected int, got string"},
+		{"if 1:\n  2\n", "if condition should be a bool: expected bool, got int"},
+		{"let a = 1\na 2\n", "value of type int is not a function"},
+		{"fn f x = x\nf 1 2\n", "too many arguments"},
+		{"fn f = 1\nf 2\n", "does not take any arguments"},
+		{"fn f x = x\nf!\n", "cannot be called without arguments"},
+		{"fn f r = r.x\nf {y: 1}\n", "record {y: int} has no field x"},
+		{"let r = {x: 1}\nr.y\n", "cannot access field y of {x: int}"},
+		{"fn f x :: {int -> string} = x", "definition of f does not match its declared type"},
+		{"fn f x :: a => {a -> int} = x", "expected {a -> int}, got {a -> a}"},
+		{"let a :: string = 1", "definition of a does not match its declared type"},
+		{"let a :: b = 1", "unknown type b"},
+		{"fn f x:\n  if x:\n    return 1\n  \"a\"\n", "returned value does not match other returns"},
+		{"fn f x = not x\nf 1\n", "argument 1 has type int which does not match {bool -> bool}"},
+		{"let a = 1\na = \"s\"\n", "assigned value does not match the type of the variable"},
+		{"let a = if true:\n  1\nelse:\n  \"a\"\n", "branches of if have different types"},
+		{"let f = do (a, b) -> a\nf [1]\n", "('a, 'b) is not [int]"},
+	}
+	for _, test := range table {
+		t.Run(test.source, func(t *testing.T) {
+			_, errs := check(t, test.source)
+			if len(errs) == 0 {
+				t.Fatalf("expected type errors")
+			}
+			for _, e := range errs {
+				if strings.Contains(e.Error(), test.want) {
+					return
+				}
+			}
+			t.Errorf("expected error containing %q, got %v", test.want, errs)
+		})
+	}
+}
+
+func TestUntypedCodeIsAccepted(t *testing.T) {
+	sources := []string{
+		// none is accepted like null
+		"let a = none\na = 1\n",
+		"fn f x:\n  if x:\n    return none\n  (1, 2)\n",
+		// matching on values of different types
+		"fn f x:\n  match x:\n    case 1 -> 1\n    case (a, b) -> a\n    case _ -> 2\n",
+		// standard library values are not typed
+		"io.print 1\nio.print \"a\"\n",
+		// effects are not typed
+		"effect Yield\nYield 1\nYield \"a\"\n",
+		// recursive structures
+		"fn f node:\n  node = node.next\n",
+		// records merging
+		"let a = {x: 1}\na {y: 2}\n",
+	}
+	for _, src := range sources {
+		t.Run(src, func(t *testing.T) {
+			_, errs := check(t, src)
+			if len(errs) > 0 {
+				t.Errorf("unexpected type errors %v", errs)
+			}
+		})
+	}
+}
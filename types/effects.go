@@ -0,0 +1,693 @@
+package types
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gala377/MLLang/syntax/ast"
+	"github.com/gala377/MLLang/syntax/span"
+)
+
+// stdEffects maps names under which the effects of the standard
+// library are usually referred to, to their canonical names.
+var stdEffects = map[string]string{
+	"iter.Yield":   "iter.Yield",
+	"errors.error": "errors.error",
+	"error":        "errors.error",
+	"export":       "export",
+}
+
+// stdPerformers lists the functions of the standard library
+// that are known to perform effects.
+var stdPerformers = map[string][]string{
+	"yield":            {"iter.Yield"},
+	"errors.throw":     {"errors.error"},
+	"errors.throwFrom": {"errors.error"},
+}
+
+// FunctionEffects is a set of effects the function can perform.
+type FunctionEffects struct {
+	Name     string
+	Effects  []string
+	Declared bool
+}
+
+func (f *FunctionEffects) String() string {
+	return fmt.Sprintf("%s ! {%s}", f.Name, strings.Join(f.Effects, ", "))
+}
+
+type effectSet map[string]bool
+
+func (s effectSet) add(o effectSet) {
+	for e := range o {
+		s[e] = true
+	}
+}
+
+func (s effectSet) sorted() []string {
+	res := []string{}
+	for e := range s {
+		res = append(res, e)
+	}
+	sort.Strings(res)
+	return res
+}
+
+type effectFn struct {
+	name     string
+	loc      *span.Span
+	params   []string
+	declared effectSet
+	inferred effectSet
+	// effects handled anywhere in the function's body,
+	// used to guess which effects of the functions passed
+	// as arguments do not escape the call
+	handles effectSet
+	// parameters the function may call, functions passed
+	// for the other ones are not called by the call
+	calls map[string]bool
+}
+
+// performs returns the effects the caller has to expect.
+// Declared effects are trusted.
+func (f *effectFn) performs() effectSet {
+	if f.declared != nil {
+		return f.declared
+	}
+	return f.inferred
+}
+
+// effectBinding is what the name resolves to, at most one of
+// effect and fn is set, neither means any other value.
+type effectBinding struct {
+	effect string
+	fn     *effectFn
+	// number of arguments fn has already been partially applied to
+	applied int
+	// set if the value is the parameter of the function
+	paramOf *effectFn
+	param   string
+}
+
+// effectAnalyzer finds effects that can be performed by the functions
+// and top level code. Effects of functions passed as arguments are
+// assumed to be performed by the call if the callee may call them.
+// The analysis is repeated
+// until the effects of every function stop growing.
+type effectAnalyzer struct {
+	scopes []map[string]*effectBinding
+	fns    map[ast.Node]*effectFn
+	order  []*effectFn
+	// functions whose bodies are being analyzed
+	current []*effectFn
+	// paths appearing in handler clauses, like coro.yield, calls
+	// to them are assumed to perform effects
+	handled map[string]bool
+	changed bool
+	report  bool
+	errors  []TypeError
+}
+
+// AnalyzeEffects returns effects each function can perform
+// and errors for the top level code that can perform effects
+// not covered by any handler or functions performing effects
+// missing from their annotations.
+func AnalyzeEffects(nodes []ast.Node) ([]*FunctionEffects, []TypeError) {
+	a := &effectAnalyzer{
+		scopes:  []map[string]*effectBinding{{}},
+		fns:     map[ast.Node]*effectFn{},
+		handled: map[string]bool{},
+		errors:  []TypeError{},
+	}
+	a.declareGlobals(nodes)
+	a.changed = true
+	for a.changed {
+		a.changed = false
+		a.analyze(nodes)
+	}
+	a.report = true
+	a.analyze(nodes)
+	res := []*FunctionEffects{}
+	for _, f := range a.order {
+		res = append(res, &FunctionEffects{
+			Name:     f.name,
+			Effects:  f.performs().sorted(),
+			Declared: f.declared != nil,
+		})
+	}
+	return res, a.errors
+}
+
+func (a *effectAnalyzer) errorf(loc *span.Span, format string, args ...interface{}) {
+	err := TypeError{msg: fmt.Sprintf(format, args...)}
+	if loc != nil {
+		err.pos = *loc
+	}
+	a.errors = append(a.errors, err)
+}
+
+func (a *effectAnalyzer) openScope() {
+	a.scopes = append(a.scopes, map[string]*effectBinding{})
+}
+
+func (a *effectAnalyzer) closeScope() {
+	a.scopes = a.scopes[:len(a.scopes)-1]
+}
+
+func (a *effectAnalyzer) bind(name string, b *effectBinding) {
+	a.scopes[len(a.scopes)-1][name] = b
+}
+
+func (a *effectAnalyzer) lookup(name string) (*effectBinding, bool) {
+	for i := len(a.scopes) - 1; i >= 0; i-- {
+		if b, ok := a.scopes[i][name]; ok {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+// function returns the information about the function
+// defined by the node creating it on the first use.
+func (a *effectAnalyzer) function(node ast.Node, name string, loc *span.Span, args []*ast.FuncDeclArg, declared *ast.EffectSet) *effectFn {
+	if f, ok := a.fns[node]; ok {
+		return f
+	}
+	f := &effectFn{
+		name:     name,
+		loc:      loc,
+		inferred: effectSet{},
+		handles:  effectSet{},
+		calls:    map[string]bool{},
+	}
+	for _, arg := range args {
+		f.params = append(f.params, arg.Name)
+	}
+	if declared != nil {
+		f.declared = effectSet{}
+		for _, n := range declared.Names {
+			f.declared[canonicalEffect(n)] = true
+		}
+	}
+	a.fns[node] = f
+	a.order = append(a.order, f)
+	return f
+}
+
+func canonicalEffect(name string) string {
+	if c, ok := stdEffects[name]; ok {
+		return c
+	}
+	return name
+}
+
+func (a *effectAnalyzer) declareGlobals(nodes []ast.Node) {
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *ast.FuncDecl:
+			a.bind(n.Name, &effectBinding{fn: a.function(n, n.Name, n.Span, n.Args, n.Effects)})
+		case *ast.EffectDecl:
+			a.bind(n.Name, &effectBinding{effect: n.Name})
+		}
+	}
+}
+
+func (a *effectAnalyzer) analyze(nodes []ast.Node) {
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *ast.FuncDecl:
+			a.analyzeFunction(a.fns[n], n.Args, n.Body)
+		case *ast.GlobalValDecl:
+			eff := a.expr(n.Rhs)
+			a.bindValue(n.Name, n.Rhs, nil)
+			a.topLevel(n.Span, eff)
+		case *ast.OperatorDecl:
+			eff := a.expr(n.Rhs)
+			a.bindValue(n.Name, n.Rhs, nil)
+			a.topLevel(n.Span, eff)
+		case *ast.GlobalPatternDecl:
+			a.topLevel(n.Span, a.expr(n.Rhs))
+		case ast.Stmt:
+			a.topLevel(n.NodeSpan(), a.stmt(n))
+		}
+	}
+}
+
+// topLevel reports effects escaping the top level code. The export
+// effect is handled by the module system.
+func (a *effectAnalyzer) topLevel(loc *span.Span, eff effectSet) {
+	if !a.report {
+		return
+	}
+	delete(eff, "export")
+	if len(eff) == 0 {
+		return
+	}
+	if len(eff) == 1 {
+		a.errorf(loc, "effect %s is not handled", eff.sorted()[0])
+		return
+	}
+	a.errorf(loc, "effects %s are not handled", strings.Join(eff.sorted(), ", "))
+}
+
+// bindValue binds the declared name, functions and effects are
+// remembered, so that calls to them can be tracked.
+func (a *effectAnalyzer) bindValue(name string, rhs ast.Expr, declared *ast.EffectSet) {
+	switch r := rhs.(type) {
+	case *ast.LambdaExpr:
+		f := a.function(r, name, r.Span, r.Args, declared)
+		a.bind(name, &effectBinding{fn: f})
+		a.analyzeFunction(f, r.Args, r.Body)
+		return
+	case *ast.LocalEffect:
+		a.bind(name, &effectBinding{effect: name})
+		return
+	case *ast.FuncApplication:
+		if f, applied := a.partial(r); f != nil && applied < len(f.params) {
+			a.bind(name, &effectBinding{fn: f, applied: applied})
+			return
+		}
+	case *ast.Identifier, *ast.Access:
+		if b, ok := a.resolve(r); ok {
+			a.bind(name, b)
+			return
+		}
+	}
+	a.bind(name, &effectBinding{})
+}
+
+// resolve returns the binding of the name or path.
+// Paths are only known if they refer to the standard library.
+func (a *effectAnalyzer) resolve(node ast.Expr) (*effectBinding, bool) {
+	if id, ok := node.(*ast.Identifier); ok {
+		if b, ok := a.lookup(id.Name); ok {
+			return b, true
+		}
+	}
+	path, ok := accessPath(node)
+	if !ok {
+		return nil, false
+	}
+	if root := strings.SplitN(path, ".", 2)[0]; root != path {
+		if _, ok := a.lookup(root); ok {
+			// paths in modules are not tracked
+			// unless they are handled somewhere
+			if a.handled[path] {
+				return &effectBinding{effect: path}, true
+			}
+			return nil, false
+		}
+	}
+	if e, ok := stdEffects[path]; ok {
+		return &effectBinding{effect: e}, true
+	}
+	if a.handled[path] {
+		return &effectBinding{effect: path}, true
+	}
+	return nil, false
+}
+
+// accessPath returns the dotted path like iter.Yield
+// if the expression is one.
+func accessPath(node ast.Expr) (string, bool) {
+	switch n := node.(type) {
+	case *ast.Identifier:
+		return n.Name, true
+	case *ast.Access:
+		lhs, ok := accessPath(n.Lhs)
+		if !ok {
+			return "", false
+		}
+		return lhs + "." + n.Property.Name, true
+	}
+	return "", false
+}
+
+// effectName returns the name of the effect handled by the clause.
+func (a *effectAnalyzer) effectName(node ast.Expr) (string, bool) {
+	if b, ok := a.resolve(node); ok && b.effect != "" {
+		return b.effect, true
+	}
+	if path, ok := accessPath(node); ok {
+		return canonicalEffect(path), true
+	}
+	return "", false
+}
+
+func (a *effectAnalyzer) analyzeFunction(f *effectFn, args []*ast.FuncDeclArg, body ast.Expr) {
+	a.current = append(a.current, f)
+	eff := a.lambda(f, args, body)
+	a.current = a.current[:len(a.current)-1]
+	for e := range eff {
+		if !f.inferred[e] {
+			f.inferred[e] = true
+			a.changed = true
+		}
+	}
+	if !a.report || f.declared == nil {
+		return
+	}
+	missing := []string{}
+	for _, e := range eff.sorted() {
+		if !f.declared[e] {
+			missing = append(missing, e)
+		}
+	}
+	if len(missing) > 0 {
+		a.errorf(f.loc, "function %s can perform effects %s missing from its signature",
+			f.name, strings.Join(missing, ", "))
+	}
+}
+
+// lambda returns effects performed when the function is called,
+// f is nil for anonymous functions.
+func (a *effectAnalyzer) lambda(f *effectFn, args []*ast.FuncDeclArg, body ast.Expr) effectSet {
+	a.openScope()
+	defer a.closeScope()
+	for _, arg := range args {
+		a.bind(arg.Name, &effectBinding{paramOf: f, param: arg.Name})
+		if arg.Pattern != nil {
+			a.bindPattern(arg.Pattern)
+		}
+	}
+	return a.expr(body)
+}
+
+func (a *effectAnalyzer) bindPattern(pat ast.Pattern) {
+	for _, b := range ast.Bindings(pat) {
+		a.bind(b.Name, &effectBinding{})
+	}
+}
+
+// called returns effects performed when the value is called.
+func (a *effectAnalyzer) called(node ast.Expr) effectSet {
+	if l, ok := node.(*ast.LambdaExpr); ok {
+		if l.Name == "" {
+			return a.lambda(nil, l.Args, l.Body)
+		}
+		a.openScope()
+		defer a.closeScope()
+		f := a.function(l, l.Name, l.Span, l.Args, nil)
+		a.bind(l.Name, &effectBinding{fn: f})
+		a.analyzeFunction(f, l.Args, l.Body)
+		return f.performs()
+	}
+	if app, ok := node.(*ast.FuncApplication); ok {
+		// partial applications perform the effects
+		// of the function once they are called
+		f, applied := a.partial(app)
+		if f == nil || applied >= len(f.params) {
+			return effectSet{}
+		}
+		res := effectSet{}
+		if _, ok := app.Callee.(*ast.FuncApplication); ok {
+			res.add(a.called(app.Callee))
+		} else {
+			res.add(f.performs())
+		}
+		res.add(a.passed(app.Callee, f, applied-argCount(app), arguments(app)))
+		return res
+	}
+	b, ok := a.resolve(node)
+	if !ok {
+		if path, ok := accessPath(node); ok {
+			root := strings.SplitN(path, ".", 2)[0]
+			if _, shadowed := a.lookup(root); !shadowed {
+				return setOf(stdPerformers[path]...)
+			}
+		}
+		return effectSet{}
+	}
+	switch {
+	case b.paramOf != nil:
+		if !b.paramOf.calls[b.param] {
+			b.paramOf.calls[b.param] = true
+			a.changed = true
+		}
+	case b.effect != "":
+		return setOf(b.effect)
+	case b.fn != nil:
+		res := effectSet{}
+		res.add(b.fn.performs())
+		return res
+	}
+	return effectSet{}
+}
+
+// partial returns the function the expression applies
+// and the number of arguments it has been applied to,
+// nil if the function is not known.
+func (a *effectAnalyzer) partial(node ast.Expr) (*effectFn, int) {
+	if app, ok := node.(*ast.FuncApplication); ok {
+		f, applied := a.partial(app.Callee)
+		return f, applied + argCount(app)
+	}
+	if b, ok := a.resolve(node); ok && b.fn != nil {
+		return b.fn, b.applied
+	}
+	return nil, 0
+}
+
+func argCount(node *ast.FuncApplication) int {
+	if node.Block != nil {
+		return len(node.Args) + 1
+	}
+	return len(node.Args)
+}
+
+// arguments returns the arguments of the call including the block.
+func arguments(node *ast.FuncApplication) []ast.Expr {
+	args := append([]ast.Expr{}, node.Args...)
+	if node.Block != nil {
+		args = append(args, node.Block)
+	}
+	return args
+}
+
+func setOf(names ...string) effectSet {
+	s := effectSet{}
+	for _, n := range names {
+		s[n] = true
+	}
+	return s
+}
+
+func (a *effectAnalyzer) block(node *ast.Block) effectSet {
+	a.openScope()
+	defer a.closeScope()
+	eff := effectSet{}
+	for _, s := range node.Instr {
+		eff.add(a.stmt(s))
+	}
+	return eff
+}
+
+func (a *effectAnalyzer) stmt(node ast.Stmt) effectSet {
+	switch n := node.(type) {
+	case *ast.StmtExpr:
+		return a.expr(n.Expr)
+	case *ast.ValDecl:
+		eff := effectSet{}
+		if _, ok := n.Rhs.(*ast.LambdaExpr); !ok {
+			eff = a.expr(n.Rhs)
+		}
+		a.bindValue(n.Name, n.Rhs, n.Effects)
+		return eff
+	case *ast.PatternDecl:
+		eff := a.expr(n.Rhs)
+		a.bindPattern(n.Pattern)
+		return eff
+	case *ast.Assignment:
+		eff := a.expr(n.RValue)
+		eff.add(a.expr(n.LValue))
+		return eff
+	case *ast.Return:
+		if n.Val != nil {
+			return a.expr(n.Val)
+		}
+	case *ast.WhileStmt:
+		eff := a.expr(n.Cond)
+		eff.add(a.block(n.Body))
+		return eff
+	case *ast.ForStmt:
+		// the loop handles iter.Yield of the iterator it runs
+		eff := a.expr(n.Iterable)
+		it := a.called(n.Iterable)
+		delete(it, "iter.Yield")
+		eff.add(it)
+		a.openScope()
+		a.bindPattern(n.Pattern)
+		eff.add(a.block(n.Body))
+		a.closeScope()
+		return eff
+	}
+	return effectSet{}
+}
+
+func (a *effectAnalyzer) expr(node ast.Expr) effectSet {
+	eff := effectSet{}
+	switch n := node.(type) {
+	case *ast.TupleConst:
+		for _, v := range n.Vals {
+			eff.add(a.expr(v))
+		}
+	case *ast.ListConst:
+		for _, v := range n.Vals {
+			eff.add(a.expr(v))
+		}
+	case *ast.RecordConst:
+		for _, f := range n.Fields {
+			eff.add(a.expr(f.Val))
+		}
+	case *ast.Access:
+		eff.add(a.expr(n.Lhs))
+	case *ast.FuncApplication:
+		eff.add(a.application(n))
+	case *ast.LambdaExpr:
+		if n.Name != "" {
+			// analyze the local function even if it is never called
+			a.called(n)
+		}
+	case *ast.Block:
+		eff.add(a.block(n))
+	case *ast.IfExpr:
+		eff.add(a.expr(n.Cond))
+		eff.add(a.block(n.IfBranch))
+		if n.ElseBranch != nil {
+			eff.add(a.expr(n.ElseBranch))
+		}
+	case *ast.Match:
+		eff.add(a.expr(n.Scrutinee))
+		for _, arm := range n.Arms {
+			a.openScope()
+			a.bindPattern(arm.Pattern)
+			if arm.Guard != nil {
+				eff.add(a.expr(arm.Guard))
+			}
+			eff.add(a.block(arm.Body))
+			a.closeScope()
+		}
+	case *ast.Handle:
+		eff.add(a.handle(n))
+	case *ast.Resume:
+		eff.add(a.expr(n.Cont))
+		if n.Arg != nil {
+			eff.add(a.expr(n.Arg))
+		}
+	case *ast.LetExpr:
+		eff.add(a.expr(n.Decls))
+		eff.add(a.block(n.Body))
+	}
+	return eff
+}
+
+// application returns effects of the call. Effects of the callee are
+// only included once it gets all of its arguments, until then they
+// are carried by the partially applied function.
+func (a *effectAnalyzer) application(node *ast.FuncApplication) effectSet {
+	eff := a.expr(node.Callee)
+	args := arguments(node)
+	for _, arg := range args {
+		eff.add(a.expr(arg))
+	}
+	f, applied := a.partial(node.Callee)
+	if f != nil && applied+len(args) < len(f.params) {
+		return eff
+	}
+	eff.add(a.called(node.Callee))
+	eff.add(a.passed(node.Callee, f, applied, args))
+	return eff
+}
+
+// passed returns effects of the functions passed as arguments to
+// the callee, f is the callee if it is known and applied is the
+// number of arguments it has already been applied to. They are
+// included unless the callee handles them or never calls its
+// parameter, handlers of effects passed as arguments are taken
+// into account. Functions from outside of the program are assumed
+// to handle iter.Yield of the passed functions as most of them
+// consume iterators. Values passed to effects are not called.
+func (a *effectAnalyzer) passed(callee ast.Expr, f *effectFn, applied int, args []ast.Expr) effectSet {
+	handles := effectSet{}
+	if f != nil {
+		handles.add(f.handles)
+		for i, arg := range args {
+			if j := applied + i; j < len(f.params) && f.handles[f.params[j]] {
+				if name, ok := a.effectName(arg); ok {
+					handles[name] = true
+				}
+			}
+		}
+	} else if b, ok := a.resolve(callee); ok && b.effect != "" {
+		return effectSet{}
+	} else if _, ok := callee.(*ast.LambdaExpr); !ok {
+		handles = setOf("iter.Yield")
+	}
+	eff := effectSet{}
+	for i, arg := range args {
+		if f != nil {
+			if j := applied + i; j < len(f.params) && !f.calls[f.params[j]] {
+				continue
+			}
+		}
+		for e := range a.called(arg) {
+			if !handles[e] {
+				eff[e] = true
+			}
+		}
+	}
+	return eff
+}
+
+func (a *effectAnalyzer) handle(node *ast.Handle) effectSet {
+	handled := effectSet{}
+	for _, arm := range node.Arms {
+		name, ok := a.effectName(arm.Effect)
+		if !ok {
+			continue
+		}
+		handled[name] = true
+		if path, ok := accessPath(arm.Effect); ok && strings.Contains(path, ".") && !a.handled[path] {
+			a.handled[path] = true
+			a.changed = true
+		}
+	}
+	if len(a.current) > 0 {
+		a.current[len(a.current)-1].handles.add(handled)
+	}
+	eff := effectSet{}
+	for e := range a.block(node.Body) {
+		if !handled[e] {
+			eff[e] = true
+		}
+	}
+	for _, arm := range node.Arms {
+		eff.add(a.expr(arm.Effect))
+		a.openScope()
+		if arm.Arg != nil {
+			a.bind(arm.Arg.Name, &effectBinding{})
+			if arm.Arg.Pattern != nil {
+				a.bindPattern(arm.Arg.Pattern)
+			}
+		}
+		if arm.Continuation != nil {
+			a.bind(arm.Continuation.Name, &effectBinding{})
+		}
+		if arm.Guard != nil {
+			eff.add(a.expr(arm.Guard))
+		}
+		eff.add(a.block(arm.Body))
+		a.closeScope()
+	}
+	if node.Return != nil {
+		a.openScope()
+		a.bind(node.Return.Arg.Name, &effectBinding{})
+		eff.add(a.block(node.Return.Body))
+		a.closeScope()
+	}
+	if node.Finally != nil {
+		eff.add(a.block(node.Finally))
+	}
+	return eff
+}
@@ -0,0 +1,172 @@
+package types
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gala377/MLLang/syntax"
+)
+
+func analyzeEffects(t *testing.T, source string) (map[string]string, []TypeError) {
+	t.Helper()
+	p := syntax.NewParser(strings.NewReader(source))
+	nodes := p.Parse()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("unexpected syntax errors %v", p.Errors())
+	}
+	fns, errs := AnalyzeEffects(nodes)
+	res := map[string]string{}
+	for _, f := range fns {
+		res[f.Name] = f.String()
+	}
+	return res, errs
+}
+
+func TestInferringEffects(t *testing.T) {
+	table := []struct {
+		source string
+		name   string
+		want   string
+	}{
+		{"effect Foo\nfn f x = Foo x", "f", "f ! {Foo}"},
+		{"fn f x = x", "f", "f ! {}"},
+		{"fn f = yield 1", "f", "f ! {iter.Yield}"},
+		{"fn f = errors.throw \"a\"", "f", "f ! {errors.error}"},
+		{"fn f = error \"a\"", "f", "f ! {errors.error}"},
+		{"effect Foo\nfn f = g!\nfn g = Foo 1", "f", "f ! {Foo}"},
+		{"effect Foo\nfn f x:\n  if x:\n    f false\n  Foo 1\n", "f", "f ! {Foo}"},
+		{
+			"effect Foo\n" +
+				"effect Bar\n" +
+				"fn f:\n" +
+				"  handle:\n" +
+				"    Foo 1\n" +
+				"    Bar 2\n" +
+				"  with Foo v -> k:\n" +
+				"    resume k v\n",
+			"f", "f ! {Bar}",
+		},
+		{
+			"effect Foo\n" +
+				"fn f:\n" +
+				"  handle:\n" +
+				"    Foo 1\n" +
+				"  with Foo v -> k:\n" +
+				"    Foo v\n",
+			"f", "f ! {Foo}",
+		},
+		{
+			"effect Foo\n" +
+				"fn f:\n" +
+				"  let g = do -> Foo 1\n" +
+				"  g!\n",
+			"f", "f ! {Foo}",
+		},
+		{
+			"effect Foo\n" +
+				"fn f xs:\n" +
+				"  foreach xs do x:\n" +
+				"    Foo x\n",
+			"f", "f ! {Foo}",
+		},
+		{
+			"effect Foo\n" +
+				"fn gen:\n" +
+				"  yield 1\n" +
+				"  Foo 2\n" +
+				"fn f:\n" +
+				"  for x in gen:\n" +
+				"    x\n",
+			"f", "f ! {Foo}",
+		},
+		{"effect Foo\nfn f ! {Foo, Bar} = 1", "f", "f ! {Bar, Foo}"},
+		{"effect Foo\nfn f ! {} = 1\nfn g Foo = Foo 1", "g", "g ! {}"},
+		{"effect Foo\nfn f:\n  fn g = Foo 1\n  g\n", "g", "g ! {Foo}"},
+		{"effect Foo\nfn f x y = Foo x\nfn g = f 1", "g", "g ! {}"},
+		{"effect Foo\nfn f x y = Foo x\nfn g = (f 1) 2", "g", "g ! {Foo}"},
+		{"effect Foo\nfn f x y = Foo x\nfn g = f 1 2", "g", "g ! {Foo}"},
+		{"effect Foo\nfn f x y = Foo x\nfn call h = h 2\nfn g = call (f 1)", "g", "g ! {Foo}"},
+		{"effect Foo\nfn f x = Foo x\nfn keep h = {h}\nfn g = keep f", "g", "g ! {}"},
+		{
+			"effect Foo\n" +
+				"fn handling eff body:\n" +
+				"  handle:\n" +
+				"    body!\n" +
+				"  with eff v:\n" +
+				"    v\n" +
+				"fn g = handling Foo (do -> Foo 1)\n",
+			"g", "g ! {}",
+		},
+	}
+	for _, test := range table {
+		t.Run(test.source, func(t *testing.T) {
+			fns, _ := analyzeEffects(t, test.source)
+			if got := fns[test.name]; got != test.want {
+				t.Errorf("expected %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestEffectErrors(t *testing.T) {
+	table := []struct {
+		source string
+		want   string
+	}{
+		{"effect Foo\nFoo 1\n", "effect Foo is not handled"},
+		{"effect Foo\nfn f = Foo 1\nf!\n", "effect Foo is not handled"},
+		{"effect Foo\nlet a = Foo 1\n", "effect Foo is not handled"},
+		{"effect Foo\nfn f x y = Foo x\nlet g = f 1\ng 2\n", "effect Foo is not handled"},
+		{"fn gen:\n  yield 1\n  error \"a\"\nfor x in gen:\n  x\n", "effect errors.error is not handled"},
+		{"effect Foo\nfn f ! {} = Foo 1\n", "function f can perform effects Foo missing from its signature"},
+		{
+			"effect Foo\n" +
+				"effect Bar\n" +
+				"handle:\n" +
+				"  Foo 1\n" +
+				"  Bar 1\n" +
+				"with Foo v -> k:\n" +
+				"  resume k v\n",
+			"effect Bar is not handled",
+		},
+	}
+	for _, test := range table {
+		t.Run(test.source, func(t *testing.T) {
+			_, errs := analyzeEffects(t, test.source)
+			for _, e := range errs {
+				if strings.Contains(e.Error(), test.want) {
+					return
+				}
+			}
+			t.Errorf("expected error containing %q, got %v", test.want, errs)
+		})
+	}
+}
+
+func TestHandledEffectsAreAccepted(t *testing.T) {
+	sources := []string{
+		"effect Foo\nhandle:\n  Foo 1\nwith Foo v -> k:\n  resume k v\n",
+		"effect Foo\nfn f = Foo 1\nhandle:\n  f!\nwith Foo v -> k:\n  resume k v\n",
+		// declared effects are trusted by the callers
+		"effect Foo\nfn f ! {Foo} = Foo 1\nhandle:\n  f!\nwith Foo v -> k:\n  resume k v\n",
+		// iterators are consumed by the loop
+		"fn gen:\n  yield 1\nfor x in gen:\n  x\n",
+		"fn gen = yield 1\niter.collect [] gen\n",
+		// functions are not called just by being defined
+		"effect Foo\nlet f = do -> Foo 1\n",
+		// nor by being partially applied
+		"effect Foo\nfn f x y = Foo x\nlet g = f 1\n",
+		"effect Foo\nfn f x y = Foo x\nfn apply g x = g x\nlet h = apply (f 1)\n",
+		// the export effect is handled by the module system
+		"export {a: 1}\n",
+		"handle:\n  error \"a\"\nwith errors.error e:\n  e\n",
+	}
+	for _, src := range sources {
+		t.Run(src, func(t *testing.T) {
+			_, errs := analyzeEffects(t, src)
+			if len(errs) > 0 {
+				t.Errorf("unexpected effect errors %v", errs)
+			}
+		})
+	}
+}
@@ -0,0 +1,558 @@
+package types
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type (
+	Type interface {
+		typ()
+	}
+
+	// Var is a type variable. Once unified with another type
+	// the link is stored in ref and the variable is transparent.
+	Var struct {
+		id    int
+		level int
+		ref   Type
+		// set for the variables coming from annotations,
+		// they cannot be unified with anything but themselves
+		rigid string
+	}
+
+	// Con is a type constructor applied to its arguments.
+	// Builtin types, lists, tuples and named types are all
+	// represented with it.
+	Con struct {
+		Name string
+		Args []Type
+	}
+
+	// Func is a curried function type. Functions without
+	// arguments have a nil Arg.
+	Func struct {
+		Arg Type
+		Ret Type
+	}
+
+	// Record is a row of fields. Rest is either nil,
+	// meaning the record is closed, or a type variable
+	// standing for the rest of the fields.
+	Record struct {
+		Fields map[string]Type
+		Rest   Type
+	}
+
+	// Scheme is a generalized type. Schemes without a type
+	// stand for values the checker knows nothing about,
+	// every use of them gets a fresh type variable.
+	Scheme struct {
+		Vars []*Var
+		Type Type
+	}
+)
+
+func (v *Var) typ()    {}
+func (c *Con) typ()    {}
+func (f *Func) typ()   {}
+func (r *Record) typ() {}
+
+const (
+	tuple = "tuple"
+	list  = "list"
+)
+
+var (
+	Int    = &Con{Name: "int"}
+	Float  = &Con{Name: "float"}
+	String = &Con{Name: "string"}
+	Bool   = &Con{Name: "bool"}
+	None   = &Con{Name: "none"}
+	Symbol = &Con{Name: "symbol"}
+)
+
+var builtinTypes = map[string]Type{
+	"int":    Int,
+	"float":  Float,
+	"string": String,
+	"bool":   Bool,
+	"none":   None,
+	"symbol": Symbol,
+}
+
+func NewTuple(elems ...Type) *Con {
+	return &Con{Name: tuple, Args: elems}
+}
+
+func NewList(elem Type) *Con {
+	return &Con{Name: list, Args: []Type{elem}}
+}
+
+// prune follows the links of bound type variables.
+func prune(t Type) Type {
+	for {
+		v, ok := t.(*Var)
+		if !ok || v.ref == nil {
+			return t
+		}
+		t = v.ref
+	}
+}
+
+// fields collects all known fields of the record row
+// following bound row variables. Returns the unbound
+// tail of the row or nil if the row is closed.
+func fields(r *Record) (map[string]Type, Type) {
+	all := map[string]Type{}
+	var rest Type = r
+	for rest != nil {
+		rec, ok := prune(rest).(*Record)
+		if !ok {
+			return all, prune(rest)
+		}
+		for k, v := range rec.Fields {
+			if _, ok := all[k]; !ok {
+				all[k] = v
+			}
+		}
+		rest = rec.Rest
+	}
+	return all, nil
+}
+
+func sortedKeys(m map[string]Type) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Printing
+
+type printer struct {
+	names map[*Var]string
+}
+
+func newPrinter() *printer {
+	return &printer{names: map[*Var]string{}}
+}
+
+func (p *printer) varName(v *Var) string {
+	if v.rigid != "" {
+		return v.rigid
+	}
+	if n, ok := p.names[v]; ok {
+		return n
+	}
+	n := ""
+	for i := len(p.names); ; i = i/26 - 1 {
+		n = string(rune('a'+i%26)) + n
+		if i < 26 {
+			break
+		}
+	}
+	n = "'" + n
+	p.names[v] = n
+	return n
+}
+
+func (p *printer) print(t Type) string {
+	switch t := prune(t).(type) {
+	case *Var:
+		return p.varName(t)
+	case *Con:
+		switch t.Name {
+		case tuple:
+			elems := []string{}
+			for _, e := range t.Args {
+				elems = append(elems, p.print(e))
+			}
+			if len(elems) == 1 {
+				return fmt.Sprintf("(%s,)", elems[0])
+			}
+			return fmt.Sprintf("(%s)", strings.Join(elems, ", "))
+		case list:
+			return fmt.Sprintf("[%s]", p.print(t.Args[0]))
+		}
+		parts := []string{t.Name}
+		for _, a := range t.Args {
+			s := p.print(a)
+			if c, ok := prune(a).(*Con); ok && len(c.Args) > 0 && c.Name != tuple && c.Name != list {
+				s = "(" + s + ")"
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, " ")
+	case *Func:
+		parts := []string{}
+		var curr Type = t
+		for {
+			f, ok := prune(curr).(*Func)
+			if !ok {
+				break
+			}
+			if f.Arg == nil {
+				// function returning a nullary function
+				// is printed as {a -> {b}}
+				if len(parts) == 0 {
+					curr = f.Ret
+				}
+				break
+			}
+			parts = append(parts, p.print(f.Arg))
+			curr = f.Ret
+		}
+		parts = append(parts, p.print(curr))
+		return fmt.Sprintf("{%s}", strings.Join(parts, " -> "))
+	case *Record:
+		all, rest := fields(t)
+		parts := []string{}
+		for _, k := range sortedKeys(all) {
+			parts = append(parts, fmt.Sprintf("%s: %s", k, p.print(all[k])))
+		}
+		if rest != nil {
+			parts = append(parts, "..")
+		}
+		return fmt.Sprintf("{%s}", strings.Join(parts, ", "))
+	}
+	panic("unreachable")
+}
+
+// TypeString returns human readable representation of the type.
+func TypeString(t Type) string {
+	return newPrinter().print(t)
+}
+
+func (s *Scheme) String() string {
+	if s.Type == nil {
+		return "?"
+	}
+	p := newPrinter()
+	vars := []string{}
+	rows := map[*Var]bool{}
+	collectRows(s.Type, rows)
+	for _, v := range s.Vars {
+		if rows[v] {
+			// printed as ".." in the record
+			continue
+		}
+		// quantified variables are printed the way
+		// they are written in annotations
+		name := strings.TrimPrefix(p.varName(v), "'")
+		p.names[v] = name
+		vars = append(vars, name)
+	}
+	typ := p.print(s.Type)
+	if len(vars) == 0 {
+		return typ
+	}
+	return fmt.Sprintf("%s => %s", strings.Join(vars, " "), typ)
+}
+
+// collectRows finds type variables standing for the rest of records.
+func collectRows(t Type, rows map[*Var]bool) {
+	switch t := prune(t).(type) {
+	case *Con:
+		for _, a := range t.Args {
+			collectRows(a, rows)
+		}
+	case *Func:
+		if t.Arg != nil {
+			collectRows(t.Arg, rows)
+		}
+		collectRows(t.Ret, rows)
+	case *Record:
+		all, rest := fields(t)
+		for _, f := range all {
+			collectRows(f, rows)
+		}
+		if v, ok := rest.(*Var); ok {
+			rows[v] = true
+		}
+	}
+}
+
+// Unification
+
+type mismatch struct {
+	msg string
+}
+
+func (m *mismatch) Error() string {
+	return m.msg
+}
+
+func mismatchf(p *printer, format string, types ...Type) *mismatch {
+	args := []interface{}{}
+	for _, t := range types {
+		args = append(args, p.print(t))
+	}
+	return &mismatch{msg: fmt.Sprintf(format, args...)}
+}
+
+func (c *Checker) unify(a, b Type) error {
+	return c.unifyWith(newPrinter(), a, b)
+}
+
+func (c *Checker) unifyWith(p *printer, a, b Type) error {
+	a, b = prune(a), prune(b)
+	if a == b {
+		return nil
+	}
+	if va, ok := a.(*Var); ok && va.rigid == "" {
+		return c.bind(p, va, b)
+	}
+	if vb, ok := b.(*Var); ok && vb.rigid == "" {
+		return c.bind(p, vb, a)
+	}
+	switch ta := a.(type) {
+	case *Con:
+		tb, ok := b.(*Con)
+		if !ok || ta.Name != tb.Name || len(ta.Args) != len(tb.Args) {
+			return mismatchf(p, "%s is not %s", a, b)
+		}
+		for i := range ta.Args {
+			if err := c.unifyWith(p, ta.Args[i], tb.Args[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *Func:
+		tb, ok := b.(*Func)
+		if !ok {
+			return mismatchf(p, "%s is not %s", a, b)
+		}
+		if (ta.Arg == nil) != (tb.Arg == nil) {
+			return mismatchf(p, "%s and %s take different number of arguments", a, b)
+		}
+		if ta.Arg != nil {
+			if err := c.unifyWith(p, ta.Arg, tb.Arg); err != nil {
+				return err
+			}
+		}
+		return c.unifyWith(p, ta.Ret, tb.Ret)
+	case *Record:
+		tb, ok := b.(*Record)
+		if !ok {
+			return mismatchf(p, "%s is not %s", a, b)
+		}
+		return c.unifyRecords(p, ta, tb)
+	}
+	return mismatchf(p, "%s is not %s", a, b)
+}
+
+func (c *Checker) unifyRecords(p *printer, a, b *Record) error {
+	fa, ra := fields(a)
+	fb, rb := fields(b)
+	onlyA := map[string]Type{}
+	onlyB := map[string]Type{}
+	for _, k := range sortedKeys(fa) {
+		t := fa[k]
+		if tb, ok := fb[k]; ok {
+			if err := c.unifyWith(p, t, tb); err != nil {
+				return err
+			}
+		} else {
+			onlyA[k] = t
+		}
+	}
+	for k, t := range fb {
+		if _, ok := fa[k]; !ok {
+			onlyB[k] = t
+		}
+	}
+	missing := func(r *Record, only map[string]Type) error {
+		return &mismatch{msg: fmt.Sprintf(
+			"record %s has no field %s", p.print(r), strings.Join(sortedKeys(only), ", "))}
+	}
+	if len(onlyA) > 0 && rb == nil {
+		return missing(b, onlyA)
+	}
+	if len(onlyB) > 0 && ra == nil {
+		return missing(a, onlyB)
+	}
+	if len(onlyA) == 0 && len(onlyB) == 0 {
+		switch {
+		case ra == nil && rb == nil:
+			return nil
+		case ra == nil:
+			return c.unifyWith(p, rb, &Record{Fields: map[string]Type{}})
+		case rb == nil:
+			return c.unifyWith(p, ra, &Record{Fields: map[string]Type{}})
+		}
+		return c.unifyWith(p, ra, rb)
+	}
+	var rest Type
+	if ra != nil && rb != nil {
+		rest = c.fresh()
+	}
+	if len(onlyA) > 0 {
+		if err := c.unifyWith(p, rb, &Record{Fields: onlyA, Rest: rest}); err != nil {
+			return err
+		}
+	} else if rb != nil {
+		if err := c.unifyWith(p, rb, orEmpty(rest)); err != nil {
+			return err
+		}
+	}
+	if len(onlyB) > 0 {
+		return c.unifyWith(p, ra, &Record{Fields: onlyB, Rest: rest})
+	} else if ra != nil {
+		return c.unifyWith(p, ra, orEmpty(rest))
+	}
+	return nil
+}
+
+func orEmpty(rest Type) Type {
+	if rest == nil {
+		return &Record{Fields: map[string]Type{}}
+	}
+	return rest
+}
+
+func (c *Checker) bind(p *printer, v *Var, t Type) error {
+	if occurs(v, t) {
+		// recursive values like linked lists or generators
+		// returning themselves cannot be typed without
+		// recursive types, leave them unchecked
+		return nil
+	}
+	adjustLevels(v.level, t)
+	v.ref = t
+	return nil
+}
+
+func occurs(v *Var, t Type) bool {
+	switch t := prune(t).(type) {
+	case *Var:
+		return t == v
+	case *Con:
+		for _, a := range t.Args {
+			if occurs(v, a) {
+				return true
+			}
+		}
+	case *Func:
+		return (t.Arg != nil && occurs(v, t.Arg)) || occurs(v, t.Ret)
+	case *Record:
+		for _, f := range t.Fields {
+			if occurs(v, f) {
+				return true
+			}
+		}
+		return t.Rest != nil && occurs(v, t.Rest)
+	}
+	return false
+}
+
+// adjustLevels makes sure that variables bound to a variable
+// from an outer let are not generalized too early.
+func adjustLevels(level int, t Type) {
+	switch t := prune(t).(type) {
+	case *Var:
+		if t.level > level {
+			t.level = level
+		}
+	case *Con:
+		for _, a := range t.Args {
+			adjustLevels(level, a)
+		}
+	case *Func:
+		if t.Arg != nil {
+			adjustLevels(level, t.Arg)
+		}
+		adjustLevels(level, t.Ret)
+	case *Record:
+		for _, f := range t.Fields {
+			adjustLevels(level, f)
+		}
+		if t.Rest != nil {
+			adjustLevels(level, t.Rest)
+		}
+	}
+}
+
+// Generalization and instantiation
+
+func (c *Checker) generalize(t Type) *Scheme {
+	vars := []*Var{}
+	seen := map[*Var]bool{}
+	var collect func(t Type)
+	collect = func(t Type) {
+		switch t := prune(t).(type) {
+		case *Var:
+			if t.level > c.level && t.rigid == "" && !seen[t] {
+				seen[t] = true
+				vars = append(vars, t)
+			}
+		case *Con:
+			for _, a := range t.Args {
+				collect(a)
+			}
+		case *Func:
+			if t.Arg != nil {
+				collect(t.Arg)
+			}
+			collect(t.Ret)
+		case *Record:
+			for _, f := range t.Fields {
+				collect(f)
+			}
+			if t.Rest != nil {
+				collect(t.Rest)
+			}
+		}
+	}
+	collect(t)
+	return &Scheme{Vars: vars, Type: t}
+}
+
+func (c *Checker) instantiate(s *Scheme) Type {
+	if s.Type == nil {
+		return c.fresh()
+	}
+	subst := map[*Var]Type{}
+	for _, v := range s.Vars {
+		subst[v] = c.fresh()
+	}
+	return substitute(subst, s.Type)
+}
+
+func substitute(subst map[*Var]Type, t Type) Type {
+	switch t := prune(t).(type) {
+	case *Var:
+		if s, ok := subst[t]; ok {
+			return s
+		}
+		return t
+	case *Con:
+		if len(t.Args) == 0 {
+			return t
+		}
+		args := []Type{}
+		for _, a := range t.Args {
+			args = append(args, substitute(subst, a))
+		}
+		return &Con{Name: t.Name, Args: args}
+	case *Func:
+		f := &Func{Ret: substitute(subst, t.Ret)}
+		if t.Arg != nil {
+			f.Arg = substitute(subst, t.Arg)
+		}
+		return f
+	case *Record:
+		r := &Record{Fields: map[string]Type{}}
+		for k, f := range t.Fields {
+			r.Fields[k] = substitute(subst, f)
+		}
+		if t.Rest != nil {
+			r.Rest = substitute(subst, t.Rest)
+		}
+		return r
+	}
+	panic("unreachable")
+}
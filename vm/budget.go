@@ -0,0 +1,110 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/metrics"
+
+	"github.com/gala377/MLLang/data"
+)
+
+var (
+	// ErrCancelled is returned when the context of the run is done.
+	ErrCancelled = errors.New("execution cancelled")
+	// ErrBudgetExceeded is returned when the run goes over its budget.
+	ErrBudgetExceeded = errors.New("execution budget exceeded")
+)
+
+// Budget limits a run of the vm, zero fields mean no limit.
+type Budget struct {
+	// number of executed instructions
+	Instructions int
+	// number of bytes allocated on the heap since the start of the run.
+	// It is measured for the whole process so allocations of other
+	// goroutines count too.
+	Allocations uint64
+}
+
+// FinalizerBudget limits each of the finalizers run when the vm stops on
+// a runtime error or an abort, including cancellation. A finalizer going
+// over it is stopped and the remaining ones are run, like after an error.
+var FinalizerBudget = Budget{Instructions: 1_000_000}
+
+// instructions executed between the checks of the context
+// and the allocation budget
+const budgetCheckInterval = 1024
+
+const heapAllocs = "/gc/heap/allocs:bytes"
+
+// InterpretContext runs the code like Interpret until the context is done
+// or the budget is exceeded. Then the pending finalizers are run and
+// ErrCancelled or ErrBudgetExceeded is returned. Goroutines spawned by
+// the code inherit the context.
+func (vm *Vm) InterpretContext(ctx context.Context, code *data.Code, budget Budget) (data.Value, error) {
+	defer vm.startRun(ctx, budget)()
+	return vm.Interpret(code)
+}
+
+// RunClosureContext calls the closure like RunClosureWith
+// limited by the context and the budget like InterpretContext.
+func (vm *Vm) RunClosureContext(ctx context.Context, budget Budget, c data.Callable, args ...data.Value) (data.Value, error) {
+	defer vm.startRun(ctx, budget)()
+	return vm.RunClosureWith(nil, c, args...)
+}
+
+// startRun sets the context and the budget of the run
+// and returns a function restoring the previous ones.
+func (vm *Vm) startRun(ctx context.Context, budget Budget) func() {
+	pctx, pbudget, psteps, pnext, palloc := vm.ctx, vm.budget, vm.steps, vm.nextCheck, vm.allocStart
+	vm.ctx, vm.budget, vm.steps, vm.nextCheck = ctx, budget, 0, 0
+	vm.allocStart = allocatedBytes()
+	return func() {
+		vm.ctx, vm.budget, vm.steps, vm.nextCheck, vm.allocStart = pctx, pbudget, psteps, pnext, palloc
+	}
+}
+
+// runNested runs the code with the clone as a part of the run of the
+// vm, like the code of imported modules, so that it counts against the
+// run's budget. Aborts of the clone's run abort the run of the vm too.
+func (vm *Vm) runNested(clone *Vm, code *data.Code) {
+	clone.budget, clone.steps, clone.nextCheck, clone.allocStart = vm.budget, vm.steps, vm.nextCheck, vm.allocStart
+	_, err := clone.Interpret(code)
+	vm.steps, vm.nextCheck = clone.steps, clone.nextCheck
+	if err != nil {
+		// the clone has already run its own finalizers
+		panic(&hostAbort{err})
+	}
+}
+
+// checkBudget aborts the run if its context is done or the budget is
+// exceeded and schedules the next check otherwise. Called by the
+// dispatch loop when the number of executed steps reaches nextCheck.
+func (vm *Vm) checkBudget() {
+	if err := vm.ctx.Err(); err != nil {
+		panic(&hostAbort{fmt.Errorf("%w: %s", ErrCancelled, err)})
+	}
+	limit := vm.budget.Instructions
+	if limit > 0 && vm.steps > limit {
+		panic(&hostAbort{fmt.Errorf("%w: more than %d instructions", ErrBudgetExceeded, limit)})
+	}
+	if max := vm.budget.Allocations; max > 0 {
+		if allocated := allocatedBytes() - vm.allocStart; allocated > max {
+			panic(&hostAbort{fmt.Errorf("%w: %d bytes allocated, more than %d", ErrBudgetExceeded, allocated, max)})
+		}
+	}
+	vm.nextCheck = vm.steps + budgetCheckInterval
+	if limit > 0 && limit < vm.nextCheck {
+		// stop right after the last allowed instruction
+		vm.nextCheck = limit + 1
+	}
+}
+
+func allocatedBytes() uint64 {
+	s := []metrics.Sample{{Name: heapAllocs}}
+	metrics.Read(s)
+	if s[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return s[0].Value.Uint64()
+}
@@ -0,0 +1,98 @@
+package vm
+
+import (
+	"strings"
+
+	"github.com/gala377/MLLang/data"
+)
+
+// HostHandler handles an effect performed by the funk code
+// in Go. The returned value resumes the computation that
+// performed the effect, returning an error aborts the run
+// instead. The error is then returned from Interpret or
+// RunClosureWith.
+type HostHandler func(vm *Vm, arg data.Value) (data.Value, error)
+
+// hostAbort unwinds the interpreter when a host handler
+// aborts or the run is cancelled or exceeds its budget.
+type hostAbort struct {
+	err error
+}
+
+// HandleEffect registers the handler for the effects of the type
+// performed by any code run by the vm and its clones. Handlers
+// installed by the funk code and the ones passed to RunClosureWith
+// take precedence.
+func (vm *Vm) HandleEffect(typ data.Type, h HostHandler) {
+	vm.hostHandlers[typ] = h
+}
+
+// RunClosureWith calls the closure like RunClosure with the handlers
+// installed for the duration of the call. Unlike RunClosure it returns
+// the error of a host handler aborting the run.
+func (vm *Vm) RunClosureWith(handlers map[data.Type]HostHandler, c data.Callable, args ...data.Value) (data.Value, error) {
+	vm.hostScopes = append(vm.hostScopes, handlers)
+	defer func() {
+		vm.hostScopes = vm.hostScopes[:len(vm.hostScopes)-1]
+	}()
+	v, t := c.Call(vm, args...)
+	switch t.Kind {
+	case data.Returned:
+		return v, nil
+	case data.Call:
+		vm.ip = 0
+		vm.locals = t.Env
+		return vm.Interpret(t.Code)
+	}
+	vm.Panic("Unsupported return kind when running closure")
+	return data.None, nil
+}
+
+// EffectType returns the effect type bound to the global
+// name or to the field of a global record, like "errors.error".
+func (vm *Vm) EffectType(path string) (data.Type, bool) {
+	parts := strings.Split(path, ".")
+	v := vm.globals.Lookup(vm.CreateSymbol(parts[0]))
+	for _, field := range parts[1:] {
+		r, ok := v.(*data.Record)
+		if !ok {
+			return data.Type{}, false
+		}
+		v, ok = r.GetField(vm.CreateSymbol(field))
+		if !ok {
+			return data.Type{}, false
+		}
+	}
+	typ, ok := v.(data.Type)
+	return typ, ok
+}
+
+// hostHandler returns the host handler for the effect type,
+// the ones passed to the innermost RunClosureWith first.
+func (vm *Vm) hostHandler(typ data.Type) (HostHandler, bool) {
+	for i := len(vm.hostScopes) - 1; i >= 0; i-- {
+		if h, ok := vm.hostScopes[i][typ]; ok {
+			return h, true
+		}
+	}
+	h, ok := vm.hostHandlers[typ]
+	return h, ok
+}
+
+// abortRun is deferred by Interpret. If the run has been aborted
+// it runs pending finalizers, clears the stack and sets the error.
+func (vm *Vm) abortRun(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	abort, ok := r.(*hostAbort)
+	if !ok {
+		panic(r)
+	}
+	vm.runFinalizers()
+	vm.stack = vm.stack[:0]
+	vm.stackTop = 0
+	vm.frames = 0
+	*err = abort.err
+}
@@ -0,0 +1,203 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gala377/MLLang/data"
+)
+
+const (
+	// DefaultMaxFrames is the maximum call depth of a new vm.
+	DefaultMaxFrames = 100_000
+	// DefaultMaxStack is the maximum number of stack slots of a new vm.
+	DefaultMaxStack = 1 << 22
+)
+
+// backtraces longer than this show only their ends
+const maxBacktraceLines = 20
+
+// SetLimits sets the maximum call depth and the maximum number of
+// stack slots of the vm and its clones. Zero disables the limit.
+// Going over a limit throws a RuntimeErr with errors.error at the
+// call that would exceed it.
+func (vm *Vm) SetLimits(frames, stack int) {
+	vm.maxFrames = frames
+	vm.maxStack = stack
+}
+
+func (vm *Vm) pushFrame() {
+	vm.push(data.Int{Val: vm.ip})
+	vm.push(vm.code)
+	vm.push(vm.locals)
+	vm.frames++
+}
+
+// overflows returns true if pushing the given number of
+// stack slots including a new frame would exceed the limits.
+func (vm *Vm) overflows(slots int) bool {
+	return (vm.maxFrames > 0 && vm.frames >= vm.maxFrames) ||
+		(vm.maxStack > 0 && vm.stackTop+slots > vm.maxStack)
+}
+
+// stackOverflow performs errors.error with a RuntimeErr
+// in place of the call that would exceed the limits.
+func (vm *Vm) stackOverflow() (data.Value, data.Trampoline, bool) {
+	var msg string
+	if vm.maxFrames > 0 && vm.frames >= vm.maxFrames {
+		msg = fmt.Sprintf("stack overflow at %s, more than %d frames", site(vm.code, vm.ip), vm.maxFrames)
+	} else {
+		msg = fmt.Sprintf("stack overflow at %s, more than %d stack slots", site(vm.code, vm.ip), vm.maxStack)
+	}
+	typ, ok := vm.EffectType("errors.error")
+	if !ok {
+		vm.bail(msg)
+	}
+	trace := vm.backtrace()
+	lines := make([]data.Value, 0, len(trace))
+	for _, l := range trace {
+		lines = append(lines, data.NewString(l.String()))
+	}
+	loc := instrLocation(vm.code, vm.ip)
+	err := data.EmptyRecord()
+	err.SetField(vm.CreateSymbol("kind"), vm.CreateSymbol("RuntimeErr"))
+	err.SetField(vm.CreateSymbol("msg"), data.NewString(msg))
+	err.SetField(vm.CreateSymbol("source"), data.None)
+	err.SetField(vm.CreateSymbol("loc"), data.NewTuple([]data.Value{
+		data.NewString(vm.code.Path),
+		data.NewInt(loc.Line + 1),
+	}))
+	err.SetField(vm.CreateSymbol("backtrace"), data.NewList(lines))
+	return vm.handleEffect(typ, err)
+}
+
+// countFrames returns the number of function frames in the stack slice.
+func countFrames(stack []data.Value) int {
+	n := 0
+	for i := 2; i < len(stack); i++ {
+		if _, ok := stack[i].(*data.Env); !ok {
+			continue
+		}
+		if _, ok := stack[i-1].(*data.Code); !ok {
+			continue
+		}
+		if _, ok := stack[i-2].(data.Int); ok {
+			n++
+		}
+	}
+	return n
+}
+
+type frame struct {
+	ip   int
+	code *data.Code
+}
+
+func (f frame) String() string {
+	return site(f.code, f.ip)
+}
+
+// callFrames returns the function frames
+// saved on the stack, the outermost first.
+func (vm *Vm) callFrames() []frame {
+	var frames []frame
+	for i := 2; i < vm.stackTop; i++ {
+		if _, ok := vm.stack[i].(*data.Env); !ok {
+			continue
+		}
+		c, ok := vm.stack[i-1].(*data.Code)
+		if !ok {
+			continue
+		}
+		if ip, ok := vm.stack[i-2].(data.Int); ok {
+			frames = append(frames, frame{ip.Val, c})
+		}
+	}
+	return frames
+}
+
+// backtrace returns the backtrace of the saved frames
+// and the current one, the same for printed backtraces
+// and the ones of stack overflow errors.
+func (vm *Vm) backtrace() []traceLine {
+	return backtrace(append(vm.callFrames(), frame{vm.ip, vm.code}))
+}
+
+// traceLine is a run of frames of the backtrace
+// repeated one after another the given number of times.
+type traceLine struct {
+	frames []frame
+	times  int
+	// number of frames omitted in place of this line
+	omitted int
+}
+
+func (l traceLine) String() string {
+	if l.omitted > 0 {
+		return fmt.Sprintf("... %d frames omitted ...", l.omitted)
+	}
+	sites := make([]string, 0, len(l.frames))
+	for _, f := range l.frames {
+		sites = append(sites, f.String())
+	}
+	s := strings.Join(sites, " -> ")
+	if l.times > 1 {
+		s += fmt.Sprintf(" repeated %d times", l.times)
+	}
+	return s
+}
+
+// backtrace returns the frames with runs of repeated frames
+// collapsed, as done by recursive calls, and its middle
+// omitted if it still is too long.
+func backtrace(frames []frame) []traceLine {
+	lines := collapseFrames(frames)
+	if len(lines) <= maxBacktraceLines {
+		return lines
+	}
+	half := maxBacktraceLines / 2
+	omitted := 0
+	for _, l := range lines[half : len(lines)-half] {
+		omitted += len(l.frames) * l.times
+	}
+	res := append([]traceLine{}, lines[:half]...)
+	res = append(res, traceLine{omitted: omitted})
+	return append(res, lines[len(lines)-half:]...)
+}
+
+// longest cycle of mutually recursive calls recognised
+const maxCycle = 8
+
+// collapseFrames groups consecutive repetitions of up to
+// maxCycle frames into single lines, picking at each frame
+// the cycle that covers the most frames.
+func collapseFrames(frames []frame) []traceLine {
+	var lines []traceLine
+	for i := 0; i < len(frames); {
+		best := traceLine{frames: frames[i : i+1], times: 1}
+		for n := 1; n <= maxCycle && i+2*n <= len(frames); n++ {
+			times := 1
+			for repeats(frames[i:i+n], frames[i+times*n:]) {
+				times++
+			}
+			if times > 1 && times*n > best.times*len(best.frames) {
+				best = traceLine{frames: frames[i : i+n], times: times}
+			}
+		}
+		lines = append(lines, best)
+		i += best.times * len(best.frames)
+	}
+	return lines
+}
+
+func repeats(cycle, frames []frame) bool {
+	if len(frames) < len(cycle) {
+		return false
+	}
+	for i, f := range cycle {
+		if frames[i] != f {
+			return false
+		}
+	}
+	return true
+}
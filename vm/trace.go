@@ -0,0 +1,98 @@
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/gala377/MLLang/data"
+)
+
+// EffectTrace, when set, receives an event for every effect
+// performed and every continuation resumed or thrown away.
+var EffectTrace io.Writer = nil
+
+// TraceJSON makes the effect trace JSON lines instead of text.
+var TraceJSON = false
+
+const (
+	// an effect has been performed, the event tells which handler
+	// has been found and how the stack has been captured
+	tracePerform = "perform"
+	// a continuation has been resumed
+	traceResume = "resume"
+	// frames between the effect and its handler have been
+	// thrown away, by a clause not taking the continuation
+	// or a host handler returning an error
+	traceAbort = "abort"
+)
+
+type traceEvent struct {
+	Event  string `json:"event"`
+	Effect string `json:"effect"`
+	Arg    string `json:"arg,omitempty"`
+	// where the effect has been performed or resumed
+	At string `json:"at"`
+	// installation site of the handler or "host"
+	// for the Go handlers, "none" if not handled
+	Handler      string `json:"handler,omitempty"`
+	Continuation bool   `json:"continuation,omitempty"`
+	// stack slots copied into the continuation on perform,
+	// restored on resume and discarded on abort
+	Slots int    `json:"slots"`
+	Error string `json:"error,omitempty"`
+}
+
+func (ev *traceEvent) String() string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "%-7s %s", ev.Event, ev.Effect)
+	if ev.Arg != "" {
+		fmt.Fprintf(&b, " %s", ev.Arg)
+	}
+	fmt.Fprintf(&b, " at %s", ev.At)
+	if ev.Handler != "" {
+		fmt.Fprintf(&b, ", handler %s", ev.Handler)
+	}
+	if ev.Continuation {
+		b.WriteString(", continuation captured")
+	}
+	switch ev.Event {
+	case tracePerform:
+		fmt.Fprintf(&b, ", %d stack slots copied", ev.Slots)
+	case traceResume:
+		fmt.Fprintf(&b, ", %d stack slots restored", ev.Slots)
+	case traceAbort:
+		fmt.Fprintf(&b, ", %d stack slots discarded", ev.Slots)
+	}
+	if ev.Error != "" {
+		fmt.Fprintf(&b, ", error: %s", ev.Error)
+	}
+	return b.String()
+}
+
+func (vm *Vm) trace(ev traceEvent) {
+	if TraceJSON {
+		enc := json.NewEncoder(EffectTrace)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(&ev); err != nil {
+			panic(fmt.Sprintf("IEE: could not encode the trace event %s", err))
+		}
+		return
+	}
+	fmt.Fprintln(EffectTrace, ev.String())
+}
+
+// site returns the location of the instruction
+// before ip as "path:line:column".
+func site(code *data.Code, ip int) string {
+	if code == nil {
+		return "unknown"
+	}
+	loc := instrLocation(code, ip)
+	return fmt.Sprintf("%s:%d:%d", code.Path, loc.Line+1, loc.Column)
+}
+
+func handlerSite(h *data.Handler) string {
+	return site(h.Code, h.Ip)
+}
@@ -1,18 +1,23 @@
 package vm
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gala377/MLLang/codegen"
 	"github.com/gala377/MLLang/data"
 	"github.com/gala377/MLLang/isa"
+	"github.com/gala377/MLLang/syntax"
 )
 
 var Debug = true
@@ -25,6 +30,9 @@ type (
 		code  *data.Code
 		ip    int
 		stack []data.Value
+		// set by the Wide prefix, the next
+		// argument read is 4 bytes long
+		wide bool
 		// shows how many elements are currently in the stack.
 		// stackTop == 0 means an empty stack
 		stackTop int
@@ -34,16 +42,50 @@ type (
 		gensymc  uint
 
 		// for better error messages
-		sources map[string]*bytes.Reader
+		sources *sourceFiles
+		// files that are being evaluated, to detect cyclic imports,
+		// clones get a copy as goroutines import on their own
+		loading map[string]bool
+		// imported modules' exports shared by the clones
+		modules *moduleCache
+		// globals every imported module starts with
+		builtins *data.Env
+		// collects values exported at the top level
+		exports *data.Record
+		// fixities of the operators declared by the code compiled
+		// so far, used by the code compiled after it
+		operators syntax.Operators
+		// effect handlers implemented in Go, see HandleEffect
+		hostHandlers map[data.Type]HostHandler
+		// handlers passed to the RunClosureWith calls in progress
+		hostScopes []map[data.Type]HostHandler
+		// limits set with SetLimits, 0 means no limit
+		maxFrames int
+		maxStack  int
+		// function frames currently on the stack
+		frames int
+		// site of the tail resume which has popped its frame,
+		// traced instead of the current one when it restores
+		// the continuation
+		resumeSite string
+		// context and budget of the run, see InterpretContext
+		ctx    context.Context
+		budget Budget
+		// instructions executed in the run so far and the number
+		// of them at which the budget is checked next time
+		steps     int
+		nextCheck int
+		// bytes allocated by the process when the run started
+		allocStart uint64
 	}
 )
 
 func NewVm(path string, source *bytes.Reader, interner *codegen.Interner) Vm {
 	globals := data.NewEnv()
 	locals := data.NewEnv()
-	sources := map[string]*bytes.Reader{
+	sources := &sourceFiles{readers: map[string]*bytes.Reader{
 		path: source,
-	}
+	}}
 	return Vm{
 		code:     nil,
 		ip:       0,
@@ -54,6 +96,15 @@ func NewVm(path string, source *bytes.Reader, interner *codegen.Interner) Vm {
 		interner: interner,
 		gensymc:  0,
 		sources:  sources,
+		loading:  map[string]bool{},
+		modules:  &moduleCache{exports: map[string]data.Value{}},
+		builtins: nil,
+		// so that modules can also be run as scripts
+		exports:      data.EmptyRecord(),
+		operators:    syntax.Operators{},
+		hostHandlers: map[data.Type]HostHandler{},
+		maxFrames:    DefaultMaxFrames,
+		maxStack:     DefaultMaxStack,
 	}
 }
 
@@ -76,16 +127,70 @@ func (vm *Vm) Interner() *codegen.Interner {
 	return vm.interner
 }
 
+// Operators returns fixities of the operators declared
+// by the code run by the virtual machine so far.
+func (vm *Vm) Operators() syntax.Operators {
+	return vm.operators
+}
+
+// MarkBuiltins records current globals as the environment
+// every imported module is evaluated with. Should be called
+// after the standard library has been loaded.
+func (vm *Vm) MarkBuiltins() {
+	vm.builtins = vm.globals.Clone()
+}
+
+// BuiltinNames returns names of the globals every
+// module is evaluated with.
+func (vm *Vm) BuiltinNames() []string {
+	env := vm.builtins
+	if env == nil {
+		env = vm.globals
+	}
+	names := []string{}
+	for s := range env.Vals {
+		names = append(names, s.String())
+	}
+	return names
+}
+
+// Builtin returns the value of the global
+// every module is evaluated with.
+func (vm *Vm) Builtin(name string) (data.Value, bool) {
+	env := vm.builtins
+	if env == nil {
+		env = vm.globals
+	}
+	v := env.Lookup(vm.CreateSymbol(name))
+	return v, v != nil
+}
+
+// globalsEnv returns the global environment of the currently
+// executed code.
+func (vm *Vm) globalsEnv() *data.Env {
+	if vm.code.Globals != nil {
+		return vm.code.Globals
+	}
+	return vm.globals
+}
+
 func (vm *Vm) AddSource(path string, s *bytes.Reader) {
-	vm.sources[path] = s
+	vm.sources.set(path, s)
 }
 
-func (vm *Vm) Interpret(code *data.Code) (data.Value, error) {
+func (vm *Vm) Interpret(code *data.Code) (res data.Value, err error) {
+	defer vm.abortRun(&err)
 	vm.code = code
 	for {
 		if vm.ip == vm.code.Len() {
 			break
 		}
+		if vm.ctx != nil {
+			vm.steps++
+			if vm.steps >= vm.nextCheck {
+				vm.checkBudget()
+			}
+		}
 		if Debug {
 			fmt.Println("======================+==========================")
 			fmt.Printf("Interpreter state for ip %d\n", vm.ip)
@@ -108,7 +213,7 @@ func (vm *Vm) Interpret(code *data.Code) (data.Value, error) {
 			v := vm.code.GetConstant(arg)
 			vm.push(v)
 		case isa.Constant2:
-			arg := vm.readShort()
+			arg := vm.readArg()
 			v := vm.code.GetConstant2(arg)
 			vm.push(v)
 		case isa.Pop:
@@ -117,7 +222,7 @@ func (vm *Vm) Interpret(code *data.Code) (data.Value, error) {
 			top := vm.stackTop - 1
 			vm.stack[top], vm.stack[top-1] = vm.stack[top-1], vm.stack[top]
 		case isa.JumpIfFalse:
-			off := vm.readShort()
+			off := vm.readArg()
 			cond := vm.pop()
 			if Debug {
 				fmt.Printf("JumpIfFalse: jumping by %d\n", off)
@@ -134,7 +239,7 @@ func (vm *Vm) Interpret(code *data.Code) (data.Value, error) {
 				fmt.Printf("Instruction after jump %s\n", i)
 			}
 		case isa.Jump:
-			off := vm.readShort()
+			off := vm.readArg()
 			if Debug {
 				fmt.Printf("Jump: jumping by %d", off)
 			}
@@ -144,7 +249,7 @@ func (vm *Vm) Interpret(code *data.Code) (data.Value, error) {
 				fmt.Printf("Instruction after jump %s", i)
 			}
 		case isa.JumpBack:
-			off := vm.readShort()
+			off := vm.readArg()
 			if Debug {
 				fmt.Printf("JumpBack: jumping by %d", off)
 			}
@@ -154,11 +259,11 @@ func (vm *Vm) Interpret(code *data.Code) (data.Value, error) {
 				fmt.Printf("Instruction after jump %s", i)
 			}
 		case isa.DefGlobal:
-			arg := vm.readShort()
+			arg := vm.readArg()
 			s := vm.getSymbolAt(arg)
-			vm.globals.Insert(s, vm.pop())
+			vm.globalsEnv().Insert(s, vm.pop())
 		case isa.DefLocal:
-			arg := vm.readShort()
+			arg := vm.readArg()
 			s := vm.getSymbolAt(arg)
 			vm.locals.Insert(s, vm.pop())
 		case isa.Call0, isa.TailCall0:
@@ -182,41 +287,28 @@ func (vm *Vm) Interpret(code *data.Code) (data.Value, error) {
 			}
 			v, t := vm.apply1(callee, arg)
 			vm.handleCall(v, t, i == isa.TailCall1)
-		case isa.Call:
-			arity := int(vm.readByte())
-			args := make([]data.Value, 0, arity)
-			for i := 0; i < arity; i++ {
-				args = append(args, vm.pop())
+		case isa.Call, isa.TailCall:
+			argc := int(vm.readByte())
+			args := make([]data.Value, argc)
+			for j := argc - 1; j >= 0; j-- {
+				args[j] = vm.pop()
 			}
 			callee := vm.pop()
 			fn, ok := callee.(data.Callable)
 			if !ok {
-				vm.bail("Trying to call something that is not callable")
+				vm.bail(fmt.Sprintf("Cannot apply %v", callee))
 			}
 			if Debug {
 				fmt.Printf("Calling a function %s\n", fn.String())
 			}
-			v, t := vm.applyFunc(fn, reverse(args))
-			switch t.Kind {
-			case data.Returned:
-				vm.push(v)
-			case data.Call:
-				vm.push(data.Int{Val: vm.ip})
-				vm.push(vm.code)
-				vm.push(vm.locals)
-				vm.ip = 0
-				vm.code = t.Code
-				vm.locals = t.Env
-			case data.Error:
-				vm.bail(v.String())
-			}
+			vm.applyArgs(fn, args, i == isa.TailCall)
 		case isa.LoadDyn:
-			arg := vm.readShort()
+			arg := vm.readArg()
 			s := vm.getSymbolAt(arg)
 			if Debug {
 				fmt.Printf("Global lookup of value %s\n", s)
 			}
-			v := vm.globals.Lookup(s)
+			v := vm.globalsEnv().Lookup(s)
 			if v == nil {
 				vm.bail(fmt.Sprintf("variable %s undefined", s))
 			}
@@ -225,7 +317,7 @@ func (vm *Vm) Interpret(code *data.Code) (data.Value, error) {
 			}
 			vm.push(v)
 		case isa.LoadLocal:
-			arg := vm.readShort()
+			arg := vm.readArg()
 			s := vm.getSymbolAt(arg)
 			if Debug {
 				fmt.Printf("Local lookup of value %s\n", s)
@@ -236,7 +328,7 @@ func (vm *Vm) Interpret(code *data.Code) (data.Value, error) {
 			}
 			vm.push(v)
 		case isa.Closure:
-			arg := vm.readShort()
+			arg := vm.readArg()
 			l := vm.getFunctionAt(arg)
 			lenv := data.NewEnv()
 			for key, val := range vm.locals.Vals {
@@ -247,20 +339,20 @@ func (vm *Vm) Interpret(code *data.Code) (data.Value, error) {
 		case isa.PushNone:
 			vm.push(data.None)
 		case isa.StoreDyn:
-			arg := vm.readShort()
+			arg := vm.readArg()
 			s := vm.getSymbolAt(arg)
-			err := vm.globals.Set(s, vm.pop())
+			err := vm.globalsEnv().Set(s, vm.pop())
 			if err != nil {
 				vm.bail(err.Error())
 			}
 		case isa.StoreLocal:
-			arg := vm.readShort()
+			arg := vm.readArg()
 			s := vm.getSymbolAt(arg)
 			vm.locals.Insert(s, vm.pop())
 		case isa.MakeCell:
 			vm.push(data.NewCell(vm.pop()))
 		case isa.LoadDeref:
-			arg := vm.readShort()
+			arg := vm.readArg()
 			s := vm.getSymbolAt(arg)
 			c := vm.locals.Lookup(s)
 			if ac, ok := c.(*data.Cell); ok {
@@ -269,7 +361,7 @@ func (vm *Vm) Interpret(code *data.Code) (data.Value, error) {
 				vm.bail("IEE: LoadDeref used not on cell")
 			}
 		case isa.StoreDeref:
-			arg := vm.readShort()
+			arg := vm.readArg()
 			s := vm.getSymbolAt(arg)
 			c := vm.locals.Lookup(s)
 			if ac, ok := c.(*data.Cell); ok {
@@ -278,7 +370,7 @@ func (vm *Vm) Interpret(code *data.Code) (data.Value, error) {
 				vm.bail("IEE: StoreDeref used not on cell")
 			}
 		case isa.MakeList:
-			size := int(vm.readShort())
+			size := vm.readArg()
 			vals := make([]data.Value, 0, size)
 			for i := 0; i < size; i++ {
 				vals = append(vals, vm.pop())
@@ -286,7 +378,7 @@ func (vm *Vm) Interpret(code *data.Code) (data.Value, error) {
 			l := data.NewList(reverse(vals))
 			vm.push(l)
 		case isa.MakeTuple:
-			size := int(vm.readShort())
+			size := vm.readArg()
 			vals := make([]data.Value, 0, size)
 			for i := 0; i < size; i++ {
 				vals = append(vals, vm.pop())
@@ -298,7 +390,7 @@ func (vm *Vm) Interpret(code *data.Code) (data.Value, error) {
 				k data.Symbol
 				v data.Value
 			}
-			size := int(vm.readShort())
+			size := vm.readArg()
 			pairs := make([]Pair, 0, size)
 			for i := 0; i < size; i++ {
 				key, ok := vm.pop().(data.Symbol)
@@ -313,7 +405,7 @@ func (vm *Vm) Interpret(code *data.Code) (data.Value, error) {
 			}
 			vm.push(rec)
 		case isa.GetField:
-			name := vm.getSymbolAt(vm.readShort())
+			name := vm.getSymbolAt(vm.readArg())
 			rec, ok := vm.pop().(*data.Record)
 			if !ok {
 				vm.bail("field can only be accessed on a record")
@@ -325,14 +417,14 @@ func (vm *Vm) Interpret(code *data.Code) (data.Value, error) {
 			vm.push(val)
 		case isa.SetField:
 			val := vm.pop()
-			name := vm.getSymbolAt(vm.readShort())
+			name := vm.getSymbolAt(vm.readArg())
 			rec, ok := vm.pop().(*data.Record)
 			if !ok {
 				vm.bail("field can only be accessed on a record")
 			}
 			rec.SetField(name, val)
 		case isa.InstallHandler:
-			argc := vm.readShort()
+			argc := vm.readArg()
 			arms := map[data.Type]data.Callable{}
 			for i := 0; i < int(argc); i++ {
 				hfunc, ok := vm.pop().(data.Callable)
@@ -349,14 +441,60 @@ func (vm *Vm) Interpret(code *data.Code) (data.Value, error) {
 				arms[typ] = hfunc
 			}
 			handler := data.NewHandler(arms)
+			handler.Code, handler.Ip, handler.Env = vm.code, vm.ip, vm.locals
 			vm.push(handler)
 		case isa.PopHandler:
 			ret := vm.pop()
-			_, ok := vm.pop().(*data.Handler)
+			handler, ok := vm.pop().(*data.Handler)
 			if !ok {
 				vm.bail("IEE PopHandler did not pop a handler")
 			}
-			vm.push(ret)
+			if _, ok := ret.(*data.LoopSignal); ok || handler.Return == nil {
+				// breaking out of the loop skips the return clause
+				vm.push(ret)
+				break
+			}
+			// both the handle and resumes pop the handler
+			// after the handled block returns
+			v, t := vm.apply1(handler.Return, ret)
+			vm.handleCall(v, t, false)
+		case isa.SetReturn:
+			ret, ok := vm.pop().(data.Callable)
+			if !ok {
+				vm.bail("IEE SetReturn expects a function")
+			}
+			handler, ok := vm.stack[vm.stackTop-1].(*data.Handler)
+			if !ok {
+				vm.bail("IEE SetReturn expects a handler on the stack")
+			}
+			handler.Return = ret
+		case isa.SetFinally:
+			fin, ok := vm.pop().(data.Callable)
+			if !ok {
+				vm.bail("IEE SetFinally expects a function")
+			}
+			handler, ok := vm.stack[vm.stackTop-1].(*data.Handler)
+			if !ok {
+				vm.bail("IEE SetFinally expects a handler on the stack")
+			}
+			handler.Finally = fin
+		case isa.Finalize:
+			handler, ok := vm.pop().(*data.Handler)
+			if !ok {
+				vm.bail("IEE Finalize expects a handler on the stack")
+			}
+			var fin data.Callable = noFinalizer
+			if f := handler.Finalize(); f != nil {
+				fin = f
+			}
+			vm.push(fin)
+		case isa.LoopSignal:
+			signal := &data.LoopSignal{Continue: vm.readByte() == isa.ContinueSignal}
+			vm.loopSignal(signal)
+		case isa.IsLoopSignal:
+			cont := vm.readByte() == isa.ContinueSignal
+			s, ok := vm.pop().(*data.LoopSignal)
+			vm.push(data.NewBool(ok && s.Continue == cont))
 		case isa.MakeEffect:
 			name, ok := vm.pop().(data.Symbol)
 			if !ok {
@@ -372,13 +510,21 @@ func (vm *Vm) Interpret(code *data.Code) (data.Value, error) {
 			if !ok {
 				vm.bail("resume expression expects a continuation to call")
 			}
+			if !vm.returnsToHandleSite() {
+				// The with clause has not reached here through tail
+				// calls so its frame cannot be replaced. Resume like
+				// a regular resume, the handler is popped by the
+				// instruction following this one.
+				vm.push(cont.Handler)
+				v, t := cont.Call(vm, arg)
+				vm.handleCall(v, t, false)
+				break
+			}
+			if EffectTrace != nil {
+				vm.resumeSite = site(vm.code, vm.ip)
+			}
 			ip, code, env := vm.popFunctionFrame()
 			vm.push(cont.Handler)
-			if code.Instrs[ip-1] != isa.PopHandler {
-				vm.bail("Cannot tail resume. Tail resumption only works if it's" +
-					" the last expression in the with clause or the function that" +
-					" tail resumes is in tail position for the with clause")
-			}
 			vm.ip = ip - 1
 			vm.code = code
 			vm.locals = env
@@ -387,6 +533,7 @@ func (vm *Vm) Interpret(code *data.Code) (data.Value, error) {
 			// last function frame and this is a frame under it.
 			// It should stay where it is.
 			vm.handleCall(v, t, false)
+			vm.resumeSite = ""
 		case isa.Resume:
 			cont, ok := vm.pop().(*data.Continuation)
 			if !ok {
@@ -394,6 +541,74 @@ func (vm *Vm) Interpret(code *data.Code) (data.Value, error) {
 			}
 			vm.push(cont.Handler)
 			vm.push(cont)
+		case isa.Equal:
+			b := vm.pop()
+			a := vm.pop()
+			vm.push(data.NewBool(a.Equal(b)))
+		case isa.MatchTuple:
+			size := vm.readArg()
+			t, ok := vm.pop().(data.Tuple)
+			vm.push(data.NewBool(ok && t.Len() == size))
+		case isa.MatchList:
+			size := vm.readArg()
+			l, ok := vm.pop().(*data.List)
+			vm.push(data.NewBool(ok && l.Len() == size))
+		case isa.MatchRecord:
+			_, ok := vm.pop().(*data.Record)
+			vm.push(data.NewBool(ok))
+		case isa.HasField:
+			name := vm.getSymbolAt(vm.readArg())
+			rec, ok := vm.pop().(*data.Record)
+			if ok {
+				_, ok = rec.GetField(name)
+			}
+			vm.push(data.NewBool(ok))
+		case isa.Index:
+			idx := vm.readArg()
+			s, ok := vm.pop().(data.Sequence)
+			if !ok {
+				vm.bail("IEE: Index used on a value that is not a sequence")
+			}
+			v, err := s.Get(data.NewInt(idx))
+			if err != nil {
+				vm.bail(err.Error())
+			}
+			vm.push(v)
+		case isa.MatchFail:
+			msg := vm.code.GetConstant2(vm.readArg())
+			v := vm.pop()
+			vm.bail("%s, got %s", msg.(data.String).Val, v)
+		case isa.Fail:
+			msg := vm.code.GetConstant2(vm.readArg())
+			vm.bail("%s", msg.(data.String).Val)
+		case isa.Wide:
+			vm.wide = true
+		case isa.Import:
+			path := vm.code.GetConstant2(vm.readArg())
+			vm.push(vm.Import(path.(data.String).Val))
+		case isa.IsSequence:
+			_, ok := vm.pop().(data.Sequence)
+			vm.push(data.NewBool(ok))
+		case isa.IterNext:
+			off := vm.readArg()
+			idx, ok := vm.pop().(data.Int)
+			if !ok {
+				vm.bail("IEE: IterNext expects an integer index")
+			}
+			s, ok := vm.pop().(data.Sequence)
+			if !ok {
+				vm.bail("IEE: IterNext used on a value that is not a sequence")
+			}
+			if idx.Val >= s.Len() {
+				vm.ip += int(off) - 3
+				break
+			}
+			v, err := s.Get(idx)
+			if err != nil {
+				vm.bail(err.Error())
+			}
+			vm.push(v)
+			vm.push(data.NewInt(idx.Val + 1))
 		default:
 			instr, _ := isa.DisassembleInstr(vm.code, vm.ip-1, -1)
 			vm.bail(fmt.Sprintf("usupported command:\n%s", instr))
@@ -410,10 +625,16 @@ func (vm *Vm) readByte() byte {
 	return b
 }
 
-func (vm *Vm) readShort() uint16 {
+// readArg reads the 2 byte argument of the instruction
+// or the 4 byte one if the instruction has been widened.
+func (vm *Vm) readArg() int {
+	if vm.wide {
+		vm.wide = false
+		args := []byte{vm.readByte(), vm.readByte(), vm.readByte(), vm.readByte()}
+		return int(binary.BigEndian.Uint32(args))
+	}
 	args := []byte{vm.readByte(), vm.readByte()}
-	index := binary.BigEndian.Uint16(args)
-	return index
+	return int(binary.BigEndian.Uint16(args))
 }
 
 func (vm *Vm) push(v data.Value) {
@@ -444,7 +665,7 @@ func (vm *Vm) printStack() {
 }
 
 func (vm *Vm) printInstr() {
-	s, _ := isa.DisassembleInstr(vm.code, vm.ip, vm.code.Lines[vm.ip])
+	s, _ := isa.DisassembleInstr(vm.code, vm.ip, -1)
 	fmt.Println(s)
 }
 
@@ -465,6 +686,63 @@ func (vm *Vm) applyFunc(fn data.Callable, args []data.Value) (data.Value, data.T
 	panic("unreachable")
 }
 
+// applyArgs calls the function with the arguments. Arguments left
+// after calling it with as many as it takes are applied to its result.
+func (vm *Vm) applyArgs(fn data.Callable, args []data.Value, tailcall bool) {
+	for {
+		if fn.Arity() == 0 {
+			vm.bail("Expected non nullary callable")
+		}
+		if len(args) <= fn.Arity() {
+			v, t := vm.applyFunc(fn, args)
+			vm.handleCall(v, t, tailcall)
+			return
+		}
+		v, t := fn.Call(vm, args[:fn.Arity()]...)
+		args = args[fn.Arity():]
+		if t.Kind != data.Returned {
+			// the function has to be run before the rest of
+			// the arguments can be applied to its result
+			if !tailcall || !AllowTailCalls {
+				if vm.overflows(FUNC_FRAME_SIZE) {
+					v, t, tail := vm.stackOverflow()
+					vm.handleCall(v, t, tail)
+					return
+				}
+				vm.pushFrame()
+			}
+			vm.code = vm.applicationOf(args, vm.code.Location(vm.ip-2))
+			vm.ip = 0
+			vm.handleCall(v, t, false)
+			return
+		}
+		next, ok := v.(data.Callable)
+		if !ok {
+			vm.bail("supplied more arguments than the function takes")
+		}
+		fn = next
+	}
+}
+
+// applicationOf returns code applying the arguments one by one
+// to the value returned to it. The last one is applied by a tail call.
+func (vm *Vm) applicationOf(args []data.Value, loc data.Location) *data.Code {
+	c := data.NewCode()
+	c.Path = vm.code.Path
+	c.Globals = vm.code.Globals
+	for i, arg := range args {
+		c.WriteByte(isa.Constant, loc)
+		c.WriteByte(byte(c.AddConstant(arg)), loc)
+		call := isa.Call1
+		if i == len(args)-1 {
+			call = isa.TailCall1
+		}
+		c.WriteByte(call, loc)
+	}
+	c.WriteByte(isa.Return, loc)
+	return &c
+}
+
 // Specialised func application for applying only 1 argument.
 // Allows to skip allocation of slice for arguments.
 func (vm *Vm) apply1(fn data.Callable, arg data.Value) (data.Value, data.Trampoline) {
@@ -484,16 +762,18 @@ func (vm *Vm) apply1(fn data.Callable, arg data.Value) (data.Value, data.Trampol
 }
 
 func (vm *Vm) handleCall(retval data.Value, tramp data.Trampoline, tailcall bool) {
-	tailcall = tailcall && AllowTailCalls
 	for {
+		tailcall = tailcall && AllowTailCalls
 		switch tramp.Kind {
 		case data.Returned:
 			vm.push(retval)
 		case data.Call:
 			if !tailcall {
-				vm.push(data.Int{Val: vm.ip})
-				vm.push(vm.code)
-				vm.push(vm.locals)
+				if vm.overflows(FUNC_FRAME_SIZE) {
+					retval, tramp, tailcall = vm.stackOverflow()
+					continue
+				}
+				vm.pushFrame()
 			}
 			vm.ip = 0
 			vm.code = tramp.Code
@@ -513,24 +793,42 @@ func (vm *Vm) handleCall(retval data.Value, tramp data.Trampoline, tailcall bool
 			retval, tramp, tailcall = vm.handleEffect(typ, arg)
 			continue
 		case data.RestoreContinuation:
-			// push current frame
-			if !tailcall {
-				vm.push(data.Int{Val: vm.ip})
-				vm.push(vm.code)
-				vm.push(vm.locals)
-			}
 			args, ok := retval.(data.Tuple)
 			if !ok {
 				vm.bail("IEE: Expected continuation stack and argument")
 			}
-			// restore stored stack
 			wstack, ok := vm.unsafeTupleGet(args, 1).(*data.List)
 			if !ok {
 				vm.bail("IEE: Expected continuation stack")
 			}
 			stack := wstack.RawValues()
+			// push current frame
+			if !tailcall {
+				if vm.overflows(FUNC_FRAME_SIZE + len(stack)) {
+					retval, tramp, tailcall = vm.stackOverflow()
+					continue
+				}
+				vm.pushFrame()
+			}
+			if EffectTrace != nil {
+				cont := vm.unsafeTupleGet(args, 2).(*data.Continuation)
+				at := vm.resumeSite
+				if at == "" {
+					at = site(vm.code, vm.ip)
+				}
+				vm.resumeSite = ""
+				vm.trace(traceEvent{
+					Event:   traceResume,
+					Effect:  cont.Effect.Name.String(),
+					At:      at,
+					Handler: handlerSite(cont.Handler),
+					Slots:   len(stack),
+				})
+			}
+			// restore stored stack
 			vm.stack = append(vm.stack, stack...)
 			vm.stackTop = len(vm.stack)
+			vm.frames += countFrames(stack)
 			// push continuation argument
 			if Debug {
 				fmt.Println("Restoring continuation")
@@ -570,18 +868,86 @@ func (vm *Vm) handleEffect(typ data.Type, arg data.Value) (data.Value, data.Tram
 				if copied := copy(stack, vm.stack[curr:]); copied != len {
 					vm.bail("IEE: Could not copy the stack")
 				}
+				if EffectTrace != nil {
+					// the handler and the frame of the handle are
+					// not part of the slots kept by the continuation
+					ev := traceEvent{
+						Event:        tracePerform,
+						Effect:       typ.Name.String(),
+						Arg:          arg.String(),
+						At:           site(vm.code, vm.ip),
+						Handler:      handlerSite(handler),
+						Continuation: data.HandlerCapturesContinuation(h),
+						Slots:        len - FUNC_FRAME_SIZE - 1,
+					}
+					vm.trace(ev)
+					if !ev.Continuation {
+						ev.Event, ev.Arg, ev.Slots = traceAbort, "", vm.stackTop-curr-len
+						vm.trace(ev)
+					}
+				}
+				var fins []data.Callable
+				if !data.HandlerCapturesContinuation(h) {
+					// the frames are thrown away for good so
+					// handles between have to be finalized
+					fins = vm.finalizers(curr + 1)
+				}
 				// throw away other stack frames
+				vm.frames -= countFrames(vm.stack[curr:vm.stackTop])
 				vm.stack = vm.stack[:curr]
 				vm.stackTop = curr
-				return vm.runHandler(stack, h, arg, handler)
+				return vm.runHandler(stack, typ, h, arg, handler, fins)
+			}
+		}
+	}
+	if host, ok := vm.hostHandler(typ); ok {
+		if EffectTrace != nil {
+			vm.trace(traceEvent{
+				Event:   tracePerform,
+				Effect:  typ.Name.String(),
+				Arg:     arg.String(),
+				At:      site(vm.code, vm.ip),
+				Handler: "host",
+			})
+		}
+		v, err := host(vm, arg)
+		if err != nil {
+			if EffectTrace != nil {
+				vm.trace(traceEvent{
+					Event:   traceAbort,
+					Effect:  typ.Name.String(),
+					At:      site(vm.code, vm.ip),
+					Handler: "host",
+					Slots:   vm.stackTop,
+					Error:   err.Error(),
+				})
 			}
+			panic(&hostAbort{err})
 		}
+		return v, data.Trampoline{Kind: data.Returned}, false
+	}
+	if EffectTrace != nil {
+		handler := "none"
+		if vm.exports != nil && vm.isExportEffect(typ) {
+			handler = "export"
+		}
+		vm.trace(traceEvent{
+			Event:   tracePerform,
+			Effect:  typ.Name.String(),
+			Arg:     arg.String(),
+			At:      site(vm.code, vm.ip),
+			Handler: handler,
+		})
+	}
+	if vm.exports != nil && vm.isExportEffect(typ) {
+		vm.export(arg)
+		return data.None, data.Trampoline{Kind: data.Returned}, false
 	}
 	vm.bail(fmt.Sprintf("Unhandled effect %s with val %s", typ, arg))
 	panic("unreachable")
 }
 
-func (vm *Vm) runHandler(stack []data.Value, h data.Callable, arg data.Value, handler *data.Handler) (data.Value, data.Trampoline, bool) {
+func (vm *Vm) runHandler(stack []data.Value, typ data.Type, h data.Callable, arg data.Value, handler *data.Handler, fins []data.Callable) (data.Value, data.Trampoline, bool) {
 	// first value on the stack is a handler
 	// then there is a function frame of function where the
 	// handler has been called.
@@ -609,13 +975,18 @@ func (vm *Vm) runHandler(stack []data.Value, h data.Callable, arg data.Value, ha
 		panic("IEE: expected instruction pointer to be pointing to PopHandler op")
 	}
 	vm.ip++ // Skip PopHandler instruction as handler is no longer on the stack
-	// Tail calls of handlers not supported yet.
-	// We would need to know if handler is in tail position.
-	// Which we can. We just need to somehow pass it here.
 	switch h.Arity() {
 	case 1:
+		// handles in tail position are followed by Return so the
+		// clause can replace the frame of the function with the handle.
+		// Clauses capturing the continuation keep it for tail resume.
+		tail := vm.ip < vm.code.Len() && vm.code.Instrs[vm.ip] == isa.Return
+		if len(fins) > 0 {
+			code := vm.finalizationOf(fins, h, arg, vm.code.Location(vm.ip-1))
+			return data.None, data.Trampoline{Kind: data.Call, Code: code, Env: vm.locals}, tail
+		}
 		v, t := h.Call(vm, arg)
-		return v, t, false
+		return v, t, tail
 	case 2:
 		// drop handler and handler's callee's stack frame
 		stack = stack[4:]
@@ -626,7 +997,10 @@ func (vm *Vm) runHandler(stack []data.Value, h data.Callable, arg data.Value, ha
 			fmt.Println("Stack frame of an effect")
 			vm.printFrame(vm.ip, vm.code)
 		}
-		k := data.NewContinuation(stack, handler, sip, scode, slocals)
+		// the captured handles are finalized when the computation
+		// leaves them after being resumed or when k is dropped
+		k := data.NewContinuation(stack, handler, sip, scode, slocals, env)
+		k.Effect = typ
 		v, t := h.Call(vm, arg, k)
 		return v, t, false
 	}
@@ -635,6 +1009,191 @@ func (vm *Vm) runHandler(stack []data.Value, h data.Callable, arg data.Value, ha
 	return nil, data.Trampoline{}, false
 }
 
+// finalizers returns finalizers of the handlers on the stack starting
+// from the given index, the innermost ones first, except the ones which
+// have already been finalized. The handlers are marked as finalized.
+func (vm *Vm) finalizers(from int) []data.Callable {
+	return finalizersOf(vm.stack[from:vm.stackTop], nil)
+}
+
+// finalizersOf returns finalizers of the handlers in the stack
+// slice other than the skipped one, like finalizers does.
+func finalizersOf(stack []data.Value, skip *data.Handler) []data.Callable {
+	var fins []data.Callable
+	for i := len(stack) - 1; i >= 0; i-- {
+		if h, ok := stack[i].(*data.Handler); ok && h != skip {
+			if fin := h.Finalize(); fin != nil {
+				fins = append(fins, fin)
+			}
+		}
+	}
+	return fins
+}
+
+// noFinalizer is pushed by Finalize for
+// handlers which have already been finalized.
+var noFinalizer = data.NewNativeFunc("finalized", 0, func(data.VmProxy, ...data.Value) (data.Value, error) {
+	return data.None, nil
+})
+
+// finalizationOf returns code calling the finalizers
+// and then tail calling the with clause with the argument.
+func (vm *Vm) finalizationOf(fins []data.Callable, h data.Callable, arg data.Value, loc data.Location) *data.Code {
+	c := data.NewCode()
+	c.Path = vm.code.Path
+	c.Globals = vm.code.Globals
+	for _, fin := range fins {
+		c.WriteByte(isa.Constant, loc)
+		c.WriteByte(byte(c.AddConstant(fin)), loc)
+		c.WriteByte(isa.Call0, loc)
+		c.WriteByte(isa.Pop, loc)
+	}
+	c.WriteByte(isa.Constant, loc)
+	c.WriteByte(byte(c.AddConstant(h)), loc)
+	c.WriteByte(isa.Constant, loc)
+	c.WriteByte(byte(c.AddConstant(arg)), loc)
+	c.WriteByte(isa.TailCall1, loc)
+	c.WriteByte(isa.Return, loc)
+	return &c
+}
+
+// loopSignal unwinds the stack from the body of a handle to the frame
+// of the function with the handle and pushes the signal for the code
+// following the handle to break or continue the loop. Until the body is
+// resumed the frame is right above the handler and returns to PopHandler.
+// Once resumed the body returns to the with clause, so the frame is the
+// one below that the clause returns to, past PopHandler. Finalizers of
+// the other handles on the way are run first.
+func (vm *Vm) loopSignal(signal *data.LoopSignal) {
+	h := vm.stackTop - 1
+	for ; h >= 0; h-- {
+		if _, ok := vm.stack[h].(*data.Handler); ok {
+			break
+		}
+	}
+	if h < 0 {
+		vm.bail("IEE: loop signal outside of a handle's body")
+	}
+	handler := vm.stack[h].(*data.Handler)
+	site := -1
+	if vm.isHandleSite(h+1, handler, 0) {
+		site = h + 1
+	} else {
+		for i := h - FUNC_FRAME_SIZE; i >= 0; i-- {
+			if vm.isHandleSite(i, handler, 1) {
+				site = i
+				break
+			}
+		}
+	}
+	if site < 0 {
+		vm.bail("IEE: could not find the frame of the handle to break out of")
+	}
+	// the handle finalizes itself at its site
+	fins := finalizersOf(vm.stack[site:vm.stackTop], handler)
+	vm.frames -= countFrames(vm.stack[site:vm.stackTop])
+	vm.ip = vm.stack[site].(data.Int).Val
+	vm.code = vm.stack[site+1].(*data.Code)
+	vm.locals = vm.stack[site+2].(*data.Env)
+	vm.stack = vm.stack[:site]
+	vm.stackTop = site
+	if len(fins) == 0 {
+		vm.push(signal)
+		return
+	}
+	code := vm.finalizationOf(fins, passValue, signal, vm.code.Location(vm.ip-1))
+	vm.handleCall(data.None, data.Trampoline{Kind: data.Call, Code: code, Env: vm.locals}, false)
+}
+
+// isHandleSite returns true if there is a frame at the index returning
+// to the handle of the handler, to the instruction back from PopHandler.
+func (vm *Vm) isHandleSite(i int, handler *data.Handler, back int) bool {
+	if i+FUNC_FRAME_SIZE > vm.stackTop {
+		return false
+	}
+	ip, ok := vm.stack[i].(data.Int)
+	if !ok || vm.stack[i+1] != data.Value(handler.Code) || vm.stack[i+2] != data.Value(handler.Env) {
+		return false
+	}
+	at := ip.Val - back
+	return at >= 0 && at < handler.Code.Len() && handler.Code.Instrs[at] == isa.PopHandler
+}
+
+// passValue returns its argument, it is called
+// by finalizationOf to only run the finalizers.
+var passValue = data.NewNativeFunc("pass", 1, func(_ data.VmProxy, vv ...data.Value) (data.Value, error) {
+	return vv[0], nil
+})
+
+// DropContinuation is a function dropping the continuation passed to
+// it so that it can no longer be resumed. Finalizers of the handles
+// captured by the continuation are run, as they are never left
+// otherwise. Dropping the continuation again does nothing.
+var DropContinuation data.Callable = dropContinuation{}
+
+type dropContinuation struct{}
+
+func (dropContinuation) Arity() int {
+	return 1
+}
+
+func (dropContinuation) Call(v data.VmProxy, vv ...data.Value) (data.Value, data.Trampoline) {
+	k, ok := vv[0].(*data.Continuation)
+	if !ok {
+		return data.NewString("drop expects a continuation"), data.ErrorTramp
+	}
+	if k.Resumed() {
+		return data.NewString("continuation has already been resumed and cannot be dropped"), data.ErrorTramp
+	}
+	fins := k.Drop()
+	if len(fins) == 0 {
+		return data.None, data.ReturnTramp
+	}
+	vm := v.(*Vm)
+	code := vm.finalizationOf(fins, passValue, data.None, vm.code.Location(vm.ip-1))
+	return data.None, data.Trampoline{Kind: data.Call, Code: code, Env: vm.locals}
+}
+
+func (dropContinuation) String() string {
+	return "<function drop>"
+}
+
+func (d dropContinuation) Equal(o data.Value) bool {
+	return data.Value(d) == o
+}
+
+// runFinalizers runs finalizers of all of the handlers on the stack
+// when the vm stops on an error. They are run by clones of the vm
+// as the state of this one cannot be trusted, errors in them are
+// reported and do not stop the others from running.
+func (vm *Vm) runFinalizers() {
+	for _, fin := range vm.finalizers(0) {
+		func() {
+			defer func() { recover() }()
+			clone := vm.cloneImpl()
+			// finalizers run even if the run has been cancelled
+			// but cannot keep it from stopping for too long
+			clone.startRun(context.Background(), FinalizerBudget)
+			clone.RunClosure(fin)
+		}()
+	}
+}
+
+// returnsToHandleSite returns true if the current function
+// returns right after the handle whose with clause has been
+// called by runHandler.
+func (vm *Vm) returnsToHandleSite() bool {
+	if vm.stackTop < FUNC_FRAME_SIZE {
+		return false
+	}
+	code, ok := vm.stack[vm.stackTop-2].(*data.Code)
+	if !ok {
+		return false
+	}
+	ip, ok := vm.stack[vm.stackTop-3].(data.Int)
+	return ok && ip.Val > 0 && code.Instrs[ip.Val-1] == isa.PopHandler
+}
+
 func (vm *Vm) popFunctionFrame() (int, *data.Code, *data.Env) {
 	env, ok := vm.pop().(*data.Env)
 	if !ok {
@@ -648,10 +1207,11 @@ func (vm *Vm) popFunctionFrame() (int, *data.Code, *data.Env) {
 	if !ok {
 		panic("IEE: on return popped value is not an ip")
 	}
+	vm.frames--
 	return ip.Val, code, env
 }
 
-func (vm *Vm) getSymbolAt(i uint16) data.Symbol {
+func (vm *Vm) getSymbolAt(i int) data.Symbol {
 	s := vm.code.GetConstant2(i)
 	if as, ok := s.(data.Symbol); ok {
 		return as
@@ -660,7 +1220,7 @@ func (vm *Vm) getSymbolAt(i uint16) data.Symbol {
 	return data.Symbol{}
 }
 
-func (vm *Vm) getFunctionAt(i uint16) *data.Closure {
+func (vm *Vm) getFunctionAt(i int) *data.Closure {
 	s := vm.code.GetConstant2(i)
 	if as, ok := s.(*data.Closure); ok {
 		return as
@@ -671,59 +1231,66 @@ func (vm *Vm) getFunctionAt(i uint16) *data.Closure {
 
 func (vm *Vm) printStackTrace() {
 	fmt.Println("========BACKTRACE========")
-	for i := 0; i < vm.stackTop; i++ {
-		_, ok := vm.stack[i].(*data.Env)
-		if !ok {
+	lines := vm.backtrace()
+	// the current frame is printed by bail,
+	// unless it is one of the repeated frames
+	if last := lines[len(lines)-1]; last.times == 1 {
+		lines = lines[:len(lines)-1]
+	}
+	for _, l := range lines {
+		if l.omitted > 0 {
+			fmt.Printf("%s\n---------------------\n", l)
 			continue
 		}
-		c, ok := vm.stack[i-1].(*data.Code)
-		if !ok {
-			continue
+		for _, f := range l.frames {
+			vm.printFrame(f.ip, f.code)
 		}
-		ip, ok := vm.stack[i-2].(data.Int)
-		if !ok {
-			continue
+		switch {
+		case l.times > 1 && len(l.frames) == 1:
+			fmt.Printf("The frame above repeated %d times\n", l.times)
+			fmt.Println("---------------------")
+		case l.times > 1:
+			fmt.Printf("The %d frames above repeated %d times\n", len(l.frames), l.times)
+			fmt.Println("---------------------")
 		}
-		vm.printFrame(ip.Val, c)
 	}
 	fmt.Println("=========================")
 }
 
 func (vm *Vm) printFrame(ip int, code *data.Code) {
-	if ip >= len(code.Lines) {
-		ip = len(code.Lines) - 1
-	}
-	line := code.Lines[ip] + 1
-	r, ok := vm.sources[code.Path]
-	var c string
-	if !ok {
-		c = fmt.Sprintf("Unknown source %v", code.Path)
-	} else {
-		c = getLine(line, r)
-	}
-	fmt.Printf("File %s line %d\n\n", code.Path, line)
-	fmt.Printf("%s\n", c)
+	loc := instrLocation(code, ip)
+	fmt.Printf("File %s line %d, column %d\n\n", code.Path, loc.Line+1, loc.Column)
+	fmt.Printf("%s\n", vm.sourceFragment(code.Path, loc))
 	fmt.Println("---------------------")
 }
 
 func (vm *Vm) bail(msg string, args ...interface{}) {
 	vm.printStackTrace()
-	ip := vm.ip
-	if ip >= len(vm.code.Lines) {
-		ip = len(vm.code.Lines) - 1
+	loc := instrLocation(vm.code, vm.ip)
+	fmt.Printf("\n\nRuntime error in file %s at line %d, column %d\n\n", vm.code.Path, loc.Line+1, loc.Column)
+	fmt.Println(vm.sourceFragment(vm.code.Path, loc) + "\n")
+	fmt.Printf(msg+"\n", args...)
+	vm.runFinalizers()
+	panic("runtime error")
+}
+
+// instrLocation returns the location of the instruction
+// that has been executed last before getting to ip.
+// Both the vm and the saved frames point past the instruction
+// so the last byte read is used.
+func instrLocation(code *data.Code, ip int) data.Location {
+	if ip > 0 {
+		ip--
 	}
-	line := vm.code.Lines[ip] + 1
-	r, ok := vm.sources[vm.code.Path]
-	var code string
+	return code.Location(ip)
+}
+
+func (vm *Vm) sourceFragment(path string, loc data.Location) string {
+	r, ok := vm.sources.get(path)
 	if !ok || r == nil {
-		code = fmt.Sprintf("Unknown source %v", vm.code.Path)
-	} else {
-		code = getLine(line, r)
+		return fmt.Sprintf("Unknown source %v", path)
 	}
-	fmt.Printf("\n\nRuntime error in file %s at line %d\n\n", vm.code.Path, line)
-	fmt.Println(code + "\n")
-	fmt.Printf(msg+"\n", args...)
-	panic("runtime error")
+	return underline(loc, r)
 }
 
 func (vm *Vm) Panic(msg string) {
@@ -751,9 +1318,18 @@ func (vm *Vm) cloneImpl() *Vm {
 		locals:   loc,
 		interner: vm.interner.Clone(),
 		// if running mulrithreaded duplicates counts
-		gensymc: vm.gensymc,
-		// not thread safe
-		sources: vm.sources,
+		gensymc:      vm.gensymc,
+		sources:      vm.sources,
+		loading:      copyLoading(vm.loading),
+		modules:      vm.modules,
+		builtins:     vm.builtins,
+		exports:      nil,
+		operators:    vm.operators,
+		hostHandlers: vm.hostHandlers,
+		maxFrames:    vm.maxFrames,
+		maxStack:     vm.maxStack,
+		// goroutines spawned by the code stop with the run
+		ctx: vm.ctx,
 	}
 }
 
@@ -765,8 +1341,9 @@ func (vm *Vm) RunClosure(c data.Callable, args ...data.Value) data.Value {
 	case data.Error:
 		panic(fmt.Sprintf("closure returned a top lovel error %s", v))
 	case data.Call:
-		c := t.Code
-		v, err := vm.Interpret(c)
+		vm.ip = 0
+		vm.locals = t.Env
+		v, err := vm.Interpret(t.Code)
 		if err != nil {
 			panic(fmt.Sprintf("error in RunClosure: %s", err))
 		}
@@ -786,7 +1363,7 @@ func (vm *Vm) unsafeTupleGet(t data.Tuple, i int) data.Value {
 }
 
 func (vm *Vm) SourceLine() int {
-	return vm.code.Lines[vm.ip]
+	return instrLocation(vm.code, vm.ip).Line
 }
 
 func (vm *Vm) FileName() string {
@@ -800,30 +1377,172 @@ func (vm *Vm) LoadFile(path string) error {
 	if err != nil {
 		vm.bail("Could not resolve path for %s. Error: %s", path, err)
 	}
-	if b, ok := vm.sources[fullPath]; ok {
-		if b == nil {
-			vm.bail("Cyclic import of %s", fullPath)
-		}
+	if vm.loading[fullPath] {
+		vm.bail("Cyclic import of %s", fullPath)
+	}
+	if _, ok := vm.sources.get(fullPath); ok {
 		// already loaded, no need to load it again
 		return nil
 	}
-	vm.sources[fullPath] = nil
 	buffer, err := ioutil.ReadFile(fullPath)
 	if err != nil {
 		vm.bail("Cannot load file %s: error %s", path, err)
 	}
+	// registered before the evaluation so that
+	// runtime errors can show the file's source
+	vm.sources.set(fullPath, bytes.NewReader(buffer))
+	vm.loading[fullPath] = true
+	defer delete(vm.loading, fullPath)
 
-	c, err := codegen.Compile(
-		fullPath, buffer, vm.Interner())
+	c, err := codegen.CompileWithVm(
+		fullPath, buffer, vm.Interner(), nil, vm)
 	if err != nil {
 		vm.bail("Could not compile %s.\nError: %s", path, err)
 	}
-	_, err = vm.cloneImpl().Interpret(c)
+	vm.runNested(vm.cloneImpl(), c)
+	return nil
+}
+
+// sourceFiles holds sources of the evaluated files for the error
+// messages, it is shared by the clones and safe for concurrent use.
+type sourceFiles struct {
+	mu      sync.Mutex
+	readers map[string]*bytes.Reader
+}
+
+func (s *sourceFiles) get(path string) (*bytes.Reader, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.readers[path]
+	return r, ok
+}
+
+func (s *sourceFiles) set(path string, r *bytes.Reader) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readers[path] = r
+}
+
+func copyLoading(loading map[string]bool) map[string]bool {
+	res := make(map[string]bool, len(loading))
+	for path := range loading {
+		res[path] = true
+	}
+	return res
+}
+
+// moduleCache holds exports of the imported modules
+// by their absolute path, it is safe for concurrent use.
+type moduleCache struct {
+	mu      sync.Mutex
+	exports map[string]data.Value
+}
+
+func (m *moduleCache) get(path string) (data.Value, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.exports[path]
+	return v, ok
+}
+
+// add caches the exports of the module and returns them, unless
+// a goroutine importing it at the same time has cached its own
+// exports first, those are returned instead.
+func (m *moduleCache) add(path string, exports data.Value) data.Value {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if v, ok := m.exports[path]; ok {
+		return v
+	}
+	m.exports[path] = exports
+	return exports
+}
+
+// Import evaluates the module at the given path and returns
+// its exported record. Modules are cached by their absolute
+// path and evaluated only once, unless goroutines import
+// them for the first time simultaneously.
+func (vm *Vm) Import(path string) data.Value {
+	fullPath, err := vm.resolveModulePath(path)
 	if err != nil {
-		vm.bail("Error while evaluating %s: error: %s", path, err)
+		vm.bail("Could not import %s. Error: %s", path, err)
+	}
+	if m, ok := vm.modules.get(fullPath); ok {
+		return m
+	}
+	if vm.loading[fullPath] {
+		vm.bail("Cyclic import of %s", fullPath)
+	}
+	buffer, err := ioutil.ReadFile(fullPath)
+	if err != nil {
+		vm.bail("Cannot import file %s: error %s", path, err)
+	}
+	vm.sources.set(fullPath, bytes.NewReader(buffer))
+	vm.loading[fullPath] = true
+	defer delete(vm.loading, fullPath)
+	c, err := codegen.CompileWithVm(fullPath, buffer, vm.Interner(), vm.BuiltinNames(), vm)
+	if err != nil {
+		vm.bail("Could not compile %s.\nError: %s", path, err)
+	}
+	builtins := vm.builtins
+	if builtins == nil {
+		builtins = vm.globals
+	}
+	c.SetGlobals(builtins.Clone())
+	mvm := vm.cloneImpl()
+	mvm.exports = data.EmptyRecord()
+	vm.runNested(mvm, c)
+	return vm.modules.add(fullPath, mvm.exports)
+}
+
+// resolveModulePath looks for the module relative to the current
+// file first and then in the directories listed in FUNK_PATH.
+// The .fnk extension can be omitted.
+func (vm *Vm) resolveModulePath(path string) (string, error) {
+	if filepath.Ext(path) == "" {
+		path += ".fnk"
+	}
+	candidates := []string{path}
+	if !filepath.IsAbs(path) {
+		candidates = []string{filepath.Join(filepath.Dir(vm.FileName()), path)}
+		for _, dir := range filepath.SplitList(os.Getenv("FUNK_PATH")) {
+			if dir != "" {
+				candidates = append(candidates, filepath.Join(dir, path))
+			}
+		}
+	}
+	for _, c := range candidates {
+		if _, err := os.Stat(c); err == nil {
+			return filepath.Abs(c)
+		}
+	}
+	return "", fmt.Errorf("module not found, tried %s", strings.Join(candidates, ", "))
+}
+
+func (vm *Vm) isExportEffect(typ data.Type) bool {
+	builtins := vm.builtins
+	if builtins == nil {
+		builtins = vm.globals
+	}
+	export := builtins.Lookup(vm.CreateSymbol("export"))
+	return export != nil && typ.Equal(export)
+}
+
+// export adds items exported at the top level of the
+// module to the module's record.
+func (vm *Vm) export(items data.Value) {
+	rec, ok := items.(*data.Record)
+	if !ok {
+		vm.bail("Items exported from a module should be wrapped in a record")
+	}
+	for i := 0; i < rec.Len(); i++ {
+		item, _ := rec.Get(data.NewInt(i))
+		name := vm.unsafeTupleGet(item.(data.Tuple), 0).(data.Symbol)
+		if _, ok := vm.exports.GetField(name); ok {
+			vm.bail("Redeclaration of exported name %s", name)
+		}
+		vm.exports.SetField(name, vm.unsafeTupleGet(item.(data.Tuple), 1))
 	}
-	vm.sources[fullPath] = bytes.NewReader(buffer)
-	return nil
 }
 
 func reverse(s []data.Value) []data.Value {
@@ -838,14 +1557,42 @@ type seekReader interface {
 	io.Seeker
 }
 
-func getLine(line int, r seekReader) string {
+// underline returns the source line the location starts in
+// with the location's fragment marked by carets below it.
+// Fragments spanning multiple lines are only marked to the line's end.
+func underline(loc data.Location, r seekReader) string {
 	r.Seek(0, 0)
-	sc := bufio.NewScanner(r)
-	sc.Split(bufio.ScanLines)
-	for cline := 1; sc.Scan(); cline++ {
-		if cline == line {
-			return sc.Text()
+	src, err := ioutil.ReadAll(r)
+	if err != nil || loc.Beg > len(src) {
+		return "could not find given line"
+	}
+	lbeg := bytes.LastIndexByte(src[:loc.Beg], '\n') + 1
+	lend := len(src)
+	if i := bytes.IndexByte(src[loc.Beg:], '\n'); i != -1 {
+		lend = loc.Beg + i
+	}
+	end := loc.End
+	if end > lend {
+		end = lend
+	}
+	for end > loc.Beg && unicode.IsSpace(rune(src[end-1])) {
+		end--
+	}
+	var b strings.Builder
+	b.Write(src[lbeg:lend])
+	b.WriteRune('\n')
+	// tabs are kept so the carets line up with the code
+	for _, ch := range string(src[lbeg:loc.Beg]) {
+		if ch == '\t' {
+			b.WriteRune(ch)
+		} else {
+			b.WriteRune(' ')
 		}
 	}
-	return "could not find given line"
+	n := utf8.RuneCount(src[loc.Beg:end])
+	if n == 0 {
+		n = 1
+	}
+	b.WriteString(strings.Repeat("^", n))
+	return b.String()
 }
@@ -2,9 +2,18 @@ package vm
 
 import (
 	"bytes"
+	"context"
+	gojson "encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gala377/MLLang/codegen"
 	"github.com/gala377/MLLang/data"
@@ -29,6 +38,23 @@ func TestSimpleVm(t *testing.T) {
 	runTest(t, source, echo)
 }
 
+func TestWideOperands(t *testing.T) {
+	// printing the stack of 70000 elements on every step takes too long
+	defer func(d bool) { Debug = d }(Debug)
+	Debug = false
+	// more constants and elements than uint16 can index
+	n := 70000
+	elems := make([]string, 0, n)
+	vals := make([]data.Value, 0, n)
+	for i := 0; i < n; i++ {
+		elems = append(elems, fmt.Sprint(i))
+		vals = append(vals, data.NewInt(i))
+	}
+	source := fmt.Sprintf("let a = (%s)\necho a", strings.Join(elems, ", "))
+	echo := echo(t, data.NewTuple(vals))
+	runTest(t, source, echo)
+}
+
 func runTest(t *testing.T, src string, echo *data.NativeFunc) {
 	s := bytes.NewReader([]byte(src))
 	p := syntax.NewParser(s)
@@ -68,3 +94,445 @@ func vmWithEcho(source *bytes.Reader, interner *codegen.Interner, name data.Inte
 	vm := VmWithEnv("dud", source, interner, global)
 	return &vm
 }
+
+// compileWithEcho compiles the source and returns
+// the code with a vm having echo in its globals.
+func compileWithEcho(t *testing.T, src string, echo *data.NativeFunc) (*Vm, *data.Code) {
+	s := bytes.NewReader([]byte(src))
+	p := syntax.NewParser(s)
+	e := codegen.NewEmitter("dummy", codegen.NewInterner())
+	c, errs := e.Compile(p.Parse())
+	if len(p.Errors()) > 0 || len(errs) > 0 {
+		t.Fatalf("unexpected errors %v %v", p.Errors(), errs)
+	}
+	return vmWithEcho(s, e.Interner(), e.Interner().Intern("echo"), echo), c
+}
+
+// runDefinitions runs the source with echo in its globals and returns
+// the vm with a lookup of the functions the source has defined.
+func runDefinitions(t *testing.T, src string, echo *data.NativeFunc) (*Vm, func(string) data.Callable) {
+	vm, c := compileWithEcho(t, src, echo)
+	if _, err := vm.Interpret(c); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	global := func(s string) data.Callable {
+		return vm.globals.Lookup(vm.CreateSymbol(s)).(data.Callable)
+	}
+	return vm, global
+}
+
+func TestUnderliningLocation(t *testing.T) {
+	table := []struct {
+		source string
+		frag   string
+		want   string
+	}{
+		{"let x = 1\nio.print (div x 0)\n", "div x 0", "io.print (div x 0)\n          ^^^^^^^"},
+		{"fn f:\n\tg 1 \n", "g 1 ", "\tg 1 \n\t^^^"},
+		// multiline fragments are marked to the end of the line
+		{"if x:\n  1\n", "if x:\n  1", "if x:\n^^^^^"},
+		{"a\n", "", "a\n^"},
+	}
+	for _, test := range table {
+		t.Run(test.source, func(t *testing.T) {
+			beg := strings.Index(test.source, test.frag)
+			loc := data.Location{Beg: beg, End: beg + len(test.frag)}
+			got := underline(loc, bytes.NewReader([]byte(test.source)))
+			if got != test.want {
+				t.Errorf("wrong underline\nwant:\n%s\ngot:\n%s", test.want, got)
+			}
+		})
+	}
+}
+
+func TestHostHandlers(t *testing.T) {
+	src := "effect Ask\n" +
+		"fn ask x = Ask x\n" +
+		"fn handled x:\n" +
+		"  handle:\n" +
+		"    Ask x\n" +
+		"  with Ask _:\n" +
+		"    `funk\n" +
+		"fn finalized x:\n" +
+		"  handle:\n" +
+		"    Ask x\n" +
+		"  finally:\n" +
+		"    echo x\n"
+	vm, global := runDefinitions(t, src, echo(t, data.NewInt(2)))
+	typ, ok := vm.EffectType("Ask")
+	if !ok {
+		t.Fatal("Ask is not an effect type")
+	}
+	host := data.Symbol(vm.CreateSymbol("host"))
+	vm.HandleEffect(typ, func(_ *Vm, arg data.Value) (data.Value, error) {
+		return host, nil
+	})
+	scoped := data.Symbol(vm.CreateSymbol("scoped"))
+	abort := errors.New("aborted")
+	table := []struct {
+		name     string
+		fn       string
+		handlers map[data.Type]HostHandler
+		want     data.Value
+		err      error
+	}{
+		{"global", "ask", nil, host, nil},
+		{"funk handlers first", "handled", nil, vm.CreateSymbol("funk"), nil},
+		{
+			"scoped", "ask",
+			map[data.Type]HostHandler{typ: func(*Vm, data.Value) (data.Value, error) {
+				return scoped, nil
+			}},
+			scoped, nil,
+		},
+		{
+			"abort", "finalized",
+			map[data.Type]HostHandler{typ: func(*Vm, data.Value) (data.Value, error) {
+				return nil, abort
+			}},
+			nil, abort,
+		},
+	}
+	for _, test := range table {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := vm.RunClosureWith(test.handlers, global(test.fn), data.NewInt(2))
+			if err != test.err {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+			if test.want != nil && !test.want.Equal(got) {
+				t.Errorf("expected %s, got %s", test.want, got)
+			}
+		})
+	}
+}
+
+func TestBudgets(t *testing.T) {
+	defer func(d, tc bool) { Debug, AllowTailCalls = d, tc }(Debug, AllowTailCalls)
+	Debug, AllowTailCalls = false, true
+	src := "fn spin n = spin n\n" +
+		"fn grow xs = grow [xs, xs, xs]\n" +
+		"fn pair a b = (a, b)\n" +
+		"fn finalized x:\n" +
+		"  handle:\n" +
+		"    spin x\n" +
+		"  finally:\n" +
+		"    echo x\n" +
+		"fn spinningFinalizer x:\n" +
+		"  handle:\n" +
+		"    spin x\n" +
+		"  finally:\n" +
+		"    spin x\n"
+	finalized := 0
+	echo := data.NewNativeFunc("echo", 1, func(_ data.VmProxy, vs ...data.Value) (data.Value, error) {
+		finalized++
+		return data.None, nil
+	})
+	vm, global := runDefinitions(t, src, echo)
+	table := []struct {
+		name    string
+		timeout time.Duration
+		budget  Budget
+		fn      string
+		args    []data.Value
+		err     error
+	}{
+		{"within budget", 0, Budget{Instructions: 100}, "pair", []data.Value{data.NewInt(1), data.NewInt(2)}, nil},
+		{"instructions", 0, Budget{Instructions: 10000}, "spin", []data.Value{data.NewInt(0)}, ErrBudgetExceeded},
+		{"allocations", 0, Budget{Allocations: 1 << 20}, "grow", []data.Value{data.NewList(nil)}, ErrBudgetExceeded},
+		{"cancelled", 10 * time.Millisecond, Budget{}, "spin", []data.Value{data.NewInt(0)}, ErrCancelled},
+		{"finalized", 10 * time.Millisecond, Budget{}, "finalized", []data.Value{data.NewInt(0)}, ErrCancelled},
+		{"spinning finalizer", 10 * time.Millisecond, Budget{}, "spinningFinalizer", []data.Value{data.NewInt(0)}, ErrCancelled},
+	}
+	for _, test := range table {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			if test.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, test.timeout)
+				defer cancel()
+			}
+			_, err := vm.RunClosureContext(ctx, test.budget, global(test.fn), test.args...)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+			if vm.stackTop != 0 {
+				t.Errorf("expected an empty stack, got %d values", vm.stackTop)
+			}
+		})
+	}
+	if finalized != 1 {
+		t.Errorf("expected the finalizer to run once, ran %d times", finalized)
+	}
+}
+
+func TestBudgetedImports(t *testing.T) {
+	defer func(d, tc bool) { Debug, AllowTailCalls = d, tc }(Debug, AllowTailCalls)
+	Debug, AllowTailCalls = false, true
+	module := filepath.Join(t.TempDir(), "spin.fnk")
+	if err := os.WriteFile(module, []byte("fn spin n = spin n\nspin 0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	src := fmt.Sprintf("import %q as spin\n", module)
+	table := []struct {
+		name    string
+		timeout time.Duration
+		budget  Budget
+		err     error
+	}{
+		{"cancelled", 10 * time.Millisecond, Budget{}, ErrCancelled},
+		{"instructions", 0, Budget{Instructions: 10000}, ErrBudgetExceeded},
+	}
+	for _, test := range table {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			if test.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, test.timeout)
+				defer cancel()
+			}
+			vm, c := compileWithEcho(t, src, echo(t, data.None))
+			if _, err := vm.InterpretContext(ctx, c, test.budget); !errors.Is(err, test.err) {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestEffectTrace(t *testing.T) {
+	defer func(w io.Writer, j bool) { EffectTrace, TraceJSON = w, j }(EffectTrace, TraceJSON)
+	src := "effect Ask\n" +
+		"fn resumed x:\n" +
+		"  handle:\n" +
+		"    Ask x\n" +
+		"  with Ask x -> k:\n" +
+		"    k x\n" +
+		"fn aborted x:\n" +
+		"  handle:\n" +
+		"    Ask x\n" +
+		"  with Ask x:\n" +
+		"    x\n" +
+		"fn tail x:\n" +
+		"  handle:\n" +
+		"    Ask x\n" +
+		"  with Ask x -> k:\n" +
+		"    resume k x\n" +
+		"echo (resumed 1, aborted 2, tail 3)\n"
+	want := []traceEvent{
+		{Event: tracePerform, Effect: "Ask", Arg: "1", At: "dummy:4:5", Handler: "dummy:5:18", Continuation: true},
+		{Event: traceResume, Effect: "Ask", At: "dummy:6:5", Handler: "dummy:5:18"},
+		{Event: tracePerform, Effect: "Ask", Arg: "2", At: "dummy:9:5", Handler: "dummy:10:13"},
+		{Event: traceAbort, Effect: "Ask", At: "dummy:9:5", Handler: "dummy:10:13"},
+		{Event: tracePerform, Effect: "Ask", Arg: "3", At: "dummy:14:5", Handler: "dummy:15:18", Continuation: true},
+		{Event: traceResume, Effect: "Ask", At: "dummy:16:5", Handler: "dummy:15:18"},
+	}
+	echo := echo(t, data.NewTuple([]data.Value{data.NewInt(1), data.NewInt(2), data.NewInt(3)}))
+	for _, json := range []bool{false, true} {
+		out := bytes.Buffer{}
+		EffectTrace, TraceJSON = &out, json
+		runTest(t, src, echo)
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if len(lines) != len(want) {
+			t.Fatalf("expected %d events, got %q", len(want), lines)
+		}
+		performed := 0
+		for i, line := range lines {
+			got := traceEvent{}
+			if json {
+				if err := gojson.Unmarshal([]byte(line), &got); err != nil {
+					t.Fatalf("could not decode %q: %s", line, err)
+				}
+			} else if !strings.HasPrefix(line, want[i].Event) {
+				t.Fatalf("expected %s event, got %q", want[i].Event, line)
+			}
+			// stack slots depend on the code generation, compare the rest
+			w := want[i]
+			if json {
+				w.Slots = got.Slots
+				if got != w {
+					t.Errorf("expected %+v, got %+v", w, got)
+				}
+				// resume restores the slots copied by the perform
+				switch {
+				case got.Event == tracePerform && got.Continuation:
+					performed = got.Slots
+				case got.Event == traceResume && got.Slots != performed:
+					t.Errorf("expected %d stack slots restored, got %d", performed, got.Slots)
+				}
+			} else {
+				w.Slots = 0
+				if exp := strings.SplitN(w.String(), ", 0 stack", 2)[0]; !strings.HasPrefix(line, exp) {
+					t.Errorf("expected %q, got %q", exp, line)
+				}
+			}
+		}
+	}
+}
+
+func TestCollapseFrames(t *testing.T) {
+	c := &data.Code{}
+	a, b, d := frame{1, c}, frame{2, c}, frame{3, c}
+	table := []struct {
+		name   string
+		frames []frame
+		want   []traceLine
+	}{
+		{"no repetitions", []frame{a, b, d}, []traceLine{
+			{frames: []frame{a}, times: 1},
+			{frames: []frame{b}, times: 1},
+			{frames: []frame{d}, times: 1},
+		}},
+		{"recursion", []frame{d, a, a, a, b}, []traceLine{
+			{frames: []frame{d}, times: 1},
+			{frames: []frame{a}, times: 3},
+			{frames: []frame{b}, times: 1},
+		}},
+		{"mutual recursion", []frame{d, a, b, a, b, a}, []traceLine{
+			{frames: []frame{d}, times: 1},
+			{frames: []frame{a, b}, times: 2},
+			{frames: []frame{a}, times: 1},
+		}},
+	}
+	for _, test := range table {
+		t.Run(test.name, func(t *testing.T) {
+			got := collapseFrames(test.frames)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestOverflowApplyingMoreArguments(t *testing.T) {
+	// over takes one argument so the frame running it
+	// is pushed before the rest of them is applied
+	src := "fn down xs:\n" +
+		"  match xs:\n" +
+		"    case (_, rest):\n" +
+		"      over rest 0\n" +
+		"      do x -> x\n" +
+		"    case _ -> do x -> x\n" +
+		"fn over xs = down xs\n" +
+		"echo $ (down nested) 5\n"
+	var nested data.Value = data.None
+	for i := 0; i < 1000; i++ {
+		nested = data.NewTuple([]data.Value{data.NewInt(i), nested})
+	}
+	// a level of the recursion pushes three frames,
+	// one of the limits is reached by the frame of over
+	for _, limit := range []int{50, 51, 52} {
+		t.Run(fmt.Sprint(limit), func(t *testing.T) {
+			vm, c := compileWithEcho(t, src, echo(t, data.NewInt(5)))
+			vm.AddToGlobals("nested", nested)
+			vm.SetLimits(limit, 0)
+			defer func() {
+				if r := recover(); r != "runtime error" {
+					t.Errorf("expected a runtime error, got %v", r)
+				}
+				if vm.frames > limit {
+					t.Errorf("expected at most %d frames, got %d", limit, vm.frames)
+				}
+			}()
+			vm.Interpret(c)
+		})
+	}
+}
+
+// printedError runs the code expecting a runtime error
+// and returns what the vm has printed about it.
+func printedError(t *testing.T, vm *Vm, c *data.Code) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- b
+	}()
+	stdout := os.Stdout
+	os.Stdout = w
+	func() {
+		defer func() {
+			os.Stdout = stdout
+			w.Close()
+			if r := recover(); r != "runtime error" {
+				t.Errorf("expected a runtime error, got %v", r)
+			}
+		}()
+		vm.Interpret(c)
+	}()
+	return string(<-out)
+}
+
+func TestPrintedBacktrace(t *testing.T) {
+	vm, c := compileWithEcho(t, "fn down n:\n  down n\n  n\ndown 1\n", echo(t, data.None))
+	vm.SetLimits(50, 0)
+	// the same count as in the backtrace of the stack overflow error
+	printed := printedError(t, vm, c)
+	if want := "The frame above repeated 50 times"; !strings.Contains(printed, want) {
+		t.Errorf("expected %q in the backtrace\n%s", want, printed)
+	}
+}
+
+// exportingModule writes a module exporting the record.
+func exportingModule(t *testing.T, name, exports string) string {
+	t.Helper()
+	module := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(module, []byte(fmt.Sprintf("export %s\n", exports)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return module
+}
+
+// withExport adds the effect exporting values from the modules.
+func withExport(vm *Vm) {
+	vm.AddToGlobals("export", data.NewType(vm.CreateSymbol("export")))
+}
+
+func TestImportingMissingMember(t *testing.T) {
+	defer func(d bool) { Debug = d }(Debug)
+	Debug = false
+	module := exportingModule(t, "exporting.fnk", "{a: 1}")
+	vm, c := compileWithEcho(t, fmt.Sprintf("from %q import a, b\necho a\n", module), echo(t, data.NewInt(1)))
+	withExport(vm)
+	printed := printedError(t, vm, c)
+	if want := fmt.Sprintf("module %s has no member b", module); !strings.Contains(printed, want) {
+		t.Errorf("expected %q in the error\n%s", want, printed)
+	}
+}
+
+func TestConcurrentImports(t *testing.T) {
+	defer func(d bool) { Debug = d }(Debug)
+	Debug = false
+	module := exportingModule(t, "exporting.fnk", "{a: 1}")
+	vm, c := compileWithEcho(t, fmt.Sprintf("import %q as m\n", module), echo(t, data.None))
+	withExport(vm)
+	if _, err := vm.Interpret(c); err != nil {
+		t.Fatal(err)
+	}
+	cached, _ := vm.modules.get(module)
+	// clones share the cache of the modules, the
+	// ones spawned for goroutines import on their own
+	other := exportingModule(t, "other.fnk", "{b: 2}")
+	results := make(chan [2]data.Value)
+	for i := 0; i < 8; i++ {
+		clone := vm.cloneImpl()
+		go func() {
+			results <- [2]data.Value{clone.Import(module), clone.Import(other)}
+		}()
+	}
+	var first data.Value
+	for i := 0; i < 8; i++ {
+		r := <-results
+		if r[0] != cached {
+			t.Errorf("expected the cached module, got %v", r[0])
+		}
+		if first == nil {
+			first = r[1]
+		}
+		if r[1] != first {
+			t.Errorf("expected every goroutine to get the same exports, got %v and %v", first, r[1])
+		}
+	}
+}